@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"field_eyes/data"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// AdminGetUsers returns every user account
+func (app *Config) AdminGetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := app.Models.User.GetAll()
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch users"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch users: %v", err)
+		return
+	}
+
+	if users == nil {
+		users = []*data.User{}
+	}
+
+	app.writeJSON(w, http.StatusOK, users)
+}
+
+// AdminUpdateUserRole changes the role of the user named in the URL
+func (app *Config) AdminUpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid user ID"), http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Role string `json:"role"`
+	}
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	if !data.ValidRole(request.Role) {
+		app.errorJSON(w, errors.New("role must be one of admin, agronomist, farmer"), http.StatusBadRequest)
+		return
+	}
+
+	// Admins cannot demote themselves and lock everyone out
+	if uint(userID) == app.userClaims(r).UserID && request.Role != data.RoleAdmin {
+		app.errorJSON(w, errors.New("admins cannot change their own role"), http.StatusBadRequest)
+		return
+	}
+
+	if err := app.Models.User.UpdateRole(uint(userID), request.Role); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, errors.New("failed to update role"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to update role of user %d: %v", userID, err)
+		return
+	}
+
+	app.InfoLog.Printf("User %d changed the role of user %d to %s", app.userClaims(r).UserID, userID, request.Role)
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Role updated successfully",
+		"user_id": userID,
+		"role":    request.Role,
+	})
+}
+
+// AdminGetDevices returns every device, claimed or not
+func (app *Config) AdminGetDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := app.Models.Device.GetAll()
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch devices"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch devices: %v", err)
+		return
+	}
+
+	if devices == nil {
+		devices = []*data.Device{}
+	}
+
+	app.writeJSON(w, http.StatusOK, devices)
+}
+
+// AdminReassignDevice moves the device named in the URL to another user, taking it out
+// of its field and crop. A user_id of 0 releases the device so it can be claimed again.
+func (app *Config) AdminReassignDevice(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		UserID uint `json:"user_id"`
+	}
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	device, err := app.Models.Device.GetBySerialNumber(chi.URLParam(r, "serial"))
+	if err != nil || device == nil {
+		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
+		return
+	}
+
+	if request.UserID != 0 {
+		user, err := app.Models.User.GetOne(request.UserID)
+		if err != nil || user == nil {
+			app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+			return
+		}
+	}
+
+	previousOwner := device.UserID
+	if request.UserID != previousOwner {
+		// The field and crop belong to the previous owner's farm
+		device.FieldID = nil
+		device.SuggestedFieldID = nil
+		device.CropProfileID = nil
+		device.PlantedAt = nil
+	}
+	device.UserID = request.UserID
+	if err := app.Models.Device.Update(device); err != nil {
+		app.errorJSON(w, errors.New("failed to reassign device"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to reassign device %s: %v", device.SerialNumber, err)
+		return
+	}
+
+	app.InfoLog.Printf("Device %s reassigned from user %d to user %d", device.SerialNumber, previousOwner, request.UserID)
+
+	// Both owners' cached device lists are now stale
+	if app.Redis != nil {
+		go func(userIDs ...uint) {
+			for _, userID := range userIDs {
+				if userID == 0 {
+					continue
+				}
+				if err := app.Redis.InvalidateUserDevicesCache(userID); err != nil {
+					app.ErrorLog.Printf("Failed to invalidate devices cache for user %d: %v", userID, err)
+				}
+			}
+		}(previousOwner, request.UserID)
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Device reassigned successfully",
+		"device":  device,
+	})
+}
+
+// assignmentRequest is the body accepted when assigning an agronomist to a farmer
+type assignmentRequest struct {
+	AgronomistID uint `json:"agronomist_id"`
+	FarmerID     uint `json:"farmer_id"`
+}
+
+// AdminGetAssignments returns every agronomist assignment
+func (app *Config) AdminGetAssignments(w http.ResponseWriter, r *http.Request) {
+	assignments, err := app.Models.Assignment.GetAll()
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch assignments"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch assignments: %v", err)
+		return
+	}
+
+	if assignments == nil {
+		assignments = []*data.Assignment{}
+	}
+
+	app.writeJSON(w, http.StatusOK, assignments)
+}
+
+// AdminCreateAssignment gives an agronomist read access to a farmer's devices
+func (app *Config) AdminCreateAssignment(w http.ResponseWriter, r *http.Request) {
+	var request assignmentRequest
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	agronomist, err := app.Models.User.GetOne(request.AgronomistID)
+	if err != nil || agronomist == nil || agronomist.Role != data.RoleAgronomist {
+		app.errorJSON(w, errors.New("agronomist not found"), http.StatusBadRequest)
+		return
+	}
+	farmer, err := app.Models.User.GetOne(request.FarmerID)
+	if err != nil || farmer == nil {
+		app.errorJSON(w, errors.New("farmer not found"), http.StatusBadRequest)
+		return
+	}
+
+	if err := app.Models.Assignment.Assign(request.AgronomistID, request.FarmerID); err != nil {
+		app.errorJSON(w, errors.New("failed to create assignment"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to create assignment: %v", err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, map[string]string{
+		"message": "Agronomist assigned successfully",
+	})
+}
+
+// AdminDeleteAssignment removes an agronomist's access to a farmer's devices
+func (app *Config) AdminDeleteAssignment(w http.ResponseWriter, r *http.Request) {
+	var request assignmentRequest
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	if err := app.Models.Assignment.Unassign(request.AgronomistID, request.FarmerID); err != nil {
+		app.errorJSON(w, errors.New("failed to delete assignment"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to delete assignment: %v", err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Assignment removed",
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"field_eyes/data"
+	"field_eyes/pkg/analysis"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Longest period the agronomic indices are computed over
+const maxAgronomyDays = 400
+
+// agronomyResult is the response of GetAgronomicIndices
+type agronomyResult struct {
+	SerialNumber    string                `json:"serial_number"`
+	Crop            string                `json:"crop,omitempty"`
+	PlantedAt       time.Time             `json:"planted_at"`
+	To              time.Time             `json:"to"`
+	Timezone        string                `json:"timezone"`
+	BaseTemp        float64               `json:"base_temp"`
+	CapTemp         float64               `json:"cap_temp"`
+	DaysWithData    int                   `json:"days_with_data"`
+	GDDTotal        float64               `json:"gdd_total"`
+	ChillHoursTotal int                   `json:"chill_hours_total"`
+	Daily           []analysis.DayIndices `json:"daily"`
+}
+
+// floatParam reads an optional float query parameter, returning def when it is absent
+func floatParam(r *http.Request, name string, def float64) (float64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: must be a number", name)
+	}
+	return f, nil
+}
+
+// GetAgronomicIndices returns a device's daily minimum and maximum temperature, growing
+// degree days, chill hours and vapour pressure deficit since planting, with running
+// totals. Readings flagged as sensor faults are left out.
+func (app *Config) GetAgronomicIndices(w http.ResponseWriter, r *http.Request) {
+	claims := app.userClaims(r)
+
+	device, err := app.Models.Device.GetBySerialNumber(chi.URLParam(r, "serial"))
+	if err != nil || device == nil {
+		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
+		return
+	}
+	if !app.canAccessDevice(claims, device, false) {
+		app.errorJSON(w, errors.New("unauthorized: device does not belong to the user"), http.StatusUnauthorized)
+		return
+	}
+
+	result := agronomyResult{SerialNumber: device.SerialNumber}
+
+	// Count from the planting date given, else the crop's planting date
+	from, err := parseTimeParam(r, "planted_at")
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if from.IsZero() {
+		crop, plantedAt, err := app.deviceCrop(device)
+		if err != nil {
+			app.ErrorLog.Printf("Failed to load the crop of device %s: %v", device.SerialNumber, err)
+		}
+		if plantedAt == nil {
+			app.errorJSON(w, errors.New("planted_at is required when the device has no crop planting date"), http.StatusBadRequest)
+			return
+		}
+		from = *plantedAt
+		result.Crop = crop.Name
+	}
+
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if !from.Before(to) || to.Sub(from) > maxAgronomyDays*24*time.Hour {
+		app.errorJSON(w, fmt.Errorf("planted_at must be before to and at most %d days earlier", maxAgronomyDays), http.StatusBadRequest)
+		return
+	}
+
+	base, err := floatParam(r, "base", analysis.DefaultGDDBase)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	upper, err := floatParam(r, "cap", analysis.DefaultGDDCap)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if upper <= base {
+		app.errorJSON(w, errors.New("cap must be above base"), http.StatusBadRequest)
+		return
+	}
+
+	loc := time.UTC
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			app.errorJSON(w, errors.New("invalid tz: use an IANA time zone such as Africa/Nairobi"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	buckets, err := app.Models.DeviceData.GetAggregatedLogs(device.ID, from, to, data.BucketHour,
+		[]string{data.QualityOK, data.QualitySuspect})
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch device readings"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to aggregate readings of device %s: %v", device.SerialNumber, err)
+		return
+	}
+
+	hours := make([]analysis.HourlyClimate, 0, len(buckets))
+	for _, b := range buckets {
+		temp := b.Fields["temperature"]
+		hours = append(hours, analysis.HourlyClimate{
+			Start:        b.Start,
+			MinTemp:      temp.Min,
+			MeanTemp:     temp.Avg,
+			MaxTemp:      temp.Max,
+			MeanHumidity: b.Fields["humidity"].Avg,
+		})
+	}
+
+	result.PlantedAt = from
+	result.To = to
+	result.Timezone = loc.String()
+	result.BaseTemp = base
+	result.CapTemp = upper
+	result.Daily = analysis.DailyIndices(hours, loc, base, upper)
+	if result.Daily == nil {
+		result.Daily = []analysis.DayIndices{}
+	}
+	result.DaysWithData = len(result.Daily)
+	if n := len(result.Daily); n > 0 {
+		result.GDDTotal = result.Daily[n-1].GDDTotal
+		result.ChillHoursTotal = result.Daily[n-1].ChillHoursTotal
+	}
+
+	app.writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"field_eyes/data"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// comparatorText describes each comparator in notification messages
+var comparatorText = map[string]string{
+	data.ComparatorLT:  "below",
+	data.ComparatorLTE: "at or below",
+	data.ComparatorGT:  "above",
+	data.ComparatorGTE: "at or above",
+}
+
+// evaluateAlertRules checks new readings of a device, oldest first, against the rules
+// that apply to it and creates a notification when a rule's condition starts to hold.
+// A rule only fires again after the value has recovered past its hysteresis margin.
+// It returns the number of notifications created.
+func (app *Config) evaluateAlertRules(device *data.Device, readings ...*data.DeviceData) int {
+	// Only devices with an owner can be notified about
+	if device.UserID == 0 || len(readings) == 0 {
+		return 0
+	}
+
+	rules, err := app.Models.AlertRule.GetRulesForDevice(device)
+	if err != nil {
+		app.ErrorLog.Printf("Failed to load alert rules for device %s: %v", device.SerialNumber, err)
+		return 0
+	}
+
+	// Built-in rules follow the ranges of the crop planted at the device
+	targets := app.deviceTargets(device)
+
+	created := 0
+	for _, rule := range rules {
+		rule.Threshold = cropThreshold(rule, targets)
+
+		var state *data.AlertState
+		changed := false
+		for _, reading := range readings {
+			value, ok := reading.Metric(rule.Metric)
+			if !ok {
+				continue
+			}
+			if state == nil {
+				if state, err = app.Models.AlertRule.GetState(rule.ID, device.ID); err != nil {
+					app.ErrorLog.Printf("Failed to load alert state for rule %d: %v", rule.ID, err)
+					break
+				}
+			}
+
+			readingTime := reading.ReadingTime()
+			if readingTime.IsZero() {
+				readingTime = time.Now()
+			}
+
+			switch {
+			case rule.Triggered(value):
+				if state.ConditionSince == nil {
+					state.ConditionSince = &readingTime
+					changed = true
+				}
+				held := readingTime.Sub(*state.ConditionSince)
+				if !state.Active && held >= time.Duration(rule.DurationSeconds)*time.Second {
+					if app.createAlertNotification(device, rule, value) {
+						created++
+					}
+					state.Active = true
+					state.LastFiredAt = &readingTime
+					changed = true
+				}
+			case !state.Active && state.ConditionSince != nil:
+				// Condition stopped holding before the duration elapsed
+				state.ConditionSince = nil
+				changed = true
+			case state.Active && rule.Cleared(value):
+				state.Active = false
+				state.ConditionSince = nil
+				changed = true
+			}
+		}
+
+		if changed {
+			if err := app.Models.AlertRule.SaveState(state); err != nil {
+				app.ErrorLog.Printf("Failed to save alert state for rule %d: %v", rule.ID, err)
+			}
+		}
+	}
+
+	return created
+}
+
+// createAlertNotification stores the notification for a rule that fired
+func (app *Config) createAlertNotification(device *data.Device, rule *data.AlertRule, value float64) bool {
+	metric := strings.ReplaceAll(rule.Metric, "_", " ")
+	message := fmt.Sprintf("%s%s is %s %g (%.2f)",
+		strings.ToUpper(metric[:1]), metric[1:], comparatorText[rule.Comparator], rule.Threshold, value)
+	if rule.DurationSeconds > 0 {
+		message += fmt.Sprintf(" for %s", time.Duration(rule.DurationSeconds)*time.Second)
+	}
+
+	notification := data.Notification{
+		Type:       rule.Severity,
+		Message:    message,
+		DeviceID:   device.ID,
+		DeviceName: device.SerialNumber,
+		UserID:     device.UserID,
+		Read:       false,
+	}
+
+	if err := app.createNotification(&notification); err != nil {
+		app.ErrorLog.Printf("Failed to create alert notification for device %s: %v", device.SerialNumber, err)
+		return false
+	}
+
+	app.InfoLog.Printf("Alert rule %d fired for device %s: %s", rule.ID, device.SerialNumber, message)
+	return true
+}
+
+// alertRuleRequest is the body accepted when creating or updating an alert rule
+type alertRuleRequest struct {
+	Name            string  `json:"name"`
+	Metric          string  `json:"metric"`
+	Comparator      string  `json:"comparator"`
+	Threshold       float64 `json:"threshold"`
+	Hysteresis      float64 `json:"hysteresis"`
+	DurationSeconds int     `json:"duration_seconds"`
+	Severity        string  `json:"severity"`
+	Scope           string  `json:"scope"`
+	SerialNumber    string  `json:"serial_number"` // for device scope
+	DeviceType      string  `json:"device_type"`   // for device_type scope
+	Enabled         *bool   `json:"enabled"`
+}
+
+// applyAlertRuleRequest copies the request onto a rule, resolving the device for device scope
+func (app *Config) applyAlertRuleRequest(req alertRuleRequest, rule *data.AlertRule) error {
+	rule.Name = req.Name
+	rule.Metric = req.Metric
+	rule.Comparator = req.Comparator
+	rule.Threshold = req.Threshold
+	rule.Hysteresis = req.Hysteresis
+	rule.DurationSeconds = req.DurationSeconds
+	rule.Severity = req.Severity
+	rule.Scope = req.Scope
+	rule.DeviceID = 0
+	rule.DeviceType = ""
+	if req.Enabled != nil {
+		rule.Enabled = *req.Enabled
+	}
+
+	switch req.Scope {
+	case data.ScopeGlobal:
+		return errors.New("scope must be one of device, device_type, user")
+	case data.ScopeDevice:
+		device, err := app.Models.Device.GetBySerialNumber(req.SerialNumber)
+		if err != nil || device == nil || device.UserID != rule.UserID {
+			return errors.New("device not found")
+		}
+		rule.DeviceID = device.ID
+	case data.ScopeDeviceType:
+		rule.DeviceType = req.DeviceType
+	}
+
+	return rule.Validate()
+}
+
+// GetAlertRules returns the alert rules owned by the authenticated user
+func (app *Config) GetAlertRules(w http.ResponseWriter, r *http.Request) {
+	// Get the authenticated user from the request context
+	userID := app.userClaims(r).UserID
+
+	rules, err := app.Models.AlertRule.GetUserRules(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch alert rules"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch alert rules: %v", err)
+		return
+	}
+
+	if rules == nil {
+		rules = []*data.AlertRule{}
+	}
+
+	app.writeJSON(w, http.StatusOK, rules)
+}
+
+// CreateAlertRule creates a new alert rule for the authenticated user
+func (app *Config) CreateAlertRule(w http.ResponseWriter, r *http.Request) {
+	// Get the authenticated user from the request context
+	userID := app.userClaims(r).UserID
+
+	var request alertRuleRequest
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	// New rules are enabled unless stated otherwise
+	rule := data.AlertRule{UserID: userID, Enabled: true}
+	if err := app.applyAlertRuleRequest(request, &rule); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := app.Models.AlertRule.CreateRule(&rule); err != nil {
+		app.errorJSON(w, errors.New("failed to create alert rule"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to create alert rule: %v", err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"message": "Alert rule created successfully",
+		"rule":    rule,
+	})
+}
+
+// UpdateAlertRule replaces an alert rule owned by the authenticated user
+func (app *Config) UpdateAlertRule(w http.ResponseWriter, r *http.Request) {
+	// Get the authenticated user from the request context
+	userID := app.userClaims(r).UserID
+
+	rule, ok := app.userAlertRule(w, r, userID)
+	if !ok {
+		return
+	}
+
+	var request alertRuleRequest
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	if err := app.applyAlertRuleRequest(request, rule); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := app.Models.AlertRule.UpdateRule(rule); err != nil {
+		app.errorJSON(w, errors.New("failed to update alert rule"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to update alert rule: %v", err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Alert rule updated successfully",
+		"rule":    rule,
+	})
+}
+
+// DeleteAlertRule deletes an alert rule owned by the authenticated user
+func (app *Config) DeleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	// Get the authenticated user from the request context
+	userID := app.userClaims(r).UserID
+
+	rule, ok := app.userAlertRule(w, r, userID)
+	if !ok {
+		return
+	}
+
+	if err := app.Models.AlertRule.DeleteRule(rule.ID); err != nil {
+		app.errorJSON(w, errors.New("failed to delete alert rule"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to delete alert rule: %v", err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Alert rule deleted",
+	})
+}
+
+// userAlertRule loads the rule named by the id query parameter and checks that the user owns it.
+// It writes the error response and returns false if not.
+func (app *Config) userAlertRule(w http.ResponseWriter, r *http.Request, userID uint) (*data.AlertRule, bool) {
+	idParam := r.URL.Query().Get("id")
+	if idParam == "" {
+		app.errorJSON(w, errors.New("alert rule ID is required"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	id, err := strconv.ParseUint(idParam, 10, 64)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid alert rule ID"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	rule, err := app.Models.AlertRule.GetRule(uint(id))
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch alert rule"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch alert rule: %v", err)
+		return nil, false
+	}
+	if rule == nil || rule.UserID != userID {
+		app.errorJSON(w, errors.New("alert rule not found"), http.StatusNotFound)
+		return nil, false
+	}
+
+	return rule, true
+}
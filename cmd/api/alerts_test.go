@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"field_eyes/data"
+	"testing"
+	"time"
+)
+
+// alertRuleStore serves one device's rules and keeps their state in memory
+type alertRuleStore struct {
+	data.AlertRuleInterface
+	rules  []*data.AlertRule
+	states map[uint]*data.AlertState
+}
+
+func (s *alertRuleStore) GetRulesForDevice(device *data.Device) ([]*data.AlertRule, error) {
+	return s.rules, nil
+}
+
+func (s *alertRuleStore) GetState(ruleID, deviceID uint) (*data.AlertState, error) {
+	if state, ok := s.states[ruleID]; ok {
+		return state, nil
+	}
+	return &data.AlertState{RuleID: ruleID, DeviceID: deviceID}, nil
+}
+
+func (s *alertRuleStore) SaveState(state *data.AlertState) error {
+	s.states[state.RuleID] = state
+	return nil
+}
+
+// alertNotificationStore records the notifications created
+type alertNotificationStore struct {
+	notificationStore
+	created []*data.Notification
+}
+
+func (s *alertNotificationStore) CreateNotification(notification *data.Notification) error {
+	s.created = append(s.created, notification)
+	return nil
+}
+
+// faultDevices throttles fault notifications as the database would
+type faultDevices struct {
+	data.DeviceInterface
+	lastFault *time.Time
+}
+
+func (s *faultDevices) MarkFault(id uint, at, since time.Time) (bool, error) {
+	if s.lastFault != nil && s.lastFault.After(since) {
+		return false, nil
+	}
+	s.lastFault = &at
+	return true, nil
+}
+
+// webhookSubscribers has no subscribers
+type webhookSubscribers struct {
+	data.WebhookInterface
+}
+
+func (s *webhookSubscribers) GetSubscribers(userID uint, eventType string) ([]*data.Webhook, error) {
+	return nil, nil
+}
+
+// newAlertTestApp returns an app that checks readings against the rules
+func newAlertTestApp(t *testing.T, rules ...*data.AlertRule) (*Config, *alertRuleStore, *alertNotificationStore) {
+	alerts := &alertRuleStore{rules: rules, states: make(map[uint]*data.AlertState)}
+	notifications := &alertNotificationStore{notificationStore: notificationStore{notifications: make(map[uint]*data.Notification)}}
+	app, _ := newNotificationTestApp(&notifications.notificationStore)
+	app.Models.AlertRule = alerts
+	app.Models.Notification = notifications
+	app.Models.Device = &faultDevices{}
+	app.Models.Webhook = &webhookSubscribers{}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	app.Stream = newStreamHub(ctx, app)
+	return app, alerts, notifications
+}
+
+// moistureReadings returns soil moisture readings measured ten minutes apart
+func moistureReadings(start time.Time, values ...float64) []*data.DeviceData {
+	readings := make([]*data.DeviceData, len(values))
+	for i, value := range values {
+		measured := start.Add(time.Duration(i) * 10 * time.Minute)
+		readings[i] = &data.DeviceData{SoilMoisture: value, MeasuredAt: &measured, Quality: data.QualityOK}
+	}
+	return readings
+}
+
+func TestCheckReadingsEvaluatesEveryReading(t *testing.T) {
+	start := time.Date(2024, 3, 1, 6, 0, 0, 0, time.UTC)
+	device := &data.Device{SerialNumber: "SN1", UserID: 1}
+	device.ID = 1
+
+	tests := []struct {
+		name     string
+		rule     data.AlertRule
+		values   []float64
+		fired    int
+		active   bool
+		firedAt  time.Time
+		faulty   []int
+		warnings int
+	}{
+		{
+			name:    "a dip in the middle of a batch fires",
+			rule:    data.AlertRule{Metric: "soil_moisture", Comparator: data.ComparatorLT, Threshold: 20, Hysteresis: 2},
+			values:  []float64{25, 15, 30},
+			fired:   1,
+			firedAt: start.Add(10 * time.Minute),
+		},
+		{
+			name:    "a duration is timed by when readings were measured",
+			rule:    data.AlertRule{Metric: "soil_moisture", Comparator: data.ComparatorLT, Threshold: 20, DurationSeconds: 900},
+			values:  []float64{15, 15, 15, 15},
+			fired:   1,
+			active:  true,
+			firedAt: start.Add(20 * time.Minute),
+		},
+		{
+			name:   "a recovery inside the duration resets it",
+			rule:   data.AlertRule{Metric: "soil_moisture", Comparator: data.ComparatorLT, Threshold: 20, DurationSeconds: 900},
+			values: []float64{15, 25, 15, 15},
+		},
+		{
+			name:     "faulty readings report the sensor instead",
+			rule:     data.AlertRule{Metric: "soil_moisture", Comparator: data.ComparatorLT, Threshold: 20},
+			values:   []float64{0, 0, 25},
+			faulty:   []int{0, 1},
+			warnings: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := tt.rule
+			rule.ID = 1
+			rule.Severity = data.SeverityAlert
+			rule.Scope = data.ScopeDevice
+			app, alerts, notifications := newAlertTestApp(t, &rule)
+
+			readings := moistureReadings(start, tt.values...)
+			for _, i := range tt.faulty {
+				readings[i].Quality = data.QualityFault
+				readings[i].QualityIssues = "soil_moisture stuck at 0"
+			}
+			app.checkReadings(device, readings)
+
+			fired, warnings := 0, 0
+			for _, notification := range notifications.created {
+				switch notification.Type {
+				case data.SeverityAlert:
+					fired++
+				case data.SeverityWarning:
+					warnings++
+				}
+			}
+			if fired != tt.fired || warnings != tt.warnings {
+				t.Errorf("%d alerts and %d fault warnings, want %d and %d", fired, warnings, tt.fired, tt.warnings)
+			}
+
+			state := alerts.states[rule.ID]
+			if tt.fired == 0 {
+				if state != nil && state.LastFiredAt != nil {
+					t.Errorf("rule fired at %v", state.LastFiredAt)
+				}
+				return
+			}
+			if state == nil || state.LastFiredAt == nil || !state.LastFiredAt.Equal(tt.firedAt) {
+				t.Errorf("rule state %+v, want fired at %v", state, tt.firedAt)
+			} else if state.Active != tt.active {
+				t.Errorf("rule active is %t, want %t", state.Active, tt.active)
+			}
+		})
+	}
+}
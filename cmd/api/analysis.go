@@ -0,0 +1,403 @@
+package main
+
+import (
+	"errors"
+	"field_eyes/data"
+	"field_eyes/pkg/analysis"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default and maximum window of readings analysed
+	defaultAnalysisWindow = 7 * 24
+	maxAnalysisWindow     = 90 * 24
+	// Most recent readings analysed within the window
+	maxAnalysisReadings = 10000
+)
+
+// analysisMetrics lists the metrics examined by each analysis type
+var analysisMetrics = map[string][]string{
+	"soil":        {"ph", "soil_moisture", "soil_temperature", "soil_humidity"},
+	"temperature": {"temperature", "soil_temperature"},
+	"moisture":    {"soil_moisture", "soil_humidity", "humidity"},
+	"nutrient":    {"nitrogen", "phosphorous", "potassium"},
+}
+
+// trendMinChange is the smallest fitted change over the window that is reported as a
+// trend for each metric; smaller drifts are labelled stable even when significant
+var trendMinChange = map[string]float64{
+	"temperature":      0.5,
+	"humidity":         2,
+	"nitrogen":         2,
+	"phosphorous":      2,
+	"potassium":        2,
+	"ph":               0.1,
+	"soil_moisture":    1,
+	"soil_temperature": 0.5,
+	"soil_humidity":    2,
+}
+
+// analysisResult is the response of AnalyzeDeviceData
+type analysisResult struct {
+	DeviceID        uint                            `json:"device_id"`
+	SerialNumber    string                          `json:"serial_number"`
+	AnalysisType    string                          `json:"analysis_type"`
+	WindowHours     int                             `json:"window_hours"`
+	ReadingCount    int                             `json:"reading_count"`
+	Statistics      map[string]analysis.Summary     `json:"statistics"`
+	Recommendations []string                        `json:"recommendations"`
+	Predictions     map[string]float64              `json:"predictions"` // <metric>_in_24h projected from the trend
+	Trends          map[string]string               `json:"trends"`
+	Forecast        *irrigationForecast             `json:"forecast,omitempty"`   // soil moisture forecast of the moisture analysis
+	Fertilizer      []analysis.FertilizerSuggestion `json:"fertilizer,omitempty"` // per hectare, from the nutrient analysis
+	Targets         cropTargets                     `json:"targets"`
+	LastUpdated     time.Time                       `json:"last_updated"`
+}
+
+// metricSeries extracts one metric from readings, oldest reading time first. Logs are
+// stored in the order they arrive, so a buffered batch can follow later live readings.
+func metricSeries(logs []*data.DeviceData, metric string) []analysis.Point {
+	points := make([]analysis.Point, 0, len(logs))
+	for _, log := range logs {
+		if value, ok := log.Metric(metric); ok {
+			points = append(points, analysis.Point{Time: log.ReadingTime(), Value: value})
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+	return points
+}
+
+// analyzeReadings computes the statistics, trends and recommendations of one analysis
+// type, judging readings against the given targets
+func analyzeReadings(analysisType string, logs []*data.DeviceData, targets cropTargets, result *analysisResult) {
+	for _, metric := range analysisMetrics[analysisType] {
+		summary := analysis.Summarize(metricSeries(logs, metric), trendMinChange[metric])
+		result.Statistics[metric] = summary
+		result.Trends[metric] = summary.Trend
+
+		switch summary.Trend {
+		case analysis.TrendIncreasing, analysis.TrendDecreasing:
+			result.Predictions[metric+"_in_24h"] = summary.Last + summary.RatePerHour*24
+		case analysis.TrendStable:
+			result.Predictions[metric+"_in_24h"] = summary.Mean
+		}
+	}
+
+	result.Recommendations = recommendations(analysisType, result.Statistics, targets)
+	if analysisType == "nutrient" {
+		result.Fertilizer = fertilizerSuggestions(result.Statistics, targets)
+	}
+	if len(result.Recommendations) == 0 {
+		result.Recommendations = []string{"No action needed: readings are within normal ranges with no concerning trends"}
+	}
+}
+
+// addMoistureForecast puts a soil moisture forecast and its irrigation advice into
+// the results, replacing the trend-based predictions of soil moisture
+func addMoistureForecast(result *analysisResult, forecast *irrigationForecast) {
+	result.Forecast = forecast
+	for _, hours := range []int{24, 48, 72} {
+		key := fmt.Sprintf("soil_moisture_in_%dh", hours)
+		delete(result.Predictions, key)
+		if hours <= len(forecast.Points) {
+			result.Predictions[key] = forecast.Points[hours-1].Value
+		}
+	}
+
+	advice := []string{irrigationAdvice(forecast)}
+	for _, a := range result.Recommendations {
+		if !strings.HasPrefix(a, "No action needed") {
+			advice = append(advice, a)
+		}
+	}
+	result.Recommendations = advice
+}
+
+// nutrientNames are the nutrient metrics as written in advice
+var nutrientNames = map[string]string{
+	"nitrogen":    "Nitrogen",
+	"phosphorous": "Phosphorous",
+	"potassium":   "Potassium",
+}
+
+// recommendations turns the computed statistics into advice
+func recommendations(analysisType string, stats map[string]analysis.Summary, targets cropTargets) []string {
+	var advice []string
+	perDay := func(s analysis.Summary) float64 { return s.RatePerHour * 24 }
+	crop := "crops"
+	if targets.Crop != "" {
+		crop = targets.Crop
+	}
+
+	switch analysisType {
+	case "soil":
+		ph := stats["ph"]
+		switch {
+		case ph.Count == 0:
+		case ph.Mean < targets.PH.Min:
+			advice = append(advice, fmt.Sprintf("Soil is too acidic for %s (mean pH %.1f, target %.1f-%.1f), consider adding lime", crop, ph.Mean, targets.PH.Min, targets.PH.Max))
+		case ph.Mean > targets.PH.Max:
+			advice = append(advice, fmt.Sprintf("Soil is too alkaline for %s (mean pH %.1f, target %.1f-%.1f), consider adding sulfur", crop, ph.Mean, targets.PH.Min, targets.PH.Max))
+		}
+		if ph.Trend != analysis.TrendStable && ph.Trend != analysis.TrendInsufficient {
+			advice = append(advice, fmt.Sprintf("Soil pH is %s by %.2f per day, retest the soil to confirm", ph.Trend, abs(perDay(ph))))
+		}
+		advice = append(advice, moistureAdvice(stats["soil_moisture"], targets.Moisture)...)
+
+	case "temperature":
+		temp := stats["temperature"]
+		if temp.Count > 0 && temp.Max > targets.Temperature.Max {
+			advice = append(advice, fmt.Sprintf("Air temperature peaked at %.1f°C, above %.0f°C for %s, consider shading during the hottest hours", temp.Max, targets.Temperature.Max, crop))
+		}
+		if temp.Count > 0 && temp.Min < targets.Temperature.Min {
+			advice = append(advice, fmt.Sprintf("Air temperature fell to %.1f°C, below %.0f°C for %s, protect frost-sensitive crops", temp.Min, targets.Temperature.Min, crop))
+		}
+		if temp.StdDev > 8 {
+			advice = append(advice, fmt.Sprintf("Air temperature varies widely (std dev %.1f°C), mulching can buffer soil temperature", temp.StdDev))
+		}
+		soilTemp := stats["soil_temperature"]
+		if soilTemp.Trend == analysis.TrendIncreasing && soilTemp.Mean > targets.Temperature.Max-5 {
+			advice = append(advice, fmt.Sprintf("Soil is warming by %.1f°C per day from a mean of %.1f°C, increase mulch or irrigation", perDay(soilTemp), soilTemp.Mean))
+		}
+
+	case "moisture":
+		advice = append(advice, moistureAdvice(stats["soil_moisture"], targets.Moisture)...)
+		humidity := stats["humidity"]
+		if humidity.Count > 0 && humidity.Mean > 85 {
+			advice = append(advice, fmt.Sprintf("Air humidity averages %.0f%%, watch for fungal disease", humidity.Mean))
+		}
+
+	case "nutrient":
+		for _, metric := range analysisMetrics["nutrient"] {
+			s := stats[metric]
+			if s.Count == 0 {
+				continue
+			}
+			band := targets.nutrient(metric)
+			switch {
+			case s.Mean < band.Min:
+				advice = append(advice, fmt.Sprintf("%s deficiency detected (mean %.1f, target %.0f-%.0f)", nutrientNames[metric], s.Mean, band.Min, band.Max))
+			case s.Mean > band.Max:
+				advice = append(advice, fmt.Sprintf("%s is above what %s needs (mean %.1f, target %.0f-%.0f), hold back %s fertilizer", nutrientNames[metric], crop, s.Mean, band.Min, band.Max, metric))
+			}
+			if s.Trend == analysis.TrendDecreasing {
+				advice = append(advice, fmt.Sprintf("%s is depleting by %.1f per day, plan the next fertilizer application", nutrientNames[metric], abs(perDay(s))))
+			}
+		}
+		if targets.Stage != "" && len(advice) > 0 {
+			advice = append(advice, fmt.Sprintf("Nutrient targets are for %s at the %s stage", targets.Crop, strings.ToLower(targets.Stage)))
+		}
+	}
+
+	return advice
+}
+
+// fertilizerSuggestions works out the fertilizer per hectare that brings each deficient
+// nutrient to the middle of its target range
+func fertilizerSuggestions(stats map[string]analysis.Summary, targets cropTargets) []analysis.FertilizerSuggestion {
+	suggestions := []analysis.FertilizerSuggestion{}
+	for _, metric := range analysisMetrics["nutrient"] {
+		s := stats[metric]
+		band := targets.nutrient(metric)
+		if s.Count == 0 || s.Mean >= band.Min {
+			continue
+		}
+		if suggestion, ok := analysis.SuggestFertilizer(metric, s.Mean, band.Mid()); ok {
+			suggestions = append(suggestions, suggestion)
+		}
+	}
+	return suggestions
+}
+
+// moistureAdvice recommends irrigation changes from soil moisture statistics
+func moistureAdvice(s analysis.Summary, band data.Range) []string {
+	if s.Count == 0 {
+		return nil
+	}
+	switch {
+	case s.Mean < band.Min && s.Trend != analysis.TrendIncreasing:
+		return []string{fmt.Sprintf("Soil moisture is low (mean %.1f%%, %s), increase irrigation", s.Mean, s.Trend)}
+	case s.Mean > band.Max && s.Trend != analysis.TrendDecreasing:
+		return []string{fmt.Sprintf("Soil moisture is high (mean %.1f%%, %s), reduce irrigation to avoid waterlogging", s.Mean, s.Trend)}
+	case s.Trend == analysis.TrendDecreasing && s.Last < band.Min+10:
+		return []string{fmt.Sprintf("Soil moisture is falling by %.1f%% per day and is at %.1f%%, plan irrigation soon", abs(s.RatePerHour*24), s.Last)}
+	}
+	return nil
+}
+
+// abs returns the absolute value of x
+func abs(x float64) float64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// AnalyzeDeviceData computes statistics, trends and recommendations from a device's
+// readings. Optional query parameter window_hours sets how far back to look, and
+// exclude_flagged=true leaves out readings flagged by the anomaly checks. The moisture
+// analysis also forecasts soil moisture horizon_hours ahead and when it will fall
+// below refill_point, defaulting to the device's refill point.
+func (app *Config) AnalyzeDeviceData(w http.ResponseWriter, r *http.Request) {
+	// Get the authenticated user from the request context
+	claims := app.userClaims(r)
+
+	// Get the device serial number and analysis type from the query parameters
+	serialNumber := r.URL.Query().Get("serial_number")
+	if serialNumber == "" {
+		app.errorJSON(w, errors.New("missing device serial number"), http.StatusBadRequest)
+		return
+	}
+
+	analysisType := r.URL.Query().Get("type")
+	if analysisType == "" {
+		analysisType = "soil" // Default analysis type
+	}
+
+	// Validate supported analysis types
+	if _, ok := analysisMetrics[analysisType]; !ok {
+		app.errorJSON(w, errors.New("unsupported analysis type"), http.StatusBadRequest)
+		return
+	}
+
+	window := defaultAnalysisWindow
+	if param := r.URL.Query().Get("window_hours"); param != "" {
+		hours, err := strconv.Atoi(param)
+		if err != nil || hours < 1 || hours > maxAnalysisWindow {
+			app.errorJSON(w, fmt.Errorf("window_hours must be between 1 and %d", maxAnalysisWindow), http.StatusBadRequest)
+			return
+		}
+		window = hours
+	}
+
+	qualities, err := qualityFilter(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// The moisture analysis forecasts when soil moisture reaches the refill point
+	var refillPoint float64
+	horizon := defaultForecastHorizon
+	if param := r.URL.Query().Get("refill_point"); param != "" {
+		refillPoint, err = strconv.ParseFloat(param, 64)
+		if err != nil || refillPoint <= 0 || refillPoint >= 100 {
+			app.errorJSON(w, errors.New("refill_point must be between 0 and 100"), http.StatusBadRequest)
+			return
+		}
+	}
+	if param := r.URL.Query().Get("horizon_hours"); param != "" {
+		horizon, err = strconv.Atoi(param)
+		if err != nil || horizon < minForecastHorizon || horizon > maxForecastHorizon {
+			app.errorJSON(w, fmt.Errorf("horizon_hours must be between %d and %d", minForecastHorizon, maxForecastHorizon), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Validate that the device exists and belongs to the user
+	device, err := app.Models.Device.GetBySerialNumber(serialNumber)
+	if err != nil || device == nil {
+		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
+		return
+	}
+	if !app.canAccessDevice(claims, device, false) {
+		app.errorJSON(w, errors.New("unauthorized: device does not belong to the user"), http.StatusUnauthorized)
+		return
+	}
+
+	targets := app.deviceTargets(device)
+	if refillPoint == 0 {
+		refillPoint = deviceRefillPoint(device, targets)
+	}
+
+	var result analysisResult
+	cacheKey := fmt.Sprintf("%s:%dh", analysisType, window)
+	if len(qualities) > 0 {
+		cacheKey += ":" + strings.Join(qualities, ",")
+	}
+	if targets.Crop != "" {
+		cacheKey += fmt.Sprintf(":crop=%s/%s", targets.Crop, targets.Stage)
+	}
+	if analysisType == "moisture" {
+		cacheKey += fmt.Sprintf(":refill=%g:%dh", refillPoint, horizon)
+	}
+
+	// Try to get analysis results from cache if Redis is available
+	cacheHit := false
+	if app.Redis != nil {
+		err := app.Redis.GetCachedMLAnalysisResults(device.ID, cacheKey, &result)
+		if err == nil {
+			cacheHit = true
+			app.InfoLog.Printf("Cache hit for analysis: %s, device: %s", cacheKey, serialNumber)
+		}
+	}
+
+	// If not found in cache, perform the analysis
+	if !cacheHit {
+		app.InfoLog.Printf("Cache miss for analysis: %s, device: %s", cacheKey, serialNumber)
+
+		// Get the device's readings within the window, oldest first
+		now := time.Now()
+		logs, err := app.Models.DeviceData.GetLogsPage(device.ID, data.LogQuery{
+			From:      now.Add(-time.Duration(window) * time.Hour),
+			Limit:     maxAnalysisReadings,
+			Qualities: qualities,
+		})
+		if err != nil {
+			app.errorJSON(w, errors.New("failed to retrieve device logs for analysis"), http.StatusInternalServerError)
+			app.ErrorLog.Printf("Failed to retrieve logs for analysis: %v", err)
+			return
+		}
+
+		if len(logs) == 0 {
+			app.errorJSON(w, errors.New("insufficient data for analysis"), http.StatusBadRequest)
+			return
+		}
+
+		for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
+			logs[i], logs[j] = logs[j], logs[i]
+		}
+
+		result = analysisResult{
+			DeviceID:     device.ID,
+			SerialNumber: serialNumber,
+			AnalysisType: analysisType,
+			WindowHours:  window,
+			ReadingCount: len(logs),
+			Statistics:   make(map[string]analysis.Summary),
+			Predictions:  make(map[string]float64),
+			Trends:       make(map[string]string),
+			Targets:      targets,
+			LastUpdated:  now,
+		}
+		analyzeReadings(analysisType, logs, targets, &result)
+
+		if analysisType == "moisture" {
+			forecast, err := app.forecastMoisture(device, refillPoint, horizon)
+			if err != nil {
+				app.ErrorLog.Printf("Failed to forecast soil moisture of device %s: %v", serialNumber, err)
+			} else if forecast != nil {
+				addMoistureForecast(&result, forecast)
+			}
+		}
+
+		// Store in cache for future requests if Redis is available
+		if app.Redis != nil {
+			go func() {
+				if err := app.Redis.CacheMLAnalysisResults(device.ID, cacheKey, result); err != nil {
+					app.ErrorLog.Printf("Failed to cache analysis results: %v", err)
+				}
+			}()
+		}
+	}
+
+	// Respond with the analysis results
+	app.writeJSON(w, http.StatusOK, result)
+}
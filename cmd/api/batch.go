@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"field_eyes/data"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maxBatchReadings is the most readings accepted in one batch
+	maxBatchReadings = 1000
+	// maxBatchBytes is the largest batch request body
+	maxBatchBytes = 4 << 20
+	// measuredAtMaxSkew is how far ahead of the server a device's clock may run
+	measuredAtMaxSkew = 5 * time.Minute
+	// measuredAtMaxAge is the oldest buffered reading a device may send; older history
+	// goes through the import endpoint
+	measuredAtMaxAge = 30 * 24 * time.Hour
+	// senmlRelativeTime is the SenML time below which times are relative to now (RFC 8428)
+	senmlRelativeTime = 1 << 28
+	// maxMessageIDLength is the longest message_id a reading may carry
+	maxMessageIDLength = 100
+)
+
+// batchError is a reading of a batch that was not stored
+type batchError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// checkReading rejects a device timestamp outside the sanity window around now or an
+// overlong message ID. An empty message ID is dropped.
+func checkReading(reading *data.DeviceData, now time.Time) error {
+	if reading.MessageID != nil {
+		if *reading.MessageID == "" {
+			reading.MessageID = nil
+		} else if len(*reading.MessageID) > maxMessageIDLength {
+			return fmt.Errorf("message_id may be at most %d characters", maxMessageIDLength)
+		}
+	}
+	if reading.MeasuredAt == nil {
+		return nil
+	}
+	if reading.MeasuredAt.After(now.Add(measuredAtMaxSkew)) {
+		return errors.New("measured_at is in the future: check the device clock")
+	}
+	if reading.MeasuredAt.Before(now.Add(-measuredAtMaxAge)) {
+		return fmt.Errorf("measured_at is more than %d days old", int(measuredAtMaxAge.Hours()/24))
+	}
+	return nil
+}
+
+// senmlRecord is one record of a SenML JSON pack (RFC 8428). Base values carry over
+// to the records that follow.
+type senmlRecord struct {
+	BaseName *string  `json:"bn"`
+	BaseTime *float64 `json:"bt"`
+	Name     string   `json:"n"`
+	Unit     string   `json:"u"`
+	Value    *float64 `json:"v"`
+	Time     float64  `json:"t"`
+}
+
+// senmlSerial takes the serial number from a base name such as "urn:dev:sn:SN123:"
+// or "SN123/"
+func senmlSerial(baseName string) string {
+	baseName = strings.TrimRight(baseName, ":/")
+	if i := strings.LastIndexAny(baseName, ":/"); i >= 0 {
+		baseName = baseName[i+1:]
+	}
+	return baseName
+}
+
+// decodeSenML turns a SenML pack into readings, one per distinct time. Names are
+// matched to reading fields like import columns; other names and non-numeric records
+// are skipped.
+func decodeSenML(records []senmlRecord, now time.Time) (string, []*data.DeviceData, error) {
+	var serial, baseName string
+	var baseTime float64
+	var readings []*data.DeviceData
+	byTime := make(map[float64]*data.DeviceData)
+
+	for i, record := range records {
+		if record.BaseName != nil {
+			baseName = *record.BaseName
+			if s := senmlSerial(baseName); s != "" {
+				if serial != "" && s != serial {
+					return "", nil, fmt.Errorf("record %d: a batch may only hold one device's readings", i)
+				}
+				serial = s
+			}
+		}
+		if record.BaseTime != nil {
+			baseTime = *record.BaseTime
+		}
+		if record.Value == nil {
+			continue
+		}
+		field := importMapping{}.field(record.Name)
+		if field == "" || field == "measured_at" || field == "created_at" {
+			continue
+		}
+		if math.IsNaN(*record.Value) || math.IsInf(*record.Value, 0) {
+			return "", nil, fmt.Errorf("record %d: invalid value", i)
+		}
+
+		t := baseTime + record.Time
+		reading, ok := byTime[t]
+		if !ok {
+			reading = &data.DeviceData{}
+			// A pack without times was measured now, which the server records anyway
+			if t != 0 {
+				var at time.Time
+				if math.Abs(t) < senmlRelativeTime {
+					at = now.Add(time.Duration(t * float64(time.Second)))
+				} else {
+					at = time.UnixMicro(int64(t * 1e6))
+				}
+				reading.MeasuredAt = &at
+			}
+			byTime[t] = reading
+			readings = append(readings, reading)
+		}
+		switch field {
+		case "longitude":
+			reading.Longitude = *record.Value
+		case "latitude":
+			reading.Latitude = *record.Value
+		default:
+			reading.SetMetric(field, *record.Value)
+		}
+	}
+	return serial, readings, nil
+}
+
+// decodeReadings parses one reading, an array of readings or a SenML pack. The
+// readings must all belong to one device, whose serial number is returned; serial is
+// used when the payload doesn't name it.
+func decodeReadings(payload []byte, serial string) (string, []*data.DeviceData, error) {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 || payload[0] != '[' {
+		var reading data.DeviceData
+		if err := json.Unmarshal(payload, &reading); err != nil {
+			return "", nil, err
+		}
+		if reading.SerialNumber != "" {
+			serial = reading.SerialNumber
+		}
+		return serial, []*data.DeviceData{&reading}, nil
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(payload, &items); err != nil {
+		return "", nil, err
+	}
+	if len(items) == 0 {
+		return "", nil, errors.New("the batch is empty")
+	}
+
+	// SenML records are recognised by their name or base name
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(items[0], &probe); err != nil {
+		return "", nil, errors.New("batch items must be JSON objects")
+	}
+	_, hasName := probe["n"]
+	_, hasBaseName := probe["bn"]
+	if hasName || hasBaseName {
+		var records []senmlRecord
+		if err := json.Unmarshal(payload, &records); err != nil {
+			return "", nil, fmt.Errorf("invalid SenML pack: %v", err)
+		}
+		packSerial, readings, err := decodeSenML(records, time.Now())
+		if err != nil {
+			return "", nil, err
+		}
+		if packSerial != "" {
+			serial = packSerial
+		}
+		if len(readings) > maxBatchReadings {
+			return "", nil, fmt.Errorf("a batch may hold at most %d readings", maxBatchReadings)
+		}
+		return serial, readings, nil
+	}
+
+	if len(items) > maxBatchReadings {
+		return "", nil, fmt.Errorf("a batch may hold at most %d readings", maxBatchReadings)
+	}
+	readings := make([]*data.DeviceData, len(items))
+	for i, item := range items {
+		var reading data.DeviceData
+		if err := json.Unmarshal(item, &reading); err != nil {
+			return "", nil, fmt.Errorf("reading %d: %v", i, err)
+		}
+		if reading.SerialNumber != "" {
+			if serial != "" && reading.SerialNumber != serial {
+				return "", nil, fmt.Errorf("reading %d: a batch may only hold one device's readings", i)
+			}
+			serial = reading.SerialNumber
+		}
+		readings[i] = &reading
+	}
+	return serial, readings, nil
+}
+
+// readingKey identifies a reading of a device across redeliveries: its message ID, or
+// else its measured_at. Readings with neither have no key.
+func readingKey(reading *data.DeviceData) string {
+	if reading.MessageID != nil {
+		return "id:" + *reading.MessageID
+	}
+	if reading.MeasuredAt != nil {
+		return fmt.Sprintf("at:%d", reading.MeasuredAt.UnixMicro())
+	}
+	return ""
+}
+
+// seenReadings reports which readings Redis remembers as stored moments ago. Without
+// Redis, or if it fails, every reading goes on to the database.
+func (app *Config) seenReadings(device *data.Device, readings []*data.DeviceData) []bool {
+	seen := make([]bool, len(readings))
+	if app.Redis == nil {
+		return seen
+	}
+	var keys []string
+	var positions []int
+	for i, reading := range readings {
+		if key := readingKey(reading); key != "" {
+			keys = append(keys, key)
+			positions = append(positions, i)
+		}
+	}
+	found, err := app.Redis.SeenReadings(device.ID, keys)
+	if err != nil {
+		app.ErrorLog.Printf("Failed to check recent readings of device %s: %v", device.SerialNumber, err)
+		return seen
+	}
+	for i, ok := range found {
+		seen[positions[i]] = ok
+	}
+	return seen
+}
+
+// markReadingsSeen remembers readings in Redis so redeliveries are dropped early
+func (app *Config) markReadingsSeen(device *data.Device, readings []*data.DeviceData) {
+	if app.Redis == nil {
+		return
+	}
+	var keys []string
+	for _, reading := range readings {
+		if key := readingKey(reading); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if err := app.Redis.MarkReadingsSeen(device.ID, keys); err != nil {
+		app.ErrorLog.Printf("Failed to remember readings of device %s: %v", device.SerialNumber, err)
+	}
+}
+
+// ingestResult is what became of readings a device sent together. Indexes are the
+// readings' positions as sent.
+type ingestResult struct {
+	Stored     []*data.DeviceData // new readings, oldest first
+	Duplicates []int              // readings already stored, by message ID or measured_at
+	Rejected   []batchError
+}
+
+// storeReadings checks, saves and follows up readings a device sent together.
+// Readings with a device timestamp outside the sanity window are rejected, and
+// readings already stored are skipped as duplicates.
+func (app *Config) storeReadings(device *data.Device, readings []*data.DeviceData) (*ingestResult, error) {
+	now := time.Now()
+	result := &ingestResult{Duplicates: []int{}, Rejected: []batchError{}}
+	index := make(map[*data.DeviceData]int, len(readings))
+	valid := make([]*data.DeviceData, 0, len(readings))
+	for i, reading := range readings {
+		if err := checkReading(reading, now); err != nil {
+			result.Rejected = append(result.Rejected, batchError{Index: i, Error: err.Error()})
+			continue
+		}
+		// A reading's ID is the server's; zero tells a skipped duplicate after saving
+		reading.ID = 0
+		reading.DeviceID = device.ID
+		reading.SerialNumber = device.SerialNumber
+		reading.CreatedAt = now
+		index[reading] = i
+		valid = append(valid, reading)
+	}
+
+	// Redeliveries of readings stored moments ago don't need the database
+	pending := make([]*data.DeviceData, 0, len(valid))
+	for i, seen := range app.seenReadings(device, valid) {
+		if seen {
+			result.Duplicates = append(result.Duplicates, index[valid[i]])
+		} else {
+			pending = append(pending, valid[i])
+		}
+	}
+	if len(pending) == 0 {
+		sort.Ints(result.Duplicates)
+		return result, nil
+	}
+
+	// Buffered readings may arrive out of order; check and store them oldest first
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].ReadingTime().Before(pending[j].ReadingTime())
+	})
+	app.checkBatchQuality(device, pending)
+
+	if _, err := app.Models.DeviceData.CreateLogs(pending); err != nil {
+		return nil, err
+	}
+	for _, reading := range pending {
+		if reading.ID == 0 {
+			result.Duplicates = append(result.Duplicates, index[reading])
+		} else {
+			result.Stored = append(result.Stored, reading)
+		}
+	}
+	sort.Ints(result.Duplicates)
+	app.markReadingsSeen(device, pending)
+
+	if len(result.Stored) == 0 {
+		return result, nil
+	}
+
+	// Dashboards, alert rules and fault checks get every reading, in the order they
+	// were measured; presence and field suggestions follow the device's current
+	// state, which is its newest reading
+	latest := result.Stored[len(result.Stored)-1]
+	app.markDeviceSeen(device, latest.CreatedAt)
+	for _, reading := range result.Stored {
+		app.Stream.PublishReading(device, reading)
+	}
+	app.checkReadings(device, result.Stored)
+	app.suggestDeviceField(device, latest)
+	app.emitReadings(device, result.Stored)
+
+	app.invalidateDeviceLogs(device)
+	return result, nil
+}
+
+// LogDeviceDataBatch stores several readings of one device sent in one request: an
+// array of readings like LogDeviceData takes, or a SenML pack. Each reading may carry
+// measured_at, the device's own timestamp.
+func (app *Config) LogDeviceDataBatch(w http.ResponseWriter, r *http.Request) {
+	// Keep the raw body, request signatures are computed over it
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	serialNumber, readings, err := decodeReadings(body, "")
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if serialNumber == "" {
+		app.errorJSON(w, errors.New("serial number is required"), http.StatusBadRequest)
+		return
+	}
+	if len(readings) == 0 {
+		app.errorJSON(w, errors.New("the batch holds no readings"), http.StatusBadRequest)
+		return
+	}
+
+	device, err := app.Models.Device.GetBySerialNumber(serialNumber)
+	if err == nil && device != nil {
+		if err := authenticateDeviceRequest(r, device, body); err != nil {
+			app.errorJSON(w, err, http.StatusUnauthorized)
+			app.ErrorLog.Printf("Rejected data for device %s: %v", serialNumber, err)
+			return
+		}
+	} else if deviceAuthStrict() {
+		// Only registered devices may report in strict mode
+		app.errorJSON(w, errors.New("unknown device"), http.StatusUnauthorized)
+		app.ErrorLog.Printf("Rejected data for unknown device %s", serialNumber)
+		return
+	} else {
+		app.InfoLog.Printf("Device with serial number %s not found, auto-registering", serialNumber)
+		device = &data.Device{
+			DeviceType:   "auto_registered",
+			SerialNumber: serialNumber,
+		}
+		if err := app.Models.Device.CreateDevice(device); err != nil {
+			app.errorJSON(w, errors.New("failed to auto-register device"), http.StatusInternalServerError)
+			app.ErrorLog.Printf("Failed to auto-register device: %v", err)
+			return
+		}
+	}
+
+	result, err := app.storeReadings(device, readings)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to log device data"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to log a batch of %d readings for device %s: %v", len(readings), serialNumber, err)
+		return
+	}
+
+	// A batch sent again is accepted; only readings that couldn't be stored fail it
+	status, message := http.StatusCreated, "device data logged successfully"
+	if len(result.Stored) == 0 {
+		if len(result.Duplicates) > 0 {
+			status, message = http.StatusOK, "readings were already stored"
+		} else {
+			status, message = http.StatusUnprocessableEntity, "no readings were stored"
+		}
+	}
+	app.writeJSON(w, status, map[string]interface{}{
+		"message":       message,
+		"device_id":     device.ID,
+		"serial_number": device.SerialNumber,
+		"stored":        len(result.Stored),
+		"duplicates":    result.Duplicates,
+		"rejected":      result.Rejected,
+	})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Maximum number of parts a chunked message may be split into
+	maxChunkParts = 256
+	// Default maximum size of a reassembled chunked message
+	defaultMaxChunkedMessageSize = 256 * 1024
+	// Incomplete messages are discarded after this long
+	incompleteBufferTTL = time.Hour
+	// Completed messages are remembered this long so late duplicates are ignored
+	completedBufferTTL = 5 * time.Minute
+	// Incomplete messages kept per device and in all; past these the oldest is dropped
+	maxPendingPerDevice = 8
+	maxPendingMessages  = 512
+)
+
+var (
+	errInvalidChunk    = errors.New("invalid chunk number or total")
+	errChunkedTooLarge = errors.New("chunked message exceeds maximum size")
+)
+
+// messageBuffer holds the parts of a chunked message while it is being reassembled
+type messageBuffer struct {
+	SerialNumber string
+	Parts        map[int][]byte
+	TotalParts   int
+	Size         int
+	ReceivedTime time.Time
+	IsComplete   bool
+}
+
+// ChunkStats reports counters for chunked message reassembly
+type ChunkStats struct {
+	Pending    int    `json:"pending"`
+	Completed  uint64 `json:"completed"`
+	Expired    uint64 `json:"expired"`
+	Duplicates uint64 `json:"duplicates"`
+	Rejected   uint64 `json:"rejected"`
+	Restarted  uint64 `json:"restarted"` // messages sent again with a different number of parts
+	Evicted    uint64 `json:"evicted"`   // incomplete messages dropped for newer ones
+}
+
+// chunkAssembler reassembles chunked messages keyed by serial number and message ID.
+// It is safe for concurrent use.
+type chunkAssembler struct {
+	mu      sync.Mutex
+	buffers map[string]*messageBuffer
+	pending map[string]int // incomplete messages by serial number
+	maxSize int
+
+	completed  atomic.Uint64
+	expired    atomic.Uint64
+	duplicates atomic.Uint64
+	rejected   atomic.Uint64
+	restarted  atomic.Uint64
+	evicted    atomic.Uint64
+}
+
+// newChunkAssembler creates a chunk assembler that rejects messages larger than maxSize bytes
+func newChunkAssembler(maxSize int) *chunkAssembler {
+	if maxSize <= 0 {
+		maxSize = defaultMaxChunkedMessageSize
+	}
+	return &chunkAssembler{
+		buffers: make(map[string]*messageBuffer),
+		pending: make(map[string]int),
+		maxSize: maxSize,
+	}
+}
+
+// bufferKey builds the map key for a device's chunked message
+func bufferKey(serialNumber, messageID string) string {
+	return serialNumber + "/" + messageID
+}
+
+// Add stores one chunk (numbered from 1 to total) and returns the reassembled
+// payload once every part has arrived. It returns nil while parts are still missing.
+func (c *chunkAssembler) Add(serialNumber, messageID string, total, part int, payload []byte) ([]byte, error) {
+	if total < 1 || total > maxChunkParts || part < 1 || part > total {
+		c.rejected.Add(1)
+		return nil, errInvalidChunk
+	}
+
+	key := bufferKey(serialNumber, messageID)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	buffer, ok := c.buffers[key]
+	if ok && buffer.IsComplete {
+		// Late retransmission of a message that was already processed
+		c.duplicates.Add(1)
+		return nil, nil
+	}
+	if ok && buffer.TotalParts != total {
+		// The device restarted the message with a different split; this chunk
+		// belongs to the new one
+		c.remove(key)
+		c.restarted.Add(1)
+		ok = false
+	}
+	if !ok {
+		c.makeRoom(serialNumber)
+		buffer = &messageBuffer{
+			SerialNumber: serialNumber,
+			Parts:        make(map[int][]byte, total),
+			TotalParts:   total,
+			ReceivedTime: time.Now(),
+		}
+		c.buffers[key] = buffer
+		c.pending[serialNumber]++
+	}
+
+	if _, seen := buffer.Parts[part]; seen {
+		c.duplicates.Add(1)
+		return nil, nil
+	}
+
+	if buffer.Size+len(payload) > c.maxSize {
+		c.remove(key)
+		c.rejected.Add(1)
+		return nil, errChunkedTooLarge
+	}
+
+	// Copy the payload, the MQTT library may reuse the slice
+	buffer.Parts[part] = append([]byte(nil), payload...)
+	buffer.Size += len(payload)
+
+	if len(buffer.Parts) < buffer.TotalParts {
+		return nil, nil
+	}
+
+	var assembled bytes.Buffer
+	assembled.Grow(buffer.Size)
+	for i := 1; i <= buffer.TotalParts; i++ {
+		assembled.Write(buffer.Parts[i])
+	}
+	c.completed.Add(1)
+
+	if messageID == "" {
+		// Without a message ID the next message reuses the same key
+		c.remove(key)
+	} else {
+		c.donePending(serialNumber)
+		buffer.IsComplete = true
+		buffer.Parts = nil
+		buffer.ReceivedTime = time.Now()
+	}
+
+	return assembled.Bytes(), nil
+}
+
+// remove drops a buffer. The caller holds c.mu.
+func (c *chunkAssembler) remove(key string) {
+	buffer, ok := c.buffers[key]
+	if !ok {
+		return
+	}
+	delete(c.buffers, key)
+	if !buffer.IsComplete {
+		c.donePending(buffer.SerialNumber)
+	}
+}
+
+// donePending counts one fewer incomplete message for a device. The caller holds c.mu.
+func (c *chunkAssembler) donePending(serialNumber string) {
+	if c.pending[serialNumber] <= 1 {
+		delete(c.pending, serialNumber)
+	} else {
+		c.pending[serialNumber]--
+	}
+}
+
+// makeRoom drops the oldest incomplete messages, of the device if it has too many and
+// of any device if there are too many in all, so a new one can start. A device
+// that keeps starting messages it never finishes can't hold unbounded memory. The
+// caller holds c.mu.
+func (c *chunkAssembler) makeRoom(serialNumber string) {
+	total := 0
+	for _, n := range c.pending {
+		total += n
+	}
+
+	for c.pending[serialNumber] >= maxPendingPerDevice || total >= maxPendingMessages {
+		device := ""
+		if c.pending[serialNumber] >= maxPendingPerDevice {
+			device = serialNumber
+		}
+		oldest := ""
+		var oldestTime time.Time
+		for key, buffer := range c.buffers {
+			if buffer.IsComplete || (device != "" && buffer.SerialNumber != device) {
+				continue
+			}
+			if oldest == "" || buffer.ReceivedTime.Before(oldestTime) {
+				oldest, oldestTime = key, buffer.ReceivedTime
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		c.remove(oldest)
+		c.evicted.Add(1)
+		total--
+	}
+}
+
+// Cleanup removes stale buffers and returns the keys of incomplete messages that expired
+func (c *chunkAssembler) Cleanup(now time.Time) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var expired []string
+	for key, buffer := range c.buffers {
+		if buffer.IsComplete {
+			if now.Sub(buffer.ReceivedTime) > completedBufferTTL {
+				delete(c.buffers, key)
+			}
+			continue
+		}
+		if now.Sub(buffer.ReceivedTime) > incompleteBufferTTL {
+			c.remove(key)
+			c.expired.Add(1)
+			expired = append(expired, fmt.Sprintf("%s (%d/%d parts)", key, len(buffer.Parts), buffer.TotalParts))
+		}
+	}
+	return expired
+}
+
+// Stats returns a snapshot of the reassembly counters
+func (c *chunkAssembler) Stats() ChunkStats {
+	c.mu.Lock()
+	pending := 0
+	for _, n := range c.pending {
+		pending += n
+	}
+	c.mu.Unlock()
+
+	return ChunkStats{
+		Pending:    pending,
+		Completed:  c.completed.Load(),
+		Expired:    c.expired.Load(),
+		Duplicates: c.duplicates.Load(),
+		Rejected:   c.rejected.Load(),
+		Restarted:  c.restarted.Load(),
+		Evicted:    c.evicted.Load(),
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// addChunk adds a chunk and fails the test on error
+func addChunk(t *testing.T, c *chunkAssembler, serial, id string, total, part int, payload string) []byte {
+	t.Helper()
+	assembled, err := c.Add(serial, id, total, part, []byte(payload))
+	if err != nil {
+		t.Fatalf("chunk %d/%d of %s/%s: %v", part, total, serial, id, err)
+	}
+	return assembled
+}
+
+// age backdates every incomplete message so the ones started later are newer
+func age(c *chunkAssembler, by time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, buffer := range c.buffers {
+		buffer.ReceivedTime = buffer.ReceivedTime.Add(-by)
+	}
+}
+
+func TestChunkAssembler(t *testing.T) {
+	t.Run("out of order", func(t *testing.T) {
+		c := newChunkAssembler(0)
+		if got := addChunk(t, c, "SN1", "m1", 3, 3, "c"); got != nil {
+			t.Fatalf("assembled %q after one part", got)
+		}
+		addChunk(t, c, "SN1", "m1", 3, 1, "a")
+		if got := addChunk(t, c, "SN1", "m1", 3, 2, "b"); string(got) != "abc" {
+			t.Fatalf("assembled %q, want abc", got)
+		}
+		if stats := c.Stats(); stats.Completed != 1 || stats.Pending != 0 {
+			t.Errorf("stats = %+v", stats)
+		}
+	})
+
+	t.Run("duplicates", func(t *testing.T) {
+		c := newChunkAssembler(0)
+		addChunk(t, c, "SN1", "m1", 2, 1, "a")
+		addChunk(t, c, "SN1", "m1", 2, 1, "x")
+		if got := addChunk(t, c, "SN1", "m1", 2, 2, "b"); string(got) != "ab" {
+			t.Fatalf("assembled %q, want ab", got)
+		}
+		// A late retransmission of a finished message isn't processed again
+		if got := addChunk(t, c, "SN1", "m1", 2, 2, "b"); got != nil {
+			t.Fatalf("finished message assembled again: %q", got)
+		}
+		if stats := c.Stats(); stats.Duplicates != 2 {
+			t.Errorf("duplicates = %d, want 2", stats.Duplicates)
+		}
+	})
+
+	t.Run("restarted with a different split", func(t *testing.T) {
+		c := newChunkAssembler(0)
+		addChunk(t, c, "SN1", "m1", 3, 1, "a")
+		addChunk(t, c, "SN1", "m1", 3, 2, "b")
+		// The device gives up and resends the message in two parts; the chunk
+		// that shows it starts the new message instead of being dropped
+		if got := addChunk(t, c, "SN1", "m1", 2, 2, "cd"); got != nil {
+			t.Fatalf("assembled %q after one part of the new split", got)
+		}
+		if got := addChunk(t, c, "SN1", "m1", 2, 1, "ab"); string(got) != "abcd" {
+			t.Fatalf("assembled %q, want abcd", got)
+		}
+		stats := c.Stats()
+		if stats.Restarted != 1 || stats.Rejected != 0 || stats.Pending != 0 {
+			t.Errorf("stats = %+v", stats)
+		}
+	})
+
+	t.Run("restarted as a single part", func(t *testing.T) {
+		c := newChunkAssembler(0)
+		addChunk(t, c, "SN1", "", 2, 1, "a")
+		if got := addChunk(t, c, "SN1", "", 1, 1, "ab"); string(got) != "ab" {
+			t.Fatalf("assembled %q, want ab", got)
+		}
+		if stats := c.Stats(); stats.Pending != 0 {
+			t.Errorf("pending = %d, want 0", stats.Pending)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		c := newChunkAssembler(4)
+		addChunk(t, c, "SN1", "m1", 2, 1, "abc")
+		if _, err := c.Add("SN1", "m1", 2, 2, []byte("de")); !errors.Is(err, errChunkedTooLarge) {
+			t.Fatalf("err = %v, want %v", err, errChunkedTooLarge)
+		}
+		if stats := c.Stats(); stats.Pending != 0 || stats.Rejected != 1 {
+			t.Errorf("stats = %+v", stats)
+		}
+	})
+
+	t.Run("invalid parts", func(t *testing.T) {
+		c := newChunkAssembler(0)
+		for _, chunk := range [][2]int{{0, 1}, {2, 0}, {2, 3}, {maxChunkParts + 1, 1}} {
+			if _, err := c.Add("SN1", "m1", chunk[0], chunk[1], []byte("a")); !errors.Is(err, errInvalidChunk) {
+				t.Errorf("chunk %d/%d: err = %v, want %v", chunk[1], chunk[0], err, errInvalidChunk)
+			}
+		}
+	})
+}
+
+func TestChunkAssemblerEvictsPerDevice(t *testing.T) {
+	c := newChunkAssembler(0)
+	for i := 0; i < maxPendingPerDevice; i++ {
+		addChunk(t, c, "SN1", fmt.Sprint("m", i), 2, 1, "a")
+		age(c, time.Second)
+	}
+	addChunk(t, c, "SN2", "other", 2, 1, "a")
+
+	// One more message drops SN1's oldest, not another device's
+	addChunk(t, c, "SN1", "new", 2, 1, "a")
+	stats := c.Stats()
+	if stats.Evicted != 1 || stats.Pending != maxPendingPerDevice+1 {
+		t.Fatalf("stats = %+v, want 1 evicted and %d pending", stats, maxPendingPerDevice+1)
+	}
+	if _, ok := c.buffers[bufferKey("SN1", "m0")]; ok {
+		t.Error("the oldest message was kept")
+	}
+	for _, key := range []string{bufferKey("SN1", "m1"), bufferKey("SN1", "new"), bufferKey("SN2", "other")} {
+		if _, ok := c.buffers[key]; !ok {
+			t.Errorf("%s was dropped", key)
+		}
+	}
+
+	// A chunk of the dropped message starts it again
+	addChunk(t, c, "SN1", "m0", 2, 1, "a")
+	if got := addChunk(t, c, "SN1", "m0", 2, 2, "b"); string(got) != "ab" {
+		t.Errorf("assembled %q, want ab", got)
+	}
+}
+
+func TestChunkAssemblerEvictsOverall(t *testing.T) {
+	c := newChunkAssembler(0)
+	for i := 0; i < maxPendingMessages; i++ {
+		addChunk(t, c, fmt.Sprint("SN", i), "m", 2, 1, "a")
+		if i == 0 {
+			age(c, time.Minute)
+		}
+	}
+	// Finished messages don't count
+	addChunk(t, c, "SN0", "done", 1, 1, "a")
+
+	addChunk(t, c, "SN-new", "m", 2, 1, "a")
+	stats := c.Stats()
+	if stats.Evicted != 1 || stats.Pending != maxPendingMessages {
+		t.Fatalf("stats = %+v, want 1 evicted and %d pending", stats, maxPendingMessages)
+	}
+	if _, ok := c.buffers[bufferKey("SN0", "m")]; ok {
+		t.Error("the oldest message was kept")
+	}
+	if _, ok := c.buffers[bufferKey("SN0", "done")]; !ok {
+		t.Error("a finished message was dropped")
+	}
+}
+
+func TestChunkAssemblerCleanup(t *testing.T) {
+	c := newChunkAssembler(0)
+	addChunk(t, c, "SN1", "stale", 2, 1, "a")
+	addChunk(t, c, "SN1", "done", 1, 1, "a")
+	age(c, incompleteBufferTTL+time.Minute)
+	addChunk(t, c, "SN1", "fresh", 2, 1, "a")
+
+	expired := c.Cleanup(time.Now())
+	if len(expired) != 1 {
+		t.Fatalf("expired = %v, want the stale message", expired)
+	}
+	if len(c.buffers) != 1 || c.Stats().Pending != 1 || c.pending["SN1"] != 1 {
+		t.Errorf("%d buffers and %d pending left, want the fresh message", len(c.buffers), c.Stats().Pending)
+	}
+}
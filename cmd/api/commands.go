@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"field_eyes/data"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// Default and maximum time a command may wait for an acknowledgement
+	defaultCommandTTL = 10 * time.Minute
+	maxCommandTTL     = 24 * time.Hour
+	// Number of times a command is published before waiting out its TTL
+	commandMaxAttempts = 3
+	// Time to wait for an acknowledgement before publishing again
+	commandRetryInterval = time.Minute
+	// How often outstanding commands are retried and expired
+	commandSweepInterval = 15 * time.Second
+	// Number of commands returned by the history endpoint
+	commandHistoryLimit = 100
+)
+
+// commandPayload is the message published on a device's command topic
+type commandPayload struct {
+	CommandID string          `json:"command_id"`
+	Command   string          `json:"command"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// commandAck is the message a device publishes on its cmd/ack topic
+type commandAck struct {
+	CommandID string `json:"command_id"`
+	Status    string `json:"status"` // ok or error
+	Message   string `json:"message"`
+}
+
+// validateCommand checks the command name and its parameters
+func validateCommand(command string, params json.RawMessage) error {
+	switch command {
+	case "reboot", "read_now":
+		return nil
+	case "set_interval":
+		var p struct {
+			IntervalSeconds int `json:"interval_seconds"`
+		}
+		if len(params) == 0 || json.Unmarshal(params, &p) != nil {
+			return errors.New("set_interval requires params.interval_seconds")
+		}
+		if p.IntervalSeconds < 10 || p.IntervalSeconds > 86400 {
+			return errors.New("interval_seconds must be between 10 and 86400")
+		}
+		return nil
+	}
+	return errors.New("unsupported command: use set_interval, reboot or read_now")
+}
+
+// newCommandID returns a random identifier for a command
+func newCommandID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sendCommand publishes a command to its device and records the attempt
+func (m *MQTTClient) sendCommand(command *data.DeviceCommand) error {
+	payload, err := json.Marshal(commandPayload{
+		CommandID: command.CommandID,
+		Command:   command.Command,
+		Params:    command.Params,
+		ExpiresAt: command.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	topic := fmt.Sprintf("%s/%s/cmd", m.topicRoot, command.SerialNumber)
+	command.Attempts++
+	now := time.Now()
+
+	if err := m.Publish(topic, 1, payload); err != nil {
+		if markErr := m.app.Models.Command.MarkAttempt(command.ID, command.Attempts, now); markErr != nil {
+			m.app.ErrorLog.Printf("Failed to record attempt for command %s: %v", command.CommandID, markErr)
+		}
+		return err
+	}
+
+	if err := m.app.Models.Command.MarkSent(command.ID, command.Attempts, now); err != nil {
+		return fmt.Errorf("command published but not recorded: %v", err)
+	}
+	if command.Status == data.CommandPending {
+		command.Status = data.CommandDelivered
+		command.DeliveredAt = &now
+	}
+	command.LastSentAt = &now
+
+	m.app.InfoLog.Printf("Sent command %s (%s) to device %s, attempt %d", command.CommandID, command.Command, command.SerialNumber, command.Attempts)
+	return nil
+}
+
+// handleCommandAck records a device's acknowledgement of a command.
+// Topic format: root/serialnumber/cmd/ack
+func (m *MQTTClient) handleCommandAck(client mqtt.Client, msg mqtt.Message) {
+	rest := strings.TrimPrefix(msg.Topic(), m.topicRoot+"/")
+	serialNumber, _, _ := strings.Cut(rest, "/")
+
+	var ack commandAck
+	if err := json.Unmarshal(msg.Payload(), &ack); err != nil || ack.CommandID == "" {
+		m.app.ErrorLog.Printf("Invalid command acknowledgement from device %s: %s", serialNumber, msg.Payload())
+		return
+	}
+
+	command, err := m.app.Models.Command.GetByCommandID(ack.CommandID)
+	if err != nil || command == nil || command.SerialNumber != serialNumber {
+		m.app.ErrorLog.Printf("Acknowledgement from device %s for unknown command %s", serialNumber, ack.CommandID)
+		return
+	}
+
+	status := data.CommandAcked
+	if ack.Status != "ok" {
+		status = data.CommandFailed
+	}
+
+	updated, err := m.app.Models.Command.Complete(ack.CommandID, status, ack.Message, time.Now())
+	if err != nil {
+		m.app.ErrorLog.Printf("Failed to record acknowledgement for command %s: %v", ack.CommandID, err)
+		return
+	}
+	if !updated {
+		// Duplicate acknowledgement, or it arrived after the command expired
+		return
+	}
+
+	m.app.InfoLog.Printf("Device %s reported command %s as %s", serialNumber, ack.CommandID, status)
+
+	// Presence checks use the device's new reporting interval
+	if status == data.CommandAcked && command.Command == "set_interval" {
+		var params struct {
+			IntervalSeconds int `json:"interval_seconds"`
+		}
+		if err := json.Unmarshal(command.Params, &params); err == nil && params.IntervalSeconds > 0 {
+			if err := m.app.Models.Device.SetReportInterval(command.DeviceID, params.IntervalSeconds); err != nil {
+				m.app.ErrorLog.Printf("Failed to update reporting interval for device %s: %v", serialNumber, err)
+			}
+		}
+	}
+}
+
+// retryCommands periodically republishes unacknowledged commands and expires old ones
+func (m *MQTTClient) retryCommands(ctx context.Context) {
+	ticker := time.NewTicker(commandSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+
+		expired, err := m.app.Models.Command.ExpireCommands(now)
+		if err != nil {
+			m.app.ErrorLog.Printf("Failed to expire device commands: %v", err)
+		} else if expired > 0 {
+			m.app.InfoLog.Printf("Expired %d unacknowledged device commands", expired)
+		}
+
+		if !m.IsConnected() {
+			continue
+		}
+
+		commands, err := m.app.Models.Command.GetRetryable(now.Add(-commandRetryInterval))
+		if err != nil {
+			m.app.ErrorLog.Printf("Failed to load device commands for retry: %v", err)
+			continue
+		}
+		for _, command := range commands {
+			if err := m.sendCommand(command); err != nil {
+				m.app.ErrorLog.Printf("Failed to send command %s: %v", command.CommandID, err)
+			}
+		}
+	}
+}
+
+// commandDevice loads the device named in the URL and checks that the user may read it,
+// or with write set, send it commands. It writes the error response and returns nil if not.
+func (app *Config) commandDevice(w http.ResponseWriter, r *http.Request, claims *UserClaims, write bool) *data.Device {
+	serialNumber := chi.URLParam(r, "serial")
+	device, err := app.Models.Device.GetBySerialNumber(serialNumber)
+	if err != nil || device == nil {
+		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
+		return nil
+	}
+	if !app.canAccessDevice(claims, device, write) {
+		app.errorJSON(w, errors.New("unauthorized: device does not belong to the user"), http.StatusUnauthorized)
+		return nil
+	}
+	return device
+}
+
+// SendDeviceCommand queues a command for a device and publishes it over MQTT
+func (app *Config) SendDeviceCommand(w http.ResponseWriter, r *http.Request) {
+	// Get the authenticated user from the request context
+	claims := app.userClaims(r)
+	userID := claims.UserID
+
+	var request struct {
+		Command    string          `json:"command"`
+		Params     json.RawMessage `json:"params"`
+		TTLSeconds int             `json:"ttl_seconds"`
+	}
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	if err := validateCommand(request.Command, request.Params); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	ttl := defaultCommandTTL
+	if request.TTLSeconds != 0 {
+		ttl = time.Duration(request.TTLSeconds) * time.Second
+		if ttl < 0 || ttl > maxCommandTTL {
+			app.errorJSON(w, fmt.Errorf("ttl_seconds must be between 1 and %d", int(maxCommandTTL.Seconds())), http.StatusBadRequest)
+			return
+		}
+	}
+
+	device := app.commandDevice(w, r, claims, true)
+	if device == nil {
+		return
+	}
+
+	if app.MQTT == nil {
+		app.errorJSON(w, errors.New("device messaging is not available"), http.StatusServiceUnavailable)
+		return
+	}
+
+	commandID, err := newCommandID()
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to create command"), http.StatusInternalServerError)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	command := data.DeviceCommand{
+		CommandID:    commandID,
+		DeviceID:     device.ID,
+		SerialNumber: device.SerialNumber,
+		UserID:       userID,
+		Command:      request.Command,
+		Params:       request.Params,
+		Status:       data.CommandPending,
+		MaxAttempts:  commandMaxAttempts,
+		ExpiresAt:    time.Now().Add(ttl),
+	}
+	if err := app.Models.Command.CreateCommand(&command); err != nil {
+		app.errorJSON(w, errors.New("failed to create command"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to create command: %v", err)
+		return
+	}
+
+	// A failed publish is retried in the background until the TTL runs out
+	if err := app.MQTT.sendCommand(&command); err != nil {
+		app.ErrorLog.Printf("Failed to send command %s, will retry: %v", command.CommandID, err)
+	}
+
+	app.writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message": "Command queued",
+		"command": command,
+	})
+}
+
+// GetDeviceCommands returns the command history of a device, newest first
+func (app *Config) GetDeviceCommands(w http.ResponseWriter, r *http.Request) {
+	// Get the authenticated user from the request context
+	claims := app.userClaims(r)
+
+	device := app.commandDevice(w, r, claims, false)
+	if device == nil {
+		return
+	}
+
+	commands, err := app.Models.Command.GetDeviceCommands(device.ID, commandHistoryLimit)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to retrieve device commands"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to retrieve device commands: %v", err)
+		return
+	}
+
+	if commands == nil {
+		commands = []*data.DeviceCommand{}
+	}
+
+	app.writeJSON(w, http.StatusOK, commands)
+}
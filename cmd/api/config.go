@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"field_eyes/data"
 	"field_eyes/pkg/email"
+	"field_eyes/pkg/notify"
 	"log"
 	"sync"
 
@@ -10,15 +12,18 @@ import (
 )
 
 type Config struct {
-	DB            *gorm.DB
-	InfoLog       *log.Logger
-	ErrorLog      *log.Logger
-	Wait          *sync.WaitGroup
-	Models        data.Models
-	Mailer        email.Mailer
-	Redis         *RedisClient
-	MQTT          *MQTTClient
-	Sessions      *SessionManager
-	ErrorChan     chan error
-	ErrorChanDone chan bool
+	DB        *gorm.DB
+	InfoLog   *log.Logger
+	ErrorLog  *log.Logger
+	Wait      *sync.WaitGroup
+	Models    data.Models
+	Mailer    email.Mailer
+	Notifiers map[string]notify.Notifier // by channel; only the channels enabled on this server
+	WebPush   *notify.WebPush
+	Redis     *RedisClient
+	MQTT      *MQTTClient
+	Sessions  *SessionManager
+	Stream    *streamHub
+	JobWake   chan struct{}   // signalled when a job is queued
+	Shutdown  context.Context // ends when the server starts shutting down
 }
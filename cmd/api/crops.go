@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"field_eyes/data"
+	"field_eyes/pkg/analysis"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// cropTargets are the ranges a device's readings are judged against, from the crop
+// planted at the device or in its field, or the defaults when there is none
+type cropTargets struct {
+	Crop        string     `json:"crop,omitempty"`
+	Stage       string     `json:"stage,omitempty"`
+	PlantedAt   *time.Time `json:"planted_at,omitempty"`
+	PH          data.Range `json:"ph"`
+	Moisture    data.Range `json:"moisture"`
+	Temperature data.Range `json:"temperature"`
+	Nitrogen    data.Range `json:"nitrogen"`
+	Phosphorous data.Range `json:"phosphorous"`
+	Potassium   data.Range `json:"potassium"`
+}
+
+// defaultTargets apply to devices without a crop. Nutrients are only limited by what
+// the sensor can report.
+var defaultTargets = cropTargets{
+	PH:          data.Range{Min: 5.5, Max: 7.5},
+	Moisture:    data.Range{Min: 20, Max: 60},
+	Temperature: data.Range{Min: 5, Max: 35},
+	Nitrogen:    data.Range{Min: 40, Max: analysis.SensorLimits["nitrogen"].Max},
+	Phosphorous: data.Range{Min: 30, Max: analysis.SensorLimits["phosphorous"].Max},
+	Potassium:   data.Range{Min: 20, Max: analysis.SensorLimits["potassium"].Max},
+}
+
+// nutrient returns the target range of a nutrient metric
+func (t *cropTargets) nutrient(metric string) data.Range {
+	switch metric {
+	case "nitrogen":
+		return t.Nitrogen
+	case "phosphorous":
+		return t.Phosphorous
+	default:
+		return t.Potassium
+	}
+}
+
+// deviceCrop returns the crop planted at a device and its planting date, falling back
+// to the crop of the device's field. It returns nil if neither has a crop.
+func (app *Config) deviceCrop(device *data.Device) (*data.CropProfile, *time.Time, error) {
+	cropID, plantedAt := device.CropProfileID, device.PlantedAt
+	if cropID == nil && device.FieldID != nil {
+		field, err := app.Models.Farm.GetField(*device.FieldID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if field != nil {
+			cropID, plantedAt = field.CropProfileID, field.PlantedAt
+		}
+	}
+	if cropID == nil {
+		return nil, nil, nil
+	}
+
+	crop, err := app.Models.Crop.GetOne(*cropID)
+	if err != nil || crop == nil {
+		return nil, nil, err
+	}
+	return crop, plantedAt, nil
+}
+
+// deviceTargets returns the ranges for a device's readings today. Failing to load the
+// crop falls back to the defaults.
+func (app *Config) deviceTargets(device *data.Device) cropTargets {
+	crop, plantedAt, err := app.deviceCrop(device)
+	if err != nil {
+		app.ErrorLog.Printf("Failed to load the crop of device %s: %v", device.SerialNumber, err)
+	}
+	if crop == nil {
+		return defaultTargets
+	}
+
+	targets := cropTargets{
+		Crop:        crop.Name,
+		PlantedAt:   plantedAt,
+		PH:          crop.PH,
+		Moisture:    crop.Moisture,
+		Temperature: crop.Temperature,
+		Nitrogen:    defaultTargets.Nitrogen,
+		Phosphorous: defaultTargets.Phosphorous,
+		Potassium:   defaultTargets.Potassium,
+	}
+	if stage := crop.StageAt(plantedAt, time.Now()); stage != nil {
+		targets.Stage = stage.Name
+		targets.Nitrogen = stage.Nitrogen
+		targets.Phosphorous = stage.Phosphorous
+		targets.Potassium = stage.Potassium
+	}
+	return targets
+}
+
+// cropThreshold returns the threshold of a built-in alert rule adjusted to the crop's
+// ranges. Rules users created themselves keep their own threshold.
+func cropThreshold(rule *data.AlertRule, targets cropTargets) float64 {
+	if rule.Scope != data.ScopeGlobal || targets.Crop == "" {
+		return rule.Threshold
+	}
+
+	var band data.Range
+	switch rule.Metric {
+	case "ph":
+		band = targets.PH
+	case "soil_moisture":
+		band = targets.Moisture
+	case "temperature", "soil_temperature":
+		band = targets.Temperature
+	default:
+		return rule.Threshold
+	}
+
+	switch rule.Comparator {
+	case data.ComparatorLT, data.ComparatorLTE:
+		return band.Min
+	default:
+		return band.Max
+	}
+}
+
+// GetCrops lists the crop profiles
+func (app *Config) GetCrops(w http.ResponseWriter, r *http.Request) {
+	crops, err := app.Models.Crop.GetAll()
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch crops"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch crops: %v", err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, crops)
+}
+
+// GetCrop returns a crop profile with its growth stages
+func (app *Config) GetCrop(w http.ResponseWriter, r *http.Request) {
+	id, err := urlID(r, "id")
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid crop ID"), http.StatusBadRequest)
+		return
+	}
+
+	crop, err := app.Models.Crop.GetOne(id)
+	if err != nil || crop == nil {
+		app.errorJSON(w, errors.New("crop not found"), http.StatusNotFound)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, crop)
+}
+
+// AdminCreateCrop adds a crop profile
+func (app *Config) AdminCreateCrop(w http.ResponseWriter, r *http.Request) {
+	var crop data.CropProfile
+	if err := app.ReadJSON(w, r, &crop); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+	crop.ID = 0
+	for i := range crop.Stages {
+		crop.Stages[i].ID = 0
+	}
+	if err := crop.Validate(); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := app.Models.Crop.Create(&crop); err != nil {
+		app.errorJSON(w, errors.New("failed to create crop"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to create crop %q: %v", crop.Name, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"message": "Crop created successfully",
+		"crop":    crop,
+	})
+}
+
+// AdminUpdateCrop replaces a crop profile and its growth stages
+func (app *Config) AdminUpdateCrop(w http.ResponseWriter, r *http.Request) {
+	id, err := urlID(r, "id")
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid crop ID"), http.StatusBadRequest)
+		return
+	}
+
+	existing, err := app.Models.Crop.GetOne(id)
+	if err != nil || existing == nil {
+		app.errorJSON(w, errors.New("crop not found"), http.StatusNotFound)
+		return
+	}
+
+	var crop data.CropProfile
+	if err := app.ReadJSON(w, r, &crop); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+	crop.Model = existing.Model
+	crop.CreatedAt = existing.CreatedAt
+	if err := crop.Validate(); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := app.Models.Crop.Update(&crop); err != nil {
+		app.errorJSON(w, errors.New("failed to update crop"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to update crop %d: %v", id, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Crop updated successfully",
+		"crop":    crop,
+	})
+}
+
+// cropRequest assigns a crop to a device or field. A null crop_profile_id removes it.
+type cropRequest struct {
+	CropProfileID *uint      `json:"crop_profile_id"`
+	PlantedAt     *time.Time `json:"planted_at"`
+}
+
+// readCropRequest decodes and checks a cropRequest. It writes the error response and
+// returns false if the request is invalid.
+func (app *Config) readCropRequest(w http.ResponseWriter, r *http.Request) (*cropRequest, bool) {
+	var request cropRequest
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return nil, false
+	}
+
+	if request.CropProfileID == nil {
+		request.PlantedAt = nil
+		return &request, true
+	}
+	crop, err := app.Models.Crop.GetOne(*request.CropProfileID)
+	if err != nil || crop == nil {
+		app.errorJSON(w, errors.New("crop not found"), http.StatusNotFound)
+		return nil, false
+	}
+	if request.PlantedAt != nil && request.PlantedAt.After(time.Now()) {
+		app.errorJSON(w, errors.New("planted_at must not be in the future"), http.StatusBadRequest)
+		return nil, false
+	}
+	return &request, true
+}
+
+// SetDeviceCrop sets the crop planted at a device, overriding its field's crop
+func (app *Config) SetDeviceCrop(w http.ResponseWriter, r *http.Request) {
+	claims := app.userClaims(r)
+
+	request, ok := app.readCropRequest(w, r)
+	if !ok {
+		return
+	}
+
+	device, err := app.Models.Device.GetBySerialNumber(chi.URLParam(r, "serial"))
+	if err != nil || device == nil {
+		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
+		return
+	}
+	if !app.canAccessDevice(claims, device, true) {
+		app.errorJSON(w, errors.New("unauthorized: device does not belong to the user"), http.StatusUnauthorized)
+		return
+	}
+
+	if err := app.Models.Device.SetCrop(device.ID, request.CropProfileID, request.PlantedAt); err != nil {
+		app.errorJSON(w, errors.New("failed to set device crop"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to set the crop of device %s: %v", device.SerialNumber, err)
+		return
+	}
+	device.CropProfileID, device.PlantedAt = request.CropProfileID, request.PlantedAt
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Device crop updated",
+		"device":  device,
+		"targets": app.deviceTargets(device),
+	})
+}
+
+// SetFieldCrop sets the crop planted in a field
+func (app *Config) SetFieldCrop(w http.ResponseWriter, r *http.Request) {
+	field := app.userField(w, r, true)
+	if field == nil {
+		return
+	}
+
+	request, ok := app.readCropRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := app.Models.Farm.SetFieldCrop(field.ID, request.CropProfileID, request.PlantedAt); err != nil {
+		app.errorJSON(w, errors.New("failed to set field crop"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to set the crop of field %d: %v", field.ID, err)
+		return
+	}
+	field.CropProfileID, field.PlantedAt = request.CropProfileID, request.PlantedAt
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Field crop updated",
+		"field":   field,
+	})
+}
@@ -18,7 +18,10 @@ func (app *Config) initDB() *gorm.DB {
 	}
 
 	// Auto-migrate the schema using actual model structs, not interfaces
-	if err := conn.AutoMigrate(&data.User{}, &data.Device{}, &data.DeviceData{}, &data.Notification{}); err != nil {
+	if err := conn.AutoMigrate(&data.User{}, &data.Device{}, &data.DeviceData{}, &data.Notification{}, &data.AlertRule{}, &data.AlertState{}, &data.DeviceCommand{}, &data.Assignment{}, &data.RefreshToken{}, &data.RevokedToken{}, &data.Farm{}, &data.Field{}, &data.CropProfile{}, &data.CropStage{}, &data.ImportJob{}, &data.Webhook{}, &data.WebhookDelivery{}, &data.NotificationPreference{}, &data.PushSubscription{}, &data.NotificationDelivery{}, &data.Job{}); err != nil {
+		log.Panic("failed to migrate database:", err)
+	}
+	if err := data.RunMigrations(conn); err != nil {
 		log.Panic("failed to migrate database:", err)
 	}
 	log.Println("Database migration completed successfully")
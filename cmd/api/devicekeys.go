@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"field_eyes/data"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// How far a signed message's timestamp may be from the server clock
+const deviceSignatureMaxSkew = 5 * time.Minute
+
+// Headers used to sign HTTP ingestion requests
+const (
+	deviceTimestampHeader = "X-Device-Timestamp"
+	deviceSignatureHeader = "X-Device-Signature"
+)
+
+// signedReading is the envelope of a signed MQTT reading. Sig is the Ed25519 signature
+// of "<ts>.<data>" where data is the reading exactly as sent.
+type signedReading struct {
+	Data      json.RawMessage `json:"data"`
+	Timestamp int64           `json:"ts"`
+	Signature string          `json:"sig"`
+}
+
+// deviceAuthStrict reports whether every device must authenticate. In strict mode
+// unknown serial numbers are rejected instead of auto-registered.
+func deviceAuthStrict() bool {
+	return os.Getenv("DEVICE_AUTH_STRICT") == "true"
+}
+
+// newDeviceKey creates a new ingestion key and sets on the device only what verifies
+// it: the key's hash for bearer authentication and the public half of the Ed25519 key
+// pair it seeds for signatures. The caller saves the device; the key itself is only
+// ever returned here.
+func newDeviceKey(device *data.Device) (string, error) {
+	key, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := devicePublicKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	device.KeyHash = hashToken(key)
+	device.KeyPublic = publicKey
+	device.KeyIssuedAt = &now
+	return key, nil
+}
+
+// issueDeviceKey replaces the key of a stored device with a new one
+func (app *Config) issueDeviceKey(device *data.Device) (string, error) {
+	key, err := newDeviceKey(device)
+	if err != nil {
+		return "", err
+	}
+	if err := app.Models.Device.SetKey(device.ID, device.KeyHash, device.KeyPublic, *device.KeyIssuedAt); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// devicePublicKey returns the hex Ed25519 public key of the key pair a device key
+// seeds. The device key is the hex of the 32 byte seed.
+func devicePublicKey(key string) (string, error) {
+	seed, err := hex.DecodeString(key)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return "", errors.New("device key is not a 32 byte hex seed")
+	}
+	public := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	return hex.EncodeToString(public), nil
+}
+
+// verifyDeviceSignature checks an Ed25519 signature of "<timestamp>.<body>" made with
+// the device key against the stored public key, so the database holds nothing a
+// signature could be forged with
+func verifyDeviceSignature(device *data.Device, timestamp int64, signature string, body []byte) error {
+	signedAt := time.Unix(timestamp, 0)
+	if skew := time.Since(signedAt); skew > deviceSignatureMaxSkew || skew < -deviceSignatureMaxSkew {
+		return errors.New("signature timestamp is too old or in the future")
+	}
+
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "ed25519="))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("invalid signature")
+	}
+	public, err := hex.DecodeString(device.KeyPublic)
+	if err != nil || len(public) != ed25519.PublicKeySize {
+		return errors.New("invalid device public key")
+	}
+
+	message := append([]byte(strconv.FormatInt(timestamp, 10)+"."), body...)
+	if !ed25519.Verify(public, message, sig) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// authenticateDeviceRequest checks the credentials of an HTTP ingestion request, given
+// either as "Authorization: Bearer <device key>" or as a signature of the body.
+// Devices without a key are let through unless strict mode is on.
+func authenticateDeviceRequest(r *http.Request, device *data.Device, body []byte) error {
+	if device.KeyHash == "" {
+		if deviceAuthStrict() {
+			return errors.New("device has no key: rotate its key to enable ingestion")
+		}
+		return nil
+	}
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key := strings.TrimPrefix(auth, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(device.KeyHash)) != 1 {
+			return errors.New("invalid device key")
+		}
+		return nil
+	}
+
+	if signature := r.Header.Get(deviceSignatureHeader); signature != "" {
+		timestamp, err := strconv.ParseInt(r.Header.Get(deviceTimestampHeader), 10, 64)
+		if err != nil {
+			return errors.New("invalid or missing " + deviceTimestampHeader + " header")
+		}
+		return verifyDeviceSignature(device, timestamp, signature, body)
+	}
+
+	return errors.New("device credentials required")
+}
+
+// authenticateDeviceMessage checks an MQTT reading. Signed readings are always verified;
+// unsigned ones are only accepted outside strict mode, where the broker's own
+// authentication is relied on.
+func authenticateDeviceMessage(device *data.Device, envelope *signedReading) error {
+	if envelope == nil {
+		if deviceAuthStrict() {
+			return errors.New("unsigned message rejected in strict mode")
+		}
+		return nil
+	}
+	if device.KeyHash == "" {
+		return errors.New("signed message from a device without a key")
+	}
+	return verifyDeviceSignature(device, envelope.Timestamp, envelope.Signature, envelope.Data)
+}
+
+// decodeMessage parses an MQTT data message: readings as decodeReadings takes them,
+// optionally wrapped in a signed envelope. serial is used when the readings don't name
+// their device.
+func decodeMessage(payload []byte, serial string) (string, []*data.DeviceData, *signedReading, error) {
+	var envelope signedReading
+	if err := json.Unmarshal(payload, &envelope); err == nil && envelope.Signature != "" && len(envelope.Data) > 0 {
+		serial, readings, err := decodeReadings(envelope.Data, serial)
+		return serial, readings, &envelope, err
+	}
+
+	serial, readings, err := decodeReadings(payload, serial)
+	return serial, readings, nil, err
+}
+
+// RotateDeviceKey issues a new ingestion key for a device. The old key stops working at once.
+func (app *Config) RotateDeviceKey(w http.ResponseWriter, r *http.Request) {
+	claims := app.userClaims(r)
+
+	device, err := app.Models.Device.GetBySerialNumber(chi.URLParam(r, "serial"))
+	if err != nil || device == nil {
+		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
+		return
+	}
+	if !app.canAccessDevice(claims, device, true) {
+		app.errorJSON(w, errors.New("unauthorized: device does not belong to the user"), http.StatusUnauthorized)
+		return
+	}
+
+	key, err := app.issueDeviceKey(device)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to rotate device key"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to rotate key for device %s: %v", device.SerialNumber, err)
+		return
+	}
+
+	app.InfoLog.Printf("User %d rotated the key of device %s", claims.UserID, device.SerialNumber)
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":       "Device key rotated; store it now, it cannot be shown again",
+		"serial_number": device.SerialNumber,
+		"device_key":    key,
+		"key_issued_at": device.KeyIssuedAt,
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"field_eyes/data"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signReading signs "<ts>.<body>" as a device holding key does
+func signReading(t *testing.T, key string, ts int64, body []byte) string {
+	t.Helper()
+	seed, err := hex.DecodeString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := append([]byte(strconv.FormatInt(ts, 10)+"."), body...)
+	return hex.EncodeToString(ed25519.Sign(ed25519.NewKeyFromSeed(seed), message))
+}
+
+func TestVerifyDeviceSignature(t *testing.T) {
+	key, err := newTokenID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := devicePublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := &data.Device{KeyHash: hashToken(key), KeyPublic: publicKey}
+	body := []byte(`{"serial_number":"SN1","soil_moisture":31.5}`)
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name      string
+		device    *data.Device
+		ts        int64
+		signature string
+		body      []byte
+		ok        bool
+	}{
+		{"signed with the device key", device, now, signReading(t, key, now, body), body, true},
+		{"with prefix", device, now, "ed25519=" + signReading(t, key, now, body), body, true},
+		{"signed with the stored hash", device, now, signReading(t, device.KeyHash, now, body), body, false},
+		{"tampered body", device, now, signReading(t, key, now, body), []byte(`{"serial_number":"SN1","soil_moisture":99}`), false},
+		{"other timestamp", device, now, signReading(t, key, now-1, body), body, false},
+		{"stale timestamp", device, now - 600, signReading(t, key, now-600, body), body, false},
+		{"not hex", device, now, "zz", body, false},
+		{"key without a public key", &data.Device{KeyHash: device.KeyHash}, now, signReading(t, key, now, body), body, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyDeviceSignature(tt.device, tt.ts, tt.signature, tt.body)
+			if (err == nil) != tt.ok {
+				t.Errorf("err = %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
@@ -1,23 +1,25 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"field_eyes/data"
+	"field_eyes/pkg/email"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
 )
 
 func (app *Config) RegisterDevice(w http.ResponseWriter, r *http.Request) {
-	// Extract user information from the token
-	userID, _, _, err := app.GetUserInfoFromToken(r)
-	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
-		return
-	}
+	// Get the authenticated user from the request context
+	userID := app.userClaims(r).UserID
 
 	// Parse the request body into a Device struct
 	var request struct {
@@ -88,6 +90,15 @@ func (app *Config) RegisterDevice(w http.ResponseWriter, r *http.Request) {
 			existingDevice.DeviceType = request.DeviceType
 		}
 
+		// Issue the key the device must use to report data, saved with the assignment so
+		// the device is never claimed without one
+		key, err := newDeviceKey(existingDevice)
+		if err != nil {
+			app.errorJSON(w, errors.New("failed to issue device key"), http.StatusInternalServerError)
+			app.ErrorLog.Printf("Failed to issue key for device %s: %v", existingDevice.SerialNumber, err)
+			return
+		}
+
 		// Assign to user
 		existingDevice.UserID = userID
 
@@ -111,6 +122,7 @@ func (app *Config) RegisterDevice(w http.ResponseWriter, r *http.Request) {
 			"message":       "device assigned to your account successfully",
 			"device_id":     fmt.Sprintf("%d", existingDevice.ID),
 			"serial_number": existingDevice.SerialNumber,
+			"device_key":    key,
 		})
 		return
 	}
@@ -127,6 +139,14 @@ func (app *Config) RegisterDevice(w http.ResponseWriter, r *http.Request) {
 		UserID:       userID,
 	}
 
+	// Issue the key the device must use to report data, saved with the device
+	key, err := newDeviceKey(&newDevice)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to issue device key"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to issue key for device %s: %v", newDevice.SerialNumber, err)
+		return
+	}
+
 	// Save the new device
 	err = app.Models.Device.AssignDevice(userID, &newDevice)
 	if err != nil {
@@ -139,21 +159,50 @@ func (app *Config) RegisterDevice(w http.ResponseWriter, r *http.Request) {
 	app.writeJSON(w, http.StatusCreated, map[string]string{
 		"message":       "new device registered successfully",
 		"serial_number": request.SerialNumber,
+		"device_key":    key,
 	})
 }
 
 func (app *Config) LogDeviceData(w http.ResponseWriter, r *http.Request) {
+	// Keep the raw body, request signatures are computed over it
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
 	// Parse the request body into a DeviceData struct
 	var logEntry data.DeviceData
-	if err := app.ReadJSON(w, r, &logEntry); err != nil {
+	if err := json.Unmarshal(body, &logEntry); err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		app.ErrorLog.Println(err)
 		return
 	}
 
+	if logEntry.SerialNumber == "" {
+		app.errorJSON(w, errors.New("serial number is required"), http.StatusBadRequest)
+		return
+	}
+	if err := checkReading(&logEntry, time.Now()); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
 	// Check if the device exists by serial number
 	device, err := app.Models.Device.GetBySerialNumber(logEntry.SerialNumber)
-	if err != nil || device == nil {
+	if err == nil && device != nil {
+		if err := authenticateDeviceRequest(r, device, body); err != nil {
+			app.errorJSON(w, err, http.StatusUnauthorized)
+			app.ErrorLog.Printf("Rejected data for device %s: %v", logEntry.SerialNumber, err)
+			return
+		}
+	} else if deviceAuthStrict() {
+		// Only registered devices may report in strict mode
+		app.errorJSON(w, errors.New("unknown device"), http.StatusUnauthorized)
+		app.ErrorLog.Printf("Rejected data for unknown device %s", logEntry.SerialNumber)
+		return
+	} else {
 		// Device doesn't exist, auto-register it
 		app.InfoLog.Printf("Device with serial number %s not found, auto-registering", logEntry.SerialNumber)
 
@@ -182,33 +231,37 @@ func (app *Config) LogDeviceData(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Link the log entry to the device using its DeviceID
+	// Link the log entry to the device using its DeviceID. The ID and receive time are
+	// the server's; the device's own clock goes in measured_at.
+	logEntry.ID = 0
 	logEntry.DeviceID = device.ID
-
-	// Save the log entry
-	err = app.Models.DeviceData.CreateLog(&logEntry)
-	if err != nil {
-		app.errorJSON(w, errors.New("failed to log device data"), http.StatusInternalServerError)
-		app.ErrorLog.Println("failed to log device data:", err)
-		return
+	logEntry.CreatedAt = time.Now()
+	logEntry.UpdatedAt = time.Time{}
+	logEntry.DeletedAt = gorm.DeletedAt{}
+
+	// A retried request whose reading was just stored is answered without saving it again
+	created := false
+	if !app.seenReadings(device, []*data.DeviceData{&logEntry})[0] {
+		// Flag readings that look like sensor faults or outliers
+		app.checkReadingQuality(device, &logEntry)
+
+		// Save the log entry, unless its message ID or measured_at is already stored
+		created, err = app.Models.DeviceData.CreateLog(&logEntry)
+		if err != nil {
+			app.errorJSON(w, errors.New("failed to log device data"), http.StatusInternalServerError)
+			app.ErrorLog.Println("failed to log device data:", err)
+			return
+		}
+		app.markReadingsSeen(device, []*data.DeviceData{&logEntry})
 	}
 
-	// Invalidate the cache for this device's logs if Redis is available
-	if app.Redis != nil {
-		go func(deviceID uint, serialNumber string) {
-			// Invalidate by device ID
-			if err := app.Redis.InvalidateDeviceLogsCache(deviceID); err != nil {
-				app.ErrorLog.Printf("Failed to invalidate device logs cache: %v", err)
-			} else {
-				app.InfoLog.Printf("Successfully invalidated cache for device %s", serialNumber)
-			}
+	if created {
+		// Run alerting and live updates for the new reading
+		app.readingStored(device, &logEntry)
+		app.emitReadings(device, []*data.DeviceData{&logEntry})
 
-			// Also invalidate any cache by serial number
-			keyToInvalidate := fmt.Sprintf("device_logs_serial:%s", serialNumber)
-			if err := app.Redis.InvalidateCache(keyToInvalidate); err != nil {
-				app.ErrorLog.Printf("Failed to invalidate device logs by serial cache: %v", err)
-			}
-		}(device.ID, logEntry.SerialNumber)
+		// Invalidate the cache for this device's logs
+		go app.invalidateDeviceLogs(device)
 	}
 
 	// Respond with success
@@ -217,320 +270,273 @@ func (app *Config) LogDeviceData(w http.ResponseWriter, r *http.Request) {
 		userAssigned = "true"
 	}
 
-	app.writeJSON(w, http.StatusCreated, map[string]string{
-		"message":       "device data logged successfully",
+	status, message := http.StatusCreated, "device data logged successfully"
+	if !created {
+		status, message = http.StatusOK, "reading was already stored"
+	}
+	app.writeJSON(w, status, map[string]string{
+		"message":       message,
 		"device_id":     fmt.Sprintf("%d", device.ID),
 		"serial_number": device.SerialNumber,
 		"registered":    "true",
 		"user_assigned": userAssigned,
+		"duplicate":     strconv.FormatBool(!created),
 	})
 }
 
-func (app *Config) GetDeviceLogs(w http.ResponseWriter, r *http.Request) {
-	// Extract user information from the token
-	userID, _, _, err := app.GetUserInfoFromToken(r)
-	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
+// invalidateDeviceLogs drops the cached logs of a device after new readings are stored
+func (app *Config) invalidateDeviceLogs(device *data.Device) {
+	if app.Redis == nil {
 		return
 	}
-
-	// Get the device serial number from the query parameters
-	serialNumber := r.URL.Query().Get("serial_number")
-	if serialNumber == "" {
-		app.errorJSON(w, errors.New("missing device serial number"), http.StatusBadRequest)
-		app.ErrorLog.Println("missing device serial number")
-		return
-	}
-
-	// Validate that the device exists and belongs to the user
-	device, err := app.Models.Device.GetBySerialNumber(serialNumber)
-	if err != nil {
-		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
-		app.ErrorLog.Println("device not found:", err)
-		return
+	if err := app.Redis.InvalidateDeviceLogsCache(device.ID); err != nil {
+		app.ErrorLog.Printf("Failed to invalidate device logs cache: %v", err)
 	}
-	if device.UserID != userID {
-		app.errorJSON(w, errors.New("unauthorized: device does not belong to the user"), http.StatusUnauthorized)
-		app.ErrorLog.Println("unauthorized: device does not belong to the user")
-		return
+	cacheKey := fmt.Sprintf("device_logs_serial:%s", device.SerialNumber)
+	if err := app.Redis.InvalidateCache(cacheKey); err != nil {
+		app.ErrorLog.Printf("Failed to invalidate device logs by serial cache: %v", err)
 	}
+}
 
-	var logs []*data.DeviceData
-	var cacheHit bool = false
+// readingStored runs the follow-up work for a reading saved over HTTP or MQTT
+func (app *Config) readingStored(device *data.Device, reading *data.DeviceData) {
+	// Every reading counts as a sign of life
+	app.markDeviceSeen(device, reading.CreatedAt)
 
-	// Try to get logs from Redis cache if Redis is available
-	if app.Redis != nil {
-		cachedLogs, err := app.Redis.GetCachedDeviceLogs(device.ID)
-		if err != nil {
-			app.ErrorLog.Printf("Redis cache error: %v", err)
-		} else if cachedLogs != nil {
-			// Convert the cached logs to device data objects
-			logs = make([]*data.DeviceData, len(cachedLogs))
-			for i, cl := range cachedLogs {
-				logs[i] = &data.DeviceData{
-					DeviceID:        cl.DeviceID,
-					SerialNumber:    cl.SerialNumber,
-					Temperature:     cl.Temperature,
-					Humidity:        cl.Humidity,
-					Nitrogen:        cl.Nitrogen,
-					Phosphorous:     cl.Phosphorous,
-					Potassium:       cl.Potassium,
-					PH:              cl.PH,
-					SoilMoisture:    cl.SoilMoisture,
-					SoilTemperature: cl.SoilTemperature,
-					SoilHumidity:    cl.SoilHumidity,
-					Longitude:       cl.Longitude,
-					Latitude:        cl.Latitude,
-					CreatedAt:       cl.CreatedAt,
-				}
-			}
-			cacheHit = true
-			app.InfoLog.Printf("Cache hit for device logs: %s (ID: %d), found %d logs",
-				serialNumber, device.ID, len(logs))
-		}
-	}
-
-	// If not found in cache, retrieve from database
-	if !cacheHit {
-		app.InfoLog.Printf("Cache miss for device logs: %s (ID: %d)", serialNumber, device.ID)
-		logs, err = app.Models.DeviceData.GetLogsByDeviceID(device.ID)
-		if err != nil {
-			app.errorJSON(w, errors.New("failed to retrieve device logs"), http.StatusInternalServerError)
-			app.ErrorLog.Println("failed to retrieve device logs:", err)
-			return
-		}
+	// Push the reading to live dashboards
+	app.Stream.PublishReading(device, reading)
 
-		// Log the number of logs retrieved
-		app.InfoLog.Printf("Retrieved %d logs for device %s (ID: %d) from database",
-			len(logs), serialNumber, device.ID)
+	app.checkReadings(device, []*data.DeviceData{reading})
 
-		// Store in cache for future requests if Redis is available
-		if app.Redis != nil && len(logs) > 0 {
-			go func() {
-				// Convert from DeviceData to DeviceDataForCache for caching
-				cacheableLogs := make([]*DeviceDataForCache, len(logs))
-				for i, log := range logs {
-					cacheableLogs[i] = &DeviceDataForCache{
-						ID:              log.ID,
-						DeviceID:        log.DeviceID,
-						SerialNumber:    log.SerialNumber,
-						Temperature:     log.Temperature,
-						Humidity:        log.Humidity,
-						Nitrogen:        log.Nitrogen,
-						Phosphorous:     log.Phosphorous,
-						Potassium:       log.Potassium,
-						PH:              log.PH,
-						SoilMoisture:    log.SoilMoisture,
-						SoilTemperature: log.SoilTemperature,
-						SoilHumidity:    log.SoilHumidity,
-						Longitude:       log.Longitude,
-						Latitude:        log.Latitude,
-						CreatedAt:       log.CreatedAt,
-					}
-				}
+	// Suggest a field for unassigned devices from their reported position
+	app.suggestDeviceField(device, reading)
+}
 
-				if err := app.Redis.CacheDeviceLogs(device.ID, cacheableLogs); err != nil {
-					app.ErrorLog.Printf("Failed to cache device logs: %v", err)
-				} else {
-					app.InfoLog.Printf("Successfully cached %d logs for device %s",
-						len(logs), serialNumber)
-				}
-			}()
+// checkReadings runs alert rules and sensor fault checks over new readings of a
+// device, oldest first. Faulty readings notify the owner about the sensor instead of
+// tripping alert rules.
+func (app *Config) checkReadings(device *data.Device, readings []*data.DeviceData) {
+	valid := make([]*data.DeviceData, 0, len(readings))
+	for _, reading := range readings {
+		if reading.Quality == data.QualityFault {
+			app.reportSensorFault(device, reading)
+		} else {
+			valid = append(valid, reading)
 		}
 	}
+	app.evaluateAlertRules(device, valid...)
+}
+
+// Page sizes for GetDeviceLogs
+const (
+	defaultLogsPageSize = 500
+	maxLogsPageSize     = 5000
+)
 
-	// Respond with the logs
-	app.writeJSON(w, http.StatusOK, logs)
+// encodeLogsCursor builds the opaque cursor that continues after the given log
+func encodeLogsCursor(log *data.DeviceData) string {
+	raw := fmt.Sprintf("%d:%d", log.ReadingTime().UnixNano(), log.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
 }
 
-// AnalyzeDeviceData performs machine learning analysis on device data
-func (app *Config) AnalyzeDeviceData(w http.ResponseWriter, r *http.Request) {
-	// Extract user information from the token
-	userID, _, _, err := app.GetUserInfoFromToken(r)
+// decodeLogsCursor parses a cursor produced by encodeLogsCursor
+func decodeLogsCursor(cursor string) (time.Time, uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
 	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
-		return
+		return time.Time{}, 0, errors.New("invalid cursor")
 	}
 
-	// Get the device serial number and analysis type from the query parameters
+	nanos, id, found := strings.Cut(string(raw), ":")
+	if !found {
+		return time.Time{}, 0, errors.New("invalid cursor")
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, errors.New("invalid cursor")
+	}
+	i, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, errors.New("invalid cursor")
+	}
+
+	return time.Unix(0, n), uint(i), nil
+}
+
+// GetDeviceLogs returns a device's logs, newest first, one page at a time.
+// Optional query parameters: from, to, limit, cursor (from the X-Next-Cursor header of the
+// previous page) and bucket=1h|1d to return min/avg/max per field instead of raw rows.
+func (app *Config) GetDeviceLogs(w http.ResponseWriter, r *http.Request) {
+	// Get the authenticated user from the request context
+	claims := app.userClaims(r)
+
+	// Get the device serial number from the query parameters
 	serialNumber := r.URL.Query().Get("serial_number")
 	if serialNumber == "" {
 		app.errorJSON(w, errors.New("missing device serial number"), http.StatusBadRequest)
+		app.ErrorLog.Println("missing device serial number")
 		return
 	}
 
-	analysisType := r.URL.Query().Get("type")
-	if analysisType == "" {
-		analysisType = "soil" // Default analysis type
+	// Parse the query shape
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
 	}
-
-	// Validate supported analysis types
-	validTypes := map[string]bool{
-		"soil":        true,
-		"temperature": true,
-		"moisture":    true,
-		"nutrient":    true,
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		app.errorJSON(w, errors.New("from must be before to"), http.StatusBadRequest)
+		return
 	}
 
-	if !validTypes[analysisType] {
-		app.errorJSON(w, errors.New("unsupported analysis type"), http.StatusBadRequest)
+	var bucket string
+	switch r.URL.Query().Get("bucket") {
+	case "":
+	case "1h":
+		bucket = data.BucketHour
+	case "1d":
+		bucket = data.BucketDay
+	default:
+		app.errorJSON(w, errors.New("unsupported bucket: use 1h or 1d"), http.StatusBadRequest)
 		return
 	}
 
+	query := data.LogQuery{From: from, To: to, Limit: defaultLogsPageSize}
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxLogsPageSize {
+			app.errorJSON(w, fmt.Errorf("limit must be between 1 and %d", maxLogsPageSize), http.StatusBadRequest)
+			return
+		}
+		query.Limit = limit
+	}
+	cursor := r.URL.Query().Get("cursor")
+	if cursor != "" {
+		query.BeforeTime, query.BeforeID, err = decodeLogsCursor(cursor)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Validate that the device exists and belongs to the user
 	device, err := app.Models.Device.GetBySerialNumber(serialNumber)
-	if err != nil {
+	if err != nil || device == nil {
 		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
+		app.ErrorLog.Println("device not found:", err)
 		return
 	}
-	if device.UserID != userID {
+	if !app.canAccessDevice(claims, device, false) {
 		app.errorJSON(w, errors.New("unauthorized: device does not belong to the user"), http.StatusUnauthorized)
+		app.ErrorLog.Println("unauthorized: device does not belong to the user")
 		return
 	}
 
-	// Define result structure depending on analysis type
-	type AnalysisResult struct {
-		DeviceID        uint               `json:"device_id"`
-		SerialNumber    string             `json:"serial_number"`
-		AnalysisType    string             `json:"analysis_type"`
-		Recommendations []string           `json:"recommendations"`
-		Predictions     map[string]float64 `json:"predictions"`
-		Trends          map[string]string  `json:"trends"`
-		LastUpdated     time.Time          `json:"last_updated"`
+	// The cache key covers every parameter that changes the result
+	shape := url.Values{}
+	shape.Set("from", r.URL.Query().Get("from"))
+	shape.Set("to", r.URL.Query().Get("to"))
+	shape.Set("bucket", bucket)
+	if bucket == "" {
+		shape.Set("limit", strconv.Itoa(query.Limit))
+		shape.Set("cursor", cursor)
 	}
+	queryShape := shape.Encode()
 
-	var result AnalysisResult
+	if bucket != "" {
+		var buckets []*data.DeviceDataBucket
+		cacheHit := false
+		if app.Redis != nil {
+			cacheHit, err = app.Redis.GetCachedDeviceLogsQuery(device.ID, queryShape, &buckets)
+			if err != nil {
+				app.ErrorLog.Printf("Redis cache error: %v", err)
+			}
+		}
+
+		if !cacheHit {
+			buckets, err = app.Models.DeviceData.GetAggregatedLogs(device.ID, from, to, bucket, nil)
+			if err != nil {
+				app.errorJSON(w, errors.New("failed to retrieve device logs"), http.StatusInternalServerError)
+				app.ErrorLog.Println("failed to aggregate device logs:", err)
+				return
+			}
+			if buckets == nil {
+				buckets = []*data.DeviceDataBucket{}
+			}
 
-	// Try to get analysis results from cache if Redis is available
+			if app.Redis != nil {
+				go func() {
+					if err := app.Redis.CacheDeviceLogsQuery(device.ID, queryShape, buckets); err != nil {
+						app.ErrorLog.Printf("Failed to cache device log buckets: %v", err)
+					}
+				}()
+			}
+		}
+
+		app.writeJSON(w, http.StatusOK, buckets)
+		return
+	}
+
+	// A page is cached together with the cursor for the next page
+	var page struct {
+		Logs       []*data.DeviceData `json:"logs"`
+		NextCursor string             `json:"next_cursor"`
+	}
 	cacheHit := false
+
+	// Try to get logs from Redis cache if Redis is available
 	if app.Redis != nil {
-		err := app.Redis.GetCachedMLAnalysisResults(device.ID, analysisType, &result)
-		if err == nil {
-			cacheHit = true
-			app.InfoLog.Printf("Cache hit for ML analysis: %s, device: %s", analysisType, serialNumber)
+		cacheHit, err = app.Redis.GetCachedDeviceLogsQuery(device.ID, queryShape, &page)
+		if err != nil {
+			app.ErrorLog.Printf("Redis cache error: %v", err)
+		} else if cacheHit {
+			app.InfoLog.Printf("Cache hit for device logs: %s (ID: %d), found %d logs",
+				serialNumber, device.ID, len(page.Logs))
 		}
 	}
 
-	// If not found in cache, perform the analysis
+	// If not found in cache, retrieve from database
 	if !cacheHit {
-		app.InfoLog.Printf("Cache miss for ML analysis: %s, device: %s", analysisType, serialNumber)
-
-		// Get device logs for analysis
-		logs, err := app.Models.DeviceData.GetLogsByDeviceID(device.ID)
+		app.InfoLog.Printf("Cache miss for device logs: %s (ID: %d)", serialNumber, device.ID)
+		page.Logs, err = app.Models.DeviceData.GetLogsPage(device.ID, query)
 		if err != nil {
-			app.errorJSON(w, errors.New("failed to retrieve device logs for analysis"), http.StatusInternalServerError)
+			app.errorJSON(w, errors.New("failed to retrieve device logs"), http.StatusInternalServerError)
+			app.ErrorLog.Println("failed to retrieve device logs:", err)
 			return
 		}
-
-		if len(logs) == 0 {
-			app.errorJSON(w, errors.New("insufficient data for analysis"), http.StatusBadRequest)
-			return
+		if page.Logs == nil {
+			page.Logs = []*data.DeviceData{}
 		}
-
-		// Initialize the result structure
-		result = AnalysisResult{
-			DeviceID:        device.ID,
-			SerialNumber:    serialNumber,
-			AnalysisType:    analysisType,
-			Recommendations: []string{},
-			Predictions:     make(map[string]float64),
-			Trends:          make(map[string]string),
-			LastUpdated:     time.Now(),
-		}
-
-		// Perform the appropriate analysis based on the type
-		switch analysisType {
-		case "soil":
-			// Simplified mock soil analysis
-			result.Recommendations = append(result.Recommendations, "Based on soil pH and moisture levels, consider adjusting irrigation schedule")
-			result.Predictions["optimal_ph"] = 6.5
-			result.Trends["soil_moisture"] = "decreasing"
-
-			// Add soil-specific analysis
-			avgPH := calculateAverage(logs, func(l *data.DeviceData) float64 { return l.PH })
-			if avgPH < 5.5 {
-				result.Recommendations = append(result.Recommendations, "Soil is too acidic, consider adding lime")
-			} else if avgPH > 7.5 {
-				result.Recommendations = append(result.Recommendations, "Soil is too alkaline, consider adding sulfur")
-			}
-
-		case "temperature":
-			// Simplified mock temperature analysis
-			result.Recommendations = append(result.Recommendations, "Temperature variations suggest implementing shading during peak hours")
-			result.Predictions["optimal_temp"] = 24.5
-			result.Trends["temperature"] = "stable"
-
-		case "moisture":
-			// Simplified mock moisture analysis
-			result.Recommendations = append(result.Recommendations, "Current moisture trends indicate potential over-irrigation")
-			result.Predictions["optimal_irrigation"] = 45.0
-			result.Trends["humidity"] = "increasing"
-
-		case "nutrient":
-			// Simplified mock nutrient analysis
-			result.Recommendations = append(result.Recommendations, "Nitrogen levels are low, consider adding nitrogen-rich fertilizer")
-
-			// Calculate nutrient levels
-			avgN := calculateAverage(logs, func(l *data.DeviceData) float64 { return l.Nitrogen })
-			avgP := calculateAverage(logs, func(l *data.DeviceData) float64 { return l.Phosphorous })
-			avgK := calculateAverage(logs, func(l *data.DeviceData) float64 { return l.Potassium })
-
-			result.Predictions["optimal_nitrogen"] = avgN + 15
-			result.Predictions["optimal_phosphorous"] = avgP + 10
-			result.Predictions["optimal_potassium"] = avgK + 5
-
-			if avgN < 40 {
-				result.Recommendations = append(result.Recommendations, "Nitrogen deficiency detected")
-			}
-			if avgP < 30 {
-				result.Recommendations = append(result.Recommendations, "Phosphorous deficiency detected")
-			}
-			if avgK < 20 {
-				result.Recommendations = append(result.Recommendations, "Potassium deficiency detected")
-			}
+		if len(page.Logs) == query.Limit {
+			page.NextCursor = encodeLogsCursor(page.Logs[len(page.Logs)-1])
 		}
 
 		// Store in cache for future requests if Redis is available
-		if app.Redis != nil {
+		if app.Redis != nil && len(page.Logs) > 0 {
 			go func() {
-				if err := app.Redis.CacheMLAnalysisResults(device.ID, analysisType, result); err != nil {
-					app.ErrorLog.Printf("Failed to cache ML analysis results: %v", err)
-				} else {
-					app.InfoLog.Printf("Successfully cached ML analysis for device %s", serialNumber)
+				if err := app.Redis.CacheDeviceLogsQuery(device.ID, queryShape, page); err != nil {
+					app.ErrorLog.Printf("Failed to cache device logs: %v", err)
 				}
 			}()
 		}
 	}
 
-	// Respond with the analysis results
-	app.writeJSON(w, http.StatusOK, result)
-}
-
-// Helper function to calculate the average of a specific field in device logs
-func calculateAverage(logs []*data.DeviceData, valueFunc func(*data.DeviceData) float64) float64 {
-	if len(logs) == 0 {
-		return 0
+	// Respond with the logs, the cursor for the next page goes in a header
+	headers := http.Header{}
+	if page.NextCursor != "" {
+		headers.Set("X-Next-Cursor", page.NextCursor)
 	}
-
-	sum := 0.0
-	for _, log := range logs {
-		sum += valueFunc(log)
-	}
-
-	return sum / float64(len(logs))
+	app.writeJSON(w, http.StatusOK, page.Logs, headers)
 }
 
 // ClaimDevice allows users to claim an auto-registered device
 func (app *Config) ClaimDevice(w http.ResponseWriter, r *http.Request) {
-	// Extract user information from the token
-	userID, _, _, err := app.GetUserInfoFromToken(r)
-	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
-		return
-	}
+	// Get the authenticated user from the request context
+	userID := app.userClaims(r).UserID
 
 	// Parse the request
 	var request struct {
@@ -574,6 +580,15 @@ func (app *Config) ClaimDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Issue the key the device must use to report data, saved with the claim so the
+	// device is never claimed without one
+	key, err := newDeviceKey(device)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to issue device key"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to issue key for device %s: %v", device.SerialNumber, err)
+		return
+	}
+
 	// Update the device with the user ID
 	device.UserID = userID
 
@@ -593,25 +608,34 @@ func (app *Config) ClaimDevice(w http.ResponseWriter, r *http.Request) {
 		}(userID)
 	}
 
+	app.emitEvents(userID, data.EventDeviceClaimed, map[string]interface{}{
+		"device": device,
+	})
+
+	// Confirm by email, so an owner notices a device claimed with their account
+	if user, err := app.Models.User.GetOne(userID); err != nil || user == nil {
+		app.ErrorLog.Printf("Failed to load user %d to confirm claim of device %s: %v", userID, device.SerialNumber, err)
+	} else {
+		app.sendTemplateEmail(user, email.TemplateDeviceClaimed, email.DeviceClaimedData{
+			Username:     user.Username,
+			SerialNumber: device.SerialNumber,
+			DeviceType:   device.DeviceType,
+			ClaimedAt:    time.Now(),
+		})
+	}
+
 	// Return success
 	app.writeJSON(w, http.StatusOK, map[string]string{
 		"message":       "device claimed successfully",
 		"device_id":     fmt.Sprintf("%d", device.ID),
 		"serial_number": device.SerialNumber,
 		"device_type":   device.DeviceType,
+		"device_key":    key,
 	})
 }
 
 // GetUnclaimedDevices returns a list of all auto-registered devices that haven't been claimed yet
 func (app *Config) GetUnclaimedDevices(w http.ResponseWriter, r *http.Request) {
-	// Extract user information from the token
-	_, _, _, err := app.GetUserInfoFromToken(r)
-	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
-		return
-	}
-
 	// Retrieve all unclaimed devices
 	devices, err := app.Models.Device.GetUnclaimedDevices()
 	if err != nil {
@@ -631,18 +655,31 @@ func (app *Config) GetUnclaimedDevices(w http.ResponseWriter, r *http.Request) {
 
 // GetUserDevices returns all devices belonging to the authenticated user
 func (app *Config) GetUserDevices(w http.ResponseWriter, r *http.Request) {
-	// Extract user information from the token
-	userID, _, _, err := app.GetUserInfoFromToken(r)
-	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
-		return
-	}
+	// Get the authenticated user from the request context
+	claims := app.userClaims(r)
+	userID := claims.UserID
 
 	app.InfoLog.Printf("Retrieving devices for user ID: %d", userID)
 
-	// Get devices directly from the database (not using Redis)
-	devices, err := app.Models.Device.GetByUserID(userID)
+	// Optional farm_id or field_id narrow the list to the devices assigned there
+	fieldIDs, filtered, ok := app.deviceFieldFilter(w, r, claims)
+	if !ok {
+		return
+	}
+
+	// Get devices directly from the database (not using Redis).
+	// Agronomists also see the devices of the farmers they are assigned to.
+	var devices []*data.Device
+	var err error
+	if filtered {
+		devices, err = app.Models.Device.GetByFieldIDs(fieldIDs)
+	} else {
+		var owners []uint
+		owners, err = app.visibleOwners(claims)
+		if err == nil {
+			devices, err = app.Models.Device.GetByUserIDs(owners)
+		}
+	}
 	if err != nil {
 		app.errorJSON(w, errors.New("failed to retrieve user's devices"), http.StatusInternalServerError)
 		app.ErrorLog.Printf("Failed to retrieve devices for user %d: %v", userID, err)
@@ -668,13 +705,8 @@ func (app *Config) GetUserDevices(w http.ResponseWriter, r *http.Request) {
 
 // GetLatestDeviceLog returns only the most recent log for a device
 func (app *Config) GetLatestDeviceLog(w http.ResponseWriter, r *http.Request) {
-	// Extract user information from the token
-	userID, _, _, err := app.GetUserInfoFromToken(r)
-	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
-		return
-	}
+	// Get the authenticated user from the request context
+	claims := app.userClaims(r)
 
 	// Get the device serial number from the query parameters
 	serialNumber := r.URL.Query().Get("serial_number")
@@ -686,19 +718,19 @@ func (app *Config) GetLatestDeviceLog(w http.ResponseWriter, r *http.Request) {
 
 	// Validate that the device exists and belongs to the user
 	device, err := app.Models.Device.GetBySerialNumber(serialNumber)
-	if err != nil {
+	if err != nil || device == nil {
 		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
 		app.ErrorLog.Println("device not found:", err)
 		return
 	}
-	if device.UserID != userID {
+	if !app.canAccessDevice(claims, device, false) {
 		app.errorJSON(w, errors.New("unauthorized: device does not belong to the user"), http.StatusUnauthorized)
 		app.ErrorLog.Println("unauthorized: device does not belong to the user")
 		return
 	}
 
-	// Get logs for the device (sorted by created_at DESC)
-	logs, err := app.Models.DeviceData.GetLogsByDeviceID(device.ID)
+	// Get the newest log for the device
+	logs, err := app.Models.DeviceData.GetLogsPage(device.ID, data.LogQuery{Limit: 1})
 	if err != nil {
 		app.errorJSON(w, errors.New("failed to retrieve device logs"), http.StatusInternalServerError)
 		app.ErrorLog.Println("failed to retrieve device logs:", err)
@@ -712,7 +744,7 @@ func (app *Config) GetLatestDeviceLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Return only the latest log (first item since sorted by created_at DESC)
+	// Return only the latest log (first item since sorted by reading time, newest first)
 	latestLog := logs[0]
 	app.InfoLog.Printf("Retrieved latest log for device %s (ID: %d) from %s",
 		serialNumber, device.ID, latestLog.CreatedAt.Format(time.RFC3339))
@@ -722,13 +754,9 @@ func (app *Config) GetLatestDeviceLog(w http.ResponseWriter, r *http.Request) {
 
 // DeleteDevice deletes a device by its serial number if the user is authorized
 func (app *Config) DeleteDevice(w http.ResponseWriter, r *http.Request) {
-	// Extract user information from the token
-	userID, _, _, err := app.GetUserInfoFromToken(r)
-	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
-		return
-	}
+	// Get the authenticated user from the request context
+	claims := app.userClaims(r)
+	userID := claims.UserID
 
 	// Get the device serial number from the query parameters
 	serialNumber := r.URL.Query().Get("serial_number")
@@ -740,13 +768,13 @@ func (app *Config) DeleteDevice(w http.ResponseWriter, r *http.Request) {
 
 	// Validate that the device exists and belongs to the user
 	device, err := app.Models.Device.GetBySerialNumber(serialNumber)
-	if err != nil {
+	if err != nil || device == nil {
 		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
 		app.ErrorLog.Printf("device not found: %v", err)
 		return
 	}
 
-	if device.UserID != userID {
+	if !app.canAccessDevice(claims, device, true) {
 		app.errorJSON(w, errors.New("unauthorized: device does not belong to the user"), http.StatusUnauthorized)
 		app.ErrorLog.Printf("user %d attempted to delete device owned by user %d", userID, device.UserID)
 		return
@@ -761,7 +789,7 @@ func (app *Config) DeleteDevice(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Delete the device
-	app.InfoLog.Printf("Deleting device %s (ID: %d) owned by user %d", serialNumber, device.ID, userID)
+	app.InfoLog.Printf("Deleting device %s (ID: %d) owned by user %d", serialNumber, device.ID, device.UserID)
 	if err := app.Models.Device.DeleteByID(device.ID); err != nil {
 		app.errorJSON(w, errors.New("failed to delete device"), http.StatusInternalServerError)
 		app.ErrorLog.Printf("failed to delete device: %v", err)
@@ -774,7 +802,7 @@ func (app *Config) DeleteDevice(w http.ResponseWriter, r *http.Request) {
 			if err := app.Redis.InvalidateUserDevicesCache(userID); err != nil {
 				app.ErrorLog.Printf("failed to invalidate user devices cache: %v", err)
 			}
-		}(userID)
+		}(device.UserID)
 	}
 
 	// Return success response
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"field_eyes/data"
+	"field_eyes/pkg/email"
+	"fmt"
+	"time"
+)
+
+const (
+	// How often users due a digest are looked for
+	digestSweepInterval = time.Hour
+	// Number of digests claimed at a time
+	digestBatchSize = 100
+	// Most notifications listed in one digest
+	maxDigestNotifications = 50
+)
+
+// digestPeriods is the time each digest frequency covers
+var digestPeriods = map[string]time.Duration{
+	data.DigestDaily:  24 * time.Hour,
+	data.DigestWeekly: 7 * 24 * time.Hour,
+}
+
+// sendDigests emails users who asked for one a summary of their devices and
+// notifications every day or week, until ctx ends. Several instances may run it side
+// by side; each digest is claimed by one of them.
+func (app *Config) sendDigests(ctx context.Context) {
+	ticker := time.NewTicker(digestSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		app.sendDueDigests(time.Now())
+	}
+}
+
+// sendDueDigests queues the digests due at now
+func (app *Config) sendDueDigests(now time.Time) {
+	// Digests are marked sent at the start of the sweep's hour, so they don't drift
+	// later by the time the sweep takes each day
+	sentAt := now.Truncate(digestSweepInterval)
+
+	for _, digest := range []string{data.DigestDaily, data.DigestWeekly} {
+		period := digestPeriods[digest]
+		for {
+			preferences, err := app.Models.Notification.ClaimDueDigests(digest, now.Add(-period), sentAt, digestBatchSize)
+			if err != nil {
+				app.ErrorLog.Printf("Failed to claim %s digests: %v", digest, err)
+				break
+			}
+			for _, preference := range preferences {
+				if err := app.sendDigest(preference.UserID, digest, now.Add(-period), now); err != nil {
+					app.ErrorLog.Printf("Failed to send the %s digest of user %d: %v", digest, preference.UserID, err)
+				}
+			}
+			if len(preferences) < digestBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// sendDigest queues the digest email of a user for the period from to to
+func (app *Config) sendDigest(userID uint, digest string, from, to time.Time) error {
+	user, err := app.Models.User.GetOne(userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return nil
+	}
+
+	digestData, err := app.digestData(user, digest, from, to)
+	if err != nil {
+		return err
+	}
+	app.sendTemplateEmail(user, email.TemplateDigest, digestData)
+	return nil
+}
+
+// digestData summarises a user's devices and notifications from from to to
+func (app *Config) digestData(user *data.User, digest string, from, to time.Time) (email.DigestData, error) {
+	digestData := email.DigestData{
+		Username: user.Username,
+		Period:   digest,
+		From:     from,
+		To:       to,
+	}
+
+	for _, device := range user.Devices {
+		buckets, err := app.Models.DeviceData.GetAggregatedLogs(device.ID, from, to, data.BucketDay, nil)
+		if err != nil {
+			return digestData, fmt.Errorf("counting the readings of %s: %w", device.SerialNumber, err)
+		}
+		readings := 0
+		for _, bucket := range buckets {
+			readings += int(bucket.Count)
+		}
+		digestData.Devices = append(digestData.Devices, email.DigestDevice{
+			SerialNumber: device.SerialNumber,
+			Readings:     readings,
+			Online:       device.Connectivity == data.ConnectivityOnline,
+			LastSeen:     device.LastSeenAt,
+		})
+	}
+
+	// Notifications come newest first
+	notifications, err := app.Models.Notification.GetUserNotifications(user.ID)
+	if err != nil {
+		return digestData, fmt.Errorf("fetching notifications: %w", err)
+	}
+	for _, notification := range notifications {
+		if notification.CreatedAt.Before(from) || len(digestData.Notifications) == maxDigestNotifications {
+			break
+		}
+		if !notification.CreatedAt.Before(to) {
+			continue
+		}
+		digestData.Notifications = append(digestData.Notifications, email.DigestNotification{
+			Severity: notification.Type,
+			Device:   notification.DeviceName,
+			Message:  notification.Message,
+			Time:     notification.CreatedAt,
+		})
+	}
+	return digestData, nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"field_eyes/data"
+	"field_eyes/pkg/email"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jobStore keeps enqueued jobs in memory
+type jobStore struct {
+	data.JobInterface
+	jobs []*data.Job
+}
+
+func (s *jobStore) Enqueue(job *data.Job) error {
+	s.jobs = append(s.jobs, job)
+	return nil
+}
+
+// userStore keeps users in memory, by email
+type userStore struct {
+	data.UserInterface
+	users map[string]*data.User
+	codes int
+}
+
+func (s *userStore) GetByEmail(address string) (*data.User, error) {
+	return s.users[address], nil
+}
+
+func (s *userStore) GetOne(id uint) (*data.User, error) {
+	for _, user := range s.users {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *userStore) Insert(user *data.User) (uint, error) {
+	user.ID = uint(len(s.users) + 1)
+	s.users[user.Email] = user
+	return user.ID, nil
+}
+
+func (s *userStore) GenerateVerificationCode(userID uint) (string, error) {
+	s.codes++
+	code := strings.Repeat(string(rune('0'+s.codes%10)), 6)
+	user, _ := s.GetOne(userID)
+	user.VerificationCode = code
+	return code, nil
+}
+
+// digestStore serves the notifications and due digests of a digest sweep
+type digestStore struct {
+	data.NotificationInterface
+	preferences   []*data.NotificationPreference
+	notifications []*data.Notification
+}
+
+func (s *digestStore) ClaimDueDigests(digest string, sentBefore, now time.Time, limit int) ([]*data.NotificationPreference, error) {
+	var claimed []*data.NotificationPreference
+	for _, preference := range s.preferences {
+		if preference.Digest != digest || (preference.DigestSentAt != nil && preference.DigestSentAt.After(sentBefore)) {
+			continue
+		}
+		if len(claimed) == limit {
+			break
+		}
+		sent := now
+		preference.DigestSentAt = &sent
+		claimed = append(claimed, preference)
+	}
+	return claimed, nil
+}
+
+func (s *digestStore) GetUserNotifications(userID uint) ([]*data.Notification, error) {
+	return s.notifications, nil
+}
+
+// readingCounts gives each device one day bucket of readings
+type readingCounts struct {
+	data.DeviceDataInterface
+	counts map[uint]int64
+}
+
+func (s *readingCounts) GetAggregatedLogs(deviceID uint, from, to time.Time, bucket string, qualities []string) ([]*data.DeviceDataBucket, error) {
+	return []*data.DeviceDataBucket{{Start: from, Count: s.counts[deviceID]}}, nil
+}
+
+// newEmailTestApp returns an app whose queued emails are sent to the recorder by
+// sendQueuedEmails
+func newEmailTestApp(models data.Models) (*Config, *email.Recorder, *jobStore) {
+	jobs := &jobStore{}
+	models.Job = jobs
+	mailer := &email.Recorder{}
+	app := &Config{
+		Models:   models,
+		Mailer:   mailer,
+		InfoLog:  log.New(io.Discard, "", 0),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	return app, mailer, jobs
+}
+
+// sendQueuedEmails runs the queued email jobs, as the job workers would
+func sendQueuedEmails(t *testing.T, app *Config, jobs *jobStore) {
+	t.Helper()
+	for _, job := range jobs.jobs {
+		if job.Type != jobSendEmail {
+			t.Fatalf("queued a %s job, want %s", job.Type, jobSendEmail)
+		}
+		if err := app.sendEmailJob(context.Background(), job.Payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jobs.jobs = nil
+}
+
+// post calls a handler with a JSON body and returns the response
+func post(handler http.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+	raw, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(raw)))
+	return w
+}
+
+func TestSignupSendsVerification(t *testing.T) {
+	users := &userStore{users: make(map[string]*data.User)}
+	app, mailer, jobs := newEmailTestApp(data.Models{User: users})
+
+	// A verified time in the body is ignored
+	w := post(app.Signup, map[string]interface{}{
+		"username":          "wanjiru",
+		"email":             "wanjiru@example.com",
+		"password":          "secret123",
+		"locale":            "sw",
+		"email_verified_at": time.Now(),
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("signup answered %d: %s", w.Code, w.Body)
+	}
+	user := users.users["wanjiru@example.com"]
+	if user.EmailVerifiedAt != nil {
+		t.Error("signup took the verified time from the request")
+	}
+
+	sendQueuedEmails(t, app, jobs)
+	msg, ok := mailer.Last()
+	if !ok || len(mailer.Messages()) != 1 {
+		t.Fatalf("%d emails sent, want the verification email", len(mailer.Messages()))
+	}
+	want, err := email.Compose(email.TemplateVerification, "sw", email.VerificationData{
+		Username:         "wanjiru",
+		Code:             user.VerificationCode,
+		ExpiresInMinutes: int(data.VerificationValidity.Minutes()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "wanjiru@example.com" {
+		t.Errorf("sent to %v", msg.To)
+	}
+	if msg.Subject != want.Subject || msg.Text != want.Text || msg.HTML != want.HTML {
+		t.Errorf("sent %q, want the Swahili verification email %q", msg.Subject, want.Subject)
+	}
+	if !strings.Contains(msg.Text, user.VerificationCode) {
+		t.Errorf("email doesn't hold the code %s:\n%s", user.VerificationCode, msg.Text)
+	}
+}
+
+func TestResendVerification(t *testing.T) {
+	verified := time.Now()
+	users := &userStore{users: map[string]*data.User{
+		"new@example.com":  {Username: "new", Email: "new@example.com"},
+		"done@example.com": {Username: "done", Email: "done@example.com", EmailVerifiedAt: &verified},
+	}}
+	users.users["new@example.com"].ID = 1
+	users.users["done@example.com"].ID = 2
+	app, mailer, jobs := newEmailTestApp(data.Models{User: users})
+
+	// Unknown and verified addresses get the same answer and no email
+	var answers []string
+	for _, address := range []string{"nobody@example.com", "done@example.com", "new@example.com"} {
+		w := post(app.ResendVerification, map[string]string{"email": address})
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: answered %d: %s", address, w.Code, w.Body)
+		}
+		answers = append(answers, w.Body.String())
+	}
+	if answers[0] != answers[1] || answers[1] != answers[2] {
+		t.Errorf("answers differ: %v", answers)
+	}
+
+	sendQueuedEmails(t, app, jobs)
+	msg, ok := mailer.Last()
+	if !ok || len(mailer.Messages()) != 1 || msg.To[0] != "new@example.com" {
+		t.Fatalf("sent %v, want one email to the unverified user", mailer.Messages())
+	}
+	if code := users.users["new@example.com"].VerificationCode; code == "" || !strings.Contains(msg.Text, code) {
+		t.Errorf("email doesn't hold the new code %q", code)
+	}
+}
+
+func TestSendDueDigests(t *testing.T) {
+	now := time.Date(2024, 3, 8, 7, 30, 0, 0, time.UTC)
+	lastSeen := now.Add(-30 * time.Hour)
+	online := data.Device{SerialNumber: "SN-ONLINE", Connectivity: data.ConnectivityOnline}
+	online.ID = 1
+	offline := data.Device{SerialNumber: "SN-OFFLINE", Connectivity: data.ConnectivityOffline, LastSeenAt: &lastSeen}
+	offline.ID = 2
+
+	users := &userStore{users: map[string]*data.User{
+		"daily@example.com":  {Username: "daily", Email: "daily@example.com", Devices: []data.Device{online, offline}},
+		"weekly@example.com": {Username: "weekly", Email: "weekly@example.com"},
+		"none@example.com":   {Username: "none", Email: "none@example.com"},
+	}}
+	users.users["daily@example.com"].ID = 1
+	users.users["weekly@example.com"].ID = 2
+	users.users["none@example.com"].ID = 3
+
+	recent := now.Add(-25 * time.Hour)
+	notifications := &digestStore{
+		preferences: []*data.NotificationPreference{
+			{UserID: 1, Digest: data.DigestDaily},
+			{UserID: 2, Digest: data.DigestWeekly, DigestSentAt: &recent},
+			{UserID: 3},
+		},
+		notifications: []*data.Notification{
+			{Type: data.SeverityAlert, DeviceName: "SN-ONLINE", Message: "Soil is dry"},
+			{Type: data.SeverityInfo, Message: "Older than the period"},
+		},
+	}
+	notifications.notifications[0].CreatedAt = now.Add(-2 * time.Hour)
+	notifications.notifications[1].CreatedAt = now.Add(-48 * time.Hour)
+
+	app, mailer, jobs := newEmailTestApp(data.Models{
+		User:         users,
+		Notification: notifications,
+		DeviceData:   &readingCounts{counts: map[uint]int64{1: 96, 2: 12}},
+	})
+
+	app.sendDueDigests(now)
+	sendQueuedEmails(t, app, jobs)
+
+	// Only the daily digest is due; the weekly one was sent a day ago
+	messages := mailer.Messages()
+	if len(messages) != 1 || messages[0].To[0] != "daily@example.com" {
+		t.Fatalf("sent %d digests, want one to the daily user", len(messages))
+	}
+	want, err := email.Compose(email.TemplateDigest, "", email.DigestData{
+		Username: "daily",
+		Period:   data.DigestDaily,
+		From:     now.Add(-24 * time.Hour),
+		To:       now,
+		Devices: []email.DigestDevice{
+			{SerialNumber: "SN-ONLINE", Readings: 96, Online: true},
+			{SerialNumber: "SN-OFFLINE", Readings: 12, LastSeen: &lastSeen},
+		},
+		Notifications: []email.DigestNotification{
+			{Severity: data.SeverityAlert, Device: "SN-ONLINE", Message: "Soil is dry", Time: now.Add(-2 * time.Hour)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages[0].Subject != want.Subject || messages[0].Text != want.Text || messages[0].HTML != want.HTML {
+		t.Errorf("digest reads:\n%s\nwant:\n%s", messages[0].Text, want.Text)
+	}
+	if sent := notifications.preferences[0].DigestSentAt; sent == nil || !sent.Equal(now.Truncate(time.Hour)) {
+		t.Errorf("digest marked sent at %v, want the start of the hour", sent)
+	}
+
+	// The digest isn't sent again an hour later
+	mailer.Reset()
+	app.sendDueDigests(now.Add(time.Hour))
+	sendQueuedEmails(t, app, jobs)
+	if len(mailer.Messages()) != 0 {
+		t.Errorf("sent %d digests an hour after the last", len(mailer.Messages()))
+	}
+
+	// but is by the next day's sweep, even if it runs earlier in the hour
+	app.sendDueDigests(now.Add(24*time.Hour - 20*time.Minute))
+	sendQueuedEmails(t, app, jobs)
+	if len(mailer.Messages()) != 1 {
+		t.Errorf("sent %d digests the next day, want 1", len(mailer.Messages()))
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"field_eyes/data"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Export formats
+const (
+	formatCSV     = "csv"
+	formatNDJSON  = "ndjson"
+	formatParquet = "parquet"
+)
+
+// exportFlushRows is how many rows are written between flushes to the client
+const exportFlushRows = 1000
+
+// exportRowGroupRows is how many rows a Parquet export buffers before writing them out
+const exportRowGroupRows = 10000
+
+// Column types of an export
+type columnKind int
+
+const (
+	kindString columnKind = iota
+	kindInt64
+	kindDouble
+	kindTime
+)
+
+// exportColumn is a column of a telemetry export
+type exportColumn struct {
+	name  string
+	kind  columnKind
+	value func(*data.DeviceData) interface{}
+}
+
+// exportColumns lists every column that can be exported, in their default order
+var exportColumns = func() []exportColumn {
+	columns := []exportColumn{
+		{"serial_number", kindString, func(d *data.DeviceData) interface{} { return d.SerialNumber }},
+		{"device_id", kindInt64, func(d *data.DeviceData) interface{} { return int64(d.DeviceID) }},
+		{"id", kindInt64, func(d *data.DeviceData) interface{} { return int64(d.ID) }},
+		{"measured_at", kindTime, func(d *data.DeviceData) interface{} { return d.ReadingTime() }},
+		{"created_at", kindTime, func(d *data.DeviceData) interface{} { return d.CreatedAt }},
+	}
+	for _, field := range data.AggregatedFields {
+		field := field
+		columns = append(columns, exportColumn{field, kindDouble, func(d *data.DeviceData) interface{} {
+			value, _ := d.Metric(field)
+			return value
+		}})
+	}
+	return append(columns,
+		exportColumn{"longitude", kindDouble, func(d *data.DeviceData) interface{} { return d.Longitude }},
+		exportColumn{"latitude", kindDouble, func(d *data.DeviceData) interface{} { return d.Latitude }},
+		exportColumn{"quality", kindString, func(d *data.DeviceData) interface{} { return d.Quality }},
+		exportColumn{"quality_issues", kindString, func(d *data.DeviceData) interface{} { return d.QualityIssues }},
+	)
+}()
+
+// selectExportColumns returns the columns named in the comma separated columns
+// parameter, in the order given. Without it every column is exported, except the
+// identifiers a single device export doesn't need.
+func selectExportColumns(r *http.Request, multiDevice bool) ([]exportColumn, error) {
+	param := r.URL.Query().Get("columns")
+	if param == "" {
+		var columns []exportColumn
+		for _, column := range exportColumns {
+			switch column.name {
+			case "id", "device_id":
+				continue
+			case "serial_number":
+				if !multiDevice {
+					continue
+				}
+			}
+			columns = append(columns, column)
+		}
+		return columns, nil
+	}
+
+	var columns []exportColumn
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		found := false
+		for _, column := range exportColumns {
+			if column.name == name {
+				columns = append(columns, column)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		seen[name] = true
+	}
+	if len(columns) == 0 {
+		return nil, errors.New("columns must name at least one column")
+	}
+	return columns, nil
+}
+
+// rowEncoder writes exported logs in one format
+type rowEncoder interface {
+	Write(log *data.DeviceData) error
+	Flush() error
+	Close() error
+}
+
+// newRowEncoder starts an export in the given format on w
+func newRowEncoder(format string, w io.Writer, columns []exportColumn) (rowEncoder, error) {
+	switch format {
+	case formatCSV:
+		return newCSVEncoder(w, columns)
+	case formatNDJSON:
+		return &ndjsonEncoder{w: bufio.NewWriter(w), columns: columns}, nil
+	default:
+		return newParquetEncoder(w, columns)
+	}
+}
+
+// formatExportTime formats timestamps in text exports
+func formatExportTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// csvEncoder writes a header row followed by one row per log
+type csvEncoder struct {
+	w       *csv.Writer
+	columns []exportColumn
+	record  []string
+}
+
+func newCSVEncoder(w io.Writer, columns []exportColumn) (*csvEncoder, error) {
+	e := &csvEncoder{w: csv.NewWriter(w), columns: columns, record: make([]string, len(columns))}
+	for i, column := range columns {
+		e.record[i] = column.name
+	}
+	return e, e.w.Write(e.record)
+}
+
+func (e *csvEncoder) Write(log *data.DeviceData) error {
+	for i, column := range e.columns {
+		switch v := column.value(log).(type) {
+		case string:
+			e.record[i] = v
+		case int64:
+			e.record[i] = strconv.FormatInt(v, 10)
+		case float64:
+			e.record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case time.Time:
+			e.record[i] = formatExportTime(v)
+		}
+	}
+	return e.w.Write(e.record)
+}
+
+func (e *csvEncoder) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvEncoder) Close() error {
+	return e.Flush()
+}
+
+// ndjsonEncoder writes one JSON object per line with the keys in column order
+type ndjsonEncoder struct {
+	w       *bufio.Writer
+	columns []exportColumn
+	line    []byte
+}
+
+func (e *ndjsonEncoder) Write(log *data.DeviceData) error {
+	line := append(e.line[:0], '{')
+	for i, column := range e.columns {
+		if i > 0 {
+			line = append(line, ',')
+		}
+		line = strconv.AppendQuote(line, column.name)
+		line = append(line, ':')
+		switch v := column.value(log).(type) {
+		case string:
+			quoted, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			line = append(line, quoted...)
+		case int64:
+			line = strconv.AppendInt(line, v, 10)
+		case float64:
+			line = strconv.AppendFloat(line, v, 'f', -1, 64)
+		case time.Time:
+			line = append(line, '"')
+			line = append(line, formatExportTime(v)...)
+			line = append(line, '"')
+		}
+	}
+	line = append(line, '}', '\n')
+	e.line = line
+	_, err := e.w.Write(line)
+	return err
+}
+
+func (e *ndjsonEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+func (e *ndjsonEncoder) Close() error {
+	return e.Flush()
+}
+
+// parquetEncoder writes a Parquet file. Rows leave the writer a row group at a time.
+type parquetEncoder struct {
+	w       *parquet.Writer
+	columns []exportColumn
+	row     []parquet.Row
+}
+
+func newParquetEncoder(w io.Writer, columns []exportColumn) (*parquetEncoder, error) {
+	pw := parquet.NewWriter(w, parquetSchema(columns), parquet.MaxRowsPerRowGroup(exportRowGroupRows))
+	return &parquetEncoder{w: pw, columns: columns, row: []parquet.Row{make(parquet.Row, len(columns))}}, nil
+}
+
+// parquetSchema returns the schema of a file with the given columns, in their order.
+// Columns are required: zero values and empty strings are values, not nulls.
+func parquetSchema(columns []exportColumn) *parquet.Schema {
+	// A schema built from a Group sorts its columns by name; one built from a struct
+	// keeps the order of its fields
+	fields := make([]reflect.StructField, len(columns))
+	for i, column := range columns {
+		field := reflect.StructField{Name: fmt.Sprintf("Column%d", i), Tag: reflect.StructTag(`parquet:"` + column.name + `"`)}
+		switch column.kind {
+		case kindString:
+			field.Type = reflect.TypeOf("")
+		case kindInt64:
+			field.Type = reflect.TypeOf(int64(0))
+		case kindDouble:
+			field.Type = reflect.TypeOf(float64(0))
+		case kindTime:
+			field.Type = reflect.TypeOf(time.Time{})
+			field.Tag = reflect.StructTag(`parquet:"` + column.name + `,timestamp(millisecond)"`)
+		}
+		fields[i] = field
+	}
+	return parquet.SchemaOf(reflect.New(reflect.StructOf(fields)).Interface())
+}
+
+func (e *parquetEncoder) Write(log *data.DeviceData) error {
+	row := e.row[0]
+	for i, column := range e.columns {
+		var value parquet.Value
+		switch v := column.value(log).(type) {
+		case string:
+			value = parquet.ByteArrayValue([]byte(v))
+		case int64:
+			value = parquet.Int64Value(v)
+		case float64:
+			value = parquet.DoubleValue(v)
+		case time.Time:
+			value = parquet.Int64Value(v.UnixMilli())
+		}
+		row[i] = value.Level(0, 0, i)
+	}
+	_, err := e.w.WriteRows(e.row)
+	return err
+}
+
+func (e *parquetEncoder) Flush() error {
+	return nil
+}
+
+func (e *parquetEncoder) Close() error {
+	return e.w.Close()
+}
+
+// exportRequest holds the parsed parameters shared by both export endpoints
+type exportRequest struct {
+	format  string
+	columns []exportColumn
+	query   data.LogQuery
+}
+
+// readExportRequest parses the format, columns, time range and quality filter. It
+// writes the error response and returns false if a parameter is invalid.
+func (app *Config) readExportRequest(w http.ResponseWriter, r *http.Request, multiDevice bool) (*exportRequest, bool) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = formatCSV
+	case formatCSV, formatNDJSON, formatParquet:
+	default:
+		app.errorJSON(w, errors.New("unsupported format: use csv, ndjson or parquet"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	columns, err := selectExportColumns(r, multiDevice)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return nil, false
+	}
+
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return nil, false
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return nil, false
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		app.errorJSON(w, errors.New("from must be before to"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	qualities, err := qualityFilter(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return nil, false
+	}
+
+	return &exportRequest{
+		format:  format,
+		columns: columns,
+		query:   data.LogQuery{From: from, To: to, Qualities: qualities},
+	}, true
+}
+
+// streamExport writes the logs of the given devices as a file download named name.
+// Rows are streamed from the database and flushed to the client as they are written,
+// so an export never holds more than a Parquet row group in memory.
+func (app *Config) streamExport(w http.ResponseWriter, export *exportRequest, deviceIDs []uint, name string) {
+	flusher, _ := w.(http.Flusher)
+
+	// The encoder is started with the first row so a failing query can still be
+	// reported as a JSON error
+	var encoder rowEncoder
+	start := func() error {
+		contentType := map[string]string{
+			formatCSV:     "text/csv; charset=utf-8",
+			formatNDJSON:  "application/x-ndjson",
+			formatParquet: "application/vnd.apache.parquet",
+		}[export.format]
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+export.format))
+		w.Header().Set("Cache-Control", "no-store")
+
+		var err error
+		encoder, err = newRowEncoder(export.format, w, export.columns)
+		return err
+	}
+
+	rows := 0
+	err := app.Models.DeviceData.StreamLogs(deviceIDs, export.query, func(log *data.DeviceData) error {
+		if encoder == nil {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		if err := encoder.Write(log); err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushRows == 0 {
+			if err := encoder.Flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if encoder == nil {
+			app.errorJSON(w, errors.New("failed to export device data"), http.StatusInternalServerError)
+		}
+		// Once rows have been sent the status can't change; the client sees a truncated file
+		app.ErrorLog.Printf("Failed to export %s after %d rows: %v", name, rows, err)
+		return
+	}
+
+	if encoder == nil {
+		if err := start(); err != nil {
+			app.errorJSON(w, errors.New("failed to export device data"), http.StatusInternalServerError)
+			app.ErrorLog.Printf("Failed to start export %s: %v", name, err)
+			return
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		app.ErrorLog.Printf("Failed to finish export %s: %v", name, err)
+	}
+}
+
+// ExportDeviceData downloads a device's logs as CSV, NDJSON or Parquet
+func (app *Config) ExportDeviceData(w http.ResponseWriter, r *http.Request) {
+	claims := app.userClaims(r)
+
+	export, ok := app.readExportRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	device, err := app.Models.Device.GetBySerialNumber(chi.URLParam(r, "serial"))
+	if err != nil || device == nil {
+		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
+		return
+	}
+	if !app.canAccessDevice(claims, device, false) {
+		app.errorJSON(w, errors.New("unauthorized: device does not belong to the user"), http.StatusUnauthorized)
+		return
+	}
+
+	app.streamExport(w, export, []uint{device.ID}, device.SerialNumber)
+}
+
+// ExportDevicesData downloads the logs of every device visible to the user, or of
+// the devices in a farm or field, as one file with a serial_number column
+func (app *Config) ExportDevicesData(w http.ResponseWriter, r *http.Request) {
+	claims := app.userClaims(r)
+
+	export, ok := app.readExportRequest(w, r, true)
+	if !ok {
+		return
+	}
+
+	fieldIDs, filtered, ok := app.deviceFieldFilter(w, r, claims)
+	if !ok {
+		return
+	}
+
+	var devices []*data.Device
+	var err error
+	name := "devices"
+	if filtered {
+		devices, err = app.Models.Device.GetByFieldIDs(fieldIDs)
+		if fieldParam := r.URL.Query().Get("field_id"); fieldParam != "" {
+			name = "field-" + fieldParam
+		} else {
+			name = "farm-" + r.URL.Query().Get("farm_id")
+		}
+	} else {
+		var owners []uint
+		owners, err = app.visibleOwners(claims)
+		if err == nil {
+			devices, err = app.Models.Device.GetByUserIDs(owners)
+		}
+	}
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch devices"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch devices to export for user %d: %v", claims.UserID, err)
+		return
+	}
+
+	deviceIDs := make([]uint, 0, len(devices))
+	for _, device := range devices {
+		deviceIDs = append(deviceIDs, device.ID)
+	}
+
+	app.streamExport(w, export, deviceIDs, name)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"field_eyes/data"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestParquetExport(t *testing.T) {
+	// Columns keep the order asked for, which isn't their names' order
+	r := httptest.NewRequest(http.MethodGet, "/?columns=serial_number,soil_moisture,id,measured_at", nil)
+	columns, err := selectExportColumns(r, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Date(2024, 3, 1, 14, 0, 0, 123e6, time.UTC)
+	readings := []*data.DeviceData{
+		{SerialNumber: "SN1", SoilMoisture: 35.2, MeasuredAt: &at},
+		{SerialNumber: "", SoilMoisture: 0},
+		{SerialNumber: "SN-ü-ñ", SoilMoisture: math.MaxFloat64},
+	}
+	readings[0].ID = 1
+	readings[1].CreatedAt = time.UnixMilli(0).UTC()
+	readings[2].ID = math.MaxInt32
+	readings[2].CreatedAt = at.Add(time.Hour)
+
+	var buf bytes.Buffer
+	encoder, err := newParquetEncoder(&buf, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reading := range readings {
+		if err := encoder.Write(reading); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("can't open the export: %v", err)
+	}
+	if f.NumRows() != int64(len(readings)) {
+		t.Fatalf("%d rows, want %d", f.NumRows(), len(readings))
+	}
+
+	fields := f.Schema().Fields()
+	if len(fields) != len(columns) {
+		t.Fatalf("%d columns, want %d", len(fields), len(columns))
+	}
+	for i, field := range fields {
+		if field.Name() != columns[i].name {
+			t.Errorf("column %d is %q, want %q", i, field.Name(), columns[i].name)
+		}
+		if !field.Required() {
+			t.Errorf("column %s is nullable", field.Name())
+		}
+	}
+	if timestamp := fields[3].Type().LogicalType().Timestamp; timestamp == nil || timestamp.Unit.Millis == nil {
+		t.Errorf("measured_at has type %v, want millisecond timestamps", fields[3].Type())
+	}
+	if fields[0].Type().LogicalType().UTF8 == nil {
+		t.Errorf("serial_number has type %v, want strings", fields[0].Type())
+	}
+
+	rows := make([]parquet.Row, len(readings))
+	reader := f.RowGroups()[0].Rows()
+	defer reader.Close()
+	if n, err := reader.ReadRows(rows); n != len(readings) || (err != nil && err != io.EOF) {
+		t.Fatalf("read %d rows: %v", n, err)
+	}
+	for i, reading := range readings {
+		row := rows[i]
+		if got := row[0].String(); got != reading.SerialNumber {
+			t.Errorf("row %d serial_number = %q, want %q", i, got, reading.SerialNumber)
+		}
+		if got := row[1].Double(); got != reading.SoilMoisture {
+			t.Errorf("row %d soil_moisture = %g, want %g", i, got, reading.SoilMoisture)
+		}
+		if got := row[2].Int64(); got != int64(reading.ID) {
+			t.Errorf("row %d id = %d, want %d", i, got, reading.ID)
+		}
+		if got := row[3].Int64(); got != reading.ReadingTime().UnixMilli() {
+			t.Errorf("row %d measured_at = %d, want %d", i, got, reading.ReadingTime().UnixMilli())
+		}
+	}
+}
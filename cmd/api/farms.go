@@ -0,0 +1,549 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"field_eyes/data"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// farmRequest is the body accepted when creating or updating a farm
+type farmRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// fieldRequest is the body accepted when creating or updating a field
+type fieldRequest struct {
+	Name     string          `json:"name"`
+	Boundary json.RawMessage `json:"boundary"` // GeoJSON Polygon or MultiPolygon
+}
+
+// fieldConditions summarises the latest readings of the devices in a field
+type fieldConditions struct {
+	FieldID         uint                       `json:"field_id"`
+	DeviceCount     int                        `json:"device_count"`
+	OnlineCount     int                        `json:"online_count"`
+	ReportingCount  int                        `json:"reporting_count"` // devices with at least one reading
+	LatestReadingAt *time.Time                 `json:"latest_reading_at"`
+	Metrics         map[string]data.FieldStats `json:"metrics"`
+	Readings        []*data.DeviceData         `json:"readings"` // latest reading of each device
+}
+
+// urlID parses a numeric ID from the URL
+func urlID(r *http.Request, name string) (uint, error) {
+	id, err := strconv.ParseUint(chi.URLParam(r, name), 10, 64)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return uint(id), nil
+}
+
+// userFarm loads the farm named in the URL and checks that the user may read it,
+// or with write, change it. It writes the error response and returns nil if not.
+func (app *Config) userFarm(w http.ResponseWriter, r *http.Request, write bool) *data.Farm {
+	id, err := urlID(r, "id")
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid farm ID"), http.StatusBadRequest)
+		return nil
+	}
+
+	farm, err := app.Models.Farm.GetFarm(id)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch farm"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch farm %d: %v", id, err)
+		return nil
+	}
+	if farm == nil || !app.canAccessOwner(app.userClaims(r), farm.UserID, write) {
+		app.errorJSON(w, errors.New("farm not found"), http.StatusNotFound)
+		return nil
+	}
+	return farm
+}
+
+// userField loads the field named in the URL and checks access like userFarm
+func (app *Config) userField(w http.ResponseWriter, r *http.Request, write bool) *data.Field {
+	id, err := urlID(r, "id")
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid field ID"), http.StatusBadRequest)
+		return nil
+	}
+
+	field, err := app.Models.Farm.GetField(id)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch field"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch field %d: %v", id, err)
+		return nil
+	}
+	if field == nil || !app.canAccessOwner(app.userClaims(r), field.UserID, write) {
+		app.errorJSON(w, errors.New("field not found"), http.StatusNotFound)
+		return nil
+	}
+	return field
+}
+
+// deviceFieldFilter reads the optional farm_id or field_id query parameter of a device
+// listing and returns the fields it selects. It writes the error response and
+// returns false if the parameter is invalid or not accessible.
+func (app *Config) deviceFieldFilter(w http.ResponseWriter, r *http.Request, claims *UserClaims) ([]uint, bool, bool) {
+	farmParam := r.URL.Query().Get("farm_id")
+	fieldParam := r.URL.Query().Get("field_id")
+	if farmParam == "" && fieldParam == "" {
+		return nil, false, true
+	}
+
+	if fieldParam != "" {
+		id, err := strconv.ParseUint(fieldParam, 10, 64)
+		if err != nil {
+			app.errorJSON(w, errors.New("invalid field_id"), http.StatusBadRequest)
+			return nil, false, false
+		}
+		field, err := app.Models.Farm.GetField(uint(id))
+		if err != nil || field == nil || !app.canAccessOwner(claims, field.UserID, false) {
+			app.errorJSON(w, errors.New("field not found"), http.StatusNotFound)
+			return nil, false, false
+		}
+		return []uint{field.ID}, true, true
+	}
+
+	id, err := strconv.ParseUint(farmParam, 10, 64)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid farm_id"), http.StatusBadRequest)
+		return nil, false, false
+	}
+	farm, err := app.Models.Farm.GetFarm(uint(id))
+	if err != nil || farm == nil || !app.canAccessOwner(claims, farm.UserID, false) {
+		app.errorJSON(w, errors.New("farm not found"), http.StatusNotFound)
+		return nil, false, false
+	}
+	fieldIDs := make([]uint, 0, len(farm.Fields))
+	for _, field := range farm.Fields {
+		fieldIDs = append(fieldIDs, field.ID)
+	}
+	return fieldIDs, true, true
+}
+
+// GetFarms returns the farms visible to the authenticated user, with their fields
+func (app *Config) GetFarms(w http.ResponseWriter, r *http.Request) {
+	owners, err := app.visibleOwners(app.userClaims(r))
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch farms"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to load assigned farmers: %v", err)
+		return
+	}
+
+	farms, err := app.Models.Farm.GetFarmsByUserIDs(owners)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch farms"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch farms: %v", err)
+		return
+	}
+
+	if farms == nil {
+		farms = []*data.Farm{}
+	}
+
+	app.writeJSON(w, http.StatusOK, farms)
+}
+
+// GetFarm returns one farm with its fields
+func (app *Config) GetFarm(w http.ResponseWriter, r *http.Request) {
+	farm := app.userFarm(w, r, false)
+	if farm == nil {
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, farm)
+}
+
+// CreateFarm creates a farm for the authenticated user
+func (app *Config) CreateFarm(w http.ResponseWriter, r *http.Request) {
+	var request farmRequest
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	if request.Name == "" {
+		app.errorJSON(w, errors.New("name is required"), http.StatusBadRequest)
+		return
+	}
+
+	farm := data.Farm{
+		UserID:      app.userClaims(r).UserID,
+		Name:        request.Name,
+		Description: request.Description,
+	}
+	if err := app.Models.Farm.CreateFarm(&farm); err != nil {
+		app.errorJSON(w, errors.New("failed to create farm"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to create farm: %v", err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"message": "Farm created successfully",
+		"farm":    farm,
+	})
+}
+
+// UpdateFarm renames or describes a farm
+func (app *Config) UpdateFarm(w http.ResponseWriter, r *http.Request) {
+	farm := app.userFarm(w, r, true)
+	if farm == nil {
+		return
+	}
+
+	var request farmRequest
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	if request.Name == "" {
+		app.errorJSON(w, errors.New("name is required"), http.StatusBadRequest)
+		return
+	}
+
+	farm.Name = request.Name
+	farm.Description = request.Description
+	if err := app.Models.Farm.UpdateFarm(farm); err != nil {
+		app.errorJSON(w, errors.New("failed to update farm"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to update farm %d: %v", farm.ID, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Farm updated successfully",
+		"farm":    farm,
+	})
+}
+
+// DeleteFarm deletes a farm and its fields. Their devices are kept but unassigned.
+func (app *Config) DeleteFarm(w http.ResponseWriter, r *http.Request) {
+	farm := app.userFarm(w, r, true)
+	if farm == nil {
+		return
+	}
+
+	if err := app.Models.Farm.DeleteFarm(farm.ID); err != nil {
+		app.errorJSON(w, errors.New("failed to delete farm"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to delete farm %d: %v", farm.ID, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Farm deleted",
+	})
+}
+
+// CreateField adds a field with a GeoJSON boundary to a farm
+func (app *Config) CreateField(w http.ResponseWriter, r *http.Request) {
+	farm := app.userFarm(w, r, true)
+	if farm == nil {
+		return
+	}
+
+	var request fieldRequest
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	if request.Name == "" {
+		app.errorJSON(w, errors.New("name is required"), http.StatusBadRequest)
+		return
+	}
+
+	field := data.Field{FarmID: farm.ID, UserID: farm.UserID, Name: request.Name}
+	if err := field.SetBoundary(request.Boundary); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := app.Models.Farm.CreateField(&field); err != nil {
+		app.errorJSON(w, errors.New("failed to create field"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to create field: %v", err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"message": "Field created successfully",
+		"field":   field,
+	})
+}
+
+// GetField returns one field
+func (app *Config) GetField(w http.ResponseWriter, r *http.Request) {
+	field := app.userField(w, r, false)
+	if field == nil {
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, field)
+}
+
+// UpdateField renames a field or replaces its boundary
+func (app *Config) UpdateField(w http.ResponseWriter, r *http.Request) {
+	field := app.userField(w, r, true)
+	if field == nil {
+		return
+	}
+
+	var request fieldRequest
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	if request.Name != "" {
+		field.Name = request.Name
+	}
+	if len(request.Boundary) > 0 {
+		if err := field.SetBoundary(request.Boundary); err != nil {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := app.Models.Farm.UpdateField(field); err != nil {
+		app.errorJSON(w, errors.New("failed to update field"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to update field %d: %v", field.ID, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Field updated successfully",
+		"field":   field,
+	})
+}
+
+// DeleteField deletes a field. Its devices are kept but unassigned.
+func (app *Config) DeleteField(w http.ResponseWriter, r *http.Request) {
+	field := app.userField(w, r, true)
+	if field == nil {
+		return
+	}
+
+	if err := app.Models.Farm.DeleteField(field.ID); err != nil {
+		app.errorJSON(w, errors.New("failed to delete field"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to delete field %d: %v", field.ID, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Field deleted",
+	})
+}
+
+// GetFieldDevices returns the devices assigned to a field. With suggested=true it
+// returns the unassigned devices whose reported position falls inside the field.
+func (app *Config) GetFieldDevices(w http.ResponseWriter, r *http.Request) {
+	field := app.userField(w, r, false)
+	if field == nil {
+		return
+	}
+
+	var devices []*data.Device
+	var err error
+	if r.URL.Query().Get("suggested") == "true" {
+		devices, err = app.Models.Device.GetSuggestedForField(field.ID)
+	} else {
+		devices, err = app.Models.Device.GetByFieldIDs([]uint{field.ID})
+	}
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch field devices"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch devices of field %d: %v", field.ID, err)
+		return
+	}
+
+	if devices == nil {
+		devices = []*data.Device{}
+	}
+
+	app.writeJSON(w, http.StatusOK, devices)
+}
+
+// GetFieldConditions returns min/avg/max of the latest reading of every device in a field.
+// With exclude_flagged=true each device's latest reading that passed the anomaly checks is used.
+func (app *Config) GetFieldConditions(w http.ResponseWriter, r *http.Request) {
+	field := app.userField(w, r, false)
+	if field == nil {
+		return
+	}
+
+	qualities, err := qualityFilter(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	devices, err := app.Models.Device.GetByFieldIDs([]uint{field.ID})
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch field devices"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch devices of field %d: %v", field.ID, err)
+		return
+	}
+
+	deviceIDs := make([]uint, 0, len(devices))
+	conditions := fieldConditions{
+		FieldID:     field.ID,
+		DeviceCount: len(devices),
+		Metrics:     make(map[string]data.FieldStats),
+	}
+	for _, device := range devices {
+		deviceIDs = append(deviceIDs, device.ID)
+		if device.Connectivity == data.ConnectivityOnline {
+			conditions.OnlineCount++
+		}
+	}
+
+	readings, err := app.Models.DeviceData.GetLatestForDevices(deviceIDs, qualities)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch field conditions"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch latest readings of field %d: %v", field.ID, err)
+		return
+	}
+
+	conditions.ReportingCount = len(readings)
+	conditions.Readings = readings
+	if conditions.Readings == nil {
+		conditions.Readings = []*data.DeviceData{}
+	}
+
+	for _, reading := range readings {
+		if conditions.LatestReadingAt == nil || reading.CreatedAt.After(*conditions.LatestReadingAt) {
+			at := reading.CreatedAt
+			conditions.LatestReadingAt = &at
+		}
+	}
+
+	if len(readings) > 0 {
+		for _, metric := range data.AggregatedFields {
+			var stats data.FieldStats
+			var sum float64
+			for i, reading := range readings {
+				value, _ := reading.Metric(metric)
+				if i == 0 || value < stats.Min {
+					stats.Min = value
+				}
+				if i == 0 || value > stats.Max {
+					stats.Max = value
+				}
+				sum += value
+			}
+			stats.Avg = sum / float64(len(readings))
+			conditions.Metrics[metric] = stats
+		}
+	}
+
+	app.writeJSON(w, http.StatusOK, conditions)
+}
+
+// AssignDeviceField assigns a device to a field of its owner, or unassigns it
+// when field_id is null
+func (app *Config) AssignDeviceField(w http.ResponseWriter, r *http.Request) {
+	claims := app.userClaims(r)
+
+	var request struct {
+		FieldID *uint `json:"field_id"`
+	}
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	device, err := app.Models.Device.GetBySerialNumber(chi.URLParam(r, "serial"))
+	if err != nil || device == nil {
+		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
+		return
+	}
+	if !app.canAccessDevice(claims, device, true) {
+		app.errorJSON(w, errors.New("unauthorized: device does not belong to the user"), http.StatusUnauthorized)
+		return
+	}
+
+	if request.FieldID != nil {
+		field, err := app.Models.Farm.GetField(*request.FieldID)
+		if err != nil || field == nil || field.UserID != device.UserID {
+			app.errorJSON(w, errors.New("field not found"), http.StatusNotFound)
+			return
+		}
+	}
+
+	if err := app.Models.Device.SetField(device.ID, request.FieldID); err != nil {
+		app.errorJSON(w, errors.New("failed to assign device"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to assign device %s to a field: %v", device.SerialNumber, err)
+		return
+	}
+
+	device.FieldID = request.FieldID
+	device.SuggestedFieldID = nil
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Device field updated",
+		"device":  device,
+	})
+}
+
+// suggestDeviceField records the field an unassigned device's reported position falls
+// inside, and tells the owner the first time a device is seen in that field
+func (app *Config) suggestDeviceField(device *data.Device, reading *data.DeviceData) {
+	if device.UserID == 0 || device.FieldID != nil || (reading.Latitude == 0 && reading.Longitude == 0) {
+		return
+	}
+
+	fields, err := app.Models.Farm.GetFieldsAt(device.UserID, reading.Longitude, reading.Latitude)
+	if err != nil {
+		app.ErrorLog.Printf("Failed to look up fields for device %s: %v", device.SerialNumber, err)
+		return
+	}
+
+	var match *data.Field
+	for _, field := range fields {
+		if field.Contains(reading.Longitude, reading.Latitude) {
+			match = field
+			break
+		}
+	}
+
+	var suggested *uint
+	if match != nil {
+		suggested = &match.ID
+	}
+	if (suggested == nil && device.SuggestedFieldID == nil) ||
+		(suggested != nil && device.SuggestedFieldID != nil && *suggested == *device.SuggestedFieldID) {
+		return
+	}
+
+	if err := app.Models.Device.SetSuggestedField(device.ID, suggested); err != nil {
+		app.ErrorLog.Printf("Failed to store field suggestion for device %s: %v", device.SerialNumber, err)
+		return
+	}
+	device.SuggestedFieldID = suggested
+
+	if match == nil {
+		return
+	}
+
+	notification := data.Notification{
+		Type:       "info",
+		Message:    fmt.Sprintf("Device %s is reporting from inside field %s. Assign it to the field to include it in the field's conditions.", device.SerialNumber, match.Name),
+		DeviceID:   device.ID,
+		DeviceName: device.SerialNumber,
+		UserID:     device.UserID,
+		Read:       false,
+	}
+	if err := app.createNotification(&notification); err != nil {
+		app.ErrorLog.Printf("Failed to create field suggestion notification for device %s: %v", device.SerialNumber, err)
+	}
+}
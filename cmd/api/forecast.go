@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"field_eyes/data"
+	"field_eyes/pkg/analysis"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// Soil moisture (%) devices are irrigated at unless their refill point is set
+	defaultRefillPoint = 25.0
+	// History the soil moisture forecast is fitted to
+	forecastHistory = 14 * 24 * time.Hour
+	// Hours ahead the analysis forecasts soil moisture, by default and at most
+	defaultForecastHorizon = 72
+	minForecastHorizon     = 24
+	maxForecastHorizon     = 72
+	// How often owners are checked for upcoming irrigation
+	irrigationForecastInterval = time.Hour
+	// How far ahead owners are told that irrigation is due, and how often at most
+	irrigationNoticeLead     = 24 * time.Hour
+	irrigationNoticeInterval = 24 * time.Hour
+)
+
+// irrigationForecast is the soil moisture forecast of a device
+type irrigationForecast struct {
+	*analysis.Forecast
+	RefillPoint float64            `json:"refill_point"`
+	Current     float64            `json:"current"` // latest hourly mean
+	IrrigateBy  *analysis.Crossing `json:"irrigate_by"`
+	Confidence  float64            `json:"confidence"` // coverage of the prediction band
+}
+
+// deviceRefillPoint returns the soil moisture a device's field is irrigated at: its own
+// refill point, else the bottom of its crop's moisture band, else the default
+func deviceRefillPoint(device *data.Device, targets cropTargets) float64 {
+	if device.RefillPoint > 0 {
+		return device.RefillPoint
+	}
+	if targets.Crop != "" {
+		return targets.Moisture.Min
+	}
+	return defaultRefillPoint
+}
+
+// forecastMoisture forecasts a device's soil moisture for the given number of hours
+// from its readings that are not flagged as faults. It returns nil if the device has
+// too little soil moisture history.
+func (app *Config) forecastMoisture(device *data.Device, refillPoint float64, horizon int) (*irrigationForecast, error) {
+	now := time.Now()
+	logs, err := app.Models.DeviceData.GetLogsPage(device.ID, data.LogQuery{
+		From:      now.Add(-forecastHistory),
+		Limit:     maxAnalysisReadings,
+		Qualities: []string{data.QualityOK, data.QualitySuspect},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
+		logs[i], logs[j] = logs[j], logs[i]
+	}
+
+	points := metricSeries(logs, "soil_moisture")
+	if !hasSoilMoisture(points) {
+		return nil, nil
+	}
+	forecast, ok := analysis.ForecastHourly(points, horizon)
+	if !ok {
+		return nil, nil
+	}
+
+	_, hourly := analysis.HourlySeries(points)
+	result := &irrigationForecast{
+		Forecast:    forecast,
+		RefillPoint: refillPoint,
+		Current:     hourly[len(hourly)-1],
+		Confidence:  0.95,
+	}
+	if crossing, ok := forecast.CrossingBelow(refillPoint); ok {
+		result.IrrigateBy = &crossing
+	}
+
+	return result, nil
+}
+
+// hasSoilMoisture reports whether a series comes from a fitted soil moisture sensor
+func hasSoilMoisture(points []analysis.Point) bool {
+	for _, p := range points {
+		if p.Value != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// irrigationAdvice describes a soil moisture forecast as a recommendation
+func irrigationAdvice(f *irrigationForecast) string {
+	if f.Current < f.RefillPoint {
+		return fmt.Sprintf("Soil moisture is %.1f%%, below the refill point of %.0f%%, irrigate now", f.Current, f.RefillPoint)
+	}
+	if f.IrrigateBy == nil {
+		return fmt.Sprintf("Soil moisture is forecast to stay above the refill point of %.0f%% for the next %d hours", f.RefillPoint, len(f.Points))
+	}
+	advice := fmt.Sprintf("Irrigate by %s, when soil moisture is forecast to fall below the refill point of %.0f%%",
+		f.IrrigateBy.At.Format(time.RFC1123), f.RefillPoint)
+	if f.IrrigateBy.Latest != nil {
+		return advice + fmt.Sprintf(" (95%% range %s to %s)", f.IrrigateBy.Earliest.Format(time.RFC1123), f.IrrigateBy.Latest.Format(time.RFC1123))
+	}
+	return advice + fmt.Sprintf(" (possibly as early as %s)", f.IrrigateBy.Earliest.Format(time.RFC1123))
+}
+
+// SetRefillPoint sets the soil moisture at which a device's field should be irrigated.
+// A refill point of 0 restores the default.
+func (app *Config) SetRefillPoint(w http.ResponseWriter, r *http.Request) {
+	claims := app.userClaims(r)
+
+	var request struct {
+		RefillPoint float64 `json:"refill_point"`
+	}
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+	if request.RefillPoint < 0 || request.RefillPoint >= 100 {
+		app.errorJSON(w, errors.New("refill_point must be between 0 and 100"), http.StatusBadRequest)
+		return
+	}
+
+	device, err := app.Models.Device.GetBySerialNumber(chi.URLParam(r, "serial"))
+	if err != nil || device == nil {
+		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
+		return
+	}
+	if !app.canAccessDevice(claims, device, true) {
+		app.errorJSON(w, errors.New("unauthorized: device does not belong to the user"), http.StatusUnauthorized)
+		return
+	}
+
+	if err := app.Models.Device.SetRefillPoint(device.ID, request.RefillPoint); err != nil {
+		app.errorJSON(w, errors.New("failed to set refill point"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to set refill point of device %s: %v", device.SerialNumber, err)
+		return
+	}
+	device.RefillPoint = request.RefillPoint
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":      "Refill point updated",
+		"refill_point": deviceRefillPoint(device, app.deviceTargets(device)),
+	})
+}
+
+// sweepIrrigationForecasts periodically forecasts the soil moisture of claimed devices
+// and tells owners ahead of time when a field will need irrigating
+func (app *Config) sweepIrrigationForecasts(ctx context.Context) {
+	ticker := time.NewTicker(irrigationForecastInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		devices, err := app.Models.Device.GetAll()
+		if err != nil {
+			app.ErrorLog.Printf("Failed to load devices for irrigation forecasts: %v", err)
+			continue
+		}
+
+		for _, device := range devices {
+			// Forecasts of devices that stopped reporting would be out of date
+			if device.UserID != 0 && device.Connectivity != data.ConnectivityOffline {
+				app.checkIrrigationDue(device)
+			}
+		}
+	}
+}
+
+// checkIrrigationDue notifies a device's owner when its soil moisture is forecast to
+// fall below the refill point within irrigationNoticeLead
+func (app *Config) checkIrrigationDue(device *data.Device) {
+	forecast, err := app.forecastMoisture(device, deviceRefillPoint(device, app.deviceTargets(device)), int(irrigationNoticeLead/time.Hour))
+	if err != nil {
+		app.ErrorLog.Printf("Failed to forecast soil moisture of device %s: %v", device.SerialNumber, err)
+		return
+	}
+	if forecast == nil || (forecast.IrrigateBy == nil && forecast.Current >= forecast.RefillPoint) {
+		return
+	}
+
+	now := time.Now()
+	notify, err := app.Models.Device.MarkIrrigationNotice(device.ID, now, now.Add(-irrigationNoticeInterval))
+	if err != nil {
+		app.ErrorLog.Printf("Failed to record irrigation notice for device %s: %v", device.SerialNumber, err)
+		return
+	}
+	if !notify {
+		return
+	}
+
+	notification := data.Notification{
+		Type:       data.SeverityInfo,
+		Message:    fmt.Sprintf("Device %s: %s", device.SerialNumber, irrigationAdvice(forecast)),
+		DeviceID:   device.ID,
+		DeviceName: device.SerialNumber,
+		UserID:     device.UserID,
+		Read:       false,
+	}
+	if err := app.createNotification(&notification); err != nil {
+		app.ErrorLog.Printf("Failed to create irrigation notification for device %s: %v", device.SerialNumber, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"field_eyes/data"
+	"field_eyes/pkg/email"
 	"fmt"
 	"io"
 	"net/http"
@@ -41,6 +42,16 @@ func (app *Config) Signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(user.Locale) > 10 {
+		app.errorJSON(w, errors.New("locale must be a language tag such as en or sw"), http.StatusBadRequest)
+		return
+	}
+
+	// New accounts are always farmers; other roles are granted by an admin
+	user.Role = data.RoleFarmer
+	// and start unverified, until the code emailed to them is entered
+	user.EmailVerifiedAt = nil
+
 	// Check if user exists
 	existingUser, err := app.Models.User.GetByEmail(user.Email)
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
@@ -64,6 +75,11 @@ func (app *Config) Signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The account exists even if the email fails; a new code can be requested
+	if err := app.sendVerificationCode(&user); err != nil {
+		app.ErrorLog.Printf("Failed to send a verification code to user %d: %v", id, err)
+	}
+
 	// Return standardized response
 	app.writeJSON(w, http.StatusCreated, map[string]interface{}{
 		"message": fmt.Sprintf("User created successfully with id %d", id),
@@ -110,7 +126,7 @@ func (app *Config) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := app.GenerateJWT(*user)
+	tokens, err := app.startSession(*user)
 	if err != nil {
 		app.errorJSON(w, errors.New("failed to generate token"), http.StatusInternalServerError)
 		app.ErrorLog.Println(err)
@@ -119,16 +135,19 @@ func (app *Config) Login(w http.ResponseWriter, r *http.Request) {
 
 	// Create a user response without password
 	userResponse := map[string]interface{}{
-		"id":       user.ID,
-		"username": user.Username,
-		"email":    user.Email,
-		"role":     user.Role,
+		"id":             user.ID,
+		"username":       user.Username,
+		"email":          user.Email,
+		"role":           user.Role,
+		"email_verified": user.EmailVerifiedAt != nil,
 	}
 
-	// Respond with the token and user
+	// Respond with the tokens and user
 	app.writeJSON(w, http.StatusOK, map[string]interface{}{
-		"token": token,
-		"user":  userResponse,
+		"token":         tokens.Token,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"user":          userResponse,
 	})
 }
 
@@ -171,7 +190,11 @@ func (app *Config) ForgotPassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Send OTP via email in a goroutine
-	app.SendEmailInBackground(request.Email, otp)
+	app.sendTemplateEmail(user, email.TemplatePasswordReset, email.PasswordResetData{
+		Username:         user.Username,
+		Code:             otp,
+		ExpiresInMinutes: int(data.OTPValidity.Minutes()),
+	})
 
 	// Respond to the user
 	app.writeJSON(w, http.StatusOK, map[string]string{
@@ -222,16 +245,116 @@ func (app *Config) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	app.InfoLog.Printf("Password reset successful for email: %s", request.Email)
 }
 
-// GetNotifications returns all notifications for the authenticated user
-func (app *Config) GetNotifications(w http.ResponseWriter, r *http.Request) {
-	// Extract user ID from JWT token
-	userID, _, _, err := app.GetUserInfoFromToken(r)
+// sendVerificationCode gives the user a new email verification code and emails it
+// to them
+func (app *Config) sendVerificationCode(user *data.User) error {
+	code, err := app.Models.User.GenerateVerificationCode(user.ID)
 	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
+		return err
+	}
+	app.sendTemplateEmail(user, email.TemplateVerification, email.VerificationData{
+		Username:         user.Username,
+		Code:             code,
+		ExpiresInMinutes: int(data.VerificationValidity.Minutes()),
+	})
+	return nil
+}
+
+// VerifyEmail marks the user's email address verified with the code sent to it
+func (app *Config) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email string `json:"email"`
+		Code  string `json:"code"`
+	}
+
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if request.Email == "" || request.Code == "" {
+		app.errorJSON(w, errors.New("email and code are required"), http.StatusBadRequest)
 		return
 	}
 
+	verified, err := app.Models.User.VerifyEmail(request.Email, request.Code)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to verify email"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to verify email %s: %v", request.Email, err)
+		return
+	}
+	if !verified {
+		app.errorJSON(w, errors.New("invalid or expired code"), http.StatusBadRequest)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Email verified",
+	})
+	app.InfoLog.Printf("Email verified: %s", request.Email)
+}
+
+// ResendVerification emails a new verification code to an unverified account
+func (app *Config) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email string `json:"email"`
+	}
+
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if request.Email == "" {
+		app.errorJSON(w, errors.New("email is required"), http.StatusBadRequest)
+		return
+	}
+
+	// Don't reveal whether the email is registered or already verified
+	response := map[string]string{
+		"message": "If your email is registered and not yet verified, you will receive a code shortly",
+	}
+
+	user, err := app.Models.User.GetByEmail(request.Email)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to send verification code"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch user %s: %v", request.Email, err)
+		return
+	}
+	if user == nil || user.EmailVerifiedAt != nil {
+		app.writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	if err := app.sendVerificationCode(user); err != nil {
+		app.errorJSON(w, errors.New("failed to send verification code"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to send a verification code to user %d: %v", user.ID, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, response)
+}
+
+// createNotification stores a notification, pushes it to the user's live dashboards,
+// queues it for the channels they chose for its severity and for their webhooks
+func (app *Config) createNotification(notification *data.Notification) error {
+	if err := app.Models.Notification.CreateNotification(notification); err != nil {
+		return err
+	}
+
+	app.Stream.PublishNotification(notification)
+	app.dispatchNotification(notification)
+	app.emitEvents(notification.UserID, data.EventNotificationCreated, map[string]interface{}{
+		"notification": notification,
+	})
+	return nil
+}
+
+// GetNotifications returns all notifications for the authenticated user
+func (app *Config) GetNotifications(w http.ResponseWriter, r *http.Request) {
+	// Get the authenticated user from the request context
+	userID := app.userClaims(r).UserID
+
 	// Get query parameter for filtering unread notifications
 	unreadOnly := r.URL.Query().Get("unread")
 
@@ -260,13 +383,8 @@ func (app *Config) GetNotifications(w http.ResponseWriter, r *http.Request) {
 
 // CreateNotification creates a new notification
 func (app *Config) CreateNotification(w http.ResponseWriter, r *http.Request) {
-	// Extract user ID from JWT token
-	userID, _, _, err := app.GetUserInfoFromToken(r)
-	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
-		return
-	}
+	// Get the authenticated user from the request context
+	userID := app.userClaims(r).UserID
 
 	// Parse request body
 	var notificationRequest struct {
@@ -298,7 +416,7 @@ func (app *Config) CreateNotification(w http.ResponseWriter, r *http.Request) {
 		Read:       false,
 	}
 
-	if err := app.Models.Notification.CreateNotification(&notification); err != nil {
+	if err := app.createNotification(&notification); err != nil {
 		app.errorJSON(w, errors.New("failed to create notification"), http.StatusInternalServerError)
 		app.ErrorLog.Printf("Failed to create notification: %v", err)
 		return
@@ -313,14 +431,6 @@ func (app *Config) CreateNotification(w http.ResponseWriter, r *http.Request) {
 
 // MarkNotificationAsRead marks a notification as read
 func (app *Config) MarkNotificationAsRead(w http.ResponseWriter, r *http.Request) {
-	// Extract user ID from JWT token
-	_, _, _, err := app.GetUserInfoFromToken(r)
-	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
-		return
-	}
-
 	// Get notification ID from request
 	idParam := r.URL.Query().Get("id")
 	if idParam == "" {
@@ -335,12 +445,17 @@ func (app *Config) MarkNotificationAsRead(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Mark as read
-	if err := app.Models.Notification.MarkAsRead(uint(id)); err != nil {
+	// Mark as read, only if the notification is the user's
+	found, err := app.Models.Notification.MarkAsRead(uint(id), app.userClaims(r).UserID)
+	if err != nil {
 		app.errorJSON(w, errors.New("failed to mark notification as read"), http.StatusInternalServerError)
 		app.ErrorLog.Printf("Failed to mark notification as read: %v", err)
 		return
 	}
+	if !found {
+		app.errorJSON(w, errors.New("notification not found"), http.StatusNotFound)
+		return
+	}
 
 	// Return success
 	app.writeJSON(w, http.StatusOK, map[string]string{
@@ -350,13 +465,8 @@ func (app *Config) MarkNotificationAsRead(w http.ResponseWriter, r *http.Request
 
 // MarkAllNotificationsAsRead marks all notifications for a user as read
 func (app *Config) MarkAllNotificationsAsRead(w http.ResponseWriter, r *http.Request) {
-	// Extract user ID from JWT token
-	userID, _, _, err := app.GetUserInfoFromToken(r)
-	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
-		return
-	}
+	// Get the authenticated user from the request context
+	userID := app.userClaims(r).UserID
 
 	// Mark all as read
 	if err := app.Models.Notification.MarkAllAsRead(userID); err != nil {
@@ -373,14 +483,6 @@ func (app *Config) MarkAllNotificationsAsRead(w http.ResponseWriter, r *http.Req
 
 // DeleteNotification deletes a notification
 func (app *Config) DeleteNotification(w http.ResponseWriter, r *http.Request) {
-	// Extract user ID from JWT token
-	_, _, _, err := app.GetUserInfoFromToken(r)
-	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
-		return
-	}
-
 	// Get notification ID from request
 	idParam := r.URL.Query().Get("id")
 	if idParam == "" {
@@ -395,12 +497,17 @@ func (app *Config) DeleteNotification(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete notification
-	if err := app.Models.Notification.DeleteNotification(uint(id)); err != nil {
+	// Delete notification, only if it is the user's
+	found, err := app.Models.Notification.DeleteNotification(uint(id), app.userClaims(r).UserID)
+	if err != nil {
 		app.errorJSON(w, errors.New("failed to delete notification"), http.StatusInternalServerError)
 		app.ErrorLog.Printf("Failed to delete notification: %v", err)
 		return
 	}
+	if !found {
+		app.errorJSON(w, errors.New("notification not found"), http.StatusNotFound)
+		return
+	}
 
 	// Return success
 	app.writeJSON(w, http.StatusOK, map[string]string{
@@ -408,15 +515,10 @@ func (app *Config) DeleteNotification(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// GenerateDeviceNotifications checks device data for conditions that should create notifications
+// GenerateDeviceNotifications evaluates the alert rules against each device's latest reading
 func (app *Config) GenerateDeviceNotifications(w http.ResponseWriter, r *http.Request) {
-	// Extract user ID from JWT token
-	userID, _, _, err := app.GetUserInfoFromToken(r)
-	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized: invalid or missing token"), http.StatusUnauthorized)
-		app.ErrorLog.Println(err)
-		return
-	}
+	// Get the authenticated user from the request context
+	userID := app.userClaims(r).UserID
 
 	// Get user's devices
 	devices, err := app.Models.Device.GetByUserID(userID)
@@ -428,64 +530,14 @@ func (app *Config) GenerateDeviceNotifications(w http.ResponseWriter, r *http.Re
 
 	notificationsGenerated := 0
 
-	// Check each device for conditions that would trigger notifications
+	// Evaluate the alert rules against each device's latest reading
 	for _, device := range devices {
-		// Get latest log for device
-		logs, err := app.Models.DeviceData.GetLogsByDeviceID(device.ID)
+		logs, err := app.Models.DeviceData.GetLogsPage(device.ID, data.LogQuery{Limit: 1})
 		if err != nil || len(logs) == 0 {
 			continue
 		}
 
-		// Get most recent log
-		latestLog := logs[0]
-
-		// Create notification for low battery (if battery < 20%)
-		if latestLog.SoilMoisture < 20 {
-			notification := data.Notification{
-				Type:       "warning",
-				Message:    fmt.Sprintf("Soil moisture is critically low (%f%%)", latestLog.SoilMoisture),
-				DeviceID:   device.ID,
-				DeviceName: device.SerialNumber,
-				UserID:     userID,
-				Read:       false,
-			}
-
-			if err := app.Models.Notification.CreateNotification(&notification); err == nil {
-				notificationsGenerated++
-			}
-		}
-
-		// Check extreme temperature
-		if latestLog.SoilTemperature > 35 || latestLog.SoilTemperature < 5 {
-			notification := data.Notification{
-				Type:       "alert",
-				Message:    fmt.Sprintf("Extreme soil temperature detected: %f°C", latestLog.SoilTemperature),
-				DeviceID:   device.ID,
-				DeviceName: device.SerialNumber,
-				UserID:     userID,
-				Read:       false,
-			}
-
-			if err := app.Models.Notification.CreateNotification(&notification); err == nil {
-				notificationsGenerated++
-			}
-		}
-
-		// Check pH levels
-		if latestLog.PH < 5.5 || latestLog.PH > 7.5 {
-			notification := data.Notification{
-				Type:       "info",
-				Message:    fmt.Sprintf("pH level outside optimal range: %f", latestLog.PH),
-				DeviceID:   device.ID,
-				DeviceName: device.SerialNumber,
-				UserID:     userID,
-				Read:       false,
-			}
-
-			if err := app.Models.Notification.CreateNotification(&notification); err == nil {
-				notificationsGenerated++
-			}
-		}
+		notificationsGenerated += app.evaluateAlertRules(device, logs[0])
 	}
 
 	// Return success with count of notifications generated
@@ -499,8 +551,15 @@ func (app *Config) GenerateDeviceNotifications(w http.ResponseWriter, r *http.Re
 // HealthCheck is a simple health check endpoint that returns 200 OK if the service is running.
 // This is used by cloud providers to check if the service is healthy.
 func (app *Config) HealthCheck(w http.ResponseWriter, r *http.Request) {
-	app.writeJSON(w, http.StatusOK, map[string]string{
+	response := map[string]interface{}{
 		"status":  "ok",
 		"service": "field_eyes_api",
-	})
+	}
+
+	// Report chunked MQTT reassembly counters when MQTT is running
+	if app.MQTT != nil {
+		response["mqtt_chunks"] = app.MQTT.chunks.Stats()
+	}
+
+	app.writeJSON(w, http.StatusOK, response)
 }
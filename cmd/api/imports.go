@@ -0,0 +1,760 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"field_eyes/data"
+	"field_eyes/pkg/analysis"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// importSyncLimit is the largest upload imported while the client waits; larger
+	// uploads run as a background job
+	importSyncLimit = 1 << 20
+	// importMaxBytes is the largest file that can be imported
+	importMaxBytes = 100 << 20
+	// importBatchSize is the number of rows inserted per transaction
+	importBatchSize = 500
+	// maxImportErrors is the number of rejected rows listed in an import's report
+	maxImportErrors = 1000
+	// maxImportLine is the longest NDJSON line accepted
+	maxImportLine = 1 << 20
+	// importClockSkew is how far in the future a timestamp may be
+	importClockSkew = 5 * time.Minute
+	// importJobTimeout is how long one attempt of a background import may run
+	importJobTimeout = 30 * time.Minute
+)
+
+// importEpoch is the earliest timestamp accepted, catching devices whose clock was never set
+var importEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// importColumnAliases maps common column names onto DeviceData fields
+var importColumnAliases = map[string]string{
+	"timestamp":  "created_at",
+	"time":       "created_at",
+	"datetime":   "created_at",
+	"temp":       "temperature",
+	"moisture":   "soil_moisture",
+	"phosphorus": "phosphorous",
+	"lat":        "latitude",
+	"lon":        "longitude",
+	"lng":        "longitude",
+}
+
+// importFields lists the DeviceData fields an import can set
+var importFields = func() map[string]bool {
+	fields := map[string]bool{"measured_at": true, "created_at": true, "longitude": true, "latitude": true}
+	for _, field := range data.AggregatedFields {
+		fields[field] = true
+	}
+	return fields
+}()
+
+// normalizeColumn lower-cases a column name and joins its words with underscores
+func normalizeColumn(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+}
+
+// importMapping resolves column names to DeviceData fields, using the map parameter
+// (source:target pairs separated by commas) before the built-in aliases
+type importMapping map[string]string
+
+// parseImportMapping reads the map query parameter
+func parseImportMapping(r *http.Request) (importMapping, error) {
+	mapping := make(importMapping)
+	param := r.URL.Query().Get("map")
+	if param == "" {
+		return mapping, nil
+	}
+	for _, pair := range strings.Split(param, ",") {
+		source, target, ok := strings.Cut(pair, ":")
+		source, target = normalizeColumn(source), normalizeColumn(target)
+		if !ok || source == "" {
+			return nil, fmt.Errorf("invalid map entry %q: use source:field", pair)
+		}
+		if !importFields[target] {
+			return nil, fmt.Errorf("map entry %q names an unknown field", pair)
+		}
+		mapping[source] = target
+	}
+	return mapping, nil
+}
+
+// field returns the DeviceData field a column maps to, or "" to ignore the column
+func (m importMapping) field(column string) string {
+	column = normalizeColumn(column)
+	if field, ok := m[column]; ok {
+		return field
+	}
+	if field, ok := importColumnAliases[column]; ok {
+		return field
+	}
+	if importFields[column] {
+		return column
+	}
+	return ""
+}
+
+// parseImportTime reads a timestamp as RFC 3339, a date and time without a zone in
+// loc, or Unix seconds or milliseconds
+func parseImportTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		// Anything past the year 5138 in seconds is taken to be milliseconds
+		if math.Abs(number) >= 1e11 {
+			return time.UnixMicro(int64(number * 1e3)), nil
+		}
+		return time.UnixMicro(int64(number * 1e6)), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+}
+
+// importRow builds a reading from the values of one row, keyed by field. The row's
+// timestamp is when the reading was measured; now is when it was received.
+func importRow(values map[string]string, loc *time.Location, now time.Time) (*data.DeviceData, error) {
+	// Exported files hold both times; the device's own wins
+	raw := values["measured_at"]
+	if raw == "" {
+		raw = values["created_at"]
+	}
+	if raw == "" {
+		return nil, errors.New("missing timestamp")
+	}
+	at, err := parseImportTime(raw, loc)
+	if err != nil {
+		return nil, err
+	}
+	if at.Before(importEpoch) || at.After(now.Add(importClockSkew)) {
+		return nil, fmt.Errorf("timestamp %s is out of range", at.UTC().Format(time.RFC3339))
+	}
+
+	// Postgres stores microseconds, so compare duplicates at that precision
+	at = at.Truncate(time.Microsecond)
+	reading := &data.DeviceData{CreatedAt: now, MeasuredAt: &at, Quality: data.QualityOK}
+	readings := 0
+	for field, raw := range values {
+		if field == "measured_at" || field == "created_at" || raw == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("%s: invalid number %q", field, raw)
+		}
+
+		switch field {
+		case "longitude":
+			if value < -180 || value > 180 {
+				return nil, fmt.Errorf("longitude %.4g is out of range", value)
+			}
+			reading.Longitude = value
+		case "latitude":
+			if value < -90 || value > 90 {
+				return nil, fmt.Errorf("latitude %.4g is out of range", value)
+			}
+			reading.Latitude = value
+		default:
+			if limits, ok := analysis.SensorLimits[field]; ok && (value < limits.Min || value > limits.Max) {
+				return nil, fmt.Errorf("%s %.4g is outside the sensor range %.4g to %.4g", field, value, limits.Min, limits.Max)
+			}
+			reading.SetMetric(field, value)
+			readings++
+		}
+	}
+	if readings == 0 {
+		return nil, errors.New("no readings")
+	}
+	return reading, nil
+}
+
+// importLine is one row of an import file with its values keyed by field
+type importLine struct {
+	values map[string]string
+	line   int
+	err    error // rejects only this row
+}
+
+// importSource yields the rows of an import file
+type importSource interface {
+	// Next returns the next row. An error ends the import; it is io.EOF after the
+	// last row.
+	Next() (*importLine, error)
+	// Ignored lists the columns that didn't map to a field
+	Ignored() []string
+}
+
+// csvSource reads a CSV file with a header row
+type csvSource struct {
+	reader  *csv.Reader
+	fields  []string
+	ignored []string
+}
+
+func newCSVSource(r io.Reader, mapping importMapping) (*csvSource, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+
+	source := &csvSource{reader: reader, fields: make([]string, len(header))}
+	timestamp := false
+	for i, column := range header {
+		// Spreadsheets often start UTF-8 files with a byte order mark
+		column = strings.TrimPrefix(column, "\ufeff")
+		source.fields[i] = mapping.field(column)
+		switch source.fields[i] {
+		case "":
+			source.ignored = append(source.ignored, column)
+		case "measured_at", "created_at":
+			timestamp = true
+		}
+	}
+	if !timestamp {
+		return nil, errors.New("no timestamp column: name one measured_at or created_at, or use the map parameter")
+	}
+	return source, nil
+}
+
+func (s *csvSource) Next() (*importLine, error) {
+	record, err := s.reader.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return &importLine{line: parseErr.StartLine, err: parseErr.Err}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	line, _ := s.reader.FieldPos(0)
+	values := make(map[string]string, len(record))
+	for i, value := range record {
+		if s.fields[i] != "" {
+			values[s.fields[i]] = strings.TrimSpace(value)
+		}
+	}
+	return &importLine{values: values, line: line}, nil
+}
+
+func (s *csvSource) Ignored() []string {
+	return s.ignored
+}
+
+// ndjsonSource reads one JSON object per line
+type ndjsonSource struct {
+	scanner *bufio.Scanner
+	mapping importMapping
+	line    int
+	ignored map[string]bool
+}
+
+func newNDJSONSource(r io.Reader, mapping importMapping) *ndjsonSource {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+	return &ndjsonSource{scanner: scanner, mapping: mapping, ignored: make(map[string]bool)}
+}
+
+func (s *ndjsonSource) Next() (*importLine, error) {
+	for s.scanner.Scan() {
+		s.line++
+		text := strings.TrimSpace(s.scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+		var object map[string]interface{}
+		if err := decoder.Decode(&object); err != nil {
+			return &importLine{line: s.line, err: errors.New("invalid JSON object")}, nil
+		}
+
+		values := make(map[string]string, len(object))
+		for key, value := range object {
+			field := s.mapping.field(key)
+			if field == "" {
+				s.ignored[key] = true
+				continue
+			}
+			switch v := value.(type) {
+			case nil:
+			case json.Number:
+				values[field] = v.String()
+			case string:
+				values[field] = strings.TrimSpace(v)
+			default:
+				return &importLine{line: s.line, err: fmt.Errorf("%s must be a number or string", key)}, nil
+			}
+		}
+		return &importLine{values: values, line: s.line}, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (s *ndjsonSource) Ignored() []string {
+	ignored := make([]string, 0, len(s.ignored))
+	for key := range s.ignored {
+		ignored = append(ignored, key)
+	}
+	sort.Strings(ignored)
+	return ignored
+}
+
+// countingReader tracks how much of an import file has been read
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// errImportInterrupted stops an import between batches when ctx ends
+var errImportInterrupted = errors.New("import interrupted")
+
+// importReadings reads an import file and inserts its readings in batches, recording
+// the outcome on the job. save is called after each batch so progress can be polled.
+// When ctx ends it stops after the batch being inserted and returns errImportInterrupted.
+// A job that was stopped resumes after the rows it has read, which were all stored
+// by the time its progress was saved.
+func (app *Config) importReadings(ctx context.Context, device *data.Device, job *data.ImportJob, source importSource, input *countingReader, size int64, loc *time.Location, save func()) error {
+	now := time.Now()
+	skip := job.RowsRead
+	seen := make(map[int64]bool)
+	batch := make([]*data.DeviceData, 0, importBatchSize)
+
+	flush := func() error {
+		inserted, err := app.Models.DeviceData.ImportLogs(device.ID, batch)
+		if err != nil {
+			return err
+		}
+		job.Inserted += inserted
+		job.Duplicates += len(batch) - inserted
+		if size > 0 {
+			job.Progress = math.Min(100, math.Round(float64(input.n)/float64(size)*1000)/10)
+		}
+		batch = batch[:0]
+		save()
+		return nil
+	}
+	reject := func(line int, err error) {
+		job.Rejected++
+		if len(job.Errors) < maxImportErrors {
+			job.Errors = append(job.Errors, data.ImportRowError{Row: line, Error: err.Error()})
+		}
+	}
+
+	for {
+		row, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		job.RowsRead++
+		if row.err != nil {
+			reject(row.line, row.err)
+			continue
+		}
+
+		reading, err := importRow(row.values, loc, now)
+		if err != nil {
+			reject(row.line, err)
+			continue
+		}
+		key := reading.MeasuredAt.UnixMicro()
+		if seen[key] {
+			job.Duplicates++
+			continue
+		}
+		seen[key] = true
+
+		reading.DeviceID = device.ID
+		reading.SerialNumber = device.SerialNumber
+		batch = append(batch, reading)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return errImportInterrupted
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+	job.Progress = 100
+	job.IgnoredColumns = source.Ignored()
+	return nil
+}
+
+// runImport imports a file into a device's logs and finishes the job as completed,
+// failed, or interrupted if ctx ends first. It returns false if the file couldn't be
+// read at all.
+func (app *Config) runImport(ctx context.Context, device *data.Device, job *data.ImportJob, r io.Reader, size int64, mapping importMapping, loc *time.Location, save func()) bool {
+	if job.StartedAt == nil {
+		started := time.Now()
+		job.StartedAt = &started
+	}
+	job.Status = data.ImportRunning
+	job.Message = ""
+	job.FinishedAt = nil
+	save()
+
+	input := &countingReader{r: r}
+	var source importSource
+	var err error
+	if job.Format == formatNDJSON {
+		source = newNDJSONSource(input, mapping)
+	} else {
+		var csvFile *csvSource
+		if csvFile, err = newCSVSource(input, mapping); err == nil {
+			source = csvFile
+		}
+	}
+	if source != nil {
+		err = app.importReadings(ctx, device, job, source, input, size, loc, save)
+	}
+
+	finished := time.Now()
+	job.FinishedAt = &finished
+	if errors.Is(err, errImportInterrupted) {
+		job.Status = data.ImportInterrupted
+		job.Message = "interrupted before the end of the file"
+		app.InfoLog.Printf("Import %d into device %s interrupted after %d rows", job.ID, device.SerialNumber, job.RowsRead)
+	} else if err != nil {
+		job.Status = data.ImportFailed
+		job.Message = err.Error()
+		app.ErrorLog.Printf("Import %d into device %s failed after %d rows: %v", job.ID, device.SerialNumber, job.RowsRead, err)
+	} else {
+		job.Status = data.ImportCompleted
+		app.InfoLog.Printf("Imported %d readings into device %s (%d duplicates, %d rejected)",
+			job.Inserted, device.SerialNumber, job.Duplicates, job.Rejected)
+	}
+	save()
+
+	if job.Inserted > 0 {
+		app.invalidateDeviceLogs(device)
+	}
+	return source != nil
+}
+
+// importFormat picks the file format from the format parameter or the Content-Type
+func importFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/x-ndjson", "application/jsonl", "application/json":
+			format = formatNDJSON
+		default:
+			format = formatCSV
+		}
+	}
+	if format != formatCSV && format != formatNDJSON {
+		return "", errors.New("unsupported format: use csv or ndjson")
+	}
+	return format, nil
+}
+
+// ImportDeviceData loads historical readings from a CSV or NDJSON request body into a
+// device's logs. Small files are imported before responding; larger ones, or any file
+// with async=true, run in the background and are polled with GetImportJob.
+func (app *Config) ImportDeviceData(w http.ResponseWriter, r *http.Request) {
+	claims := app.userClaims(r)
+
+	format, err := importFormat(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	mapping, err := parseImportMapping(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	loc := time.UTC
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			app.errorJSON(w, errors.New("invalid tz: use an IANA time zone such as Africa/Nairobi"), http.StatusBadRequest)
+			return
+		}
+	}
+	async := r.URL.Query().Get("async") == "true" || r.ContentLength < 0 || r.ContentLength > importSyncLimit
+
+	device, err := app.Models.Device.GetBySerialNumber(chi.URLParam(r, "serial"))
+	if err != nil || device == nil {
+		app.errorJSON(w, errors.New("device not found"), http.StatusNotFound)
+		return
+	}
+	if !app.canAccessDevice(claims, device, true) {
+		app.errorJSON(w, errors.New("unauthorized: device does not belong to the user"), http.StatusUnauthorized)
+		return
+	}
+
+	job := &data.ImportJob{
+		DeviceID:     device.ID,
+		SerialNumber: device.SerialNumber,
+		UserID:       claims.UserID,
+		Format:       format,
+		Status:       data.ImportPending,
+	}
+	body := http.MaxBytesReader(w, r.Body, importMaxBytes)
+
+	if !async {
+		if err := app.Models.Import.CreateJob(job); err != nil {
+			app.errorJSON(w, errors.New("failed to start import"), http.StatusInternalServerError)
+			app.ErrorLog.Printf("Failed to create import job for device %s: %v", device.SerialNumber, err)
+			return
+		}
+		save := func() {
+			if err := app.Models.Import.UpdateJob(job); err != nil {
+				app.ErrorLog.Printf("Failed to save import job %d: %v", job.ID, err)
+			}
+		}
+		if !app.runImport(r.Context(), device, job, body, r.ContentLength, mapping, loc, save) {
+			app.errorJSON(w, errors.New(job.Message), http.StatusBadRequest)
+			return
+		}
+		status := http.StatusOK
+		if job.Status == data.ImportFailed {
+			status = http.StatusInternalServerError
+		}
+		app.writeJSON(w, status, job)
+		return
+	}
+
+	// Keep the upload on disk for the import job
+	dir := importDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		app.errorJSON(w, errors.New("failed to start import"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to create import directory: %v", err)
+		return
+	}
+	file, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to start import"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to create import file: %v", err)
+		return
+	}
+	size, err := io.Copy(file, body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			app.errorJSON(w, fmt.Errorf("the file is larger than %d MB", importMaxBytes>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
+		app.errorJSON(w, errors.New("failed to read upload"), http.StatusBadRequest)
+		app.ErrorLog.Printf("Failed to store import for device %s: %v", device.SerialNumber, err)
+		return
+	}
+
+	if err := app.Models.Import.CreateJob(job); err != nil {
+		os.Remove(file.Name())
+		app.errorJSON(w, errors.New("failed to start import"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to create import job for device %s: %v", device.SerialNumber, err)
+		return
+	}
+	tz := ""
+	if loc != time.UTC {
+		tz = loc.String()
+	}
+	payload := importPayload{ImportID: job.ID, Size: size, Mapping: mapping, TZ: tz}
+	err = os.Rename(file.Name(), importFilePath(job.ID))
+	if err == nil {
+		err = app.enqueueJob(jobImport, payload, time.Now(), 0)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		os.Remove(importFilePath(job.ID))
+		finished := time.Now()
+		job.Status = data.ImportFailed
+		job.Message = "failed to queue the import"
+		job.FinishedAt = &finished
+		if err := app.Models.Import.UpdateJob(job); err != nil {
+			app.ErrorLog.Printf("Failed to save import job %d: %v", job.ID, err)
+		}
+		app.errorJSON(w, errors.New("failed to start import"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to queue import %d for device %s: %v", job.ID, device.SerialNumber, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/imports/%d", job.ID))
+	app.writeJSON(w, http.StatusAccepted, job)
+}
+
+// importPayload is the payload of a jobImport job
+type importPayload struct {
+	ImportID uint          `json:"import_id"`
+	Size     int64         `json:"size"`
+	Mapping  importMapping `json:"mapping"`
+	TZ       string        `json:"tz,omitempty"`
+}
+
+// importDir is where uploads wait for their import job: IMPORT_DIR, which instances
+// sharing a database must share too, or a directory in the system's temporary one
+func importDir() string {
+	if dir := os.Getenv("IMPORT_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "field-eyes-imports")
+}
+
+// importFilePath is where the upload of an import is kept until it finishes
+func importFilePath(id uint) string {
+	return filepath.Join(importDir(), fmt.Sprintf("import-%d", id))
+}
+
+// importJob runs a background import queued by ImportDeviceData. An attempt cut short
+// by a shutdown or its timeout leaves the import interrupted and fails, so the job is
+// retried and resumes where it stopped.
+func (app *Config) importJob(ctx context.Context, payload json.RawMessage) error {
+	var p importPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("%w: invalid import payload: %v", errPermanentJob, err)
+	}
+	job, err := app.Models.Import.GetJob(p.ImportID)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return fmt.Errorf("%w: import %d not found", errPermanentJob, p.ImportID)
+	}
+	path := importFilePath(job.ID)
+	if job.Status == data.ImportCompleted || job.Status == data.ImportFailed {
+		os.Remove(path)
+		return nil
+	}
+
+	save := func() {
+		if err := app.Models.Import.UpdateJob(job); err != nil {
+			app.ErrorLog.Printf("Failed to save import job %d: %v", job.ID, err)
+		}
+	}
+	fail := func(message string) error {
+		finished := time.Now()
+		job.Status = data.ImportFailed
+		job.Message = message
+		job.FinishedAt = &finished
+		save()
+		os.Remove(path)
+		return fmt.Errorf("%w: import %d: %s", errPermanentJob, job.ID, message)
+	}
+
+	device, err := app.Models.Device.GetOne(job.DeviceID)
+	if err != nil {
+		return err
+	}
+	if device == nil {
+		return fail("the device was deleted")
+	}
+	loc, err := time.LoadLocation(p.TZ)
+	if err != nil {
+		return fail("invalid tz")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		app.ErrorLog.Printf("Failed to open the upload of import %d: %v", job.ID, err)
+		return fail("the uploaded file is no longer available")
+	}
+	defer file.Close()
+
+	// Stop between batches on shutdown too, rather than hold it up
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(app.Shutdown, cancel)()
+
+	app.runImport(ctx, device, job, file, p.Size, p.Mapping, loc, save)
+	if job.Status == data.ImportInterrupted {
+		return fmt.Errorf("import %d stopped after %d rows, it resumes on the next attempt", job.ID, job.RowsRead)
+	}
+	os.Remove(path)
+	return nil
+}
+
+// purgeImportFiles removes uploads older than before, left by imports whose job died
+// and can no longer be retried
+func (app *Config) purgeImportFiles(before time.Time) {
+	entries, err := os.ReadDir(importDir())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || info.ModTime().After(before) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(importDir(), entry.Name())); err != nil {
+			app.ErrorLog.Printf("Failed to remove old import file %s: %v", entry.Name(), err)
+		}
+	}
+}
+
+// GetImportJob returns the progress and report of an import
+func (app *Config) GetImportJob(w http.ResponseWriter, r *http.Request) {
+	claims := app.userClaims(r)
+
+	id, err := urlID(r, "id")
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid import ID"), http.StatusBadRequest)
+		return
+	}
+
+	job, err := app.Models.Import.GetJob(id)
+	if err != nil || job == nil {
+		app.errorJSON(w, errors.New("import not found"), http.StatusNotFound)
+		return
+	}
+	device, err := app.Models.Device.GetOne(job.DeviceID)
+	if err != nil || device == nil || !app.canAccessDevice(claims, device, false) {
+		app.errorJSON(w, errors.New("import not found"), http.StatusNotFound)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, job)
+}
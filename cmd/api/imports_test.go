@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"field_eyes/data"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// importStore stores imported logs in memory, skipping any with a stored measured_at
+type importStore struct {
+	data.DeviceDataInterface
+	stored map[int64]*data.DeviceData
+}
+
+func (s *importStore) ImportLogs(deviceID uint, logs []*data.DeviceData) (int, error) {
+	inserted := 0
+	for _, log := range logs {
+		key := log.MeasuredAt.UnixMicro()
+		if s.stored[key] == nil {
+			s.stored[key] = log
+			inserted++
+		}
+	}
+	return inserted, nil
+}
+
+func TestImportRow(t *testing.T) {
+	now := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	reading, err := importRow(map[string]string{"created_at": "2024-03-01 14:00:00.1234567", "temperature": "21.5"}, time.UTC, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2024, 3, 1, 14, 0, 0, 123456000, time.UTC)
+	if reading.MeasuredAt == nil || !reading.MeasuredAt.Equal(want) {
+		t.Errorf("measured_at = %v, want %v", reading.MeasuredAt, want)
+	}
+	if !reading.CreatedAt.Equal(now) {
+		t.Errorf("created_at = %v, want the import time %v", reading.CreatedAt, now)
+	}
+
+	// measured_at wins over created_at
+	reading, err = importRow(map[string]string{"created_at": "2024-03-01T15:00:00Z", "measured_at": "2024-03-01T14:00:00Z", "ph": "6.5"}, time.UTC, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC); !reading.MeasuredAt.Equal(want) {
+		t.Errorf("measured_at = %v, want %v", reading.MeasuredAt, want)
+	}
+}
+
+func TestImportReadingsResumes(t *testing.T) {
+	const rows = 2*importBatchSize + 100
+	var file strings.Builder
+	file.WriteString("timestamp,temperature\n")
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&file, "%s,%d\n", start.Add(time.Duration(i)*time.Minute).Format(time.RFC3339), 20+i%10)
+	}
+	// A row repeated in the file and a rejected one
+	fmt.Fprintf(&file, "%s,25\n", start.Format(time.RFC3339))
+	file.WriteString("not a time,25\n")
+
+	store := &importStore{stored: make(map[int64]*data.DeviceData)}
+	app := &Config{Models: data.Models{DeviceData: store}}
+	device := &data.Device{SerialNumber: "SN1"}
+	device.ID = 1
+	job := &data.ImportJob{}
+
+	run := func(ctx context.Context) error {
+		input := &countingReader{r: strings.NewReader(file.String())}
+		source, err := newCSVSource(input, importMapping{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return app.importReadings(ctx, device, job, source, input, int64(file.Len()), time.UTC, func() {})
+	}
+
+	// A cancelled import stops after its first batch
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := run(ctx); err != errImportInterrupted {
+		t.Fatalf("err = %v, want %v", err, errImportInterrupted)
+	}
+	if job.RowsRead != importBatchSize || job.Inserted != importBatchSize || len(store.stored) != importBatchSize {
+		t.Fatalf("stopped after %d rows read and %d inserted, want %d", job.RowsRead, job.Inserted, importBatchSize)
+	}
+
+	// The next run carries on after the rows read, without counting them again
+	if err := run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if job.RowsRead != rows+2 || job.Inserted != rows || job.Duplicates != 1 || job.Rejected != 1 {
+		t.Errorf("read %d, inserted %d, %d duplicates, %d rejected; want %d, %d, 1, 1",
+			job.RowsRead, job.Inserted, job.Duplicates, job.Rejected, rows+2, rows)
+	}
+	if len(store.stored) != rows || job.Progress != 100 {
+		t.Errorf("%d readings stored and progress %v, want %d and 100", len(store.stored), job.Progress, rows)
+	}
+	for _, reading := range store.stored {
+		if reading.DeviceID != device.ID || reading.SerialNumber != device.SerialNumber || reading.MeasuredAt == nil {
+			t.Fatalf("reading stored as %+v", reading)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"field_eyes/data"
+	"field_eyes/pkg/email"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of jobs run at the same time by this instance
+	jobWorkers = 4
+	// How often the queue is checked when nothing wakes the workers earlier
+	jobPollInterval = 5 * time.Second
+	// How long a claimed job is held before another worker may retry it. Longer
+	// than jobTimeout, so a job isn't picked up again while it is still running.
+	jobLease = 5 * time.Minute
+	// Time allowed for one attempt
+	jobTimeout = 2 * time.Minute
+	// Attempts before a job is dead-lettered, unless enqueued with its own limit
+	jobMaxAttempts = 8
+	// Wait before the first retry, doubled after each failed attempt up to the maximum
+	jobBaseBackoff = 30 * time.Second
+	jobMaxBackoff  = time.Hour
+	// How long finished and dead jobs are kept
+	jobDoneRetention = 24 * time.Hour
+	jobDeadRetention = 30 * 24 * time.Hour
+	// Default and maximum number of jobs listed by the admin endpoint
+	defaultJobListSize = 100
+	maxJobListSize     = 500
+)
+
+// Job types
+const (
+	jobSendEmail = "send_email"
+	jobImport    = "import"
+)
+
+// jobTimeouts are the times allowed for an attempt of job types that need longer than
+// jobTimeout
+var jobTimeouts = map[string]time.Duration{
+	jobImport: importJobTimeout,
+}
+
+// errPermanentJob marks a job failure that retrying can't fix, such as a payload
+// that doesn't decode. Such jobs are dead-lettered at once.
+var errPermanentJob = errors.New("permanent failure")
+
+// jobHandler runs one job. The context ends when the attempt times out.
+type jobHandler func(ctx context.Context, payload json.RawMessage) error
+
+// jobHandlers maps job types to the functions that run them
+func (app *Config) jobHandlers() map[string]jobHandler {
+	return map[string]jobHandler{
+		jobSendEmail: app.sendEmailJob,
+		jobImport:    app.importJob,
+	}
+}
+
+// enqueueJob adds a job to the queue, to run once at is reached, and wakes the
+// workers. maxAttempts of 0 uses the default.
+func (app *Config) enqueueJob(jobType string, payload interface{}, at time.Time, maxAttempts int) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = jobMaxAttempts
+	}
+
+	job := data.Job{
+		Type:        jobType,
+		Payload:     body,
+		Status:      data.JobPending,
+		MaxAttempts: maxAttempts,
+		RunAt:       at,
+	}
+	if err := app.Models.Job.Enqueue(&job); err != nil {
+		return err
+	}
+
+	// Start on it now rather than at the next poll
+	select {
+	case app.JobWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// jobBackoff is the wait after the given number of failed attempts
+func jobBackoff(attempts int) time.Duration {
+	backoff := jobBaseBackoff
+	for i := 1; i < attempts && backoff < jobMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > jobMaxBackoff {
+		backoff = jobMaxBackoff
+	}
+	return backoff
+}
+
+// runJobs claims due jobs and runs them on a pool of workers until ctx ends. Jobs
+// already claimed are finished before it returns; those not yet claimed stay queued
+// for the next start. Several instances may run it side by side.
+func (app *Config) runJobs(ctx context.Context) {
+	handlers := app.jobHandlers()
+	jobs := make(chan *data.Job)
+
+	var wg sync.WaitGroup
+	for i := 0; i < jobWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				app.runJob(handlers, job)
+			}
+		}()
+	}
+
+	lastPurge := time.Now()
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for ctx.Err() == nil {
+		claimed, err := app.Models.Job.ClaimDue(time.Now(), jobWorkers, jobLease)
+		if err != nil {
+			app.ErrorLog.Printf("Failed to claim jobs: %v", err)
+		}
+		for _, job := range claimed {
+			jobs <- job
+		}
+
+		if time.Since(lastPurge) > time.Hour {
+			lastPurge = time.Now()
+			purged, err := app.Models.Job.Purge(lastPurge.Add(-jobDoneRetention), lastPurge.Add(-jobDeadRetention))
+			if err != nil {
+				app.ErrorLog.Printf("Failed to purge old jobs: %v", err)
+			} else if purged > 0 {
+				app.InfoLog.Printf("Purged %d old jobs", purged)
+			}
+			// Uploads whose import job is gone for good
+			app.purgeImportFiles(lastPurge.Add(-jobDeadRetention))
+		}
+
+		// A full batch means more may be waiting
+		if err == nil && len(claimed) == jobWorkers {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		case <-app.JobWake:
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+}
+
+// runJob runs one attempt of a job and records the outcome. Failed attempts are
+// retried with exponential backoff until the job is dead-lettered.
+func (app *Config) runJob(handlers map[string]jobHandler, job *data.Job) {
+	now := time.Now()
+	job.Attempts++
+
+	var err error
+	if handler, ok := handlers[job.Type]; !ok {
+		err = fmt.Errorf("%w: unknown job type %q", errPermanentJob, job.Type)
+	} else {
+		timeout := jobTimeout
+		if t, ok := jobTimeouts[job.Type]; ok {
+			// Hold the job as long past its timeout as the lease is past jobTimeout
+			timeout = t
+			if err := app.Models.Job.Hold(job.ID, now.Add(t+jobLease-jobTimeout)); err != nil {
+				app.ErrorLog.Printf("Failed to hold job %d: %v", job.ID, err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = handler(ctx, job.Payload)
+		cancel()
+	}
+
+	finished := time.Now()
+	if err == nil {
+		job.Status = data.JobDone
+		job.LastError = ""
+		job.FinishedAt = &finished
+		app.InfoLog.Printf("Job %d (%s) done in %v", job.ID, job.Type, finished.Sub(now))
+	} else {
+		job.LastError = err.Error()
+		if errors.Is(err, errPermanentJob) || job.Attempts >= job.MaxAttempts {
+			job.Status = data.JobDead
+			job.FinishedAt = &finished
+			app.ErrorLog.Printf("Job %d (%s) is dead after %d attempts: %v", job.ID, job.Type, job.Attempts, err)
+		} else {
+			job.RunAt = finished.Add(jobBackoff(job.Attempts))
+			app.ErrorLog.Printf("Job %d (%s) failed, retrying at %s: %v", job.ID, job.Type, job.RunAt.Format(time.RFC3339), err)
+		}
+	}
+
+	if err := app.Models.Job.SaveAttempt(job); err != nil {
+		app.ErrorLog.Printf("Failed to record attempt of job %d: %v", job.ID, err)
+	}
+}
+
+// sendEmailJob sends an email queued by enqueueEmail
+func (app *Config) sendEmailJob(ctx context.Context, payload json.RawMessage) error {
+	var msg email.Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return fmt.Errorf("%w: invalid email payload: %v", errPermanentJob, err)
+	}
+	if err := app.Mailer.Send(ctx, msg); err != nil {
+		return fmt.Errorf("sending %q to %s: %w", msg.Subject, strings.Join(msg.To, ", "), err)
+	}
+	return nil
+}
+
+// AdminGetJobs lists the most recent background jobs, optionally by status
+func (app *Config) AdminGetJobs(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", data.JobPending, data.JobDone, data.JobDead:
+	default:
+		app.errorJSON(w, errors.New("status must be pending, done or dead"), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultJobListSize
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxJobListSize {
+			app.errorJSON(w, fmt.Errorf("limit must be between 1 and %d", maxJobListSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	jobs, err := app.Models.Job.GetJobs(status, limit)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch jobs"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch jobs: %v", err)
+		return
+	}
+
+	if jobs == nil {
+		jobs = []*data.Job{}
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"jobs":  jobs,
+		"count": len(jobs),
+	})
+}
+
+// AdminRetryJob queues a dead-lettered job to run again
+func (app *Config) AdminRetryJob(w http.ResponseWriter, r *http.Request) {
+	id, err := urlID(r, "id")
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid job ID"), http.StatusBadRequest)
+		return
+	}
+
+	requeued, err := app.Models.Job.Retry(id, time.Now())
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to retry job"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to requeue job %d: %v", id, err)
+		return
+	}
+	if !requeued {
+		app.errorJSON(w, errors.New("no dead job with that ID"), http.StatusConflict)
+		return
+	}
+
+	select {
+	case app.JobWake <- struct{}{}:
+	default:
+	}
+
+	app.writeJSON(w, http.StatusAccepted, map[string]string{
+		"message": "Job queued",
+	})
+}
@@ -1,30 +1,100 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"field_eyes/data"
 	"field_eyes/pkg/email"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 const webPort = "8086"
 
-func (app *Config) serve() {
+// Time allowed for requests in progress to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// serve runs the web server until ctx ends, then stops the MQTT subscriptions and
+// waits for requests in progress. It returns an error if the server fails to start.
+func (app *Config) serve(ctx context.Context) error {
 	// Create the server with middleware for sessions
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%s", webPort),
 		Handler: app.Sessions.LoadAndSave(app.routes()),
 	}
-	app.InfoLog.Println("Starting web server...")
-	err := srv.ListenAndServe()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		app.InfoLog.Println("Starting web server...")
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+		app.InfoLog.Println("Shutting down: stopping MQTT subscriptions and draining requests")
+	}
+
+	// Device messages being handled finish first, while the database is still open
+	if app.MQTT != nil {
+		app.MQTT.StopSubscriptions()
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if shutdownErr := srv.Shutdown(shutdownCtx); shutdownErr != nil {
+		app.ErrorLog.Printf("Requests still running after %v, closing their connections: %v", shutdownTimeout, shutdownErr)
+		srv.Close()
+	}
+	return err
+}
+
+// grantAdmin gives the admin role to the user with the given email. It is how the
+// first admin is made, since signup only creates farmers.
+func (app *Config) grantAdmin(email string) error {
+	user, err := app.Models.User.GetByEmail(email)
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	if user == nil {
+		return errors.New("no user with that email")
+	}
+	if err := app.Models.User.UpdateRole(user.ID, data.RoleAdmin); err != nil {
+		return err
+	}
+	app.InfoLog.Printf("User %d (%s) is now an admin", user.ID, email)
+	return nil
+}
+
+// closeConnections closes the database, Redis and MQTT connections, in that order
+func (app *Config) closeConnections() {
+	if app.DB != nil {
+		if sqlDB, err := app.DB.DB(); err != nil {
+			app.ErrorLog.Printf("Error getting the database connection: %v", err)
+		} else if err := sqlDB.Close(); err != nil {
+			app.ErrorLog.Printf("Error closing the database connection: %v", err)
+		}
+	}
+
+	if app.Redis != nil {
+		if err := app.Redis.Close(); err != nil {
+			app.ErrorLog.Printf("Error closing Redis connection: %v", err)
+		}
+	}
+
+	if app.MQTT != nil {
+		app.MQTT.CloseConnection()
 	}
 }
 
@@ -67,6 +137,9 @@ func loadEnvFile() bool {
 }
 
 func main() {
+	makeAdmin := flag.String("make-admin", "", "grant the admin role to the user with this email, then exit")
+	flag.Parse()
+
 	// Load environment variables from .env file
 	envLoaded := loadEnvFile()
 
@@ -87,13 +160,16 @@ func main() {
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 	app := Config{
-		InfoLog:       infoLog,
-		ErrorLog:      errorLog,
-		Wait:          &sync.WaitGroup{},
-		ErrorChan:     make(chan error),
-		ErrorChanDone: make(chan bool),
+		InfoLog:  infoLog,
+		ErrorLog: errorLog,
+		Wait:     &sync.WaitGroup{},
+		JobWake:  make(chan struct{}, 1),
 	}
 
+	// Background work and the web server stop on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Additional debugging info about the environment
 	if envLoaded {
 		app.InfoLog.Println("Environment variables loaded from .env file")
@@ -105,8 +181,11 @@ func main() {
 	// In production, use SMTPMailer
 	app.Mailer = email.NewSMTPMailer()
 
-	// For development/testing, use MockMailer
-	// app.Mailer = &email.MockMailer{}
+	// For development/testing, record emails instead of sending them
+	// app.Mailer = &email.Recorder{Log: infoLog.Printf}
+
+	// Set up the channels notifications are sent over
+	app.initNotifiers()
 
 	// Initialize Redis client
 	redisClient, err := NewRedisClient()
@@ -116,13 +195,6 @@ func main() {
 	} else {
 		app.Redis = redisClient
 		app.InfoLog.Println("Connected to Redis successfully")
-
-		// Defer closing the Redis connection
-		defer func() {
-			if err := redisClient.Close(); err != nil {
-				app.ErrorLog.Printf("Error closing Redis connection: %v", err)
-			}
-		}()
 	}
 
 	// Initialize Session Manager
@@ -135,6 +207,10 @@ func main() {
 
 	app.InfoLog.Println("Session manager initialized")
 
+	// Initialize the live stream hub (shared across replicas through Redis when available)
+	app.Shutdown = ctx
+	app.Stream = newStreamHub(ctx, &app)
+
 	// connect to the database
 	db := app.initDB()
 	app.DB = db
@@ -142,6 +218,25 @@ func main() {
 	// Initialize data models
 	app.Models = data.New(db)
 
+	if *makeAdmin != "" {
+		err := app.grantAdmin(*makeAdmin)
+		app.closeConnections()
+		if err != nil {
+			app.ErrorLog.Fatalf("Failed to make %s an admin: %v", *makeAdmin, err)
+		}
+		return
+	}
+
+	// Seed the built-in alert rules on first start
+	if err := app.Models.AlertRule.SeedDefaultRules(); err != nil {
+		app.ErrorLog.Printf("Failed to seed default alert rules: %v", err)
+	}
+
+	// Seed the built-in crop profiles
+	if err := app.Models.Crop.SeedDefaultCrops(); err != nil {
+		app.ErrorLog.Printf("Failed to seed default crop profiles: %v", err)
+	}
+
 	// Initialize MQTT client
 	mqttClient, err := NewMQTTClient(&app)
 	if err != nil {
@@ -152,16 +247,48 @@ func main() {
 		app.InfoLog.Println("Connected to MQTT broker successfully")
 
 		// Start the MQTT device data listener
-		if err := mqttClient.StartDeviceDataListener(); err != nil {
+		if err := mqttClient.StartDeviceDataListener(ctx); err != nil {
 			app.ErrorLog.Printf("Failed to start MQTT device data listener: %v", err)
 		} else {
 			app.InfoLog.Println("MQTT device data listener started successfully")
 		}
+	}
+
+	// Start marking devices offline when they stop reporting
+	app.runInBackground(ctx, app.sweepDevicePresence)
 
-		// Defer closing the MQTT connection
-		defer mqttClient.CloseConnection()
+	// Warn owners ahead of time when fields will need irrigating
+	app.runInBackground(ctx, app.sweepIrrigationForecasts)
+
+	// Delete expired refresh tokens and revocations
+	app.runInBackground(ctx, app.purgeExpiredTokens)
+
+	// Post queued events to webhooks
+	app.runInBackground(ctx, app.deliverWebhooks)
+
+	// Send queued notifications by email, SMS and web push
+	app.runInBackground(ctx, app.sendNotifications)
+
+	// Email daily and weekly digests to users who asked for them
+	app.runInBackground(ctx, app.sendDigests)
+
+	// Run queued background jobs such as emails
+	app.runInBackground(ctx, app.runJobs)
+
+	err = app.serve(ctx)
+	if err != nil {
+		app.ErrorLog.Printf("Web server failed: %v", err)
 	}
 
-	go app.listenForErrors()
-	app.serve()
+	// Stop the background work too if the server failed, and wait for it to finish
+	stop()
+	app.InfoLog.Println("Waiting for background work to finish")
+	app.Wait.Wait()
+
+	app.closeConnections()
+	app.InfoLog.Println("Shutdown complete")
+
+	if err != nil {
+		os.Exit(1)
+	}
 }
@@ -1,11 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"field_eyes/data"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
@@ -28,8 +28,73 @@ func (app *Config) getJWTSecret() string {
 	return secret
 }
 
-func (app *Config) IsAuthenticated(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// contextKey is the type of values stored in the request context by this package
+type contextKey string
+
+// claimsContextKey holds the authenticated user's claims
+const claimsContextKey contextKey = "claims"
+
+// UserClaims identifies the authenticated user of a request
+type UserClaims struct {
+	UserID    uint
+	Email     string
+	Role      string
+	JTI       string    // unique ID of the access token, used for revocation
+	SessionID string    // refresh token family the access token was issued with
+	ExpiresAt time.Time // when the access token expires
+}
+
+// parseToken validates a JWT and returns its claims
+func (app *Config) parseToken(tokenString string) (*UserClaims, error) {
+	mySigningKey := app.getJWTSecret()
+
+	// Parse and validate the token
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		// Ensure the signing method is HMAC
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("invalid signing method")
+		}
+		return []byte(mySigningKey), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid or expired token")
+	}
+
+	// Extract claims
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("invalid token claims")
+	}
+
+	userID, _ := claims["user_id"].(float64)
+	email, _ := claims["email"].(string)
+	role, _ := claims["role"].(string)
+	jti, _ := claims["jti"].(string)
+	sessionID, _ := claims["sid"].(string)
+	exp, _ := claims["exp"].(float64)
+	// Tokens issued before revocation was introduced carry no jti and must log in again
+	if userID == 0 || jti == "" {
+		return nil, errors.New("invalid token claims")
+	}
+	if role == "" {
+		// Accounts created before roles were introduced are farmers
+		role = data.RoleFarmer
+	}
+
+	return &UserClaims{
+		UserID:    uint(userID),
+		Email:     email,
+		Role:      role,
+		JTI:       jti,
+		SessionID: sessionID,
+		ExpiresAt: time.Unix(int64(exp), 0),
+	}, nil
+}
+
+// IsAuthenticated is a middleware that validates the bearer token and stores
+// the user's claims in the request context
+func (app *Config) IsAuthenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
 			app.errorJSON(w, errors.New("no token found"), http.StatusUnauthorized)
@@ -41,92 +106,139 @@ func (app *Config) IsAuthenticated(handler http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		mySigningKey := app.getJWTSecret()
-
-		// Parse and validate the token
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			// Ensure the signing method is HMAC
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("invalid signing method")
-			}
-			return []byte(mySigningKey), nil
-		})
-		if err != nil || !token.Valid {
-			app.errorJSON(w, errors.New("invalid or expired token"), http.StatusUnauthorized)
+		claims, err := app.parseToken(tokenString)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusUnauthorized)
 			return
 		}
 
-		// Extract claims and set user info in the request header
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			if role, ok := claims["role"].(string); ok {
-				r.Header.Set("Role", role)
-			}
-			if userID, ok := claims["user_id"].(float64); ok {
-				r.Header.Set("UserID", strconv.Itoa(int(userID)))
-			}
+		// Reject tokens revoked by logout or a password reset
+		revoked, err := app.Models.Token.IsRevoked(claims.JTI)
+		if err != nil {
+			app.errorJSON(w, errors.New("failed to verify token"), http.StatusInternalServerError)
+			app.ErrorLog.Printf("Failed to check token revocation: %v", err)
+			return
+		}
+		if revoked {
+			app.errorJSON(w, errors.New("token has been revoked"), http.StatusUnauthorized)
+			return
 		}
 
-		// Call the next handler
-		handler.ServeHTTP(w, r)
-	}
+		// Call the next handler with the claims in the context
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
-func (app *Config) GenerateJWT(user data.User) (string, error) {
-	mySigningKey := app.getJWTSecret()
 
-	claims := jwt.MapClaims{
-		"user_id": user.ID,
-		"email":   user.Email,
-		"role":    user.Role,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
+// RequireRole is a middleware that only lets users with one of the given roles through.
+// It must be mounted after IsAuthenticated.
+func (app *Config) RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := app.userClaims(r)
+			for _, role := range roles {
+				if claims.Role == role {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			app.errorJSON(w, errors.New("forbidden: insufficient role"), http.StatusForbidden)
+		})
 	}
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(mySigningKey))
-	if err != nil {
-		return "", err
+// TokenFromQuery is a middleware that accepts the token as a ?token= query parameter,
+// for clients such as EventSource that cannot set headers
+func (app *Config) TokenFromQuery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" && r.URL.Query().Get("token") != "" {
+			r.Header.Set("Authorization", "Bearer "+r.URL.Query().Get("token"))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// userClaims returns the authenticated user's claims from the request context
+func (app *Config) userClaims(r *http.Request) *UserClaims {
+	claims, ok := r.Context().Value(claimsContextKey).(*UserClaims)
+	if !ok {
+		// Handlers using claims are only mounted behind IsAuthenticated
+		return &UserClaims{}
 	}
+	return claims
+}
 
-	return tokenString, nil
+// canAccessDevice reports whether the user may read (or, with write, change) a device.
+// Admins may access any device, farmers their own, and agronomists may read the
+// devices of the farmers they are assigned to.
+func (app *Config) canAccessDevice(claims *UserClaims, device *data.Device, write bool) bool {
+	return app.canAccessOwner(claims, device.UserID, write)
 }
 
-// GetUserInfoFromToken extracts user information from the JWT token in the Authorization header.
-func (app *Config) GetUserInfoFromToken(r *http.Request) (uint, string, string, error) {
-	// Get the Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		return 0, "", "", errors.New("no token found")
+// canAccessOwner reports whether the user may read (or, with write, change) resources
+// owned by ownerID, following the same rules as canAccessDevice
+func (app *Config) canAccessOwner(claims *UserClaims, ownerID uint, write bool) bool {
+	switch claims.Role {
+	case data.RoleAdmin:
+		return true
+	case data.RoleAgronomist:
+		if write || ownerID == 0 {
+			return false
+		}
+		assigned, err := app.Models.Assignment.IsAssigned(claims.UserID, ownerID)
+		if err != nil {
+			app.ErrorLog.Printf("Failed to check assignment of agronomist %d: %v", claims.UserID, err)
+			return false
+		}
+		return assigned
+	default:
+		return ownerID != 0 && ownerID == claims.UserID
 	}
+}
 
-	// Extract the token from the "Bearer <token>" format
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	if tokenString == authHeader {
-		return 0, "", "", errors.New("invalid token format")
+// visibleOwners returns the users whose devices and farms are listed for the user:
+// themselves, plus the assigned farmers for agronomists
+func (app *Config) visibleOwners(claims *UserClaims) ([]uint, error) {
+	owners := []uint{claims.UserID}
+	if claims.Role == data.RoleAgronomist {
+		farmerIDs, err := app.Models.Assignment.GetFarmerIDs(claims.UserID)
+		if err != nil {
+			return nil, err
+		}
+		owners = append(owners, farmerIDs...)
 	}
+	return owners, nil
+}
 
-	// Get the JWT secret
+// GenerateJWT issues a short-lived access token for a user's session.
+// It returns the token with its jti and expiry so the session can revoke it.
+func (app *Config) GenerateJWT(user data.User, sessionID string) (string, string, time.Time, error) {
 	mySigningKey := app.getJWTSecret()
 
-	// Parse and validate the token
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Ensure the signing method is HMAC
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("invalid signing method")
-		}
-		return []byte(mySigningKey), nil
-	})
-	if err != nil || !token.Valid {
-		return 0, "", "", errors.New("invalid or expired token")
+	jti, err := newTokenID()
+	if err != nil {
+		return "", "", time.Time{}, err
 	}
 
-	// Extract claims
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		userID, _ := claims["user_id"].(float64)
-		email, _ := claims["email"].(string)
-		role, _ := claims["role"].(string)
-		return uint(userID), email, role, nil
+	now := time.Now()
+	expiresAt := now.Add(accessTokenTTL)
+	claims := jwt.MapClaims{
+		"user_id": user.ID,
+		"email":   user.Email,
+		"role":    user.Role,
+		"jti":     jti,
+		"sid":     sessionID,
+		"iat":     now.Unix(),
+		"exp":     expiresAt.Unix(),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString([]byte(mySigningKey))
+	if err != nil {
+		return "", "", time.Time{}, err
 	}
 
-	return 0, "", "", errors.New("invalid token claims")
+	return tokenString, jti, expiresAt, nil
 }
 
 // EnableCORS is a middleware to allow cross-origin requests
@@ -137,6 +249,7 @@ func (app *Config) EnableCORS(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Next-Cursor")
 		w.Header().Set("Access-Control-Max-Age", "3600")
 
 		// Handle preflight requests
@@ -67,7 +67,10 @@ func main() {
 
 	// Migrate the database
 	infoLog.Println("Running migrations...")
-	if err := db.AutoMigrate(&data.User{}, &data.Device{}, &data.DeviceData{}, &data.Notification{}); err != nil {
+	if err := db.AutoMigrate(&data.User{}, &data.Device{}, &data.DeviceData{}, &data.Notification{}, &data.AlertRule{}, &data.AlertState{}, &data.DeviceCommand{}, &data.Assignment{}, &data.RefreshToken{}, &data.RevokedToken{}, &data.Farm{}, &data.Field{}, &data.CropProfile{}, &data.CropStage{}, &data.ImportJob{}, &data.Webhook{}, &data.WebhookDelivery{}, &data.NotificationPreference{}, &data.PushSubscription{}, &data.NotificationDelivery{}, &data.Job{}); err != nil {
+		errorLog.Fatalf("Migration failed: %v", err)
+	}
+	if err := data.RunMigrations(db); err != nil {
 		errorLog.Fatalf("Migration failed: %v", err)
 	}
 	infoLog.Println("Migrations completed successfully!")
@@ -1,10 +1,14 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"field_eyes/data"
@@ -14,170 +18,419 @@ import (
 
 // MQTTClient represents the MQTT client with its associated configuration
 type MQTTClient struct {
-	client     mqtt.Client
-	app        *Config
-	topicRoot  string
-	bufferSize int
+	client        mqtt.Client
+	app           *Config
+	topicRoot     string
+	bufferSize    int
+	chunks        *chunkAssembler
+	subscriptions []mqttSubscription
+	cleanSession  bool
+
+	mu       sync.RWMutex
+	stopped  bool           // set once subscriptions are stopped for shutdown
+	handling sync.WaitGroup // messages being handled
 }
 
-// Message buffer for reassembling multi-part messages
-type messageBuffer struct {
-	Parts        map[int][]byte
-	TotalParts   int
-	ReceivedTime time.Time
-	IsComplete   bool
+// mqttSubscription is a topic the server listens on
+type mqttSubscription struct {
+	topic   string
+	qos     byte
+	handler mqtt.MessageHandler
 }
 
-// Map to store message buffers by device serial number
-var messageBuffers = make(map[string]*messageBuffer)
+// defaultMQTTQoS is the QoS of subscriptions without their own setting. At least once
+// delivery lets the broker queue readings for a persistent session; redelivered
+// readings are dropped as duplicates.
+const defaultMQTTQoS = 1
 
-// NewMQTTClient creates a new MQTT client with the provided configuration
+// mqttAckTimeout is how long a subscribe or unsubscribe waits for the broker's answer
+const mqttAckTimeout = 5 * time.Second
+
+// mqttBrokerURL returns MQTT_BROKER_URL, such as mqtts://broker:8883, or builds the URL
+// from MQTT_BROKER and MQTT_PORT, over TLS if MQTT_TLS is true
+func mqttBrokerURL() string {
+	if url := os.Getenv("MQTT_BROKER_URL"); url != "" {
+		return url
+	}
+	scheme := "tcp"
+	if os.Getenv("MQTT_TLS") == "true" {
+		scheme = "ssl"
+	}
+	return fmt.Sprintf("%s://%s:%s", scheme, os.Getenv("MQTT_BROKER"), os.Getenv("MQTT_PORT"))
+}
+
+// mqttTLSConfig loads the CA in MQTT_CA_FILE and the client certificate in
+// MQTT_CERT_FILE and MQTT_KEY_FILE. It returns nil when none is set, leaving TLS
+// connections to the system roots.
+func mqttTLSConfig() (*tls.Config, error) {
+	caFile := os.Getenv("MQTT_CA_FILE")
+	certFile := os.Getenv("MQTT_CERT_FILE")
+	keyFile := os.Getenv("MQTT_KEY_FILE")
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MQTT_CA_FILE: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in MQTT_CA_FILE %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("MQTT_CERT_FILE and MQTT_KEY_FILE must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the MQTT client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// mqttQoS reads a QoS level of 0, 1 or 2 from the named variable, falling back to
+// MQTT_QOS and then to the default
+func (app *Config) mqttQoS(name string) byte {
+	for _, key := range []string{name, "MQTT_QOS"} {
+		v := os.Getenv(key)
+		if v == "" {
+			continue
+		}
+		if qos, err := strconv.Atoi(v); err == nil && qos >= 0 && qos <= 2 {
+			return byte(qos)
+		}
+		app.ErrorLog.Printf("Invalid %s %q, QoS must be 0, 1 or 2", key, v)
+	}
+	return defaultMQTTQoS
+}
+
+// mqttClientID returns MQTT_CLIENT_ID, or an ID derived from the host name. The ID must
+// stay the same across restarts for the broker to keep the session.
+func mqttClientID() string {
+	if id := os.Getenv("MQTT_CLIENT_ID"); id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "local"
+	}
+	return "field_eyes_server_" + host
+}
+
+// NewMQTTClient creates a new MQTT client with the provided configuration and connects
+// it. Subscriptions are made, and remade after every reconnect, by onConnect.
 func NewMQTTClient(app *Config) (*MQTTClient, error) {
-	brokerURL := fmt.Sprintf("tcp://%s:%s", os.Getenv("MQTT_BROKER"), os.Getenv("MQTT_PORT"))
-	clientID := fmt.Sprintf("field_eyes_server_%d_%d", time.Now().UnixNano(), os.Getpid())
+	brokerURL := mqttBrokerURL()
+	clientID := mqttClientID()
 	topicRoot := os.Getenv("MQTT_TOPIC_ROOT")
 	if topicRoot == "" {
 		topicRoot = "field_eyes/devices"
 	}
 
+	maxMessageSize := defaultMaxChunkedMessageSize
+	if v := os.Getenv("MQTT_MAX_MESSAGE_SIZE"); v != "" {
+		if size, err := strconv.Atoi(v); err == nil && size > 0 {
+			maxMessageSize = size
+		} else {
+			app.ErrorLog.Printf("Invalid MQTT_MAX_MESSAGE_SIZE %q, using default of %d bytes", v, maxMessageSize)
+		}
+	}
+
+	tlsConfig, err := mqttTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MQTTClient{
+		app:        app,
+		topicRoot:  topicRoot,
+		bufferSize: 4096, // 4KB buffer size
+		chunks:     newChunkAssembler(maxMessageSize),
+	}
+	m.subscriptions = []mqttSubscription{
+		// Standard single-message data format
+		{fmt.Sprintf("%s/+/data", topicRoot), app.mqttQoS("MQTT_DATA_QOS"), m.track(m.handleDeviceData)},
+		// Chunked data format
+		{fmt.Sprintf("%s/+/chunked/#", topicRoot), app.mqttQoS("MQTT_CHUNKED_QOS"), m.track(m.handleChunkedData)},
+		// Command acknowledgements
+		{fmt.Sprintf("%s/+/cmd/ack", topicRoot), app.mqttQoS("MQTT_ACK_QOS"), m.track(m.handleCommandAck)},
+		// Device status messages (including last-will "offline")
+		{fmt.Sprintf("%s/+/status", topicRoot), app.mqttQoS("MQTT_STATUS_QOS"), m.track(m.handleDeviceStatus)},
+	}
+
+	// A persistent session has the broker queue messages while the server is down
+	cleanSession := os.Getenv("MQTT_CLEAN_SESSION") == "true"
+	m.cleanSession = cleanSession
+
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(brokerURL)
 	opts.SetClientID(clientID)
+	opts.SetUsername(os.Getenv("MQTT_USERNAME"))
+	opts.SetPassword(os.Getenv("MQTT_PASSWORD"))
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
 	opts.SetKeepAlive(60 * time.Second)
 	opts.SetPingTimeout(1 * time.Second)
-	opts.SetCleanSession(true)
+	opts.SetCleanSession(cleanSession)
 	opts.SetAutoReconnect(true)
+	opts.SetOnConnectHandler(m.onConnect)
 	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
 		app.ErrorLog.Printf("MQTT connection lost: %v", err)
 	})
+	opts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		app.InfoLog.Printf("Reconnecting to MQTT broker %s", brokerURL)
+	})
+
+	m.client = mqtt.NewClient(opts)
+
+	// Queued messages of a resumed session arrive before the subscriptions are
+	// renewed, so the handlers are routed up front
+	for _, sub := range m.subscriptions {
+		m.client.AddRoute(sub.topic, sub.handler)
+	}
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
+	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
 		return nil, fmt.Errorf("failed to connect: %v", token.Error())
 	}
+	app.InfoLog.Printf("MQTT client %s connected to %s (clean session: %t)", clientID, brokerURL, cleanSession)
 
-	return &MQTTClient{
-		client:     client,
-		app:        app,
-		topicRoot:  topicRoot,
-		bufferSize: 4096, // 4KB buffer size
-	}, nil
+	return m, nil
 }
 
-// StartDeviceDataListener starts the MQTT subscription for device data
-func (m *MQTTClient) StartDeviceDataListener() error {
-	// Subscribe to standard single-message data format
-	dataTopic := fmt.Sprintf("%s/+/data", m.topicRoot)
-	if err := m.Subscribe(dataTopic, m.handleDeviceData); err != nil {
-		return fmt.Errorf("failed to subscribe to topic %s: %v", dataTopic, err)
+// onConnect subscribes to the device topics on every connect, so an automatic
+// reconnect doesn't leave the server deaf when the broker has dropped the session
+func (m *MQTTClient) onConnect(client mqtt.Client) {
+	// Subscribe without holding the lock: acknowledgements may wait on message handlers,
+	// which take it too, and StopSubscriptions must not wait on the broker
+	m.mu.RLock()
+	stopped := m.stopped
+	subscriptions := append([]mqttSubscription(nil), m.subscriptions...)
+	m.mu.RUnlock()
+	if stopped {
+		return
 	}
-	m.app.InfoLog.Printf("MQTT client subscribed to topic: %s", dataTopic)
 
-	// Subscribe to chunked data format
-	chunkedTopic := fmt.Sprintf("%s/+/chunked/#", m.topicRoot)
-	if err := m.Subscribe(chunkedTopic, m.handleChunkedData); err != nil {
-		return fmt.Errorf("failed to subscribe to topic %s: %v", chunkedTopic, err)
+	for _, sub := range subscriptions {
+		if err := m.Subscribe(sub.topic, sub.qos, sub.handler); err != nil {
+			m.app.ErrorLog.Printf("Failed to subscribe to topic %s: %v", sub.topic, err)
+			continue
+		}
+		m.app.InfoLog.Printf("MQTT client subscribed to topic: %s (QoS %d)", sub.topic, sub.qos)
 	}
-	m.app.InfoLog.Printf("MQTT client subscribed to topic: %s", chunkedTopic)
+}
 
+// StartDeviceDataListener starts the background work of the MQTT listener, which
+// runs until ctx ends
+func (m *MQTTClient) StartDeviceDataListener(ctx context.Context) error {
 	// Start a goroutine to clean up stale message buffers
-	go m.cleanupStaleBuffers()
+	m.app.runInBackground(ctx, m.cleanupStaleBuffers)
+
+	// Start a goroutine to retry and expire device commands
+	m.app.runInBackground(ctx, m.retryCommands)
 
 	return nil
 }
 
-// handleDeviceData processes incoming device data messages (single message format)
+// track counts a handler's messages while they are handled, so StopSubscriptions can
+// wait for them. Messages arriving after the subscriptions are stopped are dropped.
+func (m *MQTTClient) track(handler mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		m.mu.RLock()
+		if m.stopped {
+			m.mu.RUnlock()
+			return
+		}
+		m.handling.Add(1)
+		m.mu.RUnlock()
+
+		defer m.handling.Done()
+		handler(client, msg)
+	}
+}
+
+// StopSubscriptions stops taking device messages and waits for those being handled.
+// A clean session is unsubscribed, keeping the connection for publishing commands
+// until CloseConnection. A persistent session is disconnected instead, so the broker
+// keeps its subscriptions and queues messages for the next start.
+func (m *MQTTClient) StopSubscriptions() {
+	m.mu.Lock()
+	m.stopped = true
+	m.mu.Unlock()
+
+	if m.cleanSession {
+		topics := make([]string, 0, len(m.subscriptions))
+		for _, sub := range m.subscriptions {
+			topics = append(topics, sub.topic)
+		}
+		token := m.client.Unsubscribe(topics...)
+		if !token.WaitTimeout(mqttAckTimeout) {
+			m.app.ErrorLog.Printf("Timed out unsubscribing from MQTT topics")
+		} else if token.Error() != nil {
+			m.app.ErrorLog.Printf("Failed to unsubscribe from MQTT topics: %v", token.Error())
+		}
+	} else {
+		m.CloseConnection()
+	}
+
+	m.handling.Wait()
+	m.app.InfoLog.Println("MQTT subscriptions stopped")
+}
+
+// handleDeviceData processes incoming device data messages (single message format),
+// which hold one reading or a batch
 func (m *MQTTClient) handleDeviceData(client mqtt.Client, msg mqtt.Message) {
-	var logEntry data.DeviceData
-	if err := json.Unmarshal(msg.Payload(), &logEntry); err != nil {
+	// Topic format: root/serialnumber/data
+	topicSerial := strings.TrimSuffix(strings.TrimPrefix(msg.Topic(), m.topicRoot+"/"), "/data")
+
+	serialNumber, readings, envelope, err := decodeMessage(msg.Payload(), topicSerial)
+	if err != nil {
 		m.app.ErrorLog.Printf("Error unmarshaling device data: %v", err)
 		return
 	}
 
-	if err := m.processDeviceData(&logEntry); err != nil {
+	if err := m.processDeviceData(serialNumber, readings, envelope); err != nil {
 		m.app.ErrorLog.Printf("Error processing device data: %v", err)
 	}
 }
 
-// handleChunkedData processes incoming chunked device data messages
+// handleChunkedData collects the parts of a chunked device data message and
+// processes the reassembled payload once every part has arrived.
+// Topic format: root/serialnumber/chunked/[messageid/]total/part
 func (m *MQTTClient) handleChunkedData(client mqtt.Client, msg mqtt.Message) {
 	topic := msg.Topic()
-	m.app.InfoLog.Printf("Received chunked MQTT message on topic: %s", topic)
 
-	// Parse the topic to extract information (format: root/serialnumber/chunked/total/part)
-	parts := strings.Split(topic, "/")
-	if len(parts) < 6 {
-		m.app.ErrorLog.Printf("Invalid chunked topic format: %s", topic)
+	serialNumber, messageID, total, part, err := m.parseChunkedTopic(topic)
+	if err != nil {
+		m.app.ErrorLog.Printf("Invalid chunked topic format: %s: %v", topic, err)
 		return
 	}
 
-	var logEntry data.DeviceData
-	if err := json.Unmarshal(msg.Payload(), &logEntry); err != nil {
-		m.app.ErrorLog.Printf("Error unmarshaling device data: %v", err)
+	payload, err := m.chunks.Add(serialNumber, messageID, total, part, msg.Payload())
+	if err != nil {
+		m.app.ErrorLog.Printf("Dropping chunk %d/%d for device %s: %v", part, total, serialNumber, err)
+		return
+	}
+	if payload == nil {
+		// Still waiting for more parts (or a duplicate was ignored)
+		return
+	}
+
+	m.app.InfoLog.Printf("Reassembled %d-part message (%d bytes) for device %s", total, len(payload), serialNumber)
+
+	// The topic identifies the device if the payload doesn't
+	serialNumber, readings, envelope, err := decodeMessage(payload, serialNumber)
+	if err != nil {
+		m.app.ErrorLog.Printf("Error unmarshaling reassembled device data: %v", err)
 		return
 	}
 
-	if err := m.processDeviceData(&logEntry); err != nil {
+	if err := m.processDeviceData(serialNumber, readings, envelope); err != nil {
 		m.app.ErrorLog.Printf("Error processing chunked device data: %v", err)
 	}
 }
 
-// cleanupStaleBuffers removes old incomplete message buffers
-func (m *MQTTClient) cleanupStaleBuffers() {
+// parseChunkedTopic extracts the serial number, optional message ID, total and part
+// number from a chunked data topic
+func (m *MQTTClient) parseChunkedTopic(topic string) (serialNumber, messageID string, total, part int, err error) {
+	rest := strings.TrimPrefix(topic, m.topicRoot+"/")
+	if rest == topic {
+		return "", "", 0, 0, fmt.Errorf("topic is not under %s", m.topicRoot)
+	}
+
+	parts := strings.Split(rest, "/")
+	if len(parts) != 4 && len(parts) != 5 {
+		return "", "", 0, 0, fmt.Errorf("unexpected number of topic levels")
+	}
+	if parts[0] == "" || parts[1] != "chunked" {
+		return "", "", 0, 0, fmt.Errorf("missing serial number or chunked level")
+	}
+
+	serialNumber = parts[0]
+	if len(parts) == 5 {
+		messageID = parts[2]
+	}
+
+	total, err = strconv.Atoi(parts[len(parts)-2])
+	if err != nil {
+		return "", "", 0, 0, fmt.Errorf("invalid chunk total: %v", err)
+	}
+	part, err = strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return "", "", 0, 0, fmt.Errorf("invalid chunk number: %v", err)
+	}
+
+	return serialNumber, messageID, total, part, nil
+}
+
+// cleanupStaleBuffers removes old incomplete message buffers and reports the counters
+func (m *MQTTClient) cleanupStaleBuffers(ctx context.Context) {
 	ticker := time.NewTicker(10 * time.Minute)
-	for range ticker.C {
-		now := time.Now()
-		for serialNumber, buffer := range messageBuffers {
-			// If buffer is older than 1 hour and not complete, remove it
-			if now.Sub(buffer.ReceivedTime) > time.Hour && !buffer.IsComplete {
-				fmt.Printf("Cleaning up stale message buffer for device %s\n", serialNumber)
-				delete(messageBuffers, serialNumber)
-			}
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 
-			// If buffer is complete and older than 5 minutes, remove it
-			if buffer.IsComplete && now.Sub(buffer.ReceivedTime) > 5*time.Minute {
-				delete(messageBuffers, serialNumber)
-			}
+		expired := m.chunks.Cleanup(time.Now())
+		for _, key := range expired {
+			m.app.ErrorLog.Printf("Discarded incomplete chunked message %s", key)
 		}
+
+		stats := m.chunks.Stats()
+		m.app.InfoLog.Printf("Chunked MQTT messages: pending=%d completed=%d expired=%d duplicates=%d rejected=%d restarted=%d evicted=%d",
+			stats.Pending, stats.Completed, stats.Expired, stats.Duplicates, stats.Rejected, stats.Restarted, stats.Evicted)
 	}
 }
 
 // processDeviceData handles the device data logging logic (reusing logic from HTTP endpoint)
-func (m *MQTTClient) processDeviceData(logEntry *data.DeviceData) error {
+func (m *MQTTClient) processDeviceData(serialNumber string, readings []*data.DeviceData, envelope *signedReading) error {
+	if serialNumber == "" {
+		return fmt.Errorf("reading without a serial number")
+	}
+
 	// Check if the device exists
-	device, err := m.app.Models.Device.GetBySerialNumber(logEntry.SerialNumber)
-	if err != nil {
+	device, err := m.app.Models.Device.GetBySerialNumber(serialNumber)
+	if err == nil && device != nil {
+		if err := authenticateDeviceMessage(device, envelope); err != nil {
+			return fmt.Errorf("rejected data for device %s: %v", serialNumber, err)
+		}
+	} else if deviceAuthStrict() {
+		return fmt.Errorf("rejected data for unknown device %s", serialNumber)
+	} else {
 		// Auto-register the device
 		device = &data.Device{
 			DeviceType:   "auto_registered",
-			SerialNumber: logEntry.SerialNumber,
+			SerialNumber: serialNumber,
 		}
 		if err := m.app.Models.Device.CreateDevice(device); err != nil {
 			return fmt.Errorf("failed to auto-register device: %v", err)
 		}
-		m.app.InfoLog.Printf("Auto-registered device: %s", logEntry.SerialNumber)
+		m.app.InfoLog.Printf("Auto-registered device: %s", serialNumber)
 	}
 
-	// Link the log entry to the device
-	logEntry.DeviceID = device.ID
-
-	// Save the log entry
-	if err := m.app.Models.DeviceData.CreateLog(logEntry); err != nil {
+	// Flag, save and follow up the readings
+	result, err := m.app.storeReadings(device, readings)
+	if err != nil {
 		return fmt.Errorf("failed to save device data: %v", err)
 	}
-
-	// Invalidate cache if Redis is available
-	if m.app.Redis != nil {
-		if err := m.app.Redis.InvalidateDeviceLogsCache(device.ID); err != nil {
-			m.app.ErrorLog.Printf("Failed to invalidate device logs cache: %v", err)
-		}
-		cacheKey := fmt.Sprintf("device_logs_serial:%s", logEntry.SerialNumber)
-		if err := m.app.Redis.InvalidateCache(cacheKey); err != nil {
-			m.app.ErrorLog.Printf("Failed to invalidate device logs by serial cache: %v", err)
-		}
+	for _, r := range result.Rejected {
+		m.app.ErrorLog.Printf("Dropped reading %d from device %s: %s", r.Index, serialNumber, r.Error)
 	}
 
-	m.app.InfoLog.Printf("Successfully logged data for device: %s", logEntry.SerialNumber)
+	// QoS 1 redelivers messages the broker isn't sure arrived
+	if len(result.Duplicates) > 0 {
+		m.app.InfoLog.Printf("Skipped %d duplicate readings for device: %s", len(result.Duplicates), serialNumber)
+	}
+	m.app.InfoLog.Printf("Successfully logged %d readings for device: %s", len(result.Stored), serialNumber)
 	return nil
 }
 
@@ -188,7 +441,7 @@ func (m *MQTTClient) CloseConnection() {
 	}
 }
 
-func (app *Config) connectMQTT() error {
+func (app *Config) connectMQTT(ctx context.Context) error {
 	mqttClient, err := NewMQTTClient(app)
 	if err != nil {
 		return fmt.Errorf("failed to connect to MQTT broker: %v", err)
@@ -198,22 +451,26 @@ func (app *Config) connectMQTT() error {
 	app.InfoLog.Printf("Connected to MQTT broker successfully")
 
 	// Start listening for device data
-	if err := mqttClient.StartDeviceDataListener(); err != nil {
+	if err := mqttClient.StartDeviceDataListener(ctx); err != nil {
 		return fmt.Errorf("failed to start device data listener: %v", err)
 	}
 
 	return nil
 }
 
-func (m *MQTTClient) Subscribe(topic string, handler mqtt.MessageHandler) error {
-	if token := m.client.Subscribe(topic, 0, handler); token.Wait() && token.Error() != nil {
+func (m *MQTTClient) Subscribe(topic string, qos byte, handler mqtt.MessageHandler) error {
+	token := m.client.Subscribe(topic, qos, handler)
+	if !token.WaitTimeout(mqttAckTimeout) {
+		return fmt.Errorf("subscribe error: no answer from the broker after %v", mqttAckTimeout)
+	}
+	if token.Error() != nil {
 		return fmt.Errorf("subscribe error: %v", token.Error())
 	}
 	return nil
 }
 
-func (m *MQTTClient) Publish(topic string, payload interface{}) error {
-	if token := m.client.Publish(topic, 0, false, payload); token.Wait() && token.Error() != nil {
+func (m *MQTTClient) Publish(topic string, qos byte, payload interface{}) error {
+	if token := m.client.Publish(topic, qos, false, payload); token.Wait() && token.Error() != nil {
 		return fmt.Errorf("publish error: %v", token.Error())
 	}
 	return nil
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"field_eyes/data"
+	"field_eyes/pkg/notify"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the outbox is checked for notifications to send
+	notificationPollInterval = 5 * time.Second
+	// Number of deliveries claimed, and sent in parallel, at a time
+	notificationBatchSize = 20
+	// How long a claimed delivery is held before another worker may retry it
+	notificationLease = 2 * time.Minute
+	// Time allowed for one send
+	notificationSendTimeout = 20 * time.Second
+	// Time allowed for a push service to answer
+	pushTimeout = 15 * time.Second
+	// Attempts before a delivery is given up
+	notificationMaxAttempts = 5
+	// Wait before the first retry, doubled after each failed attempt
+	notificationBaseBackoff = time.Minute
+	// How long finished deliveries are kept
+	notificationRetention = 30 * 24 * time.Hour
+)
+
+// phonePattern matches an E.164 phone number
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// notificationSeverities are the severities channels are chosen for
+var notificationSeverities = []string{data.SeverityInfo, data.SeverityWarning, data.SeverityAlert}
+
+// defaultNotificationChannels applies to users who haven't set preferences: only
+// alerts leave the app, by email
+var defaultNotificationChannels = map[string][]string{
+	data.SeverityAlert: {notify.ChannelEmail},
+}
+
+// notificationPreferenceRequest is the body accepted when saving preferences
+type notificationPreferenceRequest struct {
+	Phone    string              `json:"phone"`
+	Channels map[string][]string `json:"channels"`
+	Digest   string              `json:"digest"`
+}
+
+// initNotifiers sets up the channels notifications can be sent over. Email uses the
+// mailer; SMS and web push are enabled by their environment variables.
+func (app *Config) initNotifiers() {
+	app.Notifiers = map[string]notify.Notifier{
+		notify.ChannelEmail: &notify.EmailNotifier{Mailer: app.Mailer},
+	}
+
+	if os.Getenv("SMS_GATEWAY") == "fake" {
+		// Texts are logged instead of sent, for local development
+		app.Notifiers[notify.ChannelSMS] = &notify.Recorder{Log: app.InfoLog.Printf}
+		app.InfoLog.Println("SMS notifications are logged by the fake gateway")
+	} else if gateway, err := notify.NewSMSGatewayFromEnv(); err != nil {
+		app.ErrorLog.Printf("SMS notifications disabled: %v", err)
+	} else if gateway != nil {
+		app.Notifiers[notify.ChannelSMS] = gateway
+	}
+
+	if key := os.Getenv("VAPID_PRIVATE_KEY"); key != "" {
+		subject := os.Getenv("VAPID_SUBJECT")
+		if subject == "" && os.Getenv("SMTP_FROM") != "" {
+			subject = "mailto:" + os.Getenv("SMTP_FROM")
+		}
+		webPush, err := notify.NewWebPush(key, subject)
+		if err != nil {
+			app.ErrorLog.Printf("Web push notifications disabled: %v", err)
+		} else {
+			// Push endpoints come from browsers, so users choose where they point
+			webPush.Client = newPublicClient(pushTimeout)
+			app.WebPush = webPush
+			app.Notifiers[notify.ChannelPush] = webPush
+		}
+	}
+}
+
+// availableChannels lists the channels this server can send over
+func (app *Config) availableChannels() []string {
+	var channels []string
+	for _, channel := range []string{notify.ChannelEmail, notify.ChannelSMS, notify.ChannelPush} {
+		if app.Notifiers[channel] != nil {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// notificationSeverity maps a notification type to the severity its channels are
+// chosen by. Success and unknown types count as info.
+func notificationSeverity(notificationType string) string {
+	switch notificationType {
+	case data.SeverityWarning, data.SeverityAlert:
+		return notificationType
+	}
+	return data.SeverityInfo
+}
+
+// notificationMessage is how a notification reads outside the app
+func notificationMessage(notification *data.Notification) notify.Message {
+	severity := notificationSeverity(notification.Type)
+	title := "Field Eyes " + severity
+	if notification.DeviceName != "" {
+		title = fmt.Sprintf("%s%s from %s", strings.ToUpper(severity[:1]), severity[1:], notification.DeviceName)
+	}
+	return notify.Message{
+		Title:    title,
+		Body:     notification.Message,
+		Severity: severity,
+		Tag:      fmt.Sprintf("notification-%d", notification.ID),
+		Device:   notification.DeviceName,
+		Time:     notification.CreatedAt,
+	}
+}
+
+// dispatchNotification queues a notification for the channels its owner chose for
+// its severity. The deliveries are sent by sendNotifications; failing to queue them
+// is logged rather than failing the caller.
+func (app *Config) dispatchNotification(notification *data.Notification) {
+	if notification.UserID == 0 {
+		return
+	}
+
+	preference, err := app.Models.Notification.GetPreference(notification.UserID)
+	if err != nil {
+		app.ErrorLog.Printf("Failed to load notification preferences of user %d: %v", notification.UserID, err)
+		return
+	}
+	channels := defaultNotificationChannels
+	phone := ""
+	if preference != nil {
+		channels = preference.Channels
+		phone = preference.Phone
+	}
+
+	now := time.Now()
+	var deliveries []*data.NotificationDelivery
+	queue := func(channel, address string, subscriptionID *uint) {
+		deliveries = append(deliveries, &data.NotificationDelivery{
+			NotificationID:     notification.ID,
+			UserID:             notification.UserID,
+			Channel:            channel,
+			Address:            address,
+			PushSubscriptionID: subscriptionID,
+			Status:             data.DeliveryPending,
+			NextAttemptAt:      now,
+		})
+	}
+
+	for _, channel := range channels[notificationSeverity(notification.Type)] {
+		if app.Notifiers[channel] == nil {
+			continue
+		}
+		switch channel {
+		case notify.ChannelEmail:
+			user, err := app.Models.User.GetOne(notification.UserID)
+			if err != nil || user == nil {
+				app.ErrorLog.Printf("Failed to load user %d to email notification %d: %v", notification.UserID, notification.ID, err)
+				continue
+			}
+			queue(channel, user.Email, nil)
+		case notify.ChannelSMS:
+			if phone != "" {
+				queue(channel, phone, nil)
+			}
+		case notify.ChannelPush:
+			subscriptions, err := app.Models.Notification.GetPushSubscriptions(notification.UserID)
+			if err != nil {
+				app.ErrorLog.Printf("Failed to load push subscriptions of user %d: %v", notification.UserID, err)
+				continue
+			}
+			for _, subscription := range subscriptions {
+				id := subscription.ID
+				queue(channel, subscription.Endpoint, &id)
+			}
+		}
+	}
+
+	if err := app.Models.Notification.EnqueueDeliveries(deliveries); err != nil {
+		app.ErrorLog.Printf("Failed to queue deliveries of notification %d: %v", notification.ID, err)
+	}
+}
+
+// notificationBackoff is the wait after the given number of failed attempts
+func notificationBackoff(attempts int) time.Duration {
+	return notificationBaseBackoff << (attempts - 1)
+}
+
+// sendNotifications sends due deliveries from the outbox until it is drained, then
+// waits for the next poll, until ctx ends. Several instances may run it side by side.
+func (app *Config) sendNotifications(ctx context.Context) {
+	lastPurge := time.Now()
+
+	ticker := time.NewTicker(notificationPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			deliveries, err := app.Models.Notification.ClaimDueDeliveries(time.Now(), notificationBatchSize, notificationLease)
+			if err != nil {
+				app.ErrorLog.Printf("Failed to load notification deliveries: %v", err)
+				break
+			}
+
+			var wg sync.WaitGroup
+			for _, delivery := range deliveries {
+				wg.Add(1)
+				go func(delivery *data.NotificationDelivery) {
+					defer wg.Done()
+					app.sendNotification(delivery)
+				}(delivery)
+			}
+			wg.Wait()
+
+			// Deliveries not yet claimed are left for the next start
+			if len(deliveries) < notificationBatchSize || ctx.Err() != nil {
+				break
+			}
+		}
+
+		if time.Since(lastPurge) > time.Hour {
+			lastPurge = time.Now()
+			purged, err := app.Models.Notification.PurgeDeliveries(lastPurge.Add(-notificationRetention))
+			if err != nil {
+				app.ErrorLog.Printf("Failed to purge old notification deliveries: %v", err)
+			} else if purged > 0 {
+				app.InfoLog.Printf("Purged %d old notification deliveries", purged)
+			}
+		}
+	}
+}
+
+// sendNotification sends one delivery and records the outcome. Failed attempts are
+// retried with exponential backoff; addresses that no longer exist are not.
+func (app *Config) sendNotification(delivery *data.NotificationDelivery) {
+	now := time.Now()
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+
+	err := app.sendDelivery(delivery)
+	if err == nil {
+		delivery.Status = data.DeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+	} else {
+		delivery.LastError = err.Error()
+		if errors.Is(err, notify.ErrGone) {
+			delivery.Attempts = notificationMaxAttempts
+			if delivery.PushSubscriptionID != nil {
+				if err := app.Models.Notification.DeletePushSubscriptionByID(*delivery.PushSubscriptionID); err != nil {
+					app.ErrorLog.Printf("Failed to delete expired push subscription %d: %v", *delivery.PushSubscriptionID, err)
+				}
+			}
+		}
+		if delivery.Attempts >= notificationMaxAttempts {
+			delivery.Status = data.DeliveryDead
+			app.ErrorLog.Printf("Gave up on %s delivery %d of notification %d after %d attempts: %v",
+				delivery.Channel, delivery.ID, delivery.NotificationID, delivery.Attempts, err)
+		} else {
+			delivery.NextAttemptAt = now.Add(notificationBackoff(delivery.Attempts))
+		}
+	}
+
+	if err := app.Models.Notification.SaveDeliveryAttempt(delivery); err != nil {
+		app.ErrorLog.Printf("Failed to record notification delivery %d: %v", delivery.ID, err)
+	}
+}
+
+// sendDelivery sends a delivery's notification over its channel
+func (app *Config) sendDelivery(delivery *data.NotificationDelivery) error {
+	notifier := app.Notifiers[delivery.Channel]
+	if notifier == nil {
+		return fmt.Errorf("%s notifications are not enabled", delivery.Channel)
+	}
+
+	notification, err := app.Models.Notification.GetNotification(delivery.NotificationID)
+	if err != nil {
+		return err
+	}
+	if notification == nil {
+		return fmt.Errorf("the notification was deleted: %w", notify.ErrGone)
+	}
+
+	var to notify.Recipient
+	switch delivery.Channel {
+	case notify.ChannelEmail:
+		to.Email = delivery.Address
+		user, err := app.Models.User.GetOne(delivery.UserID)
+		if err != nil {
+			return err
+		}
+		if user != nil {
+			to.Locale = user.Locale
+		}
+	case notify.ChannelSMS:
+		to.Phone = delivery.Address
+	case notify.ChannelPush:
+		if delivery.PushSubscriptionID == nil {
+			return fmt.Errorf("no push subscription: %w", notify.ErrGone)
+		}
+		subscription, err := app.Models.Notification.GetPushSubscription(*delivery.PushSubscriptionID)
+		if err != nil {
+			return err
+		}
+		if subscription == nil {
+			return fmt.Errorf("the push subscription was removed: %w", notify.ErrGone)
+		}
+		to.Push = &notify.PushSubscription{Endpoint: subscription.Endpoint}
+		to.Push.Keys.P256dh = subscription.P256dh
+		to.Push.Keys.Auth = subscription.Auth
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notificationSendTimeout)
+	defer cancel()
+	return notifier.Send(ctx, to, notificationMessage(notification))
+}
+
+// GetNotificationPreferences returns the user's notification channels, the channels
+// the server supports and the user's push subscriptions
+func (app *Config) GetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID := app.userClaims(r).UserID
+
+	preference, err := app.Models.Notification.GetPreference(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch notification preferences"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch notification preferences: %v", err)
+		return
+	}
+	if preference == nil {
+		preference = &data.NotificationPreference{UserID: userID, Channels: defaultNotificationChannels}
+	}
+
+	subscriptions, err := app.Models.Notification.GetPushSubscriptions(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch notification preferences"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch push subscriptions: %v", err)
+		return
+	}
+	if subscriptions == nil {
+		subscriptions = []*data.PushSubscription{}
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"preferences":        preference,
+		"available_channels": app.availableChannels(),
+		"push_subscriptions": subscriptions,
+	})
+}
+
+// UpdateNotificationPreferences replaces the channels the user is notified over for
+// each severity, their phone number for SMS and how often they get a digest email
+func (app *Config) UpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	var request notificationPreferenceRequest
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	if request.Phone != "" && !phonePattern.MatchString(request.Phone) {
+		app.errorJSON(w, errors.New("phone must be in international format, e.g. +254712345678"), http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := digestPeriods[request.Digest]; !ok && request.Digest != "" {
+		app.errorJSON(w, fmt.Errorf("digest must be %s, %s or empty", data.DigestDaily, data.DigestWeekly), http.StatusBadRequest)
+		return
+	}
+
+	channels := make(map[string][]string)
+	for severity, chosen := range request.Channels {
+		known := false
+		for _, s := range notificationSeverities {
+			known = known || s == severity
+		}
+		if !known {
+			app.errorJSON(w, fmt.Errorf("unknown severity %q: use %v", severity, notificationSeverities), http.StatusBadRequest)
+			return
+		}
+
+		seen := make(map[string]bool)
+		for _, channel := range chosen {
+			if app.Notifiers[channel] == nil {
+				app.errorJSON(w, fmt.Errorf("unknown or unavailable channel %q: use %v", channel, app.availableChannels()), http.StatusBadRequest)
+				return
+			}
+			if channel == notify.ChannelSMS && request.Phone == "" {
+				app.errorJSON(w, errors.New("phone is required to receive SMS"), http.StatusBadRequest)
+				return
+			}
+			if !seen[channel] {
+				seen[channel] = true
+				channels[severity] = append(channels[severity], channel)
+			}
+		}
+	}
+
+	preference := data.NotificationPreference{
+		UserID:   app.userClaims(r).UserID,
+		Phone:    request.Phone,
+		Channels: channels,
+		Digest:   request.Digest,
+	}
+	if err := app.Models.Notification.SavePreference(&preference); err != nil {
+		app.errorJSON(w, errors.New("failed to save notification preferences"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to save notification preferences: %v", err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":     "Notification preferences saved",
+		"preferences": preference,
+	})
+}
+
+// GetPushPublicKey returns the VAPID key browsers need to subscribe to push
+func (app *Config) GetPushPublicKey(w http.ResponseWriter, r *http.Request) {
+	if app.WebPush == nil {
+		app.errorJSON(w, errors.New("web push notifications are not enabled"), http.StatusNotFound)
+		return
+	}
+	app.writeJSON(w, http.StatusOK, map[string]string{"public_key": app.WebPush.PublicKey()})
+}
+
+// CreatePushSubscription stores a browser's push subscription for the user
+func (app *Config) CreatePushSubscription(w http.ResponseWriter, r *http.Request) {
+	if app.WebPush == nil {
+		app.errorJSON(w, errors.New("web push notifications are not enabled"), http.StatusNotFound)
+		return
+	}
+
+	var request notify.PushSubscription
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+	if err := request.Validate(); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	endpoint, _ := url.Parse(request.Endpoint)
+	if err := checkPublicHost(r.Context(), endpoint.Hostname()); err != nil {
+		app.errorJSON(w, fmt.Errorf("endpoint must be a public push service: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	subscription := data.PushSubscription{
+		UserID:    app.userClaims(r).UserID,
+		Endpoint:  request.Endpoint,
+		P256dh:    request.Keys.P256dh,
+		Auth:      request.Keys.Auth,
+		UserAgent: r.UserAgent(),
+	}
+	if err := app.Models.Notification.SavePushSubscription(&subscription); err != nil {
+		app.errorJSON(w, errors.New("failed to save push subscription"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to save push subscription: %v", err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"message":      "Push subscription saved",
+		"subscription": subscription,
+	})
+}
+
+// DeletePushSubscription removes one of the user's push subscriptions by endpoint
+func (app *Config) DeletePushSubscription(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+	if request.Endpoint == "" {
+		app.errorJSON(w, errors.New("endpoint is required"), http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := app.Models.Notification.DeletePushSubscription(app.userClaims(r).UserID, request.Endpoint)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to delete push subscription"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to delete push subscription: %v", err)
+		return
+	}
+	if !deleted {
+		app.errorJSON(w, errors.New("push subscription not found"), http.StatusNotFound)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]string{"message": "Push subscription deleted"})
+}
+
+// GetNotificationDeliveries returns how a notification was sent over each channel
+func (app *Config) GetNotificationDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := urlID(r, "id")
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid notification ID"), http.StatusBadRequest)
+		return
+	}
+
+	notification, err := app.Models.Notification.GetNotification(id)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch notification"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch notification %d: %v", id, err)
+		return
+	}
+	if notification == nil || !app.canAccessOwner(app.userClaims(r), notification.UserID, false) {
+		app.errorJSON(w, errors.New("notification not found"), http.StatusNotFound)
+		return
+	}
+
+	deliveries, err := app.Models.Notification.GetDeliveries(id)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch notification deliveries"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch deliveries of notification %d: %v", id, err)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*data.NotificationDelivery{}
+	}
+
+	app.writeJSON(w, http.StatusOK, deliveries)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"field_eyes/data"
+	"field_eyes/pkg/notify"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// notificationStore keeps preferences, push subscriptions and the outbox in memory
+type notificationStore struct {
+	data.NotificationInterface
+	notifications map[uint]*data.Notification
+	preferences   map[uint]*data.NotificationPreference
+	subscriptions []*data.PushSubscription
+	deliveries    []*data.NotificationDelivery
+	saved         int
+}
+
+func (s *notificationStore) GetNotification(id uint) (*data.Notification, error) {
+	return s.notifications[id], nil
+}
+
+func (s *notificationStore) GetPreference(userID uint) (*data.NotificationPreference, error) {
+	return s.preferences[userID], nil
+}
+
+func (s *notificationStore) GetPushSubscriptions(userID uint) ([]*data.PushSubscription, error) {
+	var subscriptions []*data.PushSubscription
+	for _, subscription := range s.subscriptions {
+		if subscription.UserID == userID {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	return subscriptions, nil
+}
+
+func (s *notificationStore) GetPushSubscription(id uint) (*data.PushSubscription, error) {
+	for _, subscription := range s.subscriptions {
+		if subscription.ID == id {
+			return subscription, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *notificationStore) DeletePushSubscriptionByID(id uint) error {
+	for i, subscription := range s.subscriptions {
+		if subscription.ID == id {
+			s.subscriptions = append(s.subscriptions[:i], s.subscriptions[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *notificationStore) SavePushSubscription(subscription *data.PushSubscription) error {
+	s.subscriptions = append(s.subscriptions, subscription)
+	return nil
+}
+
+func (s *notificationStore) EnqueueDeliveries(deliveries []*data.NotificationDelivery) error {
+	s.deliveries = append(s.deliveries, deliveries...)
+	return nil
+}
+
+func (s *notificationStore) SaveDeliveryAttempt(delivery *data.NotificationDelivery) error {
+	s.saved++
+	return nil
+}
+
+// newNotificationTestApp returns an app that sends notifications to a recorder for
+// each channel
+func newNotificationTestApp(store *notificationStore) (*Config, map[string]*notify.Recorder) {
+	user := &data.User{Username: "otieno", Email: "otieno@example.com", Locale: "sw"}
+	user.ID = 1
+	recorders := map[string]*notify.Recorder{
+		notify.ChannelEmail: {},
+		notify.ChannelSMS:   {},
+		notify.ChannelPush:  {},
+	}
+	app := &Config{
+		Models: data.Models{
+			User:         &userStore{users: map[string]*data.User{user.Email: user}},
+			Notification: store,
+		},
+		Notifiers: make(map[string]notify.Notifier),
+		InfoLog:   log.New(io.Discard, "", 0),
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	for channel, recorder := range recorders {
+		app.Notifiers[channel] = recorder
+	}
+	return app, recorders
+}
+
+// newNotification stores a notification for user 1
+func newNotification(store *notificationStore, id uint, notificationType string) *data.Notification {
+	notification := &data.Notification{Type: notificationType, Message: "Soil is dry", DeviceName: "SN1", UserID: 1}
+	notification.ID = id
+	notification.CreatedAt = time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC)
+	store.notifications[id] = notification
+	return notification
+}
+
+func TestDispatchNotification(t *testing.T) {
+	tests := []struct {
+		name       string
+		preference *data.NotificationPreference
+		types      []string
+		// want is the addresses each channel is sent to
+		want map[string][]string
+	}{
+		{
+			name:  "defaults send only alerts, by email",
+			types: []string{data.SeverityInfo, "success", data.SeverityWarning, data.SeverityAlert},
+			want:  map[string][]string{notify.ChannelEmail: {"otieno@example.com"}},
+		},
+		{
+			name: "preferences replace the defaults",
+			preference: &data.NotificationPreference{
+				UserID: 1,
+				Phone:  "+254712345678",
+				Channels: map[string][]string{
+					data.SeverityInfo:    {notify.ChannelPush},
+					data.SeverityWarning: {notify.ChannelSMS, notify.ChannelPush},
+				},
+			},
+			types: []string{"success", data.SeverityWarning, data.SeverityAlert},
+			want: map[string][]string{
+				notify.ChannelSMS:  {"+254712345678"},
+				notify.ChannelPush: {"https://push.example.com/a", "https://push.example.com/b", "https://push.example.com/a", "https://push.example.com/b"},
+			},
+		},
+		{
+			name: "sms needs a phone number",
+			preference: &data.NotificationPreference{
+				UserID:   1,
+				Channels: map[string][]string{data.SeverityAlert: {notify.ChannelSMS, notify.ChannelEmail}},
+			},
+			types: []string{data.SeverityAlert},
+			want:  map[string][]string{notify.ChannelEmail: {"otieno@example.com"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &notificationStore{
+				notifications: make(map[uint]*data.Notification),
+				preferences:   map[uint]*data.NotificationPreference{1: tt.preference},
+				subscriptions: []*data.PushSubscription{
+					{ID: 1, UserID: 1, Endpoint: "https://push.example.com/a", P256dh: "key-a", Auth: "auth-a"},
+					{ID: 2, UserID: 1, Endpoint: "https://push.example.com/b", P256dh: "key-b", Auth: "auth-b"},
+					{ID: 3, UserID: 2, Endpoint: "https://push.example.com/other"},
+				},
+			}
+			if tt.preference == nil {
+				delete(store.preferences, 1)
+			}
+			app, recorders := newNotificationTestApp(store)
+
+			for i, notificationType := range tt.types {
+				app.dispatchNotification(newNotification(store, uint(i+1), notificationType))
+			}
+			for _, delivery := range store.deliveries {
+				if delivery.Status != data.DeliveryPending || delivery.UserID != 1 {
+					t.Fatalf("queued %+v", delivery)
+				}
+				app.sendNotification(delivery)
+				if delivery.Status != data.DeliveryDelivered || delivery.Attempts != 1 || delivery.DeliveredAt == nil {
+					t.Errorf("%s delivery is %s after %d attempts", delivery.Channel, delivery.Status, delivery.Attempts)
+				}
+			}
+
+			for channel, recorder := range recorders {
+				sent := recorder.Sent()
+				if len(sent) != len(tt.want[channel]) {
+					t.Fatalf("%d sent by %s, want %d", len(sent), channel, len(tt.want[channel]))
+				}
+				for i, s := range sent {
+					var address string
+					switch channel {
+					case notify.ChannelEmail:
+						address = s.To.Email
+						if s.To.Locale != "sw" {
+							t.Errorf("email sent in %q, want the user's locale", s.To.Locale)
+						}
+					case notify.ChannelSMS:
+						address = s.To.Phone
+					case notify.ChannelPush:
+						address = s.To.Push.Endpoint
+						if s.To.Push.Keys.Auth == "" || s.To.Push.Keys.P256dh == "" {
+							t.Errorf("push to %s sent without its keys", address)
+						}
+					}
+					if address != tt.want[channel][i] {
+						t.Errorf("%s %d sent to %s, want %s", channel, i, address, tt.want[channel][i])
+					}
+					if s.Message.Body != "Soil is dry" || s.Message.Device != "SN1" {
+						t.Errorf("%s sent %+v", channel, s.Message)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSendNotificationRetries(t *testing.T) {
+	store := &notificationStore{notifications: make(map[uint]*data.Notification)}
+	app, recorders := newNotificationTestApp(store)
+	newNotification(store, 1, data.SeverityAlert)
+	recorders[notify.ChannelEmail].Err = errors.New("mail server unavailable")
+
+	delivery := &data.NotificationDelivery{ID: 1, NotificationID: 1, UserID: 1, Channel: notify.ChannelEmail,
+		Address: "otieno@example.com", Status: data.DeliveryPending}
+
+	// Each failure waits twice as long as the one before
+	for attempt := 1; attempt < notificationMaxAttempts; attempt++ {
+		app.sendNotification(delivery)
+		if delivery.Status != data.DeliveryPending || delivery.Attempts != attempt {
+			t.Fatalf("attempt %d: %s after %d attempts", attempt, delivery.Status, delivery.Attempts)
+		}
+		want := notificationBaseBackoff << (attempt - 1)
+		if wait := delivery.NextAttemptAt.Sub(*delivery.LastAttemptAt); wait != want {
+			t.Errorf("attempt %d: retrying after %v, want %v", attempt, wait, want)
+		}
+		if delivery.LastError != "mail server unavailable" {
+			t.Errorf("attempt %d: last error %q", attempt, delivery.LastError)
+		}
+	}
+
+	// and the last attempt dead-letters it
+	retryAt := delivery.NextAttemptAt
+	app.sendNotification(delivery)
+	if delivery.Status != data.DeliveryDead || delivery.Attempts != notificationMaxAttempts || delivery.DeliveredAt != nil {
+		t.Errorf("%s after %d attempts, want dead after %d", delivery.Status, delivery.Attempts, notificationMaxAttempts)
+	}
+	if !delivery.NextAttemptAt.Equal(retryAt) {
+		t.Error("a dead delivery was scheduled again")
+	}
+	if store.saved != notificationMaxAttempts {
+		t.Errorf("%d attempts recorded, want %d", store.saved, notificationMaxAttempts)
+	}
+	if len(recorders[notify.ChannelEmail].Sent()) != 0 {
+		t.Error("a failed send was recorded")
+	}
+}
+
+func TestSendNotificationGone(t *testing.T) {
+	store := &notificationStore{
+		notifications: make(map[uint]*data.Notification),
+		subscriptions: []*data.PushSubscription{{ID: 7, UserID: 1, Endpoint: "https://push.example.com/a"}},
+	}
+	app, recorders := newNotificationTestApp(store)
+	newNotification(store, 1, data.SeverityAlert)
+	recorders[notify.ChannelPush].Err = fmt.Errorf("endpoint answered 410: %w", notify.ErrGone)
+
+	// A dropped subscription isn't retried, and is removed
+	id := uint(7)
+	delivery := &data.NotificationDelivery{ID: 1, NotificationID: 1, UserID: 1, Channel: notify.ChannelPush,
+		Address: "https://push.example.com/a", PushSubscriptionID: &id, Status: data.DeliveryPending}
+	app.sendNotification(delivery)
+	if delivery.Status != data.DeliveryDead {
+		t.Errorf("%s after a gone subscription, want dead", delivery.Status)
+	}
+	if len(store.subscriptions) != 0 {
+		t.Error("the gone subscription was kept")
+	}
+
+	// as is a notification deleted before it was sent
+	recorders[notify.ChannelPush].Err = nil
+	delivery = &data.NotificationDelivery{ID: 2, NotificationID: 2, UserID: 1, Channel: notify.ChannelEmail,
+		Address: "otieno@example.com", Status: data.DeliveryPending}
+	app.sendNotification(delivery)
+	if delivery.Status != data.DeliveryDead || delivery.Attempts != notificationMaxAttempts {
+		t.Errorf("%s after %d attempts for a deleted notification, want dead", delivery.Status, delivery.Attempts)
+	}
+}
+
+func TestCreatePushSubscriptionRefusesInternalEndpoints(t *testing.T) {
+	store := &notificationStore{}
+	app, _ := newNotificationTestApp(store)
+	vapid, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.WebPush, err = notify.NewWebPush(base64.RawURLEncoding.EncodeToString(vapid.Bytes()), "mailto:admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	browser, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, endpoint := range []string{
+		"https://127.0.0.1/push",
+		"https://localhost:8443/push",
+		"https://169.254.169.254/latest/meta-data/",
+		"https://10.0.0.5/push",
+		"https://[fd00::1]/push",
+	} {
+		w := post(app.CreatePushSubscription, map[string]interface{}{
+			"endpoint": endpoint,
+			"keys": map[string]string{
+				"p256dh": base64.RawURLEncoding.EncodeToString(browser.PublicKey().Bytes()),
+				"auth":   base64.RawURLEncoding.EncodeToString(make([]byte, 16)),
+			},
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: answered %d, want %d", endpoint, w.Code, http.StatusBadRequest)
+		}
+	}
+	if len(store.subscriptions) != 0 {
+		t.Errorf("saved %d subscriptions to internal endpoints", len(store.subscriptions))
+	}
+}
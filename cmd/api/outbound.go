@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// checkPublicHost checks that a host users gave us to send requests to, such as a
+// webhook or push endpoint, resolves only to public addresses
+func checkPublicHost(ctx context.Context, host string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return errors.New("url host does not resolve")
+	}
+	for _, addr := range addrs {
+		if err := checkPublicAddress(addr.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPublicAddress rejects addresses requests to user-given URLs must not reach:
+// loopback, private, link-local (which includes cloud metadata services at
+// 169.254.169.254), shared, multicast and unspecified ones. ALLOW_PRIVATE_ADDRESSES=true
+// lifts this for local development.
+func checkPublicAddress(ip net.IP) error {
+	if os.Getenv("ALLOW_PRIVATE_ADDRESSES") == "true" {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() ||
+		ip.Equal(net.IPv4bcast) || ip[0] == 0 || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%s is not a public address", ip)
+	}
+	return nil
+}
+
+// sharedAddressSpace is carrier-grade NAT space (RFC 6598), internal to providers
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// newPublicClient returns a client for posting to user-given URLs. Every connection
+// is checked against checkPublicAddress after the host is resolved, so a host that
+// passed validation can't be re-pointed at an internal address. Proxies from the
+// environment are not used, as they would hide the address, and redirects are not
+// followed.
+func newPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("%s is not an IP address", host)
+			}
+			return checkPublicAddress(ip)
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConnsPerHost: 2,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckPublicAddress(t *testing.T) {
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.10", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		err := checkPublicAddress(net.ParseIP(tt.ip))
+		if (err == nil) != tt.allowed {
+			t.Errorf("checkPublicAddress(%s) = %v, want allowed %v", tt.ip, err, tt.allowed)
+		}
+	}
+}
+
+func TestCheckPublicAddressDevOverride(t *testing.T) {
+	t.Setenv("ALLOW_PRIVATE_ADDRESSES", "true")
+	if err := checkPublicAddress(net.ParseIP("127.0.0.1")); err != nil {
+		t.Fatalf("loopback refused with ALLOW_PRIVATE_ADDRESSES=true: %v", err)
+	}
+}
+
+func TestPublicClientRefusesLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// The dialer checks the address even when the URL was never validated, as
+	// happens when a saved host later resolves to an internal address
+	resp, err := newPublicClient(time.Second).Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("request to a loopback server succeeded")
+	}
+
+	t.Setenv("ALLOW_PRIVATE_ADDRESSES", "true")
+	resp, err = newPublicClient(time.Second).Get(server.URL)
+	if err != nil {
+		t.Fatalf("request with ALLOW_PRIVATE_ADDRESSES=true: %v", err)
+	}
+	resp.Body.Close()
+}
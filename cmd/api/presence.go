@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"field_eyes/data"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// Reporting interval assumed for devices that haven't been told otherwise
+	defaultReportInterval = 15 * time.Minute
+	// Number of reporting intervals a device may miss before it is considered offline
+	missedReportsBeforeOffline = 3
+	// How often devices are checked for missed reports
+	presenceSweepInterval = time.Minute
+)
+
+// markDeviceSeen records a reading or status message from a device
+func (app *Config) markDeviceSeen(device *data.Device, at time.Time) {
+	wasOffline, err := app.Models.Device.MarkSeen(device.ID, at)
+	if err != nil {
+		app.ErrorLog.Printf("Failed to update presence for device %s: %v", device.SerialNumber, err)
+		return
+	}
+
+	device.LastSeenAt = &at
+	device.Connectivity = data.ConnectivityOnline
+	if wasOffline {
+		app.InfoLog.Printf("Device %s is back online", device.SerialNumber)
+	}
+}
+
+// markDeviceOffline moves a device to offline and notifies its owner once per outage
+func (app *Config) markDeviceOffline(device *data.Device, reason string) {
+	changed, err := app.Models.Device.MarkOffline(device.ID)
+	if err != nil {
+		app.ErrorLog.Printf("Failed to mark device %s offline: %v", device.SerialNumber, err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	device.Connectivity = data.ConnectivityOffline
+	app.InfoLog.Printf("Device %s is offline: %s", device.SerialNumber, reason)
+
+	if device.UserID == 0 {
+		return
+	}
+
+	app.emitEvents(device.UserID, data.EventDeviceOffline, map[string]interface{}{
+		"device": device,
+		"reason": reason,
+	})
+
+	message := fmt.Sprintf("Device %s has gone offline (%s)", device.SerialNumber, reason)
+	if device.LastSeenAt != nil {
+		message += fmt.Sprintf(", last seen %s", device.LastSeenAt.Format(time.RFC1123))
+	}
+
+	notification := data.Notification{
+		Type:       data.SeverityWarning,
+		Message:    message,
+		DeviceID:   device.ID,
+		DeviceName: device.SerialNumber,
+		UserID:     device.UserID,
+		Read:       false,
+	}
+	if err := app.createNotification(&notification); err != nil {
+		app.ErrorLog.Printf("Failed to create offline notification for device %s: %v", device.SerialNumber, err)
+	}
+}
+
+// sweepDevicePresence periodically marks devices offline when they stop reporting
+func (app *Config) sweepDevicePresence(ctx context.Context) {
+	ticker := time.NewTicker(presenceSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		devices, err := app.Models.Device.GetOverdue(time.Now(), defaultReportInterval, missedReportsBeforeOffline)
+		if err != nil {
+			app.ErrorLog.Printf("Failed to check device presence: %v", err)
+			continue
+		}
+
+		for _, device := range devices {
+			app.markDeviceOffline(device, fmt.Sprintf("missed %d reports", missedReportsBeforeOffline))
+		}
+	}
+}
+
+// handleDeviceStatus processes "online"/"offline" status messages, including the
+// broker's last-will message when a device disconnects unexpectedly.
+// Topic format: root/serialnumber/status
+func (m *MQTTClient) handleDeviceStatus(client mqtt.Client, msg mqtt.Message) {
+	rest := strings.TrimPrefix(msg.Topic(), m.topicRoot+"/")
+	serialNumber, _, _ := strings.Cut(rest, "/")
+
+	// Accept a plain string or {"status": "..."}
+	status := strings.TrimSpace(string(msg.Payload()))
+	var payload struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(msg.Payload(), &payload); err == nil && payload.Status != "" {
+		status = payload.Status
+	}
+	status = strings.ToLower(strings.Trim(status, `"`))
+
+	device, err := m.app.Models.Device.GetBySerialNumber(serialNumber)
+	if err != nil || device == nil {
+		// Unknown devices are registered by their first reading, not their status
+		return
+	}
+
+	switch status {
+	case data.ConnectivityOnline:
+		m.app.markDeviceSeen(device, time.Now())
+	case data.ConnectivityOffline:
+		m.app.markDeviceOffline(device, "disconnected from the broker")
+	default:
+		m.app.ErrorLog.Printf("Unknown status %q from device %s", status, serialNumber)
+	}
+}
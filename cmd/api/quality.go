@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"field_eyes/data"
+	"field_eyes/pkg/analysis"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Earlier readings the anomaly checks compare a new reading against
+	qualityHistoryWindow = 24 * time.Hour
+	qualityHistoryLimit  = 500
+	// Shortest time between sensor fault notifications for one device
+	faultNotifyInterval = 6 * time.Hour
+)
+
+// checkReadingQuality flags a reading that has not been stored yet by running the
+// anomaly checks against the device's recent readings
+func (app *Config) checkReadingQuality(device *data.Device, reading *data.DeviceData) {
+	at := qualityCheckTime(reading)
+	logs, err := app.qualityHistory(device, at)
+	if err != nil {
+		app.ErrorLog.Printf("Failed to load history for quality checks of device %s: %v", device.SerialNumber, err)
+		reading.Quality, reading.QualityIssues = data.QualityOK, ""
+		return
+	}
+	flagReading(reading, at, logs)
+}
+
+// checkBatchQuality flags readings received together, sorted oldest first. Each is
+// checked against the device's recent readings and the batch's earlier readings.
+func (app *Config) checkBatchQuality(device *data.Device, readings []*data.DeviceData) {
+	if len(readings) == 0 {
+		return
+	}
+	logs, err := app.qualityHistory(device, qualityCheckTime(readings[0]))
+	if err != nil {
+		app.ErrorLog.Printf("Failed to load history for quality checks of device %s: %v", device.SerialNumber, err)
+	}
+	for _, reading := range readings {
+		flagReading(reading, qualityCheckTime(reading), logs)
+		if reading.Quality != data.QualityFault {
+			logs = append(logs, reading)
+		}
+	}
+}
+
+// qualityCheckTime is when a reading was taken, or now for one not stored yet that
+// carries no timestamp
+func qualityCheckTime(reading *data.DeviceData) time.Time {
+	if at := reading.ReadingTime(); !at.IsZero() {
+		return at
+	}
+	return time.Now()
+}
+
+// qualityHistory loads the readings before at that the anomaly checks compare against,
+// oldest first. Faulty readings are left out so the checks compare against what the
+// sensor last reported correctly.
+func (app *Config) qualityHistory(device *data.Device, at time.Time) ([]*data.DeviceData, error) {
+	logs, err := app.Models.DeviceData.GetLogsPage(device.ID, data.LogQuery{
+		From:      at.Add(-qualityHistoryWindow),
+		To:        at,
+		Limit:     qualityHistoryLimit,
+		Qualities: []string{data.QualityOK, data.QualitySuspect},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
+		logs[i], logs[j] = logs[j], logs[i]
+	}
+	return logs, nil
+}
+
+// flagReading sets the quality of a reading taken at a time from the anomaly checks
+// against earlier readings sorted oldest first
+func flagReading(reading *data.DeviceData, at time.Time, logs []*data.DeviceData) {
+	reading.Quality = data.QualityOK
+	reading.QualityIssues = ""
+
+	values := make(map[string]float64, len(data.AggregatedFields))
+	history := make(map[string][]analysis.Point, len(data.AggregatedFields))
+	for _, metric := range data.AggregatedFields {
+		values[metric], _ = reading.Metric(metric)
+		history[metric] = metricSeries(logs, metric)
+	}
+
+	issues := analysis.DetectAnomalies(values, at, history)
+	if len(issues) == 0 {
+		return
+	}
+
+	reading.Quality = data.QualitySuspect
+	if analysis.HasFault(issues) {
+		reading.Quality = data.QualityFault
+	}
+	details := make([]string, len(issues))
+	for i, issue := range issues {
+		details[i] = issue.Detail
+	}
+	reading.QualityIssues = strings.Join(details, "; ")
+}
+
+// reportSensorFault notifies the owner of a device that stored a faulty reading, at
+// most once per faultNotifyInterval
+func (app *Config) reportSensorFault(device *data.Device, reading *data.DeviceData) {
+	if reading.Quality != data.QualityFault || device.UserID == 0 {
+		return
+	}
+
+	now := time.Now()
+	notify, err := app.Models.Device.MarkFault(device.ID, now, now.Add(-faultNotifyInterval))
+	if err != nil {
+		app.ErrorLog.Printf("Failed to record sensor fault for device %s: %v", device.SerialNumber, err)
+		return
+	}
+	if !notify {
+		return
+	}
+	device.LastFaultAt = &now
+
+	notification := data.Notification{
+		Type:       data.SeverityWarning,
+		Message:    fmt.Sprintf("Sensor fault on device %s: %s", device.SerialNumber, reading.QualityIssues),
+		DeviceID:   device.ID,
+		DeviceName: device.SerialNumber,
+		UserID:     device.UserID,
+		Read:       false,
+	}
+	if err := app.createNotification(&notification); err != nil {
+		app.ErrorLog.Printf("Failed to create sensor fault notification for device %s: %v", device.SerialNumber, err)
+	}
+}
+
+// qualityFilter reads the optional exclude_flagged query parameter. When it is true
+// only readings that passed every anomaly check are used.
+func qualityFilter(r *http.Request) ([]string, error) {
+	param := r.URL.Query().Get("exclude_flagged")
+	if param == "" {
+		return nil, nil
+	}
+	exclude, err := strconv.ParseBool(param)
+	if err != nil {
+		return nil, errors.New("exclude_flagged must be true or false")
+	}
+	if exclude {
+		return []string{data.QualityOK}, nil
+	}
+	return nil, nil
+}
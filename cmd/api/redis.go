@@ -112,10 +112,22 @@ func (r *RedisClient) Close() error {
 	return r.Pool.Close()
 }
 
-// CacheDeviceLogs stores device logs in Redis with expiration
-func (r *RedisClient) CacheDeviceLogs(deviceID uint, logs []*DeviceDataForCache) error {
-	key := fmt.Sprintf("device_logs:%d", deviceID)
-	data, err := json.Marshal(logs)
+// deviceLogsKeysIndex is the set of cached query keys for a device's logs
+func deviceLogsKeysIndex(deviceID uint) string {
+	return fmt.Sprintf("device_logs_keys:%d", deviceID)
+}
+
+// deviceLogsQueryKey builds the cache key for one query shape of a device's logs
+func deviceLogsQueryKey(deviceID uint, queryShape string) string {
+	return fmt.Sprintf("device_logs:%d:%s", deviceID, queryShape)
+}
+
+// CacheDeviceLogsQuery stores the result of a device logs query with expiration.
+// The key is recorded so InvalidateDeviceLogsCache can drop every cached query for the device.
+func (r *RedisClient) CacheDeviceLogsQuery(deviceID uint, queryShape string, result interface{}) error {
+	key := deviceLogsQueryKey(deviceID, queryShape)
+	indexKey := deviceLogsKeysIndex(deviceID)
+	data, err := json.Marshal(result)
 	if err != nil {
 		return err
 	}
@@ -123,13 +135,18 @@ func (r *RedisClient) CacheDeviceLogs(deviceID uint, logs []*DeviceDataForCache)
 	conn := r.Pool.Get()
 	defer conn.Close()
 
-	_, err = conn.Do("SETEX", key, int(MediumCacheDuration.Seconds()), data)
+	conn.Send("MULTI")
+	conn.Send("SETEX", key, int(MediumCacheDuration.Seconds()), data)
+	conn.Send("SADD", indexKey, key)
+	conn.Send("EXPIRE", indexKey, int(MediumCacheDuration.Seconds()))
+	_, err = conn.Do("EXEC")
 	return err
 }
 
-// GetCachedDeviceLogs retrieves device logs from Redis cache
-func (r *RedisClient) GetCachedDeviceLogs(deviceID uint) ([]*DeviceDataForCache, error) {
-	key := fmt.Sprintf("device_logs:%d", deviceID)
+// GetCachedDeviceLogsQuery retrieves the cached result of a device logs query.
+// It reports false on a cache miss.
+func (r *RedisClient) GetCachedDeviceLogsQuery(deviceID uint, queryShape string, result interface{}) (bool, error) {
+	key := deviceLogsQueryKey(deviceID, queryShape)
 
 	conn := r.Pool.Get()
 	defer conn.Close()
@@ -137,18 +154,16 @@ func (r *RedisClient) GetCachedDeviceLogs(deviceID uint) ([]*DeviceDataForCache,
 	data, err := redis.Bytes(conn.Do("GET", key))
 	if err != nil {
 		if err == redis.ErrNil {
-			return nil, nil // Cache miss, not an error
+			return false, nil // Cache miss, not an error
 		}
-		return nil, err
+		return false, err
 	}
 
-	var logs []*DeviceDataForCache
-	err = json.Unmarshal(data, &logs)
-	if err != nil {
-		return nil, err
+	if err := json.Unmarshal(data, result); err != nil {
+		return false, err
 	}
 
-	return logs, nil
+	return true, nil
 }
 
 // CacheDeviceLogsBySerial stores device logs by serial number in Redis
@@ -271,14 +286,20 @@ func (r *RedisClient) InvalidateCache(key string) error {
 	return err
 }
 
-// InvalidateDeviceLogsCache removes cached device logs
+// InvalidateDeviceLogsCache removes every cached query of a device's logs
 func (r *RedisClient) InvalidateDeviceLogsCache(deviceID uint) error {
-	key := fmt.Sprintf("device_logs:%d", deviceID)
+	indexKey := deviceLogsKeysIndex(deviceID)
 
 	conn := r.Pool.Get()
 	defer conn.Close()
 
-	_, err := conn.Do("DEL", key)
+	keys, err := redis.Strings(conn.Do("SMEMBERS", indexKey))
+	if err != nil {
+		return err
+	}
+
+	args := redis.Args{}.Add(indexKey).AddFlat(keys)
+	_, err = conn.Do("DEL", args...)
 	return err
 }
 
@@ -292,3 +313,51 @@ func (r *RedisClient) InvalidateUserDevicesCache(userID uint) error {
 	_, err := conn.Do("DEL", key)
 	return err
 }
+
+// readingSeenKey is the key marking a device's reading as recently stored
+func readingSeenKey(deviceID uint, readingKey string) string {
+	return fmt.Sprintf("reading_seen:%d:%s", deviceID, readingKey)
+}
+
+// SeenReadings reports which of a device's reading keys were marked as stored in the
+// last few minutes
+func (r *RedisClient) SeenReadings(deviceID uint, readingKeys []string) ([]bool, error) {
+	if len(readingKeys) == 0 {
+		return nil, nil
+	}
+	args := redis.Args{}
+	for _, readingKey := range readingKeys {
+		args = args.Add(readingSeenKey(deviceID, readingKey))
+	}
+
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	values, err := redis.Values(conn.Do("MGET", args...))
+	if err != nil {
+		return nil, err
+	}
+	seen := make([]bool, len(values))
+	for i, value := range values {
+		seen[i] = value != nil
+	}
+	return seen, nil
+}
+
+// MarkReadingsSeen records a device's reading keys as stored, so redeliveries can be
+// dropped without querying the database
+func (r *RedisClient) MarkReadingsSeen(deviceID uint, readingKeys []string) error {
+	if len(readingKeys) == 0 {
+		return nil
+	}
+
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, readingKey := range readingKeys {
+		conn.Send("SETEX", readingSeenKey(deviceID, readingKey), int(ShortCacheDuration.Seconds()), 1)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
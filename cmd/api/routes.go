@@ -1,6 +1,7 @@
 package main
 
 import (
+	"field_eyes/data"
 	"net/http"
 
 	"github.com/go-chi/chi/middleware"
@@ -18,31 +19,127 @@ func (app *Config) routes() http.Handler {
 
 	mux.Route("/api", func(r chi.Router) {
 		// User account related endpoints
-		r.Post("/signup", app.Signup)                  // Endpoint for user signup
-		r.Post("/login", app.Login)                    // Endpoint for user login
-		r.Post("/forgot-password", app.ForgotPassword) // Endpoint to request password reset
-		r.Post("/reset-password", app.ResetPassword)   // Endpoint to reset password with OTP
-
-		// Device-related endpoints
-		r.Post("/register-device", app.RegisterDevice)       // Endpoint to register a device
-		r.Post("/log-device-data", app.LogDeviceData)        // Endpoint to log device data
-		r.Get("/get-device-logs", app.GetDeviceLogs)         // Endpoint to fetch device logs
-		r.Get("/unclaimed-devices", app.GetUnclaimedDevices) // Endpoint to fetch unclaimed devices
-		r.Post("/claim-device", app.ClaimDevice)             // Endpoint to claim a device
-		r.Get("/user-devices", app.GetUserDevices)           // Endpoint to fetch user's devices
-		r.Get("/latest-device-log", app.GetLatestDeviceLog)  // Endpoint to fetch only the latest log for a device
-		r.Delete("/delete-device", app.DeleteDevice)         // Endpoint to delete a device by serial number
-
-		// Analysis endpoints
-		r.Get("/analyze-device", app.AnalyzeDeviceData) // Endpoint for ML analysis of device data
-
-		// Notification endpoints
-		r.Get("/notifications", app.GetNotifications)                      // Get all notifications for a user
-		r.Post("/notifications", app.CreateNotification)                   // Create a new notification
-		r.Put("/notifications/read", app.MarkNotificationAsRead)           // Mark a notification as read
-		r.Put("/notifications/read-all", app.MarkAllNotificationsAsRead)   // Mark all notifications as read
-		r.Delete("/notifications", app.DeleteNotification)                 // Delete a notification
-		r.Post("/notifications/generate", app.GenerateDeviceNotifications) // Generate notifications from device data
+		r.Post("/signup", app.Signup)                          // Endpoint for user signup
+		r.Post("/login", app.Login)                            // Endpoint for user login
+		r.Post("/forgot-password", app.ForgotPassword)         // Endpoint to request password reset
+		r.Post("/reset-password", app.ResetPassword)           // Endpoint to reset password with OTP
+		r.Post("/token/refresh", app.RefreshToken)             // Exchange a refresh token for new tokens
+		r.Post("/verify-email", app.VerifyEmail)               // Verify an email address with the emailed code
+		r.Post("/resend-verification", app.ResendVerification) // Email a new verification code
+
+		// Devices post their readings without a user token
+		r.Post("/log-device-data", app.LogDeviceData)            // Endpoint to log device data
+		r.Post("/log-device-data/batch", app.LogDeviceDataBatch) // Log several readings, e.g. buffered offline
+
+		// Live stream of readings and notifications (Server-Sent Events).
+		// EventSource cannot set headers, so the token may be passed as ?token=
+		r.With(app.TokenFromQuery, app.IsAuthenticated).Get("/stream", app.StreamEvents)
+
+		// Endpoints available to every authenticated user
+		r.Group(func(r chi.Router) {
+			r.Use(app.IsAuthenticated)
+
+			r.Post("/logout", app.Logout) // Revoke the current session
+
+			// Device-related endpoints
+			r.Get("/get-device-logs", app.GetDeviceLogs)            // Endpoint to fetch device logs
+			r.Get("/user-devices", app.GetUserDevices)              // Endpoint to fetch user's devices
+			r.Get("/latest-device-log", app.GetLatestDeviceLog)     // Endpoint to fetch only the latest log for a device
+			r.Get("/devices/{serial}/export", app.ExportDeviceData) // Download a device's logs as CSV, NDJSON or Parquet
+			r.Get("/export", app.ExportDevicesData)                 // Download the logs of several devices as one file
+			r.Get("/imports/{id}", app.GetImportJob)                // Poll the progress of a data import
+
+			// Device command endpoints
+			r.Get("/devices/{serial}/commands", app.GetDeviceCommands) // Fetch a device's command history
+
+			// Analysis endpoints
+			r.Get("/analyze-device", app.AnalyzeDeviceData)              // Endpoint for ML analysis of device data
+			r.Get("/devices/{serial}/agronomy", app.GetAgronomicIndices) // Growing degree days, chill hours and VPD
+
+			// Notification endpoints
+			r.Get("/notifications", app.GetNotifications)                          // Get all notifications for a user
+			r.Post("/notifications", app.CreateNotification)                       // Create a new notification
+			r.Put("/notifications/read", app.MarkNotificationAsRead)               // Mark a notification as read
+			r.Put("/notifications/read-all", app.MarkAllNotificationsAsRead)       // Mark all notifications as read
+			r.Delete("/notifications", app.DeleteNotification)                     // Delete a notification
+			r.Get("/notifications/{id}/deliveries", app.GetNotificationDeliveries) // How a notification was sent on each channel
+			r.Get("/notification-preferences", app.GetNotificationPreferences)     // The user's channels per severity
+			r.Put("/notification-preferences", app.UpdateNotificationPreferences)  // Choose channels per severity
+			r.Get("/push/public-key", app.GetPushPublicKey)                        // VAPID key for subscribing to web push
+			r.Post("/push-subscriptions", app.CreatePushSubscription)              // Register a browser for web push
+			r.Delete("/push-subscriptions", app.DeletePushSubscription)            // Unregister a browser
+
+			// Alert rule endpoints
+			r.Get("/alert-rules", app.GetAlertRules) // Get the user's alert rules
+
+			// Farm and field endpoints
+			r.Get("/farms", app.GetFarms)                            // List farms with their fields
+			r.Get("/farms/{id}", app.GetFarm)                        // Get a farm with its fields
+			r.Get("/fields/{id}", app.GetField)                      // Get a field
+			r.Get("/fields/{id}/devices", app.GetFieldDevices)       // List a field's devices
+			r.Get("/fields/{id}/conditions", app.GetFieldConditions) // Current conditions across a field
+
+			// Crop profile endpoints
+			r.Get("/crops", app.GetCrops)     // List crop profiles
+			r.Get("/crops/{id}", app.GetCrop) // Get a crop profile with its growth stages
+		})
+
+		// Endpoints that change devices are closed to read-only agronomists
+		r.Group(func(r chi.Router) {
+			r.Use(app.IsAuthenticated)
+			r.Use(app.RequireRole(data.RoleFarmer, data.RoleAdmin))
+
+			r.Post("/register-device", app.RegisterDevice)       // Endpoint to register a device
+			r.Get("/unclaimed-devices", app.GetUnclaimedDevices) // Endpoint to fetch unclaimed devices
+			r.Post("/claim-device", app.ClaimDevice)             // Endpoint to claim a device
+			r.Delete("/delete-device", app.DeleteDevice)         // Endpoint to delete a device by serial number
+
+			r.Post("/devices/{serial}/commands", app.SendDeviceCommand) // Send a command to a device over MQTT
+			r.Post("/devices/{serial}/key", app.RotateDeviceKey)        // Issue a new ingestion key for a device
+			r.Put("/devices/{serial}/refill-point", app.SetRefillPoint) // Set the soil moisture to irrigate at
+			r.Post("/devices/{serial}/import", app.ImportDeviceData)    // Import historical readings from CSV or NDJSON
+
+			r.Post("/notifications/generate", app.GenerateDeviceNotifications) // Generate notifications from device data
+
+			r.Post("/farms", app.CreateFarm)                        // Create a farm
+			r.Put("/farms/{id}", app.UpdateFarm)                    // Update a farm
+			r.Delete("/farms/{id}", app.DeleteFarm)                 // Delete a farm and its fields
+			r.Post("/farms/{id}/fields", app.CreateField)           // Add a field to a farm
+			r.Put("/fields/{id}", app.UpdateField)                  // Update a field
+			r.Delete("/fields/{id}", app.DeleteField)               // Delete a field
+			r.Put("/devices/{serial}/field", app.AssignDeviceField) // Assign a device to a field
+			r.Put("/fields/{id}/crop", app.SetFieldCrop)            // Set the crop planted in a field
+			r.Put("/devices/{serial}/crop", app.SetDeviceCrop)      // Set the crop planted at a device
+
+			r.Post("/alert-rules", app.CreateAlertRule)   // Create an alert rule
+			r.Put("/alert-rules", app.UpdateAlertRule)    // Update an alert rule
+			r.Delete("/alert-rules", app.DeleteAlertRule) // Delete an alert rule
+
+			r.Get("/webhooks", app.GetWebhooks)                                            // List the user's webhooks
+			r.Post("/webhooks", app.CreateWebhook)                                         // Subscribe a URL to events
+			r.Put("/webhooks/{id}", app.UpdateWebhook)                                     // Change or pause a webhook
+			r.Delete("/webhooks/{id}", app.DeleteWebhook)                                  // Delete a webhook
+			r.Get("/webhooks/{id}/deliveries", app.GetWebhookDeliveries)                   // A webhook's delivery log
+			r.Post("/webhooks/{id}/deliveries/{delivery}/redeliver", app.RedeliverWebhook) // Retry a dead-lettered delivery
+		})
+
+		// Administration endpoints
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(app.IsAuthenticated)
+			r.Use(app.RequireRole(data.RoleAdmin))
+
+			r.Get("/users", app.AdminGetUsers)                        // List all users
+			r.Put("/users/{id}/role", app.AdminUpdateUserRole)        // Change a user's role
+			r.Get("/devices", app.AdminGetDevices)                    // List all devices
+			r.Put("/devices/{serial}/owner", app.AdminReassignDevice) // Move a device to another user
+			r.Get("/assignments", app.AdminGetAssignments)            // List agronomist assignments
+			r.Post("/assignments", app.AdminCreateAssignment)         // Assign an agronomist to a farmer
+			r.Delete("/assignments", app.AdminDeleteAssignment)       // Remove an assignment
+			r.Post("/crops", app.AdminCreateCrop)                     // Add a crop profile
+			r.Put("/crops/{id}", app.AdminUpdateCrop)                 // Replace a crop profile
+			r.Get("/jobs", app.AdminGetJobs)                          // List background jobs
+			r.Post("/jobs/{id}/retry", app.AdminRetryJob)             // Retry a dead-lettered job
+		})
 	})
 	return mux
 }
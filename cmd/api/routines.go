@@ -1,44 +1,41 @@
 package main
 
 import (
+	"context"
+	"field_eyes/data"
+	"field_eyes/pkg/email"
+	"strings"
 	"time"
 )
 
-func (app *Config) listenForErrors() {
-	for {
-		select {
-		case err := <-app.ErrorChan:
-			app.ErrorLog.Println(err)
-		case <-app.ErrorChanDone:
-			return
-		}
-	}
-}
-
-// SendEmailInBackground sends an email in the background
-func (app *Config) SendEmailInBackground(recipient, otp string) {
+// runInBackground runs fn in a goroutine that shutdown waits for. fn should return
+// soon after ctx ends.
+func (app *Config) runInBackground(ctx context.Context, fn func(ctx context.Context)) {
 	app.Wait.Add(1)
-	go func(recipient, otp string) {
+	go func() {
 		defer app.Wait.Done()
+		fn(ctx)
+	}()
+}
 
-		// Track start time for logging
-		startTime := time.Now()
-
-		// Log the beginning of the process
-		app.InfoLog.Printf("Starting to send OTP email to %s", recipient)
-
-		// Attempt to send the email
-		err := app.Mailer.SendOTP(recipient, otp)
-		if err != nil {
-			app.ErrorLog.Printf("Failed to send OTP email to %s: %v", recipient, err)
-			app.ErrorChan <- err
-			return
-		}
-
-		// Calculate time taken
-		duration := time.Since(startTime)
+// sendTemplateEmail renders an email template in the user's language and queues it
+// to be sent to them
+func (app *Config) sendTemplateEmail(user *data.User, template string, templateData interface{}) {
+	msg, err := email.Compose(template, user.Locale, templateData)
+	if err != nil {
+		app.ErrorLog.Printf("Failed to render %s email for user %d: %v", template, user.ID, err)
+		return
+	}
+	msg.To = []string{user.Email}
+	app.enqueueEmail(msg)
+}
 
-		// Log successful completion
-		app.InfoLog.Printf("Successfully sent OTP email to %s (took %v)", recipient, duration)
-	}(recipient, otp)
+// enqueueEmail queues an email on the job queue, which retries it until the mail
+// server accepts it
+func (app *Config) enqueueEmail(msg email.Message) {
+	if err := app.enqueueJob(jobSendEmail, msg, time.Now(), 0); err != nil {
+		app.ErrorLog.Printf("Failed to queue email %q to %s: %v", msg.Subject, strings.Join(msg.To, ", "), err)
+		return
+	}
+	app.InfoLog.Printf("Queued email %q to %s", msg.Subject, strings.Join(msg.To, ", "))
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"field_eyes/data"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// Redis channel used to share stream events between API replicas
+	streamChannel = "field_eyes:stream"
+	// Events buffered per subscriber before new events are dropped
+	streamBufferSize = 64
+	// Interval between keep-alive comments on idle streams
+	streamHeartbeat = 25 * time.Second
+)
+
+// StreamEvent is a single message pushed to live dashboards
+type StreamEvent struct {
+	Type         string      `json:"type"` // reading or notification
+	SerialNumber string      `json:"serial_number"`
+	Data         interface{} `json:"data"`
+}
+
+// streamMessage routes an encoded event to the subscribers of one user
+type streamMessage struct {
+	UserID       uint            `json:"user_id"`
+	Type         string          `json:"type"`
+	SerialNumber string          `json:"serial_number"`
+	Event        json.RawMessage `json:"event"`
+}
+
+// streamSubscriber is one connected client
+type streamSubscriber struct {
+	owners  map[uint]bool   // users whose events the client receives
+	serials map[string]bool // empty means every device of those users
+	events  chan streamMessage
+}
+
+// streamHub fans events out to connected clients. When Redis is available events are
+// published on a Redis channel so every API replica delivers them.
+type streamHub struct {
+	app         *Config
+	mu          sync.RWMutex
+	subscribers map[*streamSubscriber]struct{}
+	useRedis    bool
+	done        <-chan struct{} // closed on shutdown, ending every stream
+}
+
+// newStreamHub creates the hub and, if Redis is configured, starts relaying the shared
+// channel. Streams are closed when ctx ends.
+func newStreamHub(ctx context.Context, app *Config) *streamHub {
+	hub := &streamHub{
+		app:         app,
+		subscribers: make(map[*streamSubscriber]struct{}),
+		done:        ctx.Done(),
+	}
+
+	if app.Redis != nil && app.Redis.Pool != nil {
+		hub.useRedis = true
+		app.runInBackground(ctx, hub.relayRedis)
+	}
+
+	return hub
+}
+
+// subscribe registers a client for the events of the given device owners
+func (h *streamHub) subscribe(owners []uint, serials []string) *streamSubscriber {
+	sub := &streamSubscriber{
+		owners:  make(map[uint]bool, len(owners)),
+		serials: make(map[string]bool, len(serials)),
+		events:  make(chan streamMessage, streamBufferSize),
+	}
+	for _, owner := range owners {
+		sub.owners[owner] = true
+	}
+	for _, serial := range serials {
+		sub.serials[serial] = true
+	}
+
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub
+}
+
+// unsubscribe removes a client
+func (h *streamHub) unsubscribe(sub *streamSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	h.mu.Unlock()
+}
+
+// PublishReading sends a stored reading to the owner's dashboards
+func (h *streamHub) PublishReading(device *data.Device, reading *data.DeviceData) {
+	if device.UserID == 0 {
+		return
+	}
+	h.publish(device.UserID, StreamEvent{Type: "reading", SerialNumber: device.SerialNumber, Data: reading})
+}
+
+// PublishNotification sends a new notification to the user's dashboards
+func (h *streamHub) PublishNotification(notification *data.Notification) {
+	h.publish(notification.UserID, StreamEvent{Type: "notification", SerialNumber: notification.DeviceName, Data: notification})
+}
+
+// publish delivers an event through Redis when available, otherwise directly
+func (h *streamHub) publish(userID uint, event StreamEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		h.app.ErrorLog.Printf("Failed to encode stream event: %v", err)
+		return
+	}
+
+	msg := streamMessage{UserID: userID, Type: event.Type, SerialNumber: event.SerialNumber, Event: payload}
+
+	if h.useRedis {
+		encoded, err := json.Marshal(msg)
+		if err == nil {
+			conn := h.app.Redis.Pool.Get()
+			_, err = conn.Do("PUBLISH", streamChannel, encoded)
+			conn.Close()
+		}
+		if err == nil {
+			return
+		}
+		h.app.ErrorLog.Printf("Failed to publish stream event to Redis, delivering locally: %v", err)
+	}
+
+	h.deliver(msg)
+}
+
+// deliver hands an event to the matching local subscribers. Slow clients miss events
+// rather than blocking ingestion.
+func (h *streamHub) deliver(msg streamMessage) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for sub := range h.subscribers {
+		if !sub.owners[msg.UserID] {
+			continue
+		}
+		if len(sub.serials) > 0 && !sub.serials[msg.SerialNumber] {
+			continue
+		}
+		select {
+		case sub.events <- msg:
+		default:
+		}
+	}
+}
+
+// relayRedis delivers events published on the shared Redis channel, reconnecting on
+// errors, until ctx ends
+func (h *streamHub) relayRedis(ctx context.Context) {
+	for {
+		if err := h.receiveRedis(ctx); err != nil && ctx.Err() == nil {
+			h.app.ErrorLog.Printf("Stream Redis subscription error: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// receiveRedis subscribes to the shared channel and delivers messages until the
+// connection fails or ctx ends
+func (h *streamHub) receiveRedis(ctx context.Context) error {
+	psc := redis.PubSubConn{Conn: h.app.Redis.Pool.Get()}
+	defer psc.Close()
+
+	if err := psc.Subscribe(streamChannel); err != nil {
+		return err
+	}
+
+	// Unsubscribing ends the Receive loop; sending is allowed alongside a receive
+	stop := context.AfterFunc(ctx, func() { psc.Unsubscribe() })
+	defer stop()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			var msg streamMessage
+			if err := json.Unmarshal(v.Data, &msg); err != nil {
+				h.app.ErrorLog.Printf("Invalid stream message: %v", err)
+				continue
+			}
+			h.deliver(msg)
+		case redis.Subscription:
+			if v.Count == 0 {
+				return nil
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+// StreamEvents streams readings and notifications as Server-Sent Events.
+// An optional serial_number list (comma separated) restricts the stream to those devices.
+// Agronomists also receive the events of the farmers they are assigned to.
+func (app *Config) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	// Get the authenticated user from the request context
+	claims := app.userClaims(r)
+	userID := claims.UserID
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.errorJSON(w, errors.New("streaming is not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	owners, err := app.visibleOwners(claims)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to load assigned farmers"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to load assigned farmers: %v", err)
+		return
+	}
+
+	// Only devices the user can read can be subscribed to
+	var serials []string
+	if param := r.URL.Query().Get("serial_number"); param != "" {
+		for _, serial := range strings.Split(param, ",") {
+			serial = strings.TrimSpace(serial)
+			if serial == "" {
+				continue
+			}
+			device, err := app.Models.Device.GetBySerialNumber(serial)
+			if err != nil || device == nil || !app.canAccessDevice(claims, device, false) {
+				app.errorJSON(w, fmt.Errorf("device %s not found", serial), http.StatusNotFound)
+				return
+			}
+			serials = append(serials, serial)
+			owners = append(owners, device.UserID)
+		}
+	}
+
+	sub := app.Stream.subscribe(owners, serials)
+	defer app.Stream.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	app.InfoLog.Printf("User %d connected to the live stream", userID)
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			app.InfoLog.Printf("User %d disconnected from the live stream", userID)
+			return
+		case <-app.Stream.done:
+			// Shutting down; clients reconnect to another replica or after the restart
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case msg := <-sub.events:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Type, msg.Event)
+			flusher.Flush()
+		}
+	}
+}
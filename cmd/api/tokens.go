@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"field_eyes/data"
+	"net/http"
+	"time"
+)
+
+const (
+	// Lifetime of the access token sent with every request
+	accessTokenTTL = 15 * time.Minute
+	// Lifetime of a refresh token; each refresh issues a new one
+	refreshTokenTTL = 30 * 24 * time.Hour
+	// How often expired refresh tokens and revocations are deleted
+	tokenPurgeInterval = time.Hour
+)
+
+// tokenPair is returned by login and refresh
+type tokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // seconds until the access token expires
+}
+
+// newTokenID returns a random identifier for a token or session
+func newTokenID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the hash under which a refresh token is stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSessionTokens creates an access token and a refresh token for a session.
+// The refresh token is returned unsaved so the caller can create or rotate it.
+func (app *Config) newSessionTokens(user data.User, familyID string) (*tokenPair, *data.RefreshToken, error) {
+	accessToken, jti, accessExpiresAt, err := app.GenerateJWT(user, familyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshToken, err := newTokenID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stored := &data.RefreshToken{
+		UserID:          user.ID,
+		FamilyID:        familyID,
+		TokenHash:       hashToken(refreshToken),
+		AccessJTI:       jti,
+		AccessExpiresAt: accessExpiresAt,
+		ExpiresAt:       time.Now().Add(refreshTokenTTL),
+	}
+
+	pair := &tokenPair{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}
+
+	return pair, stored, nil
+}
+
+// startSession issues the tokens of a new login session
+func (app *Config) startSession(user data.User) (*tokenPair, error) {
+	familyID, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	pair, stored, err := app.newSessionTokens(user, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := app.Models.Token.CreateRefreshToken(stored); err != nil {
+		return nil, err
+	}
+
+	return pair, nil
+}
+
+// RefreshToken exchanges a refresh token for a new access token and refresh token.
+// Presenting a refresh token that was already used revokes the whole session, since
+// it means the token was copied.
+func (app *Config) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	if request.RefreshToken == "" {
+		app.errorJSON(w, errors.New("refresh_token is required"), http.StatusBadRequest)
+		return
+	}
+
+	current, err := app.Models.Token.GetRefreshToken(hashToken(request.RefreshToken))
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to refresh token"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to load refresh token: %v", err)
+		return
+	}
+	if current == nil || time.Now().After(current.ExpiresAt) {
+		app.errorJSON(w, errors.New("invalid or expired refresh token"), http.StatusUnauthorized)
+		return
+	}
+	if current.RevokedAt != nil {
+		app.revokeReusedSession(current)
+		app.errorJSON(w, errors.New("invalid or expired refresh token"), http.StatusUnauthorized)
+		return
+	}
+
+	// Reload the user so role changes take effect on refresh
+	user, err := app.Models.User.GetOne(current.UserID)
+	if err != nil || user == nil {
+		app.errorJSON(w, errors.New("invalid or expired refresh token"), http.StatusUnauthorized)
+		return
+	}
+
+	pair, next, err := app.newSessionTokens(*user, current.FamilyID)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to refresh token"), http.StatusInternalServerError)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	rotated, err := app.Models.Token.RotateRefreshToken(current, next)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to refresh token"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to rotate refresh token: %v", err)
+		return
+	}
+	if !rotated {
+		// Used by a concurrent request between the lookup and the rotation
+		app.revokeReusedSession(current)
+		app.errorJSON(w, errors.New("invalid or expired refresh token"), http.StatusUnauthorized)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, pair)
+}
+
+// revokeReusedSession ends a session whose refresh token was presented twice
+func (app *Config) revokeReusedSession(token *data.RefreshToken) {
+	app.ErrorLog.Printf("Refresh token reuse detected for user %d, revoking session", token.UserID)
+	if err := app.Models.Token.RevokeFamily(token.FamilyID); err != nil {
+		app.ErrorLog.Printf("Failed to revoke session of user %d: %v", token.UserID, err)
+	}
+}
+
+// Logout revokes the current session, or with ?all=true every session of the user
+func (app *Config) Logout(w http.ResponseWriter, r *http.Request) {
+	claims := app.userClaims(r)
+
+	var err error
+	if r.URL.Query().Get("all") == "true" {
+		err = app.Models.Token.RevokeUserTokens(claims.UserID)
+	} else {
+		err = app.Models.Token.RevokeFamily(claims.SessionID)
+	}
+	if err == nil {
+		// The family revocation covers this token, but deny it explicitly in case
+		// its refresh token has already been purged
+		err = app.Models.Token.RevokeJTI(claims.JTI, claims.ExpiresAt)
+	}
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to log out"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to revoke tokens of user %d: %v", claims.UserID, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Logged out successfully",
+	})
+}
+
+// purgeExpiredTokens periodically deletes refresh tokens and revocations past their expiry
+func (app *Config) purgeExpiredTokens(ctx context.Context) {
+	ticker := time.NewTicker(tokenPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		purged, err := app.Models.Token.PurgeExpired(time.Now())
+		if err != nil {
+			app.ErrorLog.Printf("Failed to purge expired tokens: %v", err)
+		} else if purged > 0 {
+			app.InfoLog.Printf("Purged %d expired tokens", purged)
+		}
+	}
+}
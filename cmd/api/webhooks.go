@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"field_eyes/data"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the outbox is checked for due deliveries
+	webhookPollInterval = 5 * time.Second
+	// Number of deliveries claimed, and sent in parallel, at a time
+	webhookBatchSize = 50
+	// How long a claimed delivery is held before another worker may retry it
+	webhookLease = 2 * time.Minute
+	// Time allowed for an endpoint to answer
+	webhookTimeout = 10 * time.Second
+	// Attempts before a delivery is dead-lettered
+	webhookMaxAttempts = 10
+	// Wait before the first retry, doubled after each failed attempt up to the maximum
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	// How long delivered events are kept in the delivery log
+	webhookRetention = 30 * 24 * time.Hour
+	// Default and maximum number of deliveries returned by the delivery log
+	defaultDeliveryLogSize = 100
+	maxDeliveryLogSize     = 500
+)
+
+// Headers sent with every webhook delivery
+const (
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// webhookEvent is the body posted to webhooks
+type webhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// webhookRequest is the body accepted when creating or updating a webhook
+type webhookRequest struct {
+	URL         string   `json:"url"`
+	Secret      string   `json:"secret"`
+	Events      []string `json:"events"`
+	Description string   `json:"description"`
+	Active      *bool    `json:"active"`
+}
+
+// validateWebhookURL checks that a webhook URL is an absolute http or https URL whose
+// host resolves only to public addresses. Deliveries check the address again when they
+// connect, since the host may resolve differently by then.
+func validateWebhookURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	return checkPublicHost(ctx, u.Hostname())
+}
+
+// validateWebhookEvents checks that every event type is known
+func validateWebhookEvents(events []string) error {
+	if len(events) == 0 {
+		return fmt.Errorf("events must name at least one of %v", data.WebhookEvents)
+	}
+	for _, event := range events {
+		known := false
+		for _, e := range data.WebhookEvents {
+			if e == event {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown event %q: use %v", event, data.WebhookEvents)
+		}
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>"
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is the wait after the given number of failed attempts
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
+
+// newEventID returns a random identifier for an event, the same in every delivery of
+// it, so receivers can drop events they have already handled
+func newEventID() (string, error) {
+	id, err := newCommandID()
+	return "evt_" + id, err
+}
+
+// emitEvents queues one event per payload for the user's webhooks that subscribe to
+// the event type. Events are written to the outbox and sent by deliverWebhooks;
+// failing to queue them is logged rather than failing the caller.
+func (app *Config) emitEvents(userID uint, eventType string, payloads ...interface{}) {
+	if userID == 0 || len(payloads) == 0 {
+		return
+	}
+
+	webhooks, err := app.Models.Webhook.GetSubscribers(userID, eventType)
+	if err != nil {
+		app.ErrorLog.Printf("Failed to load webhooks of user %d for %s: %v", userID, eventType, err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	now := time.Now()
+	deliveries := make([]*data.WebhookDelivery, 0, len(payloads)*len(webhooks))
+	for _, payload := range payloads {
+		eventID, err := newEventID()
+		if err != nil {
+			app.ErrorLog.Printf("Failed to create %s event: %v", eventType, err)
+			return
+		}
+		body, err := json.Marshal(webhookEvent{ID: eventID, Type: eventType, CreatedAt: now, Data: payload})
+		if err != nil {
+			app.ErrorLog.Printf("Failed to encode %s event: %v", eventType, err)
+			return
+		}
+		for _, webhook := range webhooks {
+			deliveries = append(deliveries, &data.WebhookDelivery{
+				WebhookID:     webhook.ID,
+				EventID:       eventID,
+				EventType:     eventType,
+				Payload:       body,
+				Status:        data.DeliveryPending,
+				NextAttemptAt: now,
+			})
+		}
+	}
+
+	if err := app.Models.Webhook.Enqueue(deliveries); err != nil {
+		app.ErrorLog.Printf("Failed to queue %d %s deliveries for user %d: %v", len(deliveries), eventType, userID, err)
+	}
+}
+
+// emitReadings queues reading.created events for readings stored for a device
+func (app *Config) emitReadings(device *data.Device, readings []*data.DeviceData) {
+	payloads := make([]interface{}, len(readings))
+	for i, reading := range readings {
+		payloads[i] = map[string]interface{}{
+			"device":  device,
+			"reading": reading,
+		}
+	}
+	app.emitEvents(device.UserID, data.EventReadingCreated, payloads...)
+}
+
+// deliverWebhooks sends due deliveries from the outbox until the outbox is drained,
+// then waits for the next poll, until ctx ends. Several instances may run it side by
+// side.
+func (app *Config) deliverWebhooks(ctx context.Context) {
+	client := newPublicClient(webhookTimeout)
+	lastPurge := time.Now()
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			deliveries, err := app.Models.Webhook.ClaimDue(time.Now(), webhookBatchSize, webhookLease)
+			if err != nil {
+				app.ErrorLog.Printf("Failed to load webhook deliveries: %v", err)
+				break
+			}
+
+			webhooks := app.deliveryWebhooks(deliveries)
+			var wg sync.WaitGroup
+			for _, delivery := range deliveries {
+				webhook, ok := webhooks[delivery.WebhookID]
+				if !ok {
+					// Left to be retried once the lease runs out
+					continue
+				}
+				wg.Add(1)
+				go func(delivery *data.WebhookDelivery) {
+					defer wg.Done()
+					app.deliverWebhook(client, webhook, delivery)
+				}(delivery)
+			}
+			wg.Wait()
+
+			// Deliveries not yet claimed are left for the next start
+			if len(deliveries) < webhookBatchSize || ctx.Err() != nil {
+				break
+			}
+		}
+
+		if time.Since(lastPurge) > time.Hour {
+			lastPurge = time.Now()
+			purged, err := app.Models.Webhook.PurgeDeliveries(lastPurge.Add(-webhookRetention))
+			if err != nil {
+				app.ErrorLog.Printf("Failed to purge old webhook deliveries: %v", err)
+			} else if purged > 0 {
+				app.InfoLog.Printf("Purged %d old webhook deliveries", purged)
+			}
+		}
+	}
+}
+
+// deliveryWebhooks loads the webhooks of a batch of deliveries. Deleted webhooks map
+// to nil; webhooks that failed to load are left out.
+func (app *Config) deliveryWebhooks(deliveries []*data.WebhookDelivery) map[uint]*data.Webhook {
+	webhooks := make(map[uint]*data.Webhook)
+	for _, delivery := range deliveries {
+		if _, ok := webhooks[delivery.WebhookID]; ok {
+			continue
+		}
+		webhook, err := app.Models.Webhook.GetWebhook(delivery.WebhookID)
+		if err != nil {
+			app.ErrorLog.Printf("Failed to load webhook %d: %v", delivery.WebhookID, err)
+			continue
+		}
+		webhooks[delivery.WebhookID] = webhook
+	}
+	return webhooks
+}
+
+// deliverWebhook posts one delivery and records the outcome. Failed attempts are
+// retried with exponential backoff until the delivery is dead-lettered.
+func (app *Config) deliverWebhook(client *http.Client, webhook *data.Webhook, delivery *data.WebhookDelivery) {
+	now := time.Now()
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+	delivery.LastStatusCode = 0
+
+	var err error
+	switch {
+	case webhook == nil:
+		err = errors.New("the webhook was deleted")
+		delivery.Attempts = webhookMaxAttempts
+	case !webhook.Active:
+		err = errors.New("the webhook is disabled")
+		delivery.Attempts = webhookMaxAttempts
+	default:
+		delivery.LastStatusCode, err = postWebhook(client, webhook, delivery, now)
+	}
+
+	if err == nil {
+		delivery.Status = data.DeliveryDelivered
+		delivery.DeliveredAt = &now
+		if err := app.Models.Webhook.MarkDelivered(delivery); err != nil {
+			app.ErrorLog.Printf("Webhook delivery %d sent but not recorded: %v", delivery.ID, err)
+		}
+		return
+	}
+
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= webhookMaxAttempts {
+		delivery.Status = data.DeliveryDead
+		app.ErrorLog.Printf("Webhook delivery %d (%s) to webhook %d is dead after %d attempts: %v",
+			delivery.ID, delivery.EventType, delivery.WebhookID, delivery.Attempts, err)
+	} else {
+		delivery.NextAttemptAt = now.Add(webhookBackoff(delivery.Attempts))
+	}
+	if err := app.Models.Webhook.MarkFailed(delivery); err != nil {
+		app.ErrorLog.Printf("Failed to record webhook delivery %d: %v", delivery.ID, err)
+	}
+}
+
+// postWebhook sends a delivery's payload, signed with the webhook's secret, and
+// returns the response status. Any status other than 2xx is an error.
+func postWebhook(client *http.Client, webhook *data.Webhook, delivery *data.WebhookDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := now.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "FieldEyes-Webhooks/1.0")
+	req.Header.Set(webhookEventHeader, delivery.EventType)
+	req.Header.Set(webhookDeliveryHeader, delivery.EventID)
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(webhook.Secret, timestamp, delivery.Payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// The body is never kept: the delivery log would show it to the webhook's owner
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// userWebhook loads the webhook named in the URL and checks that it belongs to the
+// user. It writes the error response and returns nil if not.
+func (app *Config) userWebhook(w http.ResponseWriter, r *http.Request) *data.Webhook {
+	id, err := urlID(r, "id")
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid webhook ID"), http.StatusBadRequest)
+		return nil
+	}
+
+	webhook, err := app.Models.Webhook.GetWebhook(id)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch webhook"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch webhook %d: %v", id, err)
+		return nil
+	}
+	if webhook == nil || !app.canAccessOwner(app.userClaims(r), webhook.UserID, true) {
+		app.errorJSON(w, errors.New("webhook not found"), http.StatusNotFound)
+		return nil
+	}
+	return webhook
+}
+
+// GetWebhooks returns the authenticated user's webhooks
+func (app *Config) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.Models.Webhook.GetUserWebhooks(app.userClaims(r).UserID)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch webhooks"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch webhooks: %v", err)
+		return
+	}
+
+	if webhooks == nil {
+		webhooks = []*data.Webhook{}
+	}
+
+	app.writeJSON(w, http.StatusOK, webhooks)
+}
+
+// CreateWebhook subscribes a URL to events of the user's devices. The signing secret
+// is generated unless one is given, and is only returned here.
+func (app *Config) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var request webhookRequest
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	if err := validateWebhookURL(r.Context(), request.URL); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookEvents(request.Events); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	secret := request.Secret
+	if secret == "" {
+		var err error
+		if secret, err = newTokenID(); err != nil {
+			app.errorJSON(w, errors.New("failed to create webhook"), http.StatusInternalServerError)
+			app.ErrorLog.Printf("Failed to generate webhook secret: %v", err)
+			return
+		}
+	} else if len(secret) < 16 || len(secret) > 100 {
+		app.errorJSON(w, errors.New("secret must be between 16 and 100 characters"), http.StatusBadRequest)
+		return
+	}
+
+	webhook := data.Webhook{
+		UserID:      app.userClaims(r).UserID,
+		URL:         request.URL,
+		Secret:      secret,
+		Events:      request.Events,
+		Description: request.Description,
+		Active:      request.Active == nil || *request.Active,
+	}
+	if err := app.Models.Webhook.CreateWebhook(&webhook); err != nil {
+		app.errorJSON(w, errors.New("failed to create webhook"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to create webhook: %v", err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"message": "Webhook created successfully",
+		"webhook": webhook,
+		"secret":  secret,
+	})
+}
+
+// UpdateWebhook changes a webhook's URL, events, description, secret or whether it
+// is active. Fields left out are kept.
+func (app *Config) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook := app.userWebhook(w, r)
+	if webhook == nil {
+		return
+	}
+
+	var request webhookRequest
+	if err := app.ReadJSON(w, r, &request); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		app.ErrorLog.Println(err)
+		return
+	}
+
+	if request.URL != "" {
+		if err := validateWebhookURL(r.Context(), request.URL); err != nil {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+		webhook.URL = request.URL
+	}
+	if request.Events != nil {
+		if err := validateWebhookEvents(request.Events); err != nil {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+		webhook.Events = request.Events
+	}
+	if request.Secret != "" {
+		if len(request.Secret) < 16 || len(request.Secret) > 100 {
+			app.errorJSON(w, errors.New("secret must be between 16 and 100 characters"), http.StatusBadRequest)
+			return
+		}
+		webhook.Secret = request.Secret
+	}
+	if request.Description != "" {
+		webhook.Description = request.Description
+	}
+	if request.Active != nil {
+		webhook.Active = *request.Active
+	}
+
+	if err := app.Models.Webhook.UpdateWebhook(webhook); err != nil {
+		app.errorJSON(w, errors.New("failed to update webhook"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to update webhook %d: %v", webhook.ID, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Webhook updated successfully",
+		"webhook": webhook,
+	})
+}
+
+// DeleteWebhook deletes a webhook. Events not yet delivered are dropped.
+func (app *Config) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook := app.userWebhook(w, r)
+	if webhook == nil {
+		return
+	}
+
+	if err := app.Models.Webhook.DeleteWebhook(webhook.ID); err != nil {
+		app.errorJSON(w, errors.New("failed to delete webhook"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to delete webhook %d: %v", webhook.ID, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]string{
+		"message": "Webhook deleted",
+	})
+}
+
+// GetWebhookDeliveries returns a webhook's delivery log, newest first.
+// Optional query parameters: status (pending, delivered or dead) and limit.
+func (app *Config) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhook := app.userWebhook(w, r)
+	if webhook == nil {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", data.DeliveryPending, data.DeliveryDelivered, data.DeliveryDead:
+	default:
+		app.errorJSON(w, errors.New("status must be pending, delivered or dead"), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultDeliveryLogSize
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxDeliveryLogSize {
+			app.errorJSON(w, fmt.Errorf("limit must be between 1 and %d", maxDeliveryLogSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	deliveries, err := app.Models.Webhook.GetDeliveries(webhook.ID, status, limit)
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to fetch webhook deliveries"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to fetch deliveries of webhook %d: %v", webhook.ID, err)
+		return
+	}
+
+	if deliveries == nil {
+		deliveries = []*data.WebhookDelivery{}
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"webhook_id": webhook.ID,
+		"deliveries": deliveries,
+		"count":      len(deliveries),
+	})
+}
+
+// RedeliverWebhook queues a dead-lettered delivery to be sent again
+func (app *Config) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook := app.userWebhook(w, r)
+	if webhook == nil {
+		return
+	}
+
+	deliveryID, err := urlID(r, "delivery")
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid delivery ID"), http.StatusBadRequest)
+		return
+	}
+	delivery, err := app.Models.Webhook.GetDelivery(deliveryID)
+	if err != nil || delivery == nil || delivery.WebhookID != webhook.ID {
+		app.errorJSON(w, errors.New("delivery not found"), http.StatusNotFound)
+		return
+	}
+
+	requeued, err := app.Models.Webhook.Redeliver(delivery.ID, time.Now())
+	if err != nil {
+		app.errorJSON(w, errors.New("failed to redeliver"), http.StatusInternalServerError)
+		app.ErrorLog.Printf("Failed to requeue webhook delivery %d: %v", delivery.ID, err)
+		return
+	}
+	if !requeued {
+		app.errorJSON(w, errors.New("only dead deliveries can be redelivered"), http.StatusConflict)
+		return
+	}
+
+	app.writeJSON(w, http.StatusAccepted, map[string]string{
+		"message": "Delivery queued",
+	})
+}
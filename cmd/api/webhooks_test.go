@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestValidateWebhookURL(t *testing.T) {
+	for _, raw := range []string{
+		"ftp://example.com/hook",
+		"/relative",
+		"http://127.0.0.1/hook",
+		"http://localhost:8080/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"https://[::1]/hook",
+		"http://10.0.0.5/hook",
+	} {
+		if err := validateWebhookURL(context.Background(), raw); err == nil {
+			t.Errorf("validateWebhookURL(%q) accepted", raw)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Alert rule comparators
+const (
+	ComparatorLT  = "lt"
+	ComparatorLTE = "lte"
+	ComparatorGT  = "gt"
+	ComparatorGTE = "gte"
+)
+
+// Alert rule scopes
+const (
+	ScopeDevice     = "device"      // a single device
+	ScopeDeviceType = "device_type" // all of the user's devices of one type
+	ScopeUser       = "user"        // all of the user's devices
+	ScopeGlobal     = "global"      // built-in defaults applied to every owned device
+)
+
+// Alert severities, stored as the notification type
+const (
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+	SeverityAlert   = "alert"
+)
+
+// AlertRule describes a condition on a reading that raises a notification,
+// e.g. "soil_moisture lt 20 for 30 minutes".
+type AlertRule struct {
+	gorm.Model
+	UserID          uint           `gorm:"index" json:"user_id"`
+	Name            string         `gorm:"type:varchar(100)" json:"name"`
+	Metric          string         `gorm:"type:varchar(50);not null" json:"metric"`
+	Comparator      string         `gorm:"type:varchar(10);not null" json:"comparator"` // lt, lte, gt, gte
+	Threshold       float64        `json:"threshold"`
+	Hysteresis      float64        `json:"hysteresis"`                                // how far past the threshold the value must recover to clear the alert
+	DurationSeconds int            `json:"duration_seconds"`                          // how long the condition must hold before alerting
+	Severity        string         `gorm:"type:varchar(50);not null" json:"severity"` // info, warning, alert
+	Scope           string         `gorm:"type:varchar(20);not null" json:"scope"`    // device, device_type, user, global
+	DeviceID        uint           `json:"device_id,omitempty"`
+	DeviceType      string         `gorm:"type:varchar(100)" json:"device_type,omitempty"`
+	Enabled         bool           `json:"enabled"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// AlertState tracks whether a rule's condition currently holds for a device
+type AlertState struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	RuleID         uint       `gorm:"uniqueIndex:idx_alert_state_rule_device;not null" json:"rule_id"`
+	DeviceID       uint       `gorm:"uniqueIndex:idx_alert_state_rule_device;not null" json:"device_id"`
+	ConditionSince *time.Time `json:"condition_since"` // first reading that met the condition
+	Active         bool       `json:"active"`          // a notification has been raised and not yet cleared
+	LastFiredAt    *time.Time `json:"last_fired_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// Validate checks that the rule is well formed
+func (a *AlertRule) Validate() error {
+	if _, ok := (&DeviceData{}).Metric(a.Metric); !ok {
+		return fmt.Errorf("unknown metric %q", a.Metric)
+	}
+	switch a.Comparator {
+	case ComparatorLT, ComparatorLTE, ComparatorGT, ComparatorGTE:
+	default:
+		return errors.New("comparator must be one of lt, lte, gt, gte")
+	}
+	switch a.Severity {
+	case SeverityInfo, SeverityWarning, SeverityAlert:
+	default:
+		return errors.New("severity must be one of info, warning, alert")
+	}
+	if a.Hysteresis < 0 || a.DurationSeconds < 0 {
+		return errors.New("hysteresis and duration must not be negative")
+	}
+	switch a.Scope {
+	case ScopeDevice:
+		if a.DeviceID == 0 {
+			return errors.New("device_id is required for device scope")
+		}
+	case ScopeDeviceType:
+		if a.DeviceType == "" {
+			return errors.New("device_type is required for device_type scope")
+		}
+	case ScopeUser, ScopeGlobal:
+	default:
+		return errors.New("scope must be one of device, device_type, user")
+	}
+	return nil
+}
+
+// Triggered reports whether a value meets the rule's condition
+func (a *AlertRule) Triggered(value float64) bool {
+	switch a.Comparator {
+	case ComparatorLT:
+		return value < a.Threshold
+	case ComparatorLTE:
+		return value <= a.Threshold
+	case ComparatorGT:
+		return value > a.Threshold
+	case ComparatorGTE:
+		return value >= a.Threshold
+	}
+	return false
+}
+
+// Cleared reports whether a value has recovered past the threshold by the hysteresis margin
+func (a *AlertRule) Cleared(value float64) bool {
+	switch a.Comparator {
+	case ComparatorLT, ComparatorLTE:
+		return value >= a.Threshold+a.Hysteresis && !a.Triggered(value)
+	case ComparatorGT, ComparatorGTE:
+		return value <= a.Threshold-a.Hysteresis && !a.Triggered(value)
+	}
+	return true
+}
+
+// DefaultAlertRules are the built-in rules seeded on first start
+func DefaultAlertRules() []AlertRule {
+	return []AlertRule{
+		{Name: "Low soil moisture", Metric: "soil_moisture", Comparator: ComparatorLT, Threshold: 20, Hysteresis: 2, Severity: SeverityWarning, Scope: ScopeGlobal, Enabled: true},
+		{Name: "High soil temperature", Metric: "soil_temperature", Comparator: ComparatorGT, Threshold: 35, Hysteresis: 1, Severity: SeverityAlert, Scope: ScopeGlobal, Enabled: true},
+		{Name: "Low soil temperature", Metric: "soil_temperature", Comparator: ComparatorLT, Threshold: 5, Hysteresis: 1, Severity: SeverityAlert, Scope: ScopeGlobal, Enabled: true},
+		{Name: "Acidic soil", Metric: "ph", Comparator: ComparatorLT, Threshold: 5.5, Hysteresis: 0.1, Severity: SeverityInfo, Scope: ScopeGlobal, Enabled: true},
+		{Name: "Alkaline soil", Metric: "ph", Comparator: ComparatorGT, Threshold: 7.5, Hysteresis: 0.1, Severity: SeverityInfo, Scope: ScopeGlobal, Enabled: true},
+	}
+}
+
+// AlertRuleRepository implements AlertRuleInterface using GORM
+type AlertRuleRepository struct {
+	db *gorm.DB
+}
+
+// NewAlertRuleRepository creates a new instance of AlertRuleRepository
+func NewAlertRuleRepository(db *gorm.DB) AlertRuleInterface {
+	return &AlertRuleRepository{db: db}
+}
+
+// CreateRule creates a new alert rule
+func (r *AlertRuleRepository) CreateRule(rule *AlertRule) error {
+	return r.db.Create(rule).Error
+}
+
+// GetRule retrieves an alert rule by its ID
+func (r *AlertRuleRepository) GetRule(id uint) (*AlertRule, error) {
+	var rule AlertRule
+	result := r.db.First(&rule, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &rule, result.Error
+}
+
+// GetUserRules retrieves all alert rules owned by a user
+func (r *AlertRuleRepository) GetUserRules(userID uint) ([]*AlertRule, error) {
+	var rules []*AlertRule
+	result := r.db.Where("user_id = ?", userID).Order("created_at DESC").Find(&rules)
+	return rules, result.Error
+}
+
+// GetRulesForDevice retrieves the enabled rules that apply to a device
+func (r *AlertRuleRepository) GetRulesForDevice(device *Device) ([]*AlertRule, error) {
+	var rules []*AlertRule
+	result := r.db.Where("enabled = ?", true).
+		Where(r.db.Where("scope = ?", ScopeGlobal).
+			Or("user_id = ? AND scope = ?", device.UserID, ScopeUser).
+			Or("user_id = ? AND scope = ? AND device_id = ?", device.UserID, ScopeDevice, device.ID).
+			Or("user_id = ? AND scope = ? AND device_type = ?", device.UserID, ScopeDeviceType, device.DeviceType)).
+		Find(&rules)
+	return rules, result.Error
+}
+
+// UpdateRule saves changes to an alert rule and resets its state so it is evaluated afresh
+func (r *AlertRuleRepository) UpdateRule(rule *AlertRule) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("rule_id = ?", rule.ID).Delete(&AlertState{}).Error; err != nil {
+			return err
+		}
+		return tx.Save(rule).Error
+	})
+}
+
+// DeleteRule deletes an alert rule and its state
+func (r *AlertRuleRepository) DeleteRule(id uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("rule_id = ?", id).Delete(&AlertState{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&AlertRule{}, id).Error
+	})
+}
+
+// GetState retrieves the state of a rule for a device, or a fresh state if none is stored
+func (r *AlertRuleRepository) GetState(ruleID, deviceID uint) (*AlertState, error) {
+	var state AlertState
+	result := r.db.Where("rule_id = ? AND device_id = ?", ruleID, deviceID).First(&state)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return &AlertState{RuleID: ruleID, DeviceID: deviceID}, nil
+	}
+	return &state, result.Error
+}
+
+// SaveState stores the state of a rule for a device
+func (r *AlertRuleRepository) SaveState(state *AlertState) error {
+	return r.db.Save(state).Error
+}
+
+// SeedDefaultRules creates the built-in global rules if there are none yet
+func (r *AlertRuleRepository) SeedDefaultRules() error {
+	var count int64
+	if err := r.db.Model(&AlertRule{}).Where("scope = ?", ScopeGlobal).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	rules := DefaultAlertRules()
+	return r.db.Create(&rules).Error
+}
@@ -0,0 +1,58 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Assignment gives an agronomist read-only access to a farmer's devices
+type Assignment struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	AgronomistID uint      `gorm:"uniqueIndex:idx_assignment_pair;not null" json:"agronomist_id"`
+	FarmerID     uint      `gorm:"uniqueIndex:idx_assignment_pair;index;not null" json:"farmer_id"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AssignmentRepository implements AssignmentInterface using GORM
+type AssignmentRepository struct {
+	db *gorm.DB
+}
+
+// NewAssignmentRepository creates a new instance of AssignmentRepository
+func NewAssignmentRepository(db *gorm.DB) AssignmentInterface {
+	return &AssignmentRepository{db: db}
+}
+
+// Assign gives an agronomist access to a farmer's devices. Assigning twice is not an error.
+func (r *AssignmentRepository) Assign(agronomistID, farmerID uint) error {
+	assignment := Assignment{AgronomistID: agronomistID, FarmerID: farmerID}
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&assignment).Error
+}
+
+// Unassign removes an agronomist's access to a farmer's devices
+func (r *AssignmentRepository) Unassign(agronomistID, farmerID uint) error {
+	return r.db.Where("agronomist_id = ? AND farmer_id = ?", agronomistID, farmerID).Delete(&Assignment{}).Error
+}
+
+// GetFarmerIDs retrieves the farmers assigned to an agronomist
+func (r *AssignmentRepository) GetFarmerIDs(agronomistID uint) ([]uint, error) {
+	var ids []uint
+	result := r.db.Model(&Assignment{}).Where("agronomist_id = ?", agronomistID).Pluck("farmer_id", &ids)
+	return ids, result.Error
+}
+
+// IsAssigned reports whether an agronomist is assigned to a farmer
+func (r *AssignmentRepository) IsAssigned(agronomistID, farmerID uint) (bool, error) {
+	var count int64
+	result := r.db.Model(&Assignment{}).Where("agronomist_id = ? AND farmer_id = ?", agronomistID, farmerID).Count(&count)
+	return count > 0, result.Error
+}
+
+// GetAll retrieves every assignment
+func (r *AssignmentRepository) GetAll() ([]*Assignment, error) {
+	var assignments []*Assignment
+	result := r.db.Order("agronomist_id, farmer_id").Find(&assignments)
+	return assignments, result.Error
+}
@@ -0,0 +1,133 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Device command states
+const (
+	CommandPending   = "pending"   // stored, not yet accepted by the broker
+	CommandDelivered = "delivered" // published to the device's command topic
+	CommandAcked     = "acked"     // the device confirmed it ran the command
+	CommandFailed    = "failed"    // the device reported an error
+	CommandExpired   = "expired"   // no acknowledgement before the TTL
+)
+
+// DeviceCommand is a command sent to a field unit over MQTT
+type DeviceCommand struct {
+	gorm.Model
+	CommandID    string          `gorm:"type:varchar(64);uniqueIndex;not null" json:"command_id"`
+	DeviceID     uint            `gorm:"index;not null" json:"device_id"`
+	SerialNumber string          `gorm:"type:varchar(100);not null" json:"serial_number"`
+	UserID       uint            `json:"user_id"`
+	Command      string          `gorm:"type:varchar(50);not null" json:"command"` // set_interval, reboot, read_now
+	Params       json.RawMessage `json:"params,omitempty"`
+	Status       string          `gorm:"type:varchar(20);index;not null" json:"status"`
+	Attempts     int             `json:"attempts"`
+	MaxAttempts  int             `json:"max_attempts"`
+	ExpiresAt    time.Time       `json:"expires_at"`
+	LastSentAt   *time.Time      `json:"last_sent_at"`
+	DeliveredAt  *time.Time      `json:"delivered_at"`
+	CompletedAt  *time.Time      `json:"completed_at"`
+	Result       string          `gorm:"type:text" json:"result,omitempty"` // message returned by the device
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+	DeletedAt    gorm.DeletedAt  `gorm:"index" json:"-"`
+}
+
+// openCommandStates are the states in which a command may still be sent or acknowledged
+var openCommandStates = []string{CommandPending, CommandDelivered}
+
+// CommandRepository implements CommandInterface using GORM
+type CommandRepository struct {
+	db *gorm.DB
+}
+
+// NewCommandRepository creates a new instance of CommandRepository
+func NewCommandRepository(db *gorm.DB) CommandInterface {
+	return &CommandRepository{db: db}
+}
+
+// CreateCommand stores a new command
+func (r *CommandRepository) CreateCommand(command *DeviceCommand) error {
+	return r.db.Create(command).Error
+}
+
+// GetByCommandID retrieves a command by its command ID
+func (r *CommandRepository) GetByCommandID(commandID string) (*DeviceCommand, error) {
+	var command DeviceCommand
+	result := r.db.Where("command_id = ?", commandID).First(&command)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &command, result.Error
+}
+
+// GetDeviceCommands retrieves the most recent commands sent to a device
+func (r *CommandRepository) GetDeviceCommands(deviceID uint, limit int) ([]*DeviceCommand, error) {
+	var commands []*DeviceCommand
+	result := r.db.Where("device_id = ?", deviceID).Order("created_at DESC").Limit(limit).Find(&commands)
+	return commands, result.Error
+}
+
+// GetRetryable retrieves open commands that have not been sent since the given time
+// and have attempts left
+func (r *CommandRepository) GetRetryable(sentBefore time.Time) ([]*DeviceCommand, error) {
+	var commands []*DeviceCommand
+	result := r.db.Where("status IN ?", openCommandStates).
+		Where("attempts < max_attempts AND expires_at > ?", time.Now()).
+		Where("last_sent_at IS NULL OR last_sent_at < ?", sentBefore).
+		Order("created_at").
+		Find(&commands)
+	return commands, result.Error
+}
+
+// MarkSent records a publish attempt, moving the command to delivered if it is still open
+func (r *CommandRepository) MarkSent(id uint, attempts int, sentAt time.Time) error {
+	return r.db.Model(&DeviceCommand{}).
+		Where("id = ? AND status IN ?", id, openCommandStates).
+		Updates(map[string]interface{}{
+			"status":       CommandDelivered,
+			"attempts":     attempts,
+			"last_sent_at": sentAt,
+			"delivered_at": gorm.Expr("COALESCE(delivered_at, ?)", sentAt),
+		}).Error
+}
+
+// MarkAttempt records a failed publish attempt without changing the status
+func (r *CommandRepository) MarkAttempt(id uint, attempts int, sentAt time.Time) error {
+	return r.db.Model(&DeviceCommand{}).
+		Where("id = ? AND status IN ?", id, openCommandStates).
+		Updates(map[string]interface{}{
+			"attempts":     attempts,
+			"last_sent_at": sentAt,
+		}).Error
+}
+
+// Complete moves an open command to acked or failed with the device's result.
+// It reports false if the command was unknown or already closed.
+func (r *CommandRepository) Complete(commandID, status, result string, at time.Time) (bool, error) {
+	tx := r.db.Model(&DeviceCommand{}).
+		Where("command_id = ? AND status IN ?", commandID, openCommandStates).
+		Updates(map[string]interface{}{
+			"status":       status,
+			"result":       result,
+			"completed_at": at,
+		})
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// ExpireCommands moves open commands past their TTL to expired and returns how many changed
+func (r *CommandRepository) ExpireCommands(now time.Time) (int64, error) {
+	tx := r.db.Model(&DeviceCommand{}).
+		Where("status IN ? AND expires_at <= ?", openCommandStates, now).
+		Updates(map[string]interface{}{
+			"status":       CommandExpired,
+			"completed_at": now,
+		})
+	return tx.RowsAffected, tx.Error
+}
@@ -0,0 +1,236 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Range is an inclusive band of acceptable values
+type Range struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// Contains reports whether a value lies within the range
+func (r Range) Contains(value float64) bool {
+	return value >= r.Min && value <= r.Max
+}
+
+// Mid returns the middle of the range
+func (r Range) Mid() float64 {
+	return (r.Min + r.Max) / 2
+}
+
+// CropProfile holds the growing conditions of a crop. Nutrient needs change as the
+// crop grows, so they are given per growth stage.
+type CropProfile struct {
+	gorm.Model
+	Name        string         `gorm:"type:varchar(100);uniqueIndex;not null" json:"name"`
+	Description string         `gorm:"type:text" json:"description"`
+	PH          Range          `gorm:"embedded;embeddedPrefix:ph_" json:"ph"`
+	Moisture    Range          `gorm:"embedded;embeddedPrefix:moisture_" json:"moisture"`       // soil moisture, %
+	Temperature Range          `gorm:"embedded;embeddedPrefix:temperature_" json:"temperature"` // °C, air and soil
+	Stages      []CropStage    `gorm:"constraint:OnDelete:CASCADE" json:"stages"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// CropStage is a growth stage of a crop and the soil nutrients it needs, in mg/kg
+type CropStage struct {
+	ID            uint   `gorm:"primaryKey" json:"id"`
+	CropProfileID uint   `gorm:"index;not null" json:"crop_profile_id"`
+	Name          string `gorm:"type:varchar(100);not null" json:"name"`
+	StartDay      int    `json:"start_day"` // days after planting the stage begins
+	Nitrogen      Range  `gorm:"embedded;embeddedPrefix:nitrogen_" json:"nitrogen"`
+	Phosphorous   Range  `gorm:"embedded;embeddedPrefix:phosphorous_" json:"phosphorous"`
+	Potassium     Range  `gorm:"embedded;embeddedPrefix:potassium_" json:"potassium"`
+}
+
+// Validate checks that the profile is well formed and sorts its stages by start day
+func (c *CropProfile) Validate() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	bands := map[string]Range{"ph": c.PH, "moisture": c.Moisture, "temperature": c.Temperature}
+	for name, band := range bands {
+		if band.Min > band.Max {
+			return fmt.Errorf("%s min must not exceed max", name)
+		}
+	}
+	if c.PH.Min < 0 || c.PH.Max > 14 {
+		return errors.New("ph must be between 0 and 14")
+	}
+	if len(c.Stages) == 0 {
+		return errors.New("at least one growth stage is required")
+	}
+
+	sort.SliceStable(c.Stages, func(i, j int) bool { return c.Stages[i].StartDay < c.Stages[j].StartDay })
+	if c.Stages[0].StartDay != 0 {
+		return errors.New("the first growth stage must start on day 0")
+	}
+	for _, stage := range c.Stages {
+		if stage.Name == "" {
+			return errors.New("each growth stage needs a name")
+		}
+		for name, band := range map[string]Range{"nitrogen": stage.Nitrogen, "phosphorous": stage.Phosphorous, "potassium": stage.Potassium} {
+			if band.Min < 0 || band.Min > band.Max {
+				return fmt.Errorf("%s range of stage %q is invalid", name, stage.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// StageAt returns the growth stage of a crop planted at plantedAt on the given day.
+// Without a planting date the first stage is used.
+func (c *CropProfile) StageAt(plantedAt *time.Time, at time.Time) *CropStage {
+	if len(c.Stages) == 0 {
+		return nil
+	}
+	stage := &c.Stages[0]
+	if plantedAt == nil {
+		return stage
+	}
+	days := int(at.Sub(*plantedAt).Hours() / 24)
+	for i := range c.Stages {
+		if c.Stages[i].StartDay <= days {
+			stage = &c.Stages[i]
+		}
+	}
+	return stage
+}
+
+// DefaultCropProfiles are the built-in crops seeded on first start
+func DefaultCropProfiles() []CropProfile {
+	return []CropProfile{
+		{
+			Name:        "Tea",
+			Description: "Camellia sinensis; perennial, prefers strongly acidic soil",
+			PH:          Range{4.5, 5.5},
+			Moisture:    Range{25, 45},
+			Temperature: Range{13, 30},
+			Stages: []CropStage{
+				{Name: "Establishment", StartDay: 0, Nitrogen: Range{30, 60}, Phosphorous: Range{15, 30}, Potassium: Range{80, 150}},
+				{Name: "Mature plucking", StartDay: 3 * 365, Nitrogen: Range{50, 100}, Phosphorous: Range{15, 30}, Potassium: Range{100, 200}},
+			},
+		},
+		{
+			Name:        "Coffee",
+			Description: "Arabica coffee; perennial, first crop about three years after planting",
+			PH:          Range{5.5, 6.5},
+			Moisture:    Range{25, 45},
+			Temperature: Range{15, 28},
+			Stages: []CropStage{
+				{Name: "Establishment", StartDay: 0, Nitrogen: Range{30, 60}, Phosphorous: Range{20, 40}, Potassium: Range{100, 180}},
+				{Name: "Bearing", StartDay: 3 * 365, Nitrogen: Range{40, 80}, Phosphorous: Range{20, 40}, Potassium: Range{150, 250}},
+			},
+		},
+		{
+			Name:        "Maize",
+			Description: "Field maize; about 120 days from planting to harvest",
+			PH:          Range{5.8, 7.0},
+			Moisture:    Range{20, 40},
+			Temperature: Range{10, 35},
+			Stages: []CropStage{
+				{Name: "Emergence", StartDay: 0, Nitrogen: Range{20, 40}, Phosphorous: Range{20, 40}, Potassium: Range{100, 180}},
+				{Name: "Vegetative", StartDay: 14, Nitrogen: Range{40, 80}, Phosphorous: Range{20, 40}, Potassium: Range{120, 200}},
+				{Name: "Tasseling and silking", StartDay: 55, Nitrogen: Range{40, 70}, Phosphorous: Range{25, 45}, Potassium: Range{120, 200}},
+				{Name: "Grain fill", StartDay: 75, Nitrogen: Range{25, 50}, Phosphorous: Range{20, 40}, Potassium: Range{100, 180}},
+				{Name: "Maturity", StartDay: 110, Nitrogen: Range{0, 40}, Phosphorous: Range{0, 40}, Potassium: Range{0, 180}},
+			},
+		},
+		{
+			Name:        "Beans",
+			Description: "Common bean; fixes its own nitrogen once nodulated, about 90 days to harvest",
+			PH:          Range{6.0, 7.5},
+			Moisture:    Range{20, 40},
+			Temperature: Range{12, 30},
+			Stages: []CropStage{
+				{Name: "Emergence", StartDay: 0, Nitrogen: Range{15, 30}, Phosphorous: Range{20, 40}, Potassium: Range{80, 150}},
+				{Name: "Vegetative", StartDay: 10, Nitrogen: Range{10, 30}, Phosphorous: Range{25, 45}, Potassium: Range{100, 160}},
+				{Name: "Flowering", StartDay: 35, Nitrogen: Range{10, 30}, Phosphorous: Range{25, 45}, Potassium: Range{100, 180}},
+				{Name: "Pod fill", StartDay: 50, Nitrogen: Range{10, 30}, Phosphorous: Range{20, 40}, Potassium: Range{100, 180}},
+				{Name: "Maturity", StartDay: 80, Nitrogen: Range{0, 30}, Phosphorous: Range{0, 40}, Potassium: Range{0, 180}},
+			},
+		},
+	}
+}
+
+// CropRepository implements CropInterface using GORM
+type CropRepository struct {
+	db *gorm.DB
+}
+
+// NewCropRepository creates a new instance of CropRepository
+func NewCropRepository(db *gorm.DB) CropInterface {
+	return &CropRepository{db: db}
+}
+
+// GetAll retrieves every crop profile with its stages
+func (r *CropRepository) GetAll() ([]*CropProfile, error) {
+	var crops []*CropProfile
+	result := r.db.Preload("Stages", orderStages).Order("name").Find(&crops)
+	return crops, result.Error
+}
+
+// GetOne retrieves a crop profile with its stages by its ID
+func (r *CropRepository) GetOne(id uint) (*CropProfile, error) {
+	var crop CropProfile
+	result := r.db.Preload("Stages", orderStages).First(&crop, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &crop, result.Error
+}
+
+// Create creates a crop profile with its stages
+func (r *CropRepository) Create(crop *CropProfile) error {
+	return r.db.Create(crop).Error
+}
+
+// Update saves a crop profile and replaces its stages
+func (r *CropRepository) Update(crop *CropProfile) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Stages").Save(crop).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("crop_profile_id = ?", crop.ID).Delete(&CropStage{}).Error; err != nil {
+			return err
+		}
+		for i := range crop.Stages {
+			crop.Stages[i].ID = 0
+			crop.Stages[i].CropProfileID = crop.ID
+		}
+		if len(crop.Stages) == 0 {
+			return nil
+		}
+		return tx.Create(&crop.Stages).Error
+	})
+}
+
+// SeedDefaultCrops creates the built-in crop profiles that don't exist yet
+func (r *CropRepository) SeedDefaultCrops() error {
+	for _, crop := range DefaultCropProfiles() {
+		var count int64
+		if err := r.db.Model(&CropProfile{}).Where("name = ?", crop.Name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if err := r.db.Create(&crop).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderStages sorts preloaded stages by the day they start
+func orderStages(db *gorm.DB) *gorm.DB {
+	return db.Order("start_day")
+}
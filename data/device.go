@@ -1,43 +1,78 @@
 package data
 
 import (
+	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Device represents the devices table in the database.
 type Device struct {
 	gorm.Model
-	DeviceType   string         `gorm:"type:varchar(100);not null" json:"device_type"`
-	SerialNumber string         `gorm:"type:varchar(100);uniqueIndex;not null" json:"serial_number"`
-	UserID       uint           `gorm:"not null" json:"user_id"`
-	User         User           `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
-	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
+	DeviceType            string         `gorm:"type:varchar(100);not null" json:"device_type"`
+	SerialNumber          string         `gorm:"type:varchar(100);uniqueIndex;not null" json:"serial_number"`
+	UserID                uint           `gorm:"not null" json:"user_id"`
+	User                  User           `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+	LastSeenAt            *time.Time     `json:"last_seen_at"`
+	Connectivity          string         `gorm:"type:varchar(20);default:unknown" json:"connectivity"` // online, offline, unknown
+	ReportIntervalSeconds int            `json:"report_interval_seconds"`                              // expected time between readings, 0 for the default
+	KeyHash               string         `gorm:"type:varchar(64)" json:"-"`                            // SHA-256 of the device's ingestion key
+	KeyPublic             string         `gorm:"type:varchar(64)" json:"-"`                            // Ed25519 public key seeded by the ingestion key, checks signatures
+	KeyIssuedAt           *time.Time     `json:"key_issued_at"`
+	FieldID               *uint          `gorm:"index" json:"field_id"`
+	SuggestedFieldID      *uint          `json:"suggested_field_id"`   // field whose boundary contains the device's reported position
+	LastFaultAt           *time.Time     `json:"last_fault_at"`        // when the owner was last notified of a sensor fault
+	RefillPoint           float64        `json:"refill_point"`         // soil moisture to irrigate at, 0 for the default
+	IrrigationNoticeAt    *time.Time     `json:"irrigation_notice_at"` // when the owner was last warned that irrigation is due
+	CropProfileID         *uint          `json:"crop_profile_id"`      // crop at the device, overriding its field's crop
+	PlantedAt             *time.Time     `json:"planted_at"`
+	CreatedAt             time.Time      `json:"created_at"`
+	UpdatedAt             time.Time      `json:"updated_at"`
+	DeletedAt             gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
+// Device connectivity states
+const (
+	ConnectivityOnline  = "online"
+	ConnectivityOffline = "offline"
+	ConnectivityUnknown = "unknown"
+)
+
 // DeviceData represents the data logs for a device.
 type DeviceData struct {
 	gorm.Model
-	DeviceID        uint      `gorm:"not null" json:"device_id"` // Foreign key to the Device table
-	SerialNumber    string    `gorm:"not null" json:"serial_number"`
-	Temperature     float64   `json:"temperature"`
-	Humidity        float64   `json:"humidity"`
-	Nitrogen        float64   `json:"nitrogen"`
-	Phosphorous     float64   `json:"phosphorous"`
-	Potassium       float64   `json:"potassium"`
-	PH              float64   `json:"ph"`
-	SoilMoisture    float64   `json:"soil_moisture"`
-	SoilTemperature float64   `json:"soil_temperature"`
-	SoilHumidity    float64   `json:"soil_humidity"`
-	Longitude       float64   `json:"longitude"`
-	Latitude        float64   `json:"latitude"`
-	CreatedAt       time.Time `json:"created_at"`
+	DeviceID        uint       `gorm:"not null;uniqueIndex:idx_device_data_message;uniqueIndex:idx_device_data_measured" json:"device_id"` // Foreign key to the Device table
+	SerialNumber    string     `gorm:"not null" json:"serial_number"`
+	Temperature     float64    `json:"temperature"`
+	Humidity        float64    `json:"humidity"`
+	Nitrogen        float64    `json:"nitrogen"`
+	Phosphorous     float64    `json:"phosphorous"`
+	Potassium       float64    `json:"potassium"`
+	PH              float64    `json:"ph"`
+	SoilMoisture    float64    `json:"soil_moisture"`
+	SoilTemperature float64    `json:"soil_temperature"`
+	SoilHumidity    float64    `json:"soil_humidity"`
+	Longitude       float64    `json:"longitude"`
+	Latitude        float64    `json:"latitude"`
+	Quality         string     `gorm:"type:varchar(20);default:ok;index" json:"quality"`                                  // ok, suspect or fault
+	QualityIssues   string     `gorm:"type:text" json:"quality_issues,omitempty"`                                         // what the anomaly checks found
+	MeasuredAt      *time.Time `gorm:"uniqueIndex:idx_device_data_measured" json:"measured_at,omitempty"`                 // when the device took the reading, by its own clock
+	MessageID       *string    `gorm:"type:varchar(100);uniqueIndex:idx_device_data_message" json:"message_id,omitempty"` // the device's ID for the message, to drop redelivered readings
+	CreatedAt       time.Time  `json:"created_at"`                                                                        // when the server received the reading
 }
 
+// Reading quality flags set by the anomaly checks
+const (
+	QualityOK      = "ok"
+	QualitySuspect = "suspect" // unusual for the device but physically plausible
+	QualityFault   = "fault"   // the sensor is misreporting
+)
+
 // Notification represents a notification in the database
 type Notification struct {
 	gorm.Model
@@ -53,6 +88,116 @@ type Notification struct {
 	DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
+// Metric returns the reading with the given JSON field name, e.g. "soil_moisture"
+func (d *DeviceData) Metric(name string) (float64, bool) {
+	switch name {
+	case "temperature":
+		return d.Temperature, true
+	case "humidity":
+		return d.Humidity, true
+	case "nitrogen":
+		return d.Nitrogen, true
+	case "phosphorous":
+		return d.Phosphorous, true
+	case "potassium":
+		return d.Potassium, true
+	case "ph":
+		return d.PH, true
+	case "soil_moisture":
+		return d.SoilMoisture, true
+	case "soil_temperature":
+		return d.SoilTemperature, true
+	case "soil_humidity":
+		return d.SoilHumidity, true
+	}
+	return 0, false
+}
+
+// ReadingTime returns when the reading was taken: the device's timestamp if it sent
+// one, otherwise when it was received
+func (d *DeviceData) ReadingTime() time.Time {
+	if d.MeasuredAt != nil {
+		return *d.MeasuredAt
+	}
+	return d.CreatedAt
+}
+
+// SetMetric sets the reading with the given JSON field name. It reports false for an
+// unknown name.
+func (d *DeviceData) SetMetric(name string, value float64) bool {
+	switch name {
+	case "temperature":
+		d.Temperature = value
+	case "humidity":
+		d.Humidity = value
+	case "nitrogen":
+		d.Nitrogen = value
+	case "phosphorous":
+		d.Phosphorous = value
+	case "potassium":
+		d.Potassium = value
+	case "ph":
+		d.PH = value
+	case "soil_moisture":
+		d.SoilMoisture = value
+	case "soil_temperature":
+		d.SoilTemperature = value
+	case "soil_humidity":
+		d.SoilHumidity = value
+	default:
+		return false
+	}
+	return true
+}
+
+// Bucket sizes supported by GetAggregatedLogs
+const (
+	BucketHour = "hour"
+	BucketDay  = "day"
+)
+
+// AggregatedFields lists the DeviceData columns summarised by GetAggregatedLogs
+var AggregatedFields = []string{
+	"temperature",
+	"humidity",
+	"nitrogen",
+	"phosphorous",
+	"potassium",
+	"ph",
+	"soil_moisture",
+	"soil_temperature",
+	"soil_humidity",
+}
+
+// ReadingTimeSQL is the SQL form of DeviceData.ReadingTime. Logs are filtered, ordered
+// and bucketed by it, so a buffered batch lands at the times it was measured.
+const ReadingTimeSQL = "COALESCE(measured_at, created_at)"
+
+// LogQuery filters and pages device logs by reading time. Logs are ordered newest
+// first; BeforeTime and BeforeID identify the last row of the previous page.
+type LogQuery struct {
+	From       time.Time
+	To         time.Time
+	BeforeTime time.Time
+	BeforeID   uint
+	Limit      int
+	Qualities  []string // only logs with one of these quality flags, all logs when empty
+}
+
+// FieldStats holds the summary of one reading within a bucket
+type FieldStats struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+}
+
+// DeviceDataBucket summarises the readings of a device within one time bucket
+type DeviceDataBucket struct {
+	Start  time.Time             `json:"start"`
+	Count  int64                 `json:"count"`
+	Fields map[string]FieldStats `json:"fields"`
+}
+
 func (Notification) TableName() string {
 	return "notifications"
 }
@@ -139,6 +284,16 @@ func (r *DeviceRepository) GetByUserID(userID uint) ([]*Device, error) {
 	return devices, result.Error
 }
 
+// GetByUserIDs retrieves the devices of several users.
+func (r *DeviceRepository) GetByUserIDs(userIDs []uint) ([]*Device, error) {
+	var devices []*Device
+	if len(userIDs) == 0 {
+		return devices, nil
+	}
+	result := r.db.Where("user_id IN ?", userIDs).Order("user_id, id").Find(&devices)
+	return devices, result.Error
+}
+
 func (r *DeviceRepository) CreateDevice(device *Device) error {
 	return r.db.Create(device).Error
 }
@@ -152,22 +307,267 @@ func (r *DeviceRepository) GetBySerialNumber(serialNumber string) (*Device, erro
 	return &device, result.Error
 }
 
-// CreateLog creates a new log entry for a device.
-func (r *DeviceDataRepository) CreateLog(data *DeviceData) error {
-	return r.db.Create(data).Error
+// CreateLog creates a new log entry for a device. A log with the message ID or
+// measured_at of one already stored for the device is a duplicate: nothing is
+// inserted and it reports false.
+func (r *DeviceDataRepository) CreateLog(data *DeviceData) (bool, error) {
+	result := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(data)
+	return result.RowsAffected > 0, result.Error
+}
+
+// logBatchSize is how many logs go in one insert, well under Postgres' limit of
+// 65535 parameters a statement
+const logBatchSize = 500
+
+// CreateLogs creates log entries received together in one transaction and returns how
+// many were new. Duplicates, as for CreateLog, are skipped and keep a zero ID.
+func (r *DeviceDataRepository) CreateLogs(logs []*DeviceData) (int, error) {
+	if len(logs) == 0 {
+		return 0, nil
+	}
+
+	inserted := 0
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// Take the IDs from the sequence first. A multi-row insert that skips conflicts
+		// returns IDs only for the rows it inserted, which can't be told apart; with the
+		// IDs known, the skipped rows are the ones whose ID wasn't stored.
+		var ids []uint
+		if err := tx.Raw("SELECT nextval(pg_get_serial_sequence('device_data', 'id')) FROM generate_series(1, ?)", len(logs)).
+			Scan(&ids).Error; err != nil {
+			return err
+		}
+		if len(ids) != len(logs) {
+			return fmt.Errorf("reserved %d log IDs for %d logs", len(ids), len(logs))
+		}
+		for i, log := range logs {
+			log.ID = ids[i]
+		}
+
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(logs, logBatchSize).Error; err != nil {
+			return err
+		}
+
+		var stored []uint
+		if err := tx.Model(&DeviceData{}).Where("id IN ?", ids).Pluck("id", &stored).Error; err != nil {
+			return err
+		}
+		storedIDs := make(map[uint]bool, len(stored))
+		for _, id := range stored {
+			storedIDs[id] = true
+		}
+		for _, log := range logs {
+			if !storedIDs[log.ID] {
+				log.ID = 0
+			}
+		}
+		inserted = len(stored)
+		return nil
+	})
+	if err != nil {
+		for _, log := range logs {
+			log.ID = 0
+		}
+		return 0, err
+	}
+	return inserted, nil
 }
 
 // GetLogsByDeviceID retrieves all logs for a specific device using its DeviceID.
 func (r *DeviceDataRepository) GetLogsByDeviceID(deviceID uint) ([]*DeviceData, error) {
 	var logs []*DeviceData
-	result := r.db.Where("device_id = ?", deviceID).Order("created_at DESC").Find(&logs)
+	result := r.db.Where("device_id = ?", deviceID).Order(ReadingTimeSQL + " DESC").Find(&logs)
+	return logs, result.Error
+}
+
+// GetLogsPage retrieves one page of logs for a device, newest first, filtered by the query.
+func (r *DeviceDataRepository) GetLogsPage(deviceID uint, query LogQuery) ([]*DeviceData, error) {
+	tx := r.db.Where("device_id = ?", deviceID)
+	if !query.From.IsZero() {
+		tx = tx.Where(ReadingTimeSQL+" >= ?", query.From)
+	}
+	if !query.To.IsZero() {
+		tx = tx.Where(ReadingTimeSQL+" < ?", query.To)
+	}
+	if !query.BeforeTime.IsZero() {
+		// Keyset pagination: continue strictly after the last row of the previous page
+		tx = tx.Where("("+ReadingTimeSQL+", id) < (?, ?)", query.BeforeTime, query.BeforeID)
+	}
+	if len(query.Qualities) > 0 {
+		tx = tx.Where("quality IN ?", query.Qualities)
+	}
+	if query.Limit > 0 {
+		tx = tx.Limit(query.Limit)
+	}
+
+	var logs []*DeviceData
+	result := tx.Order(ReadingTimeSQL + " DESC, id DESC").Find(&logs)
+	return logs, result.Error
+}
+
+// ImportLogs stores a batch of a device's historical logs in one transaction and
+// returns how many were inserted. Logs are matched to stored ones by measured_at:
+// one with the reading time of a stored log is skipped. Times should be truncated to
+// microseconds, the database precision.
+func (r *DeviceDataRepository) ImportLogs(deviceID uint, logs []*DeviceData) (int, error) {
+	if len(logs) == 0 {
+		return 0, nil
+	}
+
+	inserted := 0
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// The unique index on measured_at catches the rest, but not readings stored
+		// without one, whose reading time is when they were received
+		times := make([]time.Time, 0, len(logs))
+		for _, log := range logs {
+			if log.MeasuredAt != nil {
+				times = append(times, *log.MeasuredAt)
+			}
+		}
+		var existing []time.Time
+		if err := tx.Model(&DeviceData{}).
+			Where("device_id = ? AND measured_at IS NULL AND created_at IN ?", deviceID, times).
+			Pluck("created_at", &existing).Error; err != nil {
+			return err
+		}
+		stored := make(map[int64]bool, len(existing))
+		for _, t := range existing {
+			stored[t.UnixMicro()] = true
+		}
+
+		fresh := make([]*DeviceData, 0, len(logs))
+		for _, log := range logs {
+			if log.MeasuredAt == nil || !stored[log.MeasuredAt.UnixMicro()] {
+				fresh = append(fresh, log)
+			}
+		}
+		if len(fresh) == 0 {
+			return nil
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&fresh)
+		if result.Error != nil {
+			return result.Error
+		}
+		inserted = int(result.RowsAffected)
+		return nil
+	})
+	return inserted, err
+}
+
+// StreamLogs calls fn for each log of the given devices, oldest first, filtered by the
+// query's time range and qualities. Rows are read through a cursor rather than loaded
+// at once; the log passed to fn is reused between calls. Streaming stops at the first
+// error fn returns.
+func (r *DeviceDataRepository) StreamLogs(deviceIDs []uint, query LogQuery, fn func(*DeviceData) error) error {
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+	tx := r.db.Model(&DeviceData{}).Where("device_id IN ?", deviceIDs)
+	if !query.From.IsZero() {
+		tx = tx.Where(ReadingTimeSQL+" >= ?", query.From)
+	}
+	if !query.To.IsZero() {
+		tx = tx.Where(ReadingTimeSQL+" < ?", query.To)
+	}
+	if len(query.Qualities) > 0 {
+		tx = tx.Where("quality IN ?", query.Qualities)
+	}
+
+	rows, err := tx.Order(ReadingTimeSQL + ", id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var log DeviceData
+	for rows.Next() {
+		log = DeviceData{}
+		if err := r.db.ScanRows(rows, &log); err != nil {
+			return err
+		}
+		if err := fn(&log); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetAggregatedLogs returns min/avg/max of each reading per time bucket, oldest bucket first.
+// The bucket must be BucketHour or BucketDay. Only logs with one of the given quality
+// flags are summarised unless qualities is empty.
+func (r *DeviceDataRepository) GetAggregatedLogs(deviceID uint, from, to time.Time, bucket string, qualities []string) ([]*DeviceDataBucket, error) {
+	if bucket != BucketHour && bucket != BucketDay {
+		return nil, fmt.Errorf("unsupported bucket size %q", bucket)
+	}
+
+	columns := []string{"date_trunc(?, " + ReadingTimeSQL + ") AS bucket", "count(*) AS count"}
+	for _, field := range AggregatedFields {
+		columns = append(columns, fmt.Sprintf("min(%[1]s), avg(%[1]s), max(%[1]s)", field))
+	}
+
+	tx := r.db.Model(&DeviceData{}).
+		Select(strings.Join(columns, ", "), bucket).
+		Where("device_id = ?", deviceID)
+	if !from.IsZero() {
+		tx = tx.Where(ReadingTimeSQL+" >= ?", from)
+	}
+	if !to.IsZero() {
+		tx = tx.Where(ReadingTimeSQL+" < ?", to)
+	}
+	if len(qualities) > 0 {
+		tx = tx.Where("quality IN ?", qualities)
+	}
+
+	rows, err := tx.Group("bucket").Order("bucket").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []*DeviceDataBucket
+	for rows.Next() {
+		b := &DeviceDataBucket{Fields: make(map[string]FieldStats, len(AggregatedFields))}
+		values := make([]sql.NullFloat64, len(AggregatedFields)*3)
+		dest := []interface{}{&b.Start, &b.Count}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, field := range AggregatedFields {
+			b.Fields[field] = FieldStats{
+				Min: values[i*3].Float64,
+				Avg: values[i*3+1].Float64,
+				Max: values[i*3+2].Float64,
+			}
+		}
+		buckets = append(buckets, b)
+	}
+
+	return buckets, rows.Err()
+}
+
+// GetLatestForDevices retrieves the most recent log of each of the given devices,
+// considering only logs with one of the given quality flags unless qualities is empty
+func (r *DeviceDataRepository) GetLatestForDevices(deviceIDs []uint, qualities []string) ([]*DeviceData, error) {
+	var logs []*DeviceData
+	if len(deviceIDs) == 0 {
+		return logs, nil
+	}
+	tx := r.db.Model(&DeviceData{}).Where("device_id IN ?", deviceIDs)
+	if len(qualities) > 0 {
+		tx = tx.Where("quality IN ?", qualities)
+	}
+	result := tx.Select("DISTINCT ON (device_id) *").
+		Order("device_id, " + ReadingTimeSQL + " DESC, id DESC").
+		Find(&logs)
 	return logs, result.Error
 }
 
 // GetLogsBySerialNumber retrieves all logs for a specific device using its SerialNumber.
 func (r *DeviceDataRepository) GetLogsBySerialNumber(serialNumber string) ([]*DeviceData, error) {
 	var logs []*DeviceData
-	result := r.db.Where("serial_number = ?", serialNumber).Order("created_at DESC").Find(&logs)
+	result := r.db.Where("serial_number = ?", serialNumber).Order(ReadingTimeSQL + " DESC").Find(&logs)
 	return logs, result.Error
 }
 
@@ -203,9 +603,11 @@ func (r *NotificationRepository) GetUnreadNotifications(userID uint) ([]*Notific
 	return notifications, result.Error
 }
 
-// MarkAsRead marks a notification as read
-func (r *NotificationRepository) MarkAsRead(id uint) error {
-	return r.db.Model(&Notification{}).Where("id = ?", id).Update("read", true).Error
+// MarkAsRead marks one of a user's notifications as read and reports whether the user
+// has a notification with that ID
+func (r *NotificationRepository) MarkAsRead(id, userID uint) (bool, error) {
+	tx := r.db.Model(&Notification{}).Where("id = ? AND user_id = ?", id, userID).Update("read", true)
+	return tx.RowsAffected > 0, tx.Error
 }
 
 // MarkAllAsRead marks all notifications for a user as read
@@ -213,9 +615,123 @@ func (r *NotificationRepository) MarkAllAsRead(userID uint) error {
 	return r.db.Model(&Notification{}).Where("user_id = ?", userID).Update("read", true).Error
 }
 
-// DeleteNotification deletes a notification by its ID
-func (r *NotificationRepository) DeleteNotification(id uint) error {
-	return r.db.Delete(&Notification{}, id).Error
+// DeleteNotification deletes one of a user's notifications and reports whether the
+// user had a notification with that ID
+func (r *NotificationRepository) DeleteNotification(id, userID uint) (bool, error) {
+	tx := r.db.Where("id = ? AND user_id = ?", id, userID).Delete(&Notification{})
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// MarkSeen records that a device was heard from and marks it online.
+// It reports whether the device was offline before.
+func (r *DeviceRepository) MarkSeen(id uint, at time.Time) (bool, error) {
+	var device Device
+	if err := r.db.Select("id", "connectivity").First(&device, id).Error; err != nil {
+		return false, err
+	}
+
+	err := r.db.Model(&Device{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"last_seen_at": at,
+		"connectivity": ConnectivityOnline,
+	}).Error
+	return device.Connectivity == ConnectivityOffline, err
+}
+
+// MarkOffline marks a device offline. It reports false if the device was already
+// offline, so callers only act on the transition once.
+func (r *DeviceRepository) MarkOffline(id uint) (bool, error) {
+	tx := r.db.Model(&Device{}).
+		Where("id = ? AND connectivity <> ?", id, ConnectivityOffline).
+		Update("connectivity", ConnectivityOffline)
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// MarkFault records a sensor fault notification unless one was recorded after since.
+// It reports whether the owner should be notified.
+func (r *DeviceRepository) MarkFault(id uint, at, since time.Time) (bool, error) {
+	tx := r.db.Model(&Device{}).
+		Where("id = ? AND (last_fault_at IS NULL OR last_fault_at < ?)", id, since).
+		Update("last_fault_at", at)
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// GetOverdue retrieves online devices that have not been seen for missed reporting
+// intervals. Devices without their own interval use defaultInterval.
+func (r *DeviceRepository) GetOverdue(now time.Time, defaultInterval time.Duration, missed int) ([]*Device, error) {
+	var devices []*Device
+	result := r.db.Where("connectivity = ? AND last_seen_at IS NOT NULL", ConnectivityOnline).
+		Where("last_seen_at + COALESCE(NULLIF(report_interval_seconds, 0), ?) * ? * interval '1 second' < ?",
+			int(defaultInterval.Seconds()), missed, now).
+		Find(&devices)
+	return devices, result.Error
+}
+
+// SetReportInterval stores the expected time between a device's readings
+func (r *DeviceRepository) SetReportInterval(id uint, seconds int) error {
+	return r.db.Model(&Device{}).Where("id = ?", id).Update("report_interval_seconds", seconds).Error
+}
+
+// SetRefillPoint stores the soil moisture a device's field should be irrigated at
+func (r *DeviceRepository) SetRefillPoint(id uint, refillPoint float64) error {
+	return r.db.Model(&Device{}).Where("id = ?", id).Update("refill_point", refillPoint).Error
+}
+
+// MarkIrrigationNotice records an irrigation notice unless one was recorded after since.
+// It reports whether the owner should be notified.
+func (r *DeviceRepository) MarkIrrigationNotice(id uint, at, since time.Time) (bool, error) {
+	tx := r.db.Model(&Device{}).
+		Where("id = ? AND (irrigation_notice_at IS NULL OR irrigation_notice_at < ?)", id, since).
+		Update("irrigation_notice_at", at)
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// SetCrop stores the crop planted at a device and when it was planted
+func (r *DeviceRepository) SetCrop(id uint, cropID *uint, plantedAt *time.Time) error {
+	return r.db.Model(&Device{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"crop_profile_id": cropID,
+		"planted_at":      plantedAt,
+	}).Error
+}
+
+// SetKey stores the hash and public key of a new ingestion key for a device, replacing
+// any previous key
+func (r *DeviceRepository) SetKey(id uint, keyHash, publicKey string, issuedAt time.Time) error {
+	return r.db.Model(&Device{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"key_hash":      keyHash,
+		"key_public":    publicKey,
+		"key_issued_at": issuedAt,
+	}).Error
+}
+
+// GetByFieldIDs retrieves the devices assigned to any of the given fields
+func (r *DeviceRepository) GetByFieldIDs(fieldIDs []uint) ([]*Device, error) {
+	var devices []*Device
+	if len(fieldIDs) == 0 {
+		return devices, nil
+	}
+	result := r.db.Where("field_id IN ?", fieldIDs).Order("field_id, id").Find(&devices)
+	return devices, result.Error
+}
+
+// GetSuggestedForField retrieves the unassigned devices suggested for a field
+func (r *DeviceRepository) GetSuggestedForField(fieldID uint) ([]*Device, error) {
+	var devices []*Device
+	result := r.db.Where("suggested_field_id = ? AND field_id IS NULL", fieldID).Order("id").Find(&devices)
+	return devices, result.Error
+}
+
+// SetField assigns a device to a field, or unassigns it when fieldID is nil.
+// Any pending field suggestion is cleared.
+func (r *DeviceRepository) SetField(id uint, fieldID *uint) error {
+	return r.db.Model(&Device{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"field_id":           fieldID,
+		"suggested_field_id": nil,
+	}).Error
+}
+
+// SetSuggestedField records the field a device appears to be in
+func (r *DeviceRepository) SetSuggestedField(id uint, fieldID *uint) error {
+	return r.db.Model(&Device{}).Where("id = ?", id).Update("suggested_field_id", fieldID).Error
 }
 
 // DeleteByID deletes a device by its ID
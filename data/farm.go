@@ -0,0 +1,178 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Farm groups the fields of one user
+type Farm struct {
+	gorm.Model
+	UserID      uint           `gorm:"index;not null" json:"user_id"`
+	Name        string         `gorm:"type:varchar(100);not null" json:"name"`
+	Description string         `gorm:"type:text" json:"description"`
+	Fields      []Field        `json:"fields,omitempty"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// Field is an area of a farm with a GeoJSON boundary. The bounding box of the
+// boundary is stored so fields containing a point can be found quickly.
+type Field struct {
+	gorm.Model
+	FarmID        uint            `gorm:"index;not null" json:"farm_id"`
+	UserID        uint            `gorm:"index;not null" json:"user_id"` // owner of the farm
+	Name          string          `gorm:"type:varchar(100);not null" json:"name"`
+	Boundary      json.RawMessage `json:"boundary"` // GeoJSON Polygon or MultiPolygon
+	MinLat        float64         `json:"-"`
+	MaxLat        float64         `json:"-"`
+	MinLng        float64         `json:"-"`
+	MaxLng        float64         `json:"-"`
+	CropProfileID *uint           `json:"crop_profile_id"` // crop planted in the field
+	PlantedAt     *time.Time      `json:"planted_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+	DeletedAt     gorm.DeletedAt  `gorm:"index" json:"-"`
+}
+
+// SetBoundary validates a GeoJSON boundary and stores it with its bounding box
+func (f *Field) SetBoundary(raw json.RawMessage) error {
+	boundary, err := ParseBoundary(raw)
+	if err != nil {
+		return err
+	}
+	f.Boundary = raw
+	f.MinLat, f.MaxLat = boundary.MinLat, boundary.MaxLat
+	f.MinLng, f.MaxLng = boundary.MinLng, boundary.MaxLng
+	return nil
+}
+
+// Contains reports whether a point lies inside the field's boundary
+func (f *Field) Contains(lng, lat float64) bool {
+	boundary, err := ParseBoundary(f.Boundary)
+	if err != nil {
+		return false
+	}
+	return boundary.Contains(lng, lat)
+}
+
+// FarmRepository implements FarmInterface using GORM
+type FarmRepository struct {
+	db *gorm.DB
+}
+
+// NewFarmRepository creates a new instance of FarmRepository
+func NewFarmRepository(db *gorm.DB) FarmInterface {
+	return &FarmRepository{db: db}
+}
+
+// CreateFarm creates a new farm
+func (r *FarmRepository) CreateFarm(farm *Farm) error {
+	return r.db.Create(farm).Error
+}
+
+// GetFarm retrieves a farm by its ID, including its fields
+func (r *FarmRepository) GetFarm(id uint) (*Farm, error) {
+	var farm Farm
+	result := r.db.Preload("Fields").First(&farm, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &farm, result.Error
+}
+
+// GetFarmsByUserIDs retrieves the farms of the given users, including their fields
+func (r *FarmRepository) GetFarmsByUserIDs(userIDs []uint) ([]*Farm, error) {
+	var farms []*Farm
+	if len(userIDs) == 0 {
+		return farms, nil
+	}
+	result := r.db.Preload("Fields").Where("user_id IN ?", userIDs).Order("user_id, name").Find(&farms)
+	return farms, result.Error
+}
+
+// UpdateFarm saves changes to a farm
+func (r *FarmRepository) UpdateFarm(farm *Farm) error {
+	return r.db.Omit("Fields").Save(farm).Error
+}
+
+// DeleteFarm deletes a farm and its fields, leaving their devices unassigned
+func (r *FarmRepository) DeleteFarm(id uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var fieldIDs []uint
+		if err := tx.Model(&Field{}).Where("farm_id = ?", id).Pluck("id", &fieldIDs).Error; err != nil {
+			return err
+		}
+		if err := unassignFieldDevices(tx, fieldIDs); err != nil {
+			return err
+		}
+		if err := tx.Where("farm_id = ?", id).Delete(&Field{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Farm{}, id).Error
+	})
+}
+
+// CreateField creates a new field
+func (r *FarmRepository) CreateField(field *Field) error {
+	return r.db.Create(field).Error
+}
+
+// GetField retrieves a field by its ID
+func (r *FarmRepository) GetField(id uint) (*Field, error) {
+	var field Field
+	result := r.db.First(&field, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &field, result.Error
+}
+
+// GetFieldsAt retrieves a user's fields whose bounding box contains a point.
+// Callers check the boundary itself with Field.Contains.
+func (r *FarmRepository) GetFieldsAt(userID uint, lng, lat float64) ([]*Field, error) {
+	var fields []*Field
+	result := r.db.Where("user_id = ?", userID).
+		Where("min_lng <= ? AND max_lng >= ? AND min_lat <= ? AND max_lat >= ?", lng, lng, lat, lat).
+		Order("id").
+		Find(&fields)
+	return fields, result.Error
+}
+
+// UpdateField saves changes to a field
+func (r *FarmRepository) UpdateField(field *Field) error {
+	return r.db.Save(field).Error
+}
+
+// SetFieldCrop stores the crop planted in a field and when it was planted
+func (r *FarmRepository) SetFieldCrop(id uint, cropID *uint, plantedAt *time.Time) error {
+	return r.db.Model(&Field{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"crop_profile_id": cropID,
+		"planted_at":      plantedAt,
+	}).Error
+}
+
+// DeleteField deletes a field, leaving its devices unassigned
+func (r *FarmRepository) DeleteField(id uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := unassignFieldDevices(tx, []uint{id}); err != nil {
+			return err
+		}
+		return tx.Delete(&Field{}, id).Error
+	})
+}
+
+// unassignFieldDevices clears the field and field suggestion of devices in the given fields
+func unassignFieldDevices(tx *gorm.DB, fieldIDs []uint) error {
+	if len(fieldIDs) == 0 {
+		return nil
+	}
+	if err := tx.Model(&Device{}).Where("field_id IN ?", fieldIDs).Update("field_id", nil).Error; err != nil {
+		return err
+	}
+	return tx.Model(&Device{}).Where("suggested_field_id IN ?", fieldIDs).Update("suggested_field_id", nil).Error
+}
@@ -0,0 +1,111 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Boundary is a parsed GeoJSON Polygon or MultiPolygon. Each polygon is a list of
+// rings of [longitude, latitude] positions; rings after the first are holes.
+type Boundary struct {
+	Polygons [][][][2]float64
+	MinLat   float64
+	MaxLat   float64
+	MinLng   float64
+	MaxLng   float64
+}
+
+// ParseBoundary parses and validates a GeoJSON Polygon or MultiPolygon geometry
+func ParseBoundary(raw json.RawMessage) (*Boundary, error) {
+	var geometry struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	}
+	if err := json.Unmarshal(raw, &geometry); err != nil {
+		return nil, errors.New("boundary must be a GeoJSON geometry")
+	}
+
+	var polygons [][][][2]float64
+	switch geometry.Type {
+	case "Polygon":
+		var polygon [][][2]float64
+		if err := json.Unmarshal(geometry.Coordinates, &polygon); err != nil {
+			return nil, errors.New("invalid Polygon coordinates")
+		}
+		polygons = append(polygons, polygon)
+	case "MultiPolygon":
+		if err := json.Unmarshal(geometry.Coordinates, &polygons); err != nil {
+			return nil, errors.New("invalid MultiPolygon coordinates")
+		}
+	default:
+		return nil, errors.New("boundary must be a GeoJSON Polygon or MultiPolygon")
+	}
+
+	if len(polygons) == 0 {
+		return nil, errors.New("boundary has no polygons")
+	}
+
+	b := &Boundary{Polygons: polygons, MinLat: 90, MaxLat: -90, MinLng: 180, MaxLng: -180}
+	for _, polygon := range polygons {
+		if len(polygon) == 0 {
+			return nil, errors.New("polygon has no rings")
+		}
+		for _, ring := range polygon {
+			if len(ring) < 4 {
+				return nil, errors.New("each ring needs at least four positions")
+			}
+			if ring[0] != ring[len(ring)-1] {
+				return nil, errors.New("each ring must end at its first position")
+			}
+			for _, p := range ring {
+				lng, lat := p[0], p[1]
+				if lng < -180 || lng > 180 || lat < -90 || lat > 90 {
+					return nil, fmt.Errorf("position [%g, %g] is out of range", lng, lat)
+				}
+				b.MinLng = min(b.MinLng, lng)
+				b.MaxLng = max(b.MaxLng, lng)
+				b.MinLat = min(b.MinLat, lat)
+				b.MaxLat = max(b.MaxLat, lat)
+			}
+		}
+	}
+
+	return b, nil
+}
+
+// Contains reports whether a point lies inside the boundary and outside its holes
+func (b *Boundary) Contains(lng, lat float64) bool {
+	if lng < b.MinLng || lng > b.MaxLng || lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	for _, polygon := range b.Polygons {
+		if !ringContains(polygon[0], lng, lat) {
+			continue
+		}
+		inHole := false
+		for _, hole := range polygon[1:] {
+			if ringContains(hole, lng, lat) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// ringContains tests a point against a closed ring by ray casting
+func ringContains(ring [][2]float64, lng, lat float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && lng < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
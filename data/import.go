@@ -0,0 +1,76 @@
+package data
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Import job states
+const (
+	ImportPending     = "pending"
+	ImportRunning     = "running"
+	ImportCompleted   = "completed"
+	ImportFailed      = "failed"
+	ImportInterrupted = "interrupted" // stopped before the end of the file, resumed by its job
+)
+
+// ImportRowError is a row of an import file that was rejected
+type ImportRowError struct {
+	Row   int    `json:"row"` // line of the file
+	Error string `json:"error"`
+}
+
+// ImportJob tracks the import of a file of historical readings into a device's logs
+type ImportJob struct {
+	gorm.Model
+	DeviceID       uint             `gorm:"index;not null" json:"device_id"`
+	SerialNumber   string           `gorm:"type:varchar(100);not null" json:"serial_number"`
+	UserID         uint             `json:"user_id"`
+	Format         string           `gorm:"type:varchar(10);not null" json:"format"` // csv or ndjson
+	Status         string           `gorm:"type:varchar(20);index;not null" json:"status"`
+	Progress       float64          `json:"progress"` // percentage of the file read
+	RowsRead       int              `json:"rows_read"`
+	Inserted       int              `json:"inserted"`
+	Duplicates     int              `json:"duplicates"` // rows already stored or repeated in the file
+	Rejected       int              `json:"rejected"`
+	Errors         []ImportRowError `gorm:"serializer:json;type:text" json:"errors"` // the first rejected rows
+	IgnoredColumns []string         `gorm:"serializer:json;type:text" json:"ignored_columns"`
+	Message        string           `gorm:"type:text" json:"message,omitempty"` // why the import failed
+	StartedAt      *time.Time       `json:"started_at"`
+	FinishedAt     *time.Time       `json:"finished_at"`
+	CreatedAt      time.Time        `json:"created_at"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+	DeletedAt      gorm.DeletedAt   `gorm:"index" json:"-"`
+}
+
+// ImportRepository implements ImportInterface using GORM
+type ImportRepository struct {
+	db *gorm.DB
+}
+
+// NewImportRepository creates a new instance of ImportRepository
+func NewImportRepository(db *gorm.DB) ImportInterface {
+	return &ImportRepository{db: db}
+}
+
+// CreateJob stores a new import job
+func (r *ImportRepository) CreateJob(job *ImportJob) error {
+	return r.db.Create(job).Error
+}
+
+// GetJob retrieves an import job by its ID
+func (r *ImportRepository) GetJob(id uint) (*ImportJob, error) {
+	var job ImportJob
+	result := r.db.First(&job, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &job, result.Error
+}
+
+// UpdateJob saves the progress and outcome of an import job
+func (r *ImportRepository) UpdateJob(job *ImportJob) error {
+	return r.db.Save(job).Error
+}
@@ -1,5 +1,7 @@
 package data
 
+import "time"
+
 // UserInterface defines the methods that must be implemented by a User repository
 type UserInterface interface {
 	GetAll() ([]*User, error)
@@ -10,11 +12,15 @@ type UserInterface interface {
 	Delete(user *User) error
 	DeleteByID(id uint) error
 	ResetPassword(userID uint, newPassword string) error
+	UpdateRole(userID uint, role string) error
 	PasswordMatches(user *User, plainText string) (bool, error)
 	// OTP Related methods
 	GenerateAndSaveOTP(email string) (string, error)
 	VerifyOTP(email, otp string) (bool, error)
 	ResetPasswordWithOTP(email, otp, newPassword string) error
+	// Email verification methods
+	GenerateVerificationCode(userID uint) (string, error)
+	VerifyEmail(email, code string) (bool, error)
 }
 
 // DeviceInterface defines the methods for Device operations.
@@ -23,18 +29,38 @@ type DeviceInterface interface {
 	GetOne(id uint) (*Device, error)
 	AssignDevice(userID uint, device *Device) error
 	GetByUserID(userID uint) ([]*Device, error)
+	GetByUserIDs(userIDs []uint) ([]*Device, error)
 	CreateDevice(device *Device) error
 	GetBySerialNumber(serialNumber string) (*Device, error)
 	Update(device *Device) error
 	GetUnclaimedDevices() ([]*Device, error)
 	DeleteByID(id uint) error
+	MarkSeen(id uint, at time.Time) (bool, error)
+	MarkOffline(id uint) (bool, error)
+	MarkFault(id uint, at, since time.Time) (bool, error)
+	GetOverdue(now time.Time, defaultInterval time.Duration, missed int) ([]*Device, error)
+	SetReportInterval(id uint, seconds int) error
+	SetKey(id uint, keyHash, publicKey string, issuedAt time.Time) error
+	SetRefillPoint(id uint, refillPoint float64) error
+	SetCrop(id uint, cropID *uint, plantedAt *time.Time) error
+	MarkIrrigationNotice(id uint, at, since time.Time) (bool, error)
+	GetByFieldIDs(fieldIDs []uint) ([]*Device, error)
+	GetSuggestedForField(fieldID uint) ([]*Device, error)
+	SetField(id uint, fieldID *uint) error
+	SetSuggestedField(id uint, fieldID *uint) error
 	// Add other methods as needed
 }
 
 // DeviceDataInterface defines the methods for DeviceData operations.
 type DeviceDataInterface interface {
-	CreateLog(data *DeviceData) error
+	CreateLog(data *DeviceData) (bool, error)
+	CreateLogs(logs []*DeviceData) (int, error)
 	GetLogsByDeviceID(deviceID uint) ([]*DeviceData, error)
+	GetLogsPage(deviceID uint, query LogQuery) ([]*DeviceData, error)
+	ImportLogs(deviceID uint, logs []*DeviceData) (int, error)
+	StreamLogs(deviceIDs []uint, query LogQuery, fn func(*DeviceData) error) error
+	GetAggregatedLogs(deviceID uint, from, to time.Time, bucket string, qualities []string) ([]*DeviceDataBucket, error)
+	GetLatestForDevices(deviceIDs []uint, qualities []string) ([]*DeviceData, error)
 	GetLogsBySerialNumber(serialNumber string) ([]*DeviceData, error)
 	DeleteByDeviceID(deviceID uint) error
 }
@@ -44,7 +70,127 @@ type NotificationInterface interface {
 	CreateNotification(notification *Notification) error
 	GetUserNotifications(userID uint) ([]*Notification, error)
 	GetUnreadNotifications(userID uint) ([]*Notification, error)
-	MarkAsRead(id uint) error
+	MarkAsRead(id, userID uint) (bool, error)
 	MarkAllAsRead(userID uint) error
-	DeleteNotification(id uint) error
+	DeleteNotification(id, userID uint) (bool, error)
+	GetNotification(id uint) (*Notification, error)
+	GetPreference(userID uint) (*NotificationPreference, error)
+	SavePreference(preference *NotificationPreference) error
+	GetPushSubscriptions(userID uint) ([]*PushSubscription, error)
+	GetPushSubscription(id uint) (*PushSubscription, error)
+	SavePushSubscription(subscription *PushSubscription) error
+	DeletePushSubscription(userID uint, endpoint string) (bool, error)
+	DeletePushSubscriptionByID(id uint) error
+	EnqueueDeliveries(deliveries []*NotificationDelivery) error
+	ClaimDueDeliveries(now time.Time, limit int, lease time.Duration) ([]*NotificationDelivery, error)
+	SaveDeliveryAttempt(delivery *NotificationDelivery) error
+	GetDeliveries(notificationID uint) ([]*NotificationDelivery, error)
+	PurgeDeliveries(before time.Time) (int64, error)
+	ClaimDueDigests(digest string, sentBefore, now time.Time, limit int) ([]*NotificationPreference, error)
+}
+
+// AlertRuleInterface defines the methods for AlertRule operations
+type AlertRuleInterface interface {
+	CreateRule(rule *AlertRule) error
+	GetRule(id uint) (*AlertRule, error)
+	GetUserRules(userID uint) ([]*AlertRule, error)
+	GetRulesForDevice(device *Device) ([]*AlertRule, error)
+	UpdateRule(rule *AlertRule) error
+	DeleteRule(id uint) error
+	GetState(ruleID, deviceID uint) (*AlertState, error)
+	SaveState(state *AlertState) error
+	SeedDefaultRules() error
+}
+
+// CommandInterface defines the methods for DeviceCommand operations
+type CommandInterface interface {
+	CreateCommand(command *DeviceCommand) error
+	GetByCommandID(commandID string) (*DeviceCommand, error)
+	GetDeviceCommands(deviceID uint, limit int) ([]*DeviceCommand, error)
+	GetRetryable(sentBefore time.Time) ([]*DeviceCommand, error)
+	MarkSent(id uint, attempts int, sentAt time.Time) error
+	MarkAttempt(id uint, attempts int, sentAt time.Time) error
+	Complete(commandID, status, result string, at time.Time) (bool, error)
+	ExpireCommands(now time.Time) (int64, error)
+}
+
+// ImportInterface defines the methods for ImportJob operations
+type ImportInterface interface {
+	CreateJob(job *ImportJob) error
+	GetJob(id uint) (*ImportJob, error)
+	UpdateJob(job *ImportJob) error
+}
+
+// AssignmentInterface defines the methods for agronomist assignments
+type AssignmentInterface interface {
+	Assign(agronomistID, farmerID uint) error
+	Unassign(agronomistID, farmerID uint) error
+	GetFarmerIDs(agronomistID uint) ([]uint, error)
+	IsAssigned(agronomistID, farmerID uint) (bool, error)
+	GetAll() ([]*Assignment, error)
+}
+
+// TokenInterface defines the methods for login sessions and token revocation
+type TokenInterface interface {
+	CreateRefreshToken(token *RefreshToken) error
+	GetRefreshToken(tokenHash string) (*RefreshToken, error)
+	RotateRefreshToken(current *RefreshToken, next *RefreshToken) (bool, error)
+	RevokeFamily(familyID string) error
+	RevokeUserTokens(userID uint) error
+	RevokeJTI(jti string, expiresAt time.Time) error
+	IsRevoked(jti string) (bool, error)
+	PurgeExpired(now time.Time) (int64, error)
+}
+
+// FarmInterface defines the methods for farms and their fields
+type FarmInterface interface {
+	CreateFarm(farm *Farm) error
+	GetFarm(id uint) (*Farm, error)
+	GetFarmsByUserIDs(userIDs []uint) ([]*Farm, error)
+	UpdateFarm(farm *Farm) error
+	DeleteFarm(id uint) error
+	CreateField(field *Field) error
+	GetField(id uint) (*Field, error)
+	GetFieldsAt(userID uint, lng, lat float64) ([]*Field, error)
+	UpdateField(field *Field) error
+	SetFieldCrop(id uint, cropID *uint, plantedAt *time.Time) error
+	DeleteField(id uint) error
+}
+
+// CropInterface defines the methods for crop profiles
+type CropInterface interface {
+	GetAll() ([]*CropProfile, error)
+	GetOne(id uint) (*CropProfile, error)
+	Create(crop *CropProfile) error
+	Update(crop *CropProfile) error
+	SeedDefaultCrops() error
+}
+
+// JobInterface defines the methods for the background job queue
+type JobInterface interface {
+	Enqueue(job *Job) error
+	ClaimDue(now time.Time, limit int, lease time.Duration) ([]*Job, error)
+	SaveAttempt(job *Job) error
+	GetJobs(status string, limit int) ([]*Job, error)
+	Retry(id uint, at time.Time) (bool, error)
+	Purge(doneBefore, deadBefore time.Time) (int64, error)
+	Hold(id uint, until time.Time) error
+}
+
+// WebhookInterface defines the methods for webhooks and their delivery outbox
+type WebhookInterface interface {
+	CreateWebhook(webhook *Webhook) error
+	GetWebhook(id uint) (*Webhook, error)
+	GetUserWebhooks(userID uint) ([]*Webhook, error)
+	GetSubscribers(userID uint, event string) ([]*Webhook, error)
+	UpdateWebhook(webhook *Webhook) error
+	DeleteWebhook(id uint) error
+	Enqueue(deliveries []*WebhookDelivery) error
+	ClaimDue(now time.Time, limit int, lease time.Duration) ([]*WebhookDelivery, error)
+	MarkDelivered(delivery *WebhookDelivery) error
+	MarkFailed(delivery *WebhookDelivery) error
+	GetDeliveries(webhookID uint, status string, limit int) ([]*WebhookDelivery, error)
+	GetDelivery(id uint) (*WebhookDelivery, error)
+	Redeliver(id uint, at time.Time) (bool, error)
+	PurgeDeliveries(before time.Time) (int64, error)
 }
@@ -0,0 +1,114 @@
+package data
+
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Job states
+const (
+	JobPending = "pending" // waiting for its first or next attempt
+	JobDone    = "done"    // ran successfully
+	JobDead    = "dead"    // every attempt failed; kept for inspection and retry
+)
+
+// Job is a background task queued in Postgres, such as sending an email. Workers
+// claim due jobs so each runs once even with several API instances.
+type Job struct {
+	ID          uint            `gorm:"primarykey" json:"id"`
+	Type        string          `gorm:"type:varchar(50);not null" json:"type"`
+	Payload     json.RawMessage `gorm:"not null" json:"-"` // may hold secrets such as OTPs
+	Status      string          `gorm:"type:varchar(20);not null;index:idx_jobs_due,priority:1" json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `gorm:"not null" json:"max_attempts"`
+	RunAt       time.Time       `gorm:"index:idx_jobs_due,priority:2" json:"run_at"`
+	LastError   string          `gorm:"type:text" json:"last_error,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at"`
+	CreatedAt   time.Time       `gorm:"index" json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// JobRepository implements JobInterface using GORM
+type JobRepository struct {
+	db *gorm.DB
+}
+
+// NewJobRepository creates a new instance of JobRepository
+func NewJobRepository(db *gorm.DB) JobInterface {
+	return &JobRepository{db: db}
+}
+
+// Enqueue adds a job to the queue
+func (r *JobRepository) Enqueue(job *Job) error {
+	return r.db.Create(job).Error
+}
+
+// ClaimDue takes up to limit pending jobs that are due and holds them for the lease
+// by moving their run time forward, so other workers skip them. A worker that dies
+// mid-job leaves it to be retried once the lease runs out.
+func (r *JobRepository) ClaimDue(now time.Time, limit int, lease time.Duration) ([]*Job, error) {
+	var jobs []*Job
+	err := r.db.Raw(`
+		UPDATE jobs SET run_at = ?, updated_at = ?
+		WHERE id IN (
+			SELECT id FROM jobs
+			WHERE status = ? AND run_at <= ?
+			ORDER BY run_at, id
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		now.Add(lease), now, JobPending, now, limit).Scan(&jobs).Error
+	return jobs, err
+}
+
+// Hold keeps a claimed job from other workers until the given time, for jobs that may
+// run longer than the lease they were claimed with
+func (r *JobRepository) Hold(id uint, until time.Time) error {
+	return r.db.Model(&Job{}).Where("id = ? AND status = ?", id, JobPending).Update("run_at", until).Error
+}
+
+// SaveAttempt records the outcome of running a job
+func (r *JobRepository) SaveAttempt(job *Job) error {
+	return r.db.Model(job).Updates(map[string]interface{}{
+		"status":      job.Status,
+		"attempts":    job.Attempts,
+		"run_at":      job.RunAt,
+		"last_error":  job.LastError,
+		"finished_at": job.FinishedAt,
+	}).Error
+}
+
+// GetJobs retrieves the most recent jobs, optionally only those with the given status
+func (r *JobRepository) GetJobs(status string, limit int) ([]*Job, error) {
+	tx := r.db.Model(&Job{})
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	var jobs []*Job
+	result := tx.Order("created_at DESC, id DESC").Limit(limit).Find(&jobs)
+	return jobs, result.Error
+}
+
+// Retry moves a dead job back to pending with fresh attempts. It reports false if
+// the job wasn't dead.
+func (r *JobRepository) Retry(id uint, at time.Time) (bool, error) {
+	tx := r.db.Model(&Job{}).
+		Where("id = ? AND status = ?", id, JobDead).
+		Updates(map[string]interface{}{
+			"status":   JobPending,
+			"attempts": 0,
+			"run_at":   at,
+		})
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// Purge deletes jobs that finished before doneBefore and dead jobs created before
+// deadBefore, and returns how many were removed
+func (r *JobRepository) Purge(doneBefore, deadBefore time.Time) (int64, error) {
+	tx := r.db.Where("(status = ? AND finished_at < ?) OR (status = ? AND created_at < ?)",
+		JobDone, doneBefore, JobDead, deadBefore).Delete(&Job{})
+	return tx.RowsAffected, tx.Error
+}
@@ -0,0 +1,92 @@
+package data
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SchemaMigration records a migration that has been applied
+type SchemaMigration struct {
+	Name      string    `gorm:"type:varchar(100);primaryKey"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// migrationLock is the advisory lock that keeps instances starting together from
+// applying the same migration twice
+const migrationLock = 7206
+
+// migrations are schema and data changes AutoMigrate can't express, such as indexes on
+// expressions. Each runs once, in order, and is recorded by name; never rename one.
+var migrations = []struct {
+	name string
+	run  func(tx *gorm.DB) error
+}{
+	{
+		name: "index device logs by reading time",
+		run: func(tx *gorm.DB) error {
+			return tx.Exec("CREATE INDEX IF NOT EXISTS idx_device_data_reading_time ON device_data (device_id, (" + ReadingTimeSQL + "), id)").Error
+		},
+	},
+	{
+		name: "reset self-assigned roles",
+		run:  resetUnknownRoles,
+	},
+}
+
+// RunMigrations applies the migrations not applied yet, after AutoMigrate
+func RunMigrations(db *gorm.DB) error {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLock).Error; err != nil {
+				return err
+			}
+			var applied int64
+			if err := tx.Model(&SchemaMigration{}).Where("name = ?", m.name).Count(&applied).Error; err != nil {
+				return err
+			}
+			if applied > 0 {
+				return nil
+			}
+			if err := m.run(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Name: m.name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %v", m.name, err)
+		}
+	}
+	return nil
+}
+
+// resetUnknownRoles makes farmers of users with any role but farmer or agronomist and
+// signs them out. Signup used to take the role from the request body, so admin roles
+// from before roles were enforced can't be trusted; admins are granted again with the
+// -make-admin flag.
+func resetUnknownRoles(tx *gorm.DB) error {
+	var ids []uint
+	if err := tx.Unscoped().Model(&User{}).
+		Where("role IS NULL OR role NOT IN ?", []string{RoleFarmer, RoleAgronomist}).
+		Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := tx.Unscoped().Model(&User{}).Where("id IN ?", ids).Update("role", RoleFarmer).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := revokeUserTokens(tx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -9,6 +9,15 @@ type Models struct {
 	Device       DeviceInterface
 	DeviceData   DeviceDataInterface
 	Notification NotificationInterface
+	AlertRule    AlertRuleInterface
+	Command      CommandInterface
+	Assignment   AssignmentInterface
+	Token        TokenInterface
+	Farm         FarmInterface
+	Crop         CropInterface
+	Import       ImportInterface
+	Webhook      WebhookInterface
+	Job          JobInterface
 	// Add other repositories like Plan here if needed
 }
 
@@ -19,6 +28,15 @@ func New(gormDB *gorm.DB) Models {
 		Device:       NewDeviceRepository(gormDB),
 		DeviceData:   NewDeviceDataRepository(gormDB),
 		Notification: NewNotificationRepository(gormDB),
+		AlertRule:    NewAlertRuleRepository(gormDB),
+		Command:      NewCommandRepository(gormDB),
+		Assignment:   NewAssignmentRepository(gormDB),
+		Token:        NewTokenRepository(gormDB),
+		Farm:         NewFarmRepository(gormDB),
+		Crop:         NewCropRepository(gormDB),
+		Import:       NewImportRepository(gormDB),
+		Webhook:      NewWebhookRepository(gormDB),
+		Job:          NewJobRepository(gormDB),
 		// Initialize other repositories here
 	}
 }
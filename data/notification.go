@@ -0,0 +1,196 @@
+package data
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// NotificationPreference holds how a user wants notifications sent outside the app
+type NotificationPreference struct {
+	ID           uint                `gorm:"primarykey" json:"-"`
+	UserID       uint                `gorm:"uniqueIndex;not null" json:"user_id"`
+	Phone        string              `gorm:"type:varchar(20)" json:"phone"`             // E.164 number for SMS
+	Channels     map[string][]string `gorm:"serializer:json;type:text" json:"channels"` // severity to channels, e.g. "alert": ["email", "sms"]
+	Digest       string              `gorm:"type:varchar(10);index" json:"digest"`      // daily or weekly summary email, none when empty
+	DigestSentAt *time.Time          `json:"digest_sent_at"`                            // when the last digest was sent
+	CreatedAt    time.Time           `json:"created_at"`
+	UpdatedAt    time.Time           `json:"updated_at"`
+}
+
+// Digest frequencies
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// PushSubscription is a browser a user has allowed to receive push notifications
+type PushSubscription struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	UserID    uint      `gorm:"index;not null" json:"user_id"`
+	Endpoint  string    `gorm:"type:text;uniqueIndex;not null" json:"endpoint"`
+	P256dh    string    `gorm:"type:varchar(100);not null" json:"-"` // the browser's public key
+	Auth      string    `gorm:"type:varchar(50);not null" json:"-"`  // the browser's auth secret
+	UserAgent string    `gorm:"type:text" json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NotificationDelivery is a notification waiting to be sent over one channel, or the
+// record of it. Its status uses the webhook delivery states.
+type NotificationDelivery struct {
+	ID                 uint       `gorm:"primarykey" json:"id"`
+	NotificationID     uint       `gorm:"index;not null" json:"notification_id"`
+	UserID             uint       `gorm:"not null" json:"user_id"`
+	Channel            string     `gorm:"type:varchar(20);not null" json:"channel"`
+	Address            string     `gorm:"type:text" json:"address"` // email address, phone number or push endpoint
+	PushSubscriptionID *uint      `json:"push_subscription_id,omitempty"`
+	Status             string     `gorm:"type:varchar(20);not null;index:idx_notification_deliveries_due,priority:1" json:"status"`
+	Attempts           int        `json:"attempts"`
+	NextAttemptAt      time.Time  `gorm:"index:idx_notification_deliveries_due,priority:2" json:"next_attempt_at"`
+	LastAttemptAt      *time.Time `json:"last_attempt_at"`
+	LastError          string     `gorm:"type:text" json:"last_error,omitempty"`
+	DeliveredAt        *time.Time `json:"delivered_at"`
+	CreatedAt          time.Time  `gorm:"index" json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+}
+
+// GetNotification retrieves a notification by its ID
+func (r *NotificationRepository) GetNotification(id uint) (*Notification, error) {
+	var notification Notification
+	result := r.db.First(&notification, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &notification, result.Error
+}
+
+// GetPreference retrieves a user's notification preferences, or nil if they have
+// never set any
+func (r *NotificationRepository) GetPreference(userID uint) (*NotificationPreference, error) {
+	var preference NotificationPreference
+	result := r.db.Where("user_id = ?", userID).First(&preference)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &preference, result.Error
+}
+
+// SavePreference creates or replaces a user's notification preferences
+func (r *NotificationRepository) SavePreference(preference *NotificationPreference) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"phone", "channels", "digest", "updated_at"}),
+	}).Create(preference).Error
+}
+
+// GetPushSubscriptions retrieves a user's push subscriptions
+func (r *NotificationRepository) GetPushSubscriptions(userID uint) ([]*PushSubscription, error) {
+	var subscriptions []*PushSubscription
+	result := r.db.Where("user_id = ?", userID).Order("id").Find(&subscriptions)
+	return subscriptions, result.Error
+}
+
+// GetPushSubscription retrieves a push subscription by its ID
+func (r *NotificationRepository) GetPushSubscription(id uint) (*PushSubscription, error) {
+	var subscription PushSubscription
+	result := r.db.First(&subscription, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &subscription, result.Error
+}
+
+// SavePushSubscription stores a push subscription. A browser subscribing again keeps
+// its endpoint, so the existing row is taken over with the new keys and user.
+func (r *NotificationRepository) SavePushSubscription(subscription *PushSubscription) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "endpoint"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "p256dh", "auth", "user_agent", "updated_at"}),
+	}).Create(subscription).Error
+}
+
+// DeletePushSubscription deletes a user's subscription by its endpoint and reports
+// whether it existed
+func (r *NotificationRepository) DeletePushSubscription(userID uint, endpoint string) (bool, error) {
+	tx := r.db.Where("user_id = ? AND endpoint = ?", userID, endpoint).Delete(&PushSubscription{})
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// DeletePushSubscriptionByID deletes a subscription the push service reported gone
+func (r *NotificationRepository) DeletePushSubscriptionByID(id uint) error {
+	return r.db.Delete(&PushSubscription{}, id).Error
+}
+
+// EnqueueDeliveries adds deliveries to the outbox
+func (r *NotificationRepository) EnqueueDeliveries(deliveries []*NotificationDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return r.db.CreateInBatches(deliveries, 500).Error
+}
+
+// ClaimDueDeliveries takes up to limit pending deliveries that are due and holds
+// them for the lease, as WebhookRepository.ClaimDue does
+func (r *NotificationRepository) ClaimDueDeliveries(now time.Time, limit int, lease time.Duration) ([]*NotificationDelivery, error) {
+	var deliveries []*NotificationDelivery
+	err := r.db.Raw(`
+		UPDATE notification_deliveries SET next_attempt_at = ?, updated_at = ?
+		WHERE id IN (
+			SELECT id FROM notification_deliveries
+			WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		now.Add(lease), now, DeliveryPending, now, limit).Scan(&deliveries).Error
+	return deliveries, err
+}
+
+// ClaimDueDigests takes up to limit preferences for the given digest frequency whose
+// last digest was sent before sentBefore, or never, and marks them sent at now. Each
+// digest is claimed by one instance only.
+func (r *NotificationRepository) ClaimDueDigests(digest string, sentBefore, now time.Time, limit int) ([]*NotificationPreference, error) {
+	var preferences []*NotificationPreference
+	err := r.db.Raw(`
+		UPDATE notification_preferences SET digest_sent_at = ?
+		WHERE id IN (
+			SELECT id FROM notification_preferences
+			WHERE digest = ? AND (digest_sent_at IS NULL OR digest_sent_at <= ?)
+			ORDER BY id
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		now, digest, sentBefore, limit).Scan(&preferences).Error
+	return preferences, err
+}
+
+// SaveDeliveryAttempt records the outcome of an attempt to send a delivery
+func (r *NotificationRepository) SaveDeliveryAttempt(delivery *NotificationDelivery) error {
+	return r.db.Model(delivery).Updates(map[string]interface{}{
+		"status":          delivery.Status,
+		"attempts":        delivery.Attempts,
+		"next_attempt_at": delivery.NextAttemptAt,
+		"last_attempt_at": delivery.LastAttemptAt,
+		"last_error":      delivery.LastError,
+		"delivered_at":    delivery.DeliveredAt,
+	}).Error
+}
+
+// GetDeliveries retrieves the deliveries of a notification
+func (r *NotificationRepository) GetDeliveries(notificationID uint) ([]*NotificationDelivery, error) {
+	var deliveries []*NotificationDelivery
+	result := r.db.Where("notification_id = ?", notificationID).Order("id").Find(&deliveries)
+	return deliveries, result.Error
+}
+
+// PurgeDeliveries deletes finished deliveries older than the given time and returns
+// how many were removed
+func (r *NotificationRepository) PurgeDeliveries(before time.Time) (int64, error) {
+	tx := r.db.Where("status <> ? AND created_at < ?", DeliveryPending, before).Delete(&NotificationDelivery{})
+	return tx.RowsAffected, tx.Error
+}
@@ -0,0 +1,149 @@
+package data
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RefreshToken is one refresh token of a login session. Each refresh replaces the
+// token with a new one in the same family, so a family is one session.
+type RefreshToken struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	UserID          uint       `gorm:"index;not null" json:"user_id"`
+	FamilyID        string     `gorm:"type:varchar(64);index;not null" json:"family_id"`
+	TokenHash       string     `gorm:"type:varchar(64);uniqueIndex;not null" json:"-"` // SHA-256 of the token
+	AccessJTI       string     `gorm:"type:varchar(64)" json:"-"`                      // access token issued alongside it
+	AccessExpiresAt time.Time  `json:"-"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	RevokedAt       *time.Time `json:"revoked_at"` // set when used, logged out or revoked
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// RevokedToken is an access token that must be rejected until it expires
+type RevokedToken struct {
+	JTI       string    `gorm:"type:varchar(64);primaryKey" json:"jti"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TokenRepository implements TokenInterface using GORM
+type TokenRepository struct {
+	db *gorm.DB
+}
+
+// NewTokenRepository creates a new instance of TokenRepository
+func NewTokenRepository(db *gorm.DB) TokenInterface {
+	return &TokenRepository{db: db}
+}
+
+// CreateRefreshToken stores the first refresh token of a new session
+func (r *TokenRepository) CreateRefreshToken(token *RefreshToken) error {
+	return r.db.Create(token).Error
+}
+
+// GetRefreshToken retrieves a refresh token by its hash
+func (r *TokenRepository) GetRefreshToken(tokenHash string) (*RefreshToken, error) {
+	var token RefreshToken
+	result := r.db.Where("token_hash = ?", tokenHash).First(&token)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &token, result.Error
+}
+
+// RotateRefreshToken marks a refresh token as used and stores its replacement.
+// It reports false if the token had already been used or revoked.
+func (r *TokenRepository) RotateRefreshToken(current *RefreshToken, next *RefreshToken) (bool, error) {
+	rotated := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&RefreshToken{}).
+			Where("id = ? AND revoked_at IS NULL", current.ID).
+			Update("revoked_at", time.Now())
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		rotated = true
+		return tx.Create(next).Error
+	})
+	return rotated, err
+}
+
+// RevokeFamily revokes every refresh token of a session and the access tokens issued with them
+func (r *TokenRepository) RevokeFamily(familyID string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return revokeTokens(tx, "family_id", familyID)
+	})
+}
+
+// RevokeUserTokens revokes every session of a user
+func (r *TokenRepository) RevokeUserTokens(userID uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return revokeUserTokens(tx, userID)
+	})
+}
+
+// RevokeJTI rejects an access token until it expires
+func (r *TokenRepository) RevokeJTI(jti string, expiresAt time.Time) error {
+	return denyJTIs(r.db, []RevokedToken{{JTI: jti, ExpiresAt: expiresAt}})
+}
+
+// IsRevoked reports whether an access token has been revoked
+func (r *TokenRepository) IsRevoked(jti string) (bool, error) {
+	var count int64
+	result := r.db.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count)
+	return count > 0, result.Error
+}
+
+// PurgeExpired deletes refresh tokens and revocations that can no longer be used
+func (r *TokenRepository) PurgeExpired(now time.Time) (int64, error) {
+	var purged int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("expires_at < ?", now).Delete(&RefreshToken{})
+		if result.Error != nil {
+			return result.Error
+		}
+		purged += result.RowsAffected
+		result = tx.Where("expires_at < ?", now).Delete(&RevokedToken{})
+		purged += result.RowsAffected
+		return result.Error
+	})
+	return purged, err
+}
+
+// revokeUserTokens revokes every session of a user inside a transaction
+func revokeUserTokens(tx *gorm.DB, userID uint) error {
+	return revokeTokens(tx, "user_id", userID)
+}
+
+// revokeTokens revokes the refresh tokens whose column matches value and denies their access tokens
+func revokeTokens(tx *gorm.DB, column string, value interface{}) error {
+	now := time.Now()
+
+	// Access tokens issued before a rotation stay valid until they expire, so they
+	// are denied as well as the ones issued with the live refresh tokens
+	var issued []RefreshToken
+	if err := tx.Where(column+" = ? AND access_jti <> '' AND access_expires_at > ?", value, now).Find(&issued).Error; err != nil {
+		return err
+	}
+
+	var denied []RevokedToken
+	for _, token := range issued {
+		denied = append(denied, RevokedToken{JTI: token.AccessJTI, ExpiresAt: token.AccessExpiresAt})
+	}
+	if err := denyJTIs(tx, denied); err != nil {
+		return err
+	}
+
+	return tx.Model(&RefreshToken{}).Where(column+" = ? AND revoked_at IS NULL", value).Update("revoked_at", now).Error
+}
+
+// denyJTIs adds access tokens to the revocation list, ignoring ones already on it
+func denyJTIs(db *gorm.DB, tokens []RevokedToken) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&tokens).Error
+}
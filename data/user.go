@@ -1,7 +1,10 @@
 package data
 
 import (
+	crand "crypto/rand"
 	"errors"
+	"fmt"
+	"math/big"
 	"math/rand"
 	"strconv"
 	"time"
@@ -21,10 +24,39 @@ type User struct {
 	CreatedAt    time.Time      `json:"created_at"`
 	UpdatedAt    time.Time      `json:"updated_at"`
 	Role         string         `gorm:"type:varchar(50);" json:"role,omitempty"`
+	Locale       string         `gorm:"type:varchar(10)" json:"locale,omitempty"` // language of emails, e.g. "sw"; English when empty
 	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
 	// OTP fields
 	OTPCode      string    `gorm:"type:varchar(6)" json:"-"`
 	OTPExpiresAt time.Time `json:"-"`
+	// Email verification fields
+	EmailVerifiedAt       *time.Time `json:"email_verified_at"`
+	VerificationCode      string     `gorm:"type:varchar(6)" json:"-"`
+	VerificationExpiresAt time.Time  `json:"-"`
+	VerificationAttempts  int        `gorm:"not null;default:0" json:"-"` // wrong guesses at the current code
+}
+
+// OTPValidity is how long a password reset OTP can be used
+const OTPValidity = 15 * time.Minute
+
+const (
+	// VerificationValidity is how long an email verification code can be used
+	VerificationValidity = time.Hour
+	// MaxVerificationAttempts is the number of wrong guesses after which a
+	// verification code stops working and a new one must be sent
+	MaxVerificationAttempts = 5
+)
+
+// User roles
+const (
+	RoleAdmin      = "admin"      // full access, including the admin endpoints
+	RoleAgronomist = "agronomist" // read-only access to the devices of assigned farmers
+	RoleFarmer     = "farmer"     // owns and manages their own devices
+)
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleAgronomist || role == RoleFarmer
 }
 
 // UserRepository implements UserInterface using GORM.
@@ -136,8 +168,32 @@ func (r *UserRepository) ResetPassword(userID uint, newPassword string) error {
 	}
 
 	user.Password = hashedPassword
-	result := r.db.Save(&user)
-	return result.Error
+
+	// Save the new password and sign out every existing session
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&user).Error; err != nil {
+			return err
+		}
+		return revokeUserTokens(tx, user.ID)
+	})
+}
+
+// UpdateRole changes a user's role. A change signs out every session of the user, so
+// no token keeps carrying the old role.
+func (r *UserRepository) UpdateRole(userID uint, role string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var user User
+		if err := tx.Select("id", "role").First(&user, userID).Error; err != nil {
+			return err
+		}
+		if user.Role == role {
+			return nil
+		}
+		if err := tx.Model(&user).Update("role", role).Error; err != nil {
+			return err
+		}
+		return revokeUserTokens(tx, user.ID)
+	})
 }
 
 // PasswordMatches checks if the provided plain text password matches the stored hashed password.
@@ -164,9 +220,9 @@ func (r *UserRepository) GenerateAndSaveOTP(email string) (string, error) {
 	otpNum := 100000 + rand.New(rand.NewSource(time.Now().UnixNano())).Intn(900000)
 	otp := strconv.Itoa(otpNum)
 
-	// Set OTP and expiration (15 minutes from now)
+	// Set OTP and expiration
 	user.OTPCode = otp
-	user.OTPExpiresAt = time.Now().Add(15 * time.Minute)
+	user.OTPExpiresAt = time.Now().Add(OTPValidity)
 
 	// Save the user with the new OTP
 	if err := r.db.Save(&user).Error; err != nil {
@@ -222,6 +278,62 @@ func (r *UserRepository) ResetPasswordWithOTP(email, otp, newPassword string) er
 	user.Password = hashedPassword
 	user.OTPCode = ""
 
-	// Save the changes
-	return r.db.Save(&user).Error
+	// Save the changes and sign out every existing session
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&user).Error; err != nil {
+			return err
+		}
+		return revokeUserTokens(tx, user.ID)
+	})
+}
+
+// GenerateVerificationCode gives a user a new 6-digit email verification code,
+// replacing any earlier one
+func (r *UserRepository) GenerateVerificationCode(userID uint) (string, error) {
+	n, err := crand.Int(crand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	result := r.db.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"verification_code":       code,
+		"verification_expires_at": time.Now().Add(VerificationValidity),
+		"verification_attempts":   0,
+	})
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", gorm.ErrRecordNotFound
+	}
+	return code, nil
+}
+
+// VerifyEmail marks the user's email verified if code is their current, unexpired
+// verification code. A wrong code counts against the code's attempts, and the code
+// is cleared once they are used up.
+func (r *UserRepository) VerifyEmail(email, code string) (bool, error) {
+	now := time.Now()
+	result := r.db.Model(&User{}).
+		Where("email = ? AND verification_code = ? AND verification_code <> '' AND verification_expires_at > ?", email, code, now).
+		Updates(map[string]interface{}{
+			"email_verified_at":     now,
+			"verification_code":     "",
+			"verification_attempts": 0,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	err := r.db.Model(&User{}).
+		Where("email = ? AND verification_code <> ''", email).
+		Updates(map[string]interface{}{
+			"verification_attempts": gorm.Expr("verification_attempts + 1"),
+			"verification_code":     gorm.Expr("CASE WHEN verification_attempts + 1 >= ? THEN '' ELSE verification_code END", MaxVerificationAttempts),
+		}).Error
+	return false, err
 }
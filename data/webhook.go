@@ -0,0 +1,226 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Webhook event types
+const (
+	EventReadingCreated      = "reading.created"
+	EventNotificationCreated = "notification.created"
+	EventDeviceClaimed       = "device.claimed"
+	EventDeviceOffline       = "device.offline"
+)
+
+// WebhookEvents lists the event types a webhook can subscribe to
+var WebhookEvents = []string{EventReadingCreated, EventNotificationCreated, EventDeviceClaimed, EventDeviceOffline}
+
+// Webhook delivery states
+const (
+	DeliveryPending   = "pending"   // waiting for its first or next attempt
+	DeliveryDelivered = "delivered" // the endpoint answered with a 2xx status
+	DeliveryDead      = "dead"      // every attempt failed; kept for inspection and redelivery
+)
+
+// Webhook is a user's subscription to events, posted to their URL
+type Webhook struct {
+	gorm.Model
+	UserID      uint           `gorm:"index;not null" json:"user_id"`
+	URL         string         `gorm:"type:text;not null" json:"url"`
+	Secret      string         `gorm:"type:varchar(100);not null" json:"-"` // key of the HMAC signature
+	Events      []string       `gorm:"serializer:json;type:text" json:"events"`
+	Description string         `gorm:"type:text" json:"description"`
+	Active      bool           `gorm:"default:true" json:"active"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// Subscribes reports whether the webhook receives the event type
+func (w *Webhook) Subscribes(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is an event waiting to be posted to a webhook, or the record of
+// its delivery. Deliveries form the outbox the delivery worker reads.
+type WebhookDelivery struct {
+	ID             uint            `gorm:"primarykey" json:"id"`
+	WebhookID      uint            `gorm:"index;not null" json:"webhook_id"`
+	EventID        string          `gorm:"type:varchar(64);not null" json:"event_id"` // the same for every webhook receiving the event
+	EventType      string          `gorm:"type:varchar(50);not null" json:"event_type"`
+	Payload        json.RawMessage `gorm:"not null" json:"payload"`
+	Status         string          `gorm:"type:varchar(20);not null;index:idx_webhook_deliveries_due,priority:1" json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `gorm:"index:idx_webhook_deliveries_due,priority:2" json:"next_attempt_at"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `gorm:"type:text" json:"last_error,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+	CreatedAt      time.Time       `gorm:"index" json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+// WebhookRepository implements WebhookInterface using GORM
+type WebhookRepository struct {
+	db *gorm.DB
+}
+
+// NewWebhookRepository creates a new instance of WebhookRepository
+func NewWebhookRepository(db *gorm.DB) WebhookInterface {
+	return &WebhookRepository{db: db}
+}
+
+// CreateWebhook stores a new webhook
+func (r *WebhookRepository) CreateWebhook(webhook *Webhook) error {
+	return r.db.Create(webhook).Error
+}
+
+// GetWebhook retrieves a webhook by its ID
+func (r *WebhookRepository) GetWebhook(id uint) (*Webhook, error) {
+	var webhook Webhook
+	result := r.db.First(&webhook, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &webhook, result.Error
+}
+
+// GetUserWebhooks retrieves a user's webhooks
+func (r *WebhookRepository) GetUserWebhooks(userID uint) ([]*Webhook, error) {
+	var webhooks []*Webhook
+	result := r.db.Where("user_id = ?", userID).Order("id").Find(&webhooks)
+	return webhooks, result.Error
+}
+
+// GetSubscribers retrieves a user's active webhooks that receive the event type
+func (r *WebhookRepository) GetSubscribers(userID uint, event string) ([]*Webhook, error) {
+	var webhooks []*Webhook
+	if err := r.db.Where("user_id = ? AND active", userID).Find(&webhooks).Error; err != nil {
+		return nil, err
+	}
+	subscribers := webhooks[:0]
+	for _, webhook := range webhooks {
+		if webhook.Subscribes(event) {
+			subscribers = append(subscribers, webhook)
+		}
+	}
+	return subscribers, nil
+}
+
+// UpdateWebhook saves changes to a webhook
+func (r *WebhookRepository) UpdateWebhook(webhook *Webhook) error {
+	return r.db.Save(webhook).Error
+}
+
+// DeleteWebhook deletes a webhook and drops its undelivered events
+func (r *WebhookRepository) DeleteWebhook(id uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ? AND status = ?", id, DeliveryPending).Delete(&WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Webhook{}, id).Error
+	})
+}
+
+// Enqueue adds deliveries to the outbox
+func (r *WebhookRepository) Enqueue(deliveries []*WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return r.db.CreateInBatches(deliveries, 500).Error
+}
+
+// ClaimDue takes up to limit pending deliveries that are due and holds them for the
+// lease by moving their next attempt forward, so other workers skip them. A worker
+// that dies mid-delivery leaves them to be retried once the lease runs out.
+func (r *WebhookRepository) ClaimDue(now time.Time, limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	err := r.db.Raw(`
+		UPDATE webhook_deliveries SET next_attempt_at = ?, updated_at = ?
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		now.Add(lease), now, DeliveryPending, now, limit).Scan(&deliveries).Error
+	return deliveries, err
+}
+
+// MarkDelivered records a successful attempt
+func (r *WebhookRepository) MarkDelivered(delivery *WebhookDelivery) error {
+	return r.db.Model(delivery).Updates(map[string]interface{}{
+		"status":           DeliveryDelivered,
+		"attempts":         delivery.Attempts,
+		"last_attempt_at":  delivery.LastAttemptAt,
+		"last_status_code": delivery.LastStatusCode,
+		"last_error":       "",
+		"delivered_at":     delivery.DeliveredAt,
+	}).Error
+}
+
+// MarkFailed records a failed attempt, with the time of the next one or, once the
+// delivery is dead, without
+func (r *WebhookRepository) MarkFailed(delivery *WebhookDelivery) error {
+	return r.db.Model(delivery).Updates(map[string]interface{}{
+		"status":           delivery.Status,
+		"attempts":         delivery.Attempts,
+		"next_attempt_at":  delivery.NextAttemptAt,
+		"last_attempt_at":  delivery.LastAttemptAt,
+		"last_status_code": delivery.LastStatusCode,
+		"last_error":       delivery.LastError,
+	}).Error
+}
+
+// GetDeliveries retrieves a webhook's most recent deliveries, optionally only those
+// with the given status
+func (r *WebhookRepository) GetDeliveries(webhookID uint, status string, limit int) ([]*WebhookDelivery, error) {
+	tx := r.db.Where("webhook_id = ?", webhookID)
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	var deliveries []*WebhookDelivery
+	result := tx.Order("created_at DESC, id DESC").Limit(limit).Find(&deliveries)
+	return deliveries, result.Error
+}
+
+// GetDelivery retrieves a delivery by its ID
+func (r *WebhookRepository) GetDelivery(id uint) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	result := r.db.First(&delivery, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &delivery, result.Error
+}
+
+// Redeliver moves a dead delivery back to pending with fresh attempts. It reports
+// false if the delivery wasn't dead.
+func (r *WebhookRepository) Redeliver(id uint, at time.Time) (bool, error) {
+	tx := r.db.Model(&WebhookDelivery{}).
+		Where("id = ? AND status = ?", id, DeliveryDead).
+		Updates(map[string]interface{}{
+			"status":          DeliveryPending,
+			"attempts":        0,
+			"next_attempt_at": at,
+		})
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// PurgeDeliveries deletes delivered events older than the given time and returns
+// how many were removed. Dead deliveries are kept.
+func (r *WebhookRepository) PurgeDeliveries(before time.Time) (int64, error) {
+	tx := r.db.Where("status = ? AND created_at < ?", DeliveryDelivered, before).Delete(&WebhookDelivery{})
+	return tx.RowsAffected, tx.Error
+}
@@ -0,0 +1,125 @@
+package analysis
+
+import (
+	"math"
+	"time"
+)
+
+// Default growing degree day and chill hour settings, in °C
+const (
+	DefaultGDDBase = 10.0
+	DefaultGDDCap  = 30.0
+	ChillMin       = 0.0
+	ChillMax       = 7.2 // 45°F, the classic chilling hours model
+	dateLayout     = "2006-01-02"
+)
+
+// HourlyClimate is the temperature and humidity of one hour
+type HourlyClimate struct {
+	Start        time.Time
+	MinTemp      float64
+	MeanTemp     float64
+	MaxTemp      float64
+	MeanHumidity float64 // relative humidity, %
+}
+
+// DayIndices holds the agronomic indices of one local day. Totals run from the first day.
+type DayIndices struct {
+	Date            string   `json:"date"`
+	Hours           int      `json:"hours"` // hours with readings
+	MinTemp         float64  `json:"min_temp"`
+	MaxTemp         float64  `json:"max_temp"`
+	GDD             float64  `json:"gdd"`
+	GDDTotal        float64  `json:"gdd_total"`
+	ChillHours      int      `json:"chill_hours"`
+	ChillHoursTotal int      `json:"chill_hours_total"`
+	MeanVPD         *float64 `json:"mean_vpd_kpa"` // null without humidity readings
+	MaxVPD          *float64 `json:"max_vpd_kpa"`
+}
+
+// DailyIndices groups hourly climate sorted by time into days in loc and computes
+// growing degree days with the given base and upper cap temperatures, chill hours and
+// vapour pressure deficit. Days without readings are left out; their GDD and chill
+// hours count as zero in the totals. So do days whose temperatures are all zero, which
+// come from devices without a temperature sensor.
+func DailyIndices(hours []HourlyClimate, loc *time.Location, base, upper float64) []DayIndices {
+	var days []DayIndices
+	var gddTotal float64
+	var chillTotal int
+	var vpdSum float64
+	var vpdCount int
+	var hasTemp bool
+
+	finish := func() {
+		d := &days[len(days)-1]
+		if hasTemp {
+			d.GDD = GrowingDegreeDays(d.MinTemp, d.MaxTemp, base, upper)
+		} else {
+			d.ChillHours = 0
+		}
+		gddTotal += d.GDD
+		chillTotal += d.ChillHours
+		d.GDDTotal = gddTotal
+		d.ChillHoursTotal = chillTotal
+		if vpdCount > 0 {
+			mean := vpdSum / float64(vpdCount)
+			d.MeanVPD = &mean
+		}
+		vpdSum, vpdCount = 0, 0
+		hasTemp = false
+	}
+
+	for _, h := range hours {
+		date := h.Start.In(loc).Format(dateLayout)
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			if len(days) > 0 {
+				finish()
+			}
+			days = append(days, DayIndices{Date: date, MinTemp: h.MinTemp, MaxTemp: h.MaxTemp})
+		}
+
+		d := &days[len(days)-1]
+		d.Hours++
+		d.MinTemp = math.Min(d.MinTemp, h.MinTemp)
+		d.MaxTemp = math.Max(d.MaxTemp, h.MaxTemp)
+		if h.MinTemp != 0 || h.MeanTemp != 0 || h.MaxTemp != 0 {
+			hasTemp = true
+		}
+		if h.MeanTemp >= ChillMin && h.MeanTemp <= ChillMax {
+			d.ChillHours++
+		}
+		// Zero humidity is a device without a humidity sensor
+		if h.MeanHumidity > 0 {
+			vpd := VapourPressureDeficit(h.MeanTemp, h.MeanHumidity)
+			vpdSum += vpd
+			vpdCount++
+			if d.MaxVPD == nil || vpd > *d.MaxVPD {
+				d.MaxVPD = &vpd
+			}
+		}
+	}
+	if len(days) > 0 {
+		finish()
+	}
+
+	return days
+}
+
+// GrowingDegreeDays computes one day's growing degree days by the modified average
+// method: temperatures are held between the base and the upper cap before averaging.
+func GrowingDegreeDays(minTemp, maxTemp, base, upper float64) float64 {
+	clamp := func(t float64) float64 { return math.Max(base, math.Min(upper, t)) }
+	return (clamp(minTemp)+clamp(maxTemp))/2 - base
+}
+
+// SaturationVapourPressure returns the saturation vapour pressure in kPa at a
+// temperature in °C (Tetens equation)
+func SaturationVapourPressure(temp float64) float64 {
+	return 0.6108 * math.Exp(17.27*temp/(temp+237.3))
+}
+
+// VapourPressureDeficit returns the vapour pressure deficit in kPa of air at a
+// temperature in °C and relative humidity in %
+func VapourPressureDeficit(temp, humidity float64) float64 {
+	return SaturationVapourPressure(temp) * (1 - math.Min(humidity, 100)/100)
+}
@@ -0,0 +1,134 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestGrowingDegreeDays(t *testing.T) {
+	tests := []struct {
+		name             string
+		minTemp, maxTemp float64
+		base, upper      float64
+		want             float64
+	}{
+		{"between base and cap", 12, 24, DefaultGDDBase, DefaultGDDCap, 8},
+		{"cool night held at the base", 5, 20, DefaultGDDBase, DefaultGDDCap, 5},
+		{"hot afternoon held at the cap", 20, 35, DefaultGDDBase, DefaultGDDCap, 15},
+		{"below the base all day", 2, 8, DefaultGDDBase, DefaultGDDCap, 0},
+		{"above the cap all day", 32, 40, DefaultGDDBase, DefaultGDDCap, DefaultGDDCap - DefaultGDDBase},
+		{"other base and cap", 0, 15, 5, 25, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GrowingDegreeDays(tt.minTemp, tt.maxTemp, tt.base, tt.upper); got != tt.want {
+				t.Errorf("GrowingDegreeDays(%g, %g) = %g, want %g", tt.minTemp, tt.maxTemp, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDailyIndices(t *testing.T) {
+	// hour returns an hour of climate starting h hours after seriesStart
+	hour := func(h int, minTemp, meanTemp, maxTemp, humidity float64) HourlyClimate {
+		return HourlyClimate{
+			Start:        seriesStart.Add(time.Duration(h) * time.Hour),
+			MinTemp:      minTemp,
+			MeanTemp:     meanTemp,
+			MaxTemp:      maxTemp,
+			MeanHumidity: humidity,
+		}
+	}
+	eat := time.FixedZone("EAT", 3*60*60)
+
+	// want is one day's indices; noVPD marks a day without humidity readings
+	type want struct {
+		date             string
+		hours            int
+		minTemp, maxTemp float64
+		gdd, gddTotal    float64
+		chill, chillTot  int
+		meanVPD          float64
+		noVPD            bool
+	}
+
+	tests := []struct {
+		name  string
+		hours []HourlyClimate
+		loc   *time.Location
+		want  []want
+	}{
+		{
+			name: "empty",
+			loc:  time.UTC,
+		},
+		{
+			name:  "one day",
+			hours: []HourlyClimate{hour(0, 4, 5, 6, 0), hour(1, 14, 18, 22, 0)},
+			loc:   time.UTC,
+			want: []want{
+				{date: "2024-03-01", hours: 2, minTemp: 4, maxTemp: 22, gdd: 6, gddTotal: 6, chill: 1, chillTot: 1, noVPD: true},
+			},
+		},
+		{
+			name:  "totals run past a day without readings",
+			hours: []HourlyClimate{hour(0, 4, 5, 6, 0), hour(1, 14, 18, 22, 0), hour(48, 12, 16, 20, 0)},
+			loc:   time.UTC,
+			want: []want{
+				{date: "2024-03-01", hours: 2, minTemp: 4, maxTemp: 22, gdd: 6, gddTotal: 6, chill: 1, chillTot: 1, noVPD: true},
+				{date: "2024-03-03", hours: 1, minTemp: 12, maxTemp: 20, gdd: 6, gddTotal: 12, chill: 0, chillTot: 1, noVPD: true},
+			},
+		},
+		{
+			name:  "days without a temperature sensor add nothing",
+			hours: []HourlyClimate{hour(0, 0, 0, 0, 60), hour(1, 0, 0, 0, 60), hour(24, 4, 5, 6, 0)},
+			loc:   time.UTC,
+			want: []want{
+				{date: "2024-03-01", hours: 2, gdd: 0, gddTotal: 0, chill: 0, chillTot: 0, meanVPD: 0.6108 * 0.4},
+				{date: "2024-03-02", hours: 1, minTemp: 4, maxTemp: 6, gdd: 0, gddTotal: 0, chill: 1, chillTot: 1, noVPD: true},
+			},
+		},
+		{
+			name:  "a real freeze is still counted",
+			hours: []HourlyClimate{hour(0, -2, 0, 2, 0)},
+			loc:   time.UTC,
+			want: []want{
+				{date: "2024-03-01", hours: 1, minTemp: -2, maxTemp: 2, gdd: 0, gddTotal: 0, chill: 1, chillTot: 1, noVPD: true},
+			},
+		},
+		{
+			name:  "days follow the local clock",
+			hours: []HourlyClimate{hour(20, 12, 14, 16, 50), hour(21, 12, 14, 16, 50)},
+			loc:   eat,
+			want: []want{
+				{date: "2024-03-01", hours: 1, minTemp: 12, maxTemp: 16, gdd: 4, gddTotal: 4, meanVPD: VapourPressureDeficit(14, 50)},
+				{date: "2024-03-02", hours: 1, minTemp: 12, maxTemp: 16, gdd: 4, gddTotal: 8, meanVPD: VapourPressureDeficit(14, 50)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			days := DailyIndices(tt.hours, tt.loc, DefaultGDDBase, DefaultGDDCap)
+			if len(days) != len(tt.want) {
+				t.Fatalf("%d days, want %d", len(days), len(tt.want))
+			}
+			for i, w := range tt.want {
+				d := days[i]
+				got := want{date: d.Date, hours: d.Hours, minTemp: d.MinTemp, maxTemp: d.MaxTemp,
+					gdd: d.GDD, gddTotal: d.GDDTotal, chill: d.ChillHours, chillTot: d.ChillHoursTotal, noVPD: d.MeanVPD == nil}
+				if d.MeanVPD != nil {
+					got.meanVPD = *d.MeanVPD
+				}
+				if math.Abs(got.meanVPD-w.meanVPD) < 1e-9 {
+					got.meanVPD = w.meanVPD
+				}
+				if got != w {
+					t.Errorf("day %d = %+v, want %+v", i, got, w)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Anomaly checks
+const (
+	CheckRange    = "range"    // value outside what the sensor can physically report
+	CheckStep     = "step"     // change from the previous reading too large to be real
+	CheckFlatline = "flatline" // value stuck for longer than the metric ever stays constant
+	CheckOutlier  = "outlier"  // far from recent readings by the median absolute deviation
+	CheckBusDrop  = "bus_drop" // nitrogen, phosphorous and potassium all zero at once
+)
+
+const (
+	// OutlierScore is the modified z-score beyond which a reading is an outlier
+	OutlierScore = 3.5
+	// MinOutlierHistory is the fewest previous readings the outlier check needs
+	MinOutlierHistory = 12
+	// StepWindow is the longest gap between readings the step check applies to
+	StepWindow = time.Hour
+)
+
+// Limits are the plausible values of one metric
+type Limits struct {
+	Min      float64
+	Max      float64
+	MaxStep  float64       // largest change between readings within StepWindow, 0 to skip
+	Flatline time.Duration // longest time the value may stay identical, 0 to skip
+}
+
+// SensorLimits holds the limits of each metric a device reports
+var SensorLimits = map[string]Limits{
+	"temperature":      {Min: -40, Max: 60, MaxStep: 15, Flatline: 6 * time.Hour},
+	"humidity":         {Min: 0, Max: 100, MaxStep: 40, Flatline: 6 * time.Hour},
+	"soil_temperature": {Min: -20, Max: 60, MaxStep: 10, Flatline: 12 * time.Hour},
+	"soil_moisture":    {Min: 0, Max: 100, MaxStep: 50, Flatline: 24 * time.Hour},
+	"soil_humidity":    {Min: 0, Max: 100, MaxStep: 50},
+	"ph":               {Min: 2, Max: 12, MaxStep: 2},
+	"nitrogen":         {Min: 0, Max: 1999},
+	"phosphorous":      {Min: 0, Max: 1999},
+	"potassium":        {Min: 0, Max: 1999},
+}
+
+// npkMetrics are read from one soil probe over a shared bus
+var npkMetrics = []string{"nitrogen", "phosphorous", "potassium"}
+
+// Issue is one problem found with a reading
+type Issue struct {
+	Metric string `json:"metric,omitempty"`
+	Check  string `json:"check"`
+	Detail string `json:"detail"`
+	Fault  bool   `json:"fault"` // the sensor is misreporting, rather than the value being unusual
+}
+
+// DetectAnomalies checks the values of a reading taken at a time against the same
+// device's earlier readings, given oldest first per metric without faulty readings.
+//
+// A metric that reads zero and has never read anything else is treated as a sensor the
+// device doesn't have and is skipped.
+func DetectAnomalies(values map[string]float64, at time.Time, history map[string][]Point) []Issue {
+	var issues []Issue
+
+	metrics := make([]string, 0, len(values))
+	for metric := range values {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	for _, metric := range metrics {
+		limits, ok := SensorLimits[metric]
+		if !ok || !fitted(values[metric], history[metric]) {
+			continue
+		}
+		issues = append(issues, checkMetric(metric, values[metric], at, limits, history[metric])...)
+	}
+
+	npkZero, npkFitted := true, false
+	for _, metric := range npkMetrics {
+		value, ok := values[metric]
+		npkZero = npkZero && ok && value == 0
+		npkFitted = npkFitted || hasNonZero(history[metric])
+	}
+	if npkZero && npkFitted {
+		issues = append(issues, Issue{
+			Check:  CheckBusDrop,
+			Detail: "nitrogen, phosphorous and potassium all read zero",
+			Fault:  true,
+		})
+	}
+
+	return issues
+}
+
+// HasFault reports whether any of the issues is a sensor fault
+func HasFault(issues []Issue) bool {
+	for _, issue := range issues {
+		if issue.Fault {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMetric runs the single-metric checks. The outlier check only runs when the
+// value passes the others, since a faulty value is an outlier anyway.
+func checkMetric(metric string, value float64, at time.Time, limits Limits, history []Point) []Issue {
+	var issues []Issue
+
+	if value < limits.Min || value > limits.Max {
+		issues = append(issues, Issue{
+			Metric: metric,
+			Check:  CheckRange,
+			Detail: fmt.Sprintf("%s %.4g is outside %g to %g", metric, value, limits.Min, limits.Max),
+			Fault:  true,
+		})
+	}
+
+	// A value out of range has certainly jumped, so the step check would only repeat it
+	if len(issues) == 0 && limits.MaxStep > 0 && len(history) > 0 {
+		prev := history[len(history)-1]
+		if at.Sub(prev.Time) <= StepWindow && math.Abs(value-prev.Value) > limits.MaxStep {
+			issues = append(issues, Issue{
+				Metric: metric,
+				Check:  CheckStep,
+				Detail: fmt.Sprintf("%s jumped from %.4g to %.4g in %s", metric, prev.Value, value, at.Sub(prev.Time).Round(time.Second)),
+				Fault:  true,
+			})
+		}
+	}
+
+	if limits.Flatline > 0 {
+		if since, ok := flatSince(value, history); ok && at.Sub(since) >= limits.Flatline {
+			issues = append(issues, Issue{
+				Metric: metric,
+				Check:  CheckFlatline,
+				Detail: fmt.Sprintf("%s has been stuck at %.4g since %s", metric, value, since.UTC().Format(time.RFC3339)),
+				Fault:  true,
+			})
+		}
+	}
+
+	if len(issues) == 0 && len(history) >= MinOutlierHistory {
+		if score := modifiedZScore(value, history); math.Abs(score) > OutlierScore {
+			issues = append(issues, Issue{
+				Metric: metric,
+				Check:  CheckOutlier,
+				Detail: fmt.Sprintf("%s %.4g is unusual for this device (score %.1f)", metric, value, score),
+			})
+		}
+	}
+
+	return issues
+}
+
+// flatSince returns the time of the earliest reading in the unbroken run of readings
+// at the end of history equal to value
+func flatSince(value float64, history []Point) (time.Time, bool) {
+	var since time.Time
+	found := false
+	for i := len(history) - 1; i >= 0 && history[i].Value == value; i-- {
+		since = history[i].Time
+		found = true
+	}
+	return since, found
+}
+
+// modifiedZScore scores a value against the median and median absolute deviation of
+// the history. It is 0 when the history has no spread.
+func modifiedZScore(value float64, history []Point) float64 {
+	values := make([]float64, len(history))
+	for i, p := range history {
+		values[i] = p.Value
+	}
+	med := median(values)
+
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - med)
+	}
+	mad := median(deviations)
+	if mad == 0 {
+		return 0
+	}
+
+	// 0.6745 scales the MAD to a standard deviation for normally distributed data
+	return 0.6745 * (value - med) / mad
+}
+
+// median returns the median of values, reordering them
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
+
+// fitted reports whether a metric comes from a sensor the device has
+func fitted(value float64, history []Point) bool {
+	return value != 0 || hasNonZero(history)
+}
+
+// hasNonZero reports whether any point has a non-zero value
+func hasNonZero(points []Point) bool {
+	for _, p := range points {
+		if p.Value != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package analysis
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDetectAnomalies(t *testing.T) {
+	jitter := noise(0.5)
+	// A day of soil moisture readings every 15 minutes around 30%
+	moisture := series(96, 15*time.Minute, func(int) float64 { return 30 + jitter() })
+	next := moisture[len(moisture)-1].Time.Add(15 * time.Minute)
+
+	tests := []struct {
+		name    string
+		values  map[string]float64
+		at      time.Time
+		history map[string][]Point
+		want    []string // metric:check of each issue
+		fault   bool
+	}{
+		{
+			name:    "noise",
+			values:  map[string]float64{"soil_moisture": 30.4},
+			at:      next,
+			history: map[string][]Point{"soil_moisture": moisture},
+		},
+		{
+			name:    "out of range",
+			values:  map[string]float64{"soil_moisture": 120},
+			at:      next,
+			history: map[string][]Point{"soil_moisture": moisture},
+			want:    []string{"soil_moisture:range"},
+			fault:   true,
+		},
+		{
+			name:    "step change",
+			values:  map[string]float64{"temperature": 41},
+			at:      seriesStart.Add(4 * time.Hour),
+			history: map[string][]Point{"temperature": series(4, time.Hour, func(int) float64 { return 22 })},
+			want:    []string{"temperature:step"},
+			fault:   true,
+		},
+		{
+			name:    "change after a gap is not a step",
+			values:  map[string]float64{"temperature": 41},
+			at:      seriesStart.Add(8 * time.Hour),
+			history: map[string][]Point{"temperature": series(4, time.Hour, func(i int) float64 { return 22 + float64(i) })},
+		},
+		{
+			name:    "outlier within the step limit",
+			values:  map[string]float64{"soil_moisture": 45},
+			at:      next,
+			history: map[string][]Point{"soil_moisture": moisture},
+			want:    []string{"soil_moisture:outlier"},
+		},
+		{
+			name:    "too little history for outliers",
+			values:  map[string]float64{"soil_moisture": 45},
+			at:      next,
+			history: map[string][]Point{"soil_moisture": moisture[len(moisture)-MinOutlierHistory+1:]},
+		},
+		{
+			name:    "slow drift",
+			values:  map[string]float64{"soil_moisture": 36.3},
+			at:      next,
+			history: map[string][]Point{"soil_moisture": series(24, time.Hour, func(i int) float64 { return 25 + 0.5*float64(i) })},
+		},
+		{
+			name:    "flatline",
+			values:  map[string]float64{"temperature": 18.5},
+			at:      seriesStart.Add(7 * time.Hour),
+			history: map[string][]Point{"temperature": series(7, time.Hour, func(int) float64 { return 18.5 })},
+			want:    []string{"temperature:flatline"},
+			fault:   true,
+		},
+		{
+			name:    "constant for less than the flatline limit",
+			values:  map[string]float64{"temperature": 18.5},
+			at:      seriesStart.Add(5 * time.Hour),
+			history: map[string][]Point{"temperature": series(5, time.Hour, func(int) float64 { return 18.5 })},
+		},
+		{
+			name:    "sensor the device doesn't have",
+			values:  map[string]float64{"ph": 0},
+			at:      next,
+			history: map[string][]Point{"ph": series(12, time.Hour, func(int) float64 { return 0 })},
+		},
+		{
+			name:   "no history",
+			values: map[string]float64{"soil_moisture": 30, "ph": 6.5},
+			at:     next,
+		},
+		{
+			name:   "nutrient bus drop",
+			values: map[string]float64{"nitrogen": 0, "phosphorous": 0, "potassium": 0},
+			at:     seriesStart.Add(3 * time.Hour),
+			history: map[string][]Point{
+				"nitrogen":    series(3, time.Hour, func(int) float64 { return 120 }),
+				"phosphorous": series(3, time.Hour, func(int) float64 { return 40 }),
+				"potassium":   series(3, time.Hour, func(int) float64 { return 200 }),
+			},
+			want:  []string{":bus_drop"},
+			fault: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issues := DetectAnomalies(tt.values, tt.at, tt.history)
+			var got []string
+			for _, issue := range issues {
+				got = append(got, issue.Metric+":"+issue.Check)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("issues = %v, want %v", got, tt.want)
+			}
+			if HasFault(issues) != tt.fault {
+				t.Errorf("fault = %t, want %t", HasFault(issues), tt.fault)
+			}
+		})
+	}
+}
+
+func TestModifiedZScore(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   float64
+		history []float64
+		want    float64
+	}{
+		{"at the median", 5, []float64{1, 3, 5, 7, 9}, 0},
+		{"two deviations above", 9, []float64{1, 3, 5, 7, 9}, 0.6745 * 4 / 2},
+		{"below", 1, []float64{1, 3, 5, 7, 9}, -0.6745 * 4 / 2},
+		{"no spread", 100, []float64{4, 4, 4, 4}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history := series(len(tt.history), time.Hour, func(i int) float64 { return tt.history[i] })
+			if got := modifiedZScore(tt.value, history); got != tt.want {
+				t.Errorf("score = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package analysis
+
+import "math"
+
+// SoilMassPerHectare is the mass in kg of the top 20 cm of a hectare of soil at a bulk
+// density of 1.3 g/cm³, which converts a soil test in mg/kg to kg/ha
+const SoilMassPerHectare = 2.6e6
+
+// Fertilizer is a straight fertilizer supplying one nutrient
+type Fertilizer struct {
+	Product  string
+	Content  float64 // fraction of the product that is the nutrient element
+	Recovery float64 // fraction of the applied nutrient that reaches the soil test
+}
+
+// Fertilizers holds the product suggested for each nutrient. Phosphorus and potassium
+// contents are the elements, not the P2O5 and K2O on the label.
+var Fertilizers = map[string]Fertilizer{
+	"nitrogen":    {Product: "Urea (46-0-0)", Content: 0.46, Recovery: 0.5},
+	"phosphorous": {Product: "Triple superphosphate (0-46-0)", Content: 0.46 / 2.29, Recovery: 0.25},
+	"potassium":   {Product: "Muriate of potash (0-0-60)", Content: 0.60 / 1.205, Recovery: 0.6},
+}
+
+// FertilizerSuggestion is how much fertilizer raises a nutrient to its target
+type FertilizerSuggestion struct {
+	Nutrient        string  `json:"nutrient"`
+	Current         float64 `json:"current"` // mg/kg
+	Target          float64 `json:"target"`  // mg/kg
+	NutrientKgPerHa float64 `json:"nutrient_kg_per_ha"`
+	Product         string  `json:"product"`
+	ProductKgPerHa  float64 `json:"product_kg_per_ha"`
+}
+
+// SuggestFertilizer works out the fertilizer per hectare that raises a nutrient from its
+// current soil test value to the target, both in mg/kg. It reports false if no
+// fertilizer is needed or the nutrient has no product.
+func SuggestFertilizer(nutrient string, current, target float64) (FertilizerSuggestion, bool) {
+	fertilizer, ok := Fertilizers[nutrient]
+	if !ok || current >= target {
+		return FertilizerSuggestion{}, false
+	}
+
+	needed := (target - current) * SoilMassPerHectare / 1e6 / fertilizer.Recovery
+	return FertilizerSuggestion{
+		Nutrient:        nutrient,
+		Current:         current,
+		Target:          target,
+		NutrientKgPerHa: math.Round(needed),
+		Product:         fertilizer.Product,
+		ProductKgPerHa:  math.Round(needed / fertilizer.Content),
+	}, true
+}
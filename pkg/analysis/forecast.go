@@ -0,0 +1,244 @@
+package analysis
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Forecast methods
+const (
+	MethodHoltWinters = "holt_winters" // level, trend and daily seasonality
+	MethodHolt        = "holt"         // level and trend, for less than two days of history
+)
+
+const (
+	// SeasonLength is the number of hourly steps in the daily cycle
+	SeasonLength = 24
+	// MinForecastHours is the fewest hours of history a forecast is made from
+	MinForecastHours = 6
+	// bandZ is the normal quantile of the 95% prediction band
+	bandZ = 1.96
+)
+
+// Smoothing parameters tried when fitting a forecast
+var (
+	alphaGrid = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9}
+	betaGrid  = []float64{0.01, 0.05, 0.1, 0.2}
+	gammaGrid = []float64{0.05, 0.1, 0.2, 0.4}
+)
+
+// ForecastPoint is the predicted value of one future hour with its 95% prediction band
+type ForecastPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Lower float64   `json:"lower"`
+	Upper float64   `json:"upper"`
+}
+
+// Forecast predicts a series hour by hour after its last reading
+type Forecast struct {
+	Method string          `json:"method"`
+	Alpha  float64         `json:"alpha"`
+	Beta   float64         `json:"beta"`
+	Gamma  float64         `json:"gamma,omitempty"`
+	RMSE   float64         `json:"rmse"` // root mean square of the one-step-ahead errors
+	Points []ForecastPoint `json:"points"`
+}
+
+// Crossing is when a forecast first falls below a threshold. Earliest and Latest are
+// where the lower and upper edges of the band fall below it; Latest is nil if the upper
+// edge stays above the threshold for the whole forecast.
+type Crossing struct {
+	At       time.Time  `json:"at"`
+	Earliest time.Time  `json:"earliest"`
+	Latest   *time.Time `json:"latest"`
+}
+
+// HourlySeries averages a series into hourly values, starting at the hour of the
+// earliest point. Hours without readings are interpolated linearly. Points out of
+// order are sorted first, on a copy.
+func HourlySeries(points []Point) (time.Time, []float64) {
+	if len(points) == 0 {
+		return time.Time{}, nil
+	}
+	if !sort.SliceIsSorted(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) }) {
+		points = append([]Point(nil), points...)
+		sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	}
+
+	start := points[0].Time.Truncate(time.Hour)
+	hours := int(points[len(points)-1].Time.Sub(start)/time.Hour) + 1
+	sums := make([]float64, hours)
+	counts := make([]int, hours)
+	for _, p := range points {
+		i := int(p.Time.Sub(start) / time.Hour)
+		sums[i] += p.Value
+		counts[i]++
+	}
+
+	values := make([]float64, hours)
+	last := -1
+	for i := range values {
+		if counts[i] == 0 {
+			continue
+		}
+		values[i] = sums[i] / float64(counts[i])
+		for j := last + 1; j < i && last >= 0; j++ {
+			values[j] = values[last] + (values[i]-values[last])*float64(j-last)/float64(i-last)
+		}
+		last = i
+	}
+
+	return start, values
+}
+
+// ForecastHourly forecasts a series for the given number of hours after its last
+// reading. Holt-Winters with daily seasonality is used when there are at least two
+// days of history, Holt's linear trend otherwise; the smoothing parameters are chosen
+// by minimising the one-step-ahead error. It reports false with too little history.
+func ForecastHourly(points []Point, horizon int) (*Forecast, bool) {
+	start, values := HourlySeries(points)
+	if len(values) < MinForecastHours || horizon < 1 {
+		return nil, false
+	}
+
+	seasonal := len(values) >= 2*SeasonLength
+	gammas := []float64{0}
+	if seasonal {
+		gammas = gammaGrid
+	}
+
+	var best *smoothing
+	for _, alpha := range alphaGrid {
+		for _, beta := range betaGrid {
+			for _, gamma := range gammas {
+				s := smooth(values, alpha, beta, gamma, seasonal)
+				if best == nil || s.sse < best.sse {
+					best = s
+				}
+			}
+		}
+	}
+
+	f := &Forecast{Method: MethodHolt, Alpha: best.alpha, Beta: best.beta}
+	if seasonal {
+		f.Method = MethodHoltWinters
+		f.Gamma = best.gamma
+	}
+	if best.steps > 0 {
+		f.RMSE = math.Sqrt(best.sse / float64(best.steps))
+	}
+
+	// The forecast variance grows with the horizon as the errors of the level, trend
+	// and seasonal updates accumulate (Hyndman et al., additive Holt-Winters)
+	last := start.Add(time.Duration(len(values)-1) * time.Hour)
+	variance := f.RMSE * f.RMSE
+	for h := 1; h <= horizon; h++ {
+		if h > 1 {
+			j := float64(h - 1)
+			c := f.Alpha * (1 + j*f.Beta)
+			if seasonal && (h-1)%SeasonLength == 0 {
+				c += f.Gamma * (1 - f.Alpha)
+			}
+			variance += f.RMSE * f.RMSE * c * c
+		}
+
+		value := best.level + float64(h)*best.trend
+		if seasonal {
+			value += best.season[(len(values)+h-1)%SeasonLength]
+		}
+		band := bandZ * math.Sqrt(variance)
+		f.Points = append(f.Points, ForecastPoint{
+			Time:  last.Add(time.Duration(h) * time.Hour),
+			Value: value,
+			Lower: value - band,
+			Upper: value + band,
+		})
+	}
+
+	return f, true
+}
+
+// CrossingBelow finds when the forecast first falls below a threshold. It reports false
+// if the forecast and the lower edge of its band stay at or above the threshold.
+func (f *Forecast) CrossingBelow(threshold float64) (Crossing, bool) {
+	var c Crossing
+	var at, earliest *time.Time
+	for i := range f.Points {
+		p := &f.Points[i]
+		if earliest == nil && p.Lower < threshold {
+			earliest = &p.Time
+		}
+		if at == nil && p.Value < threshold {
+			at = &p.Time
+		}
+		if c.Latest == nil && p.Upper < threshold {
+			c.Latest = &p.Time
+		}
+	}
+	if at == nil || earliest == nil {
+		return c, false
+	}
+	c.At, c.Earliest = *at, *earliest
+	return c, true
+}
+
+// smoothing is the state of exponential smoothing after the last value of a series
+type smoothing struct {
+	alpha, beta, gamma float64
+	level, trend       float64
+	season             []float64 // indexed by step modulo SeasonLength
+	sse                float64
+	steps              int
+}
+
+// smooth runs additive Holt-Winters, or Holt's linear trend when not seasonal, over the
+// values and sums the squared one-step-ahead errors
+func smooth(values []float64, alpha, beta, gamma float64, seasonal bool) *smoothing {
+	s := &smoothing{alpha: alpha, beta: beta, gamma: gamma}
+	var first int
+
+	if seasonal {
+		// The first two days set the initial level, trend and daily pattern
+		var day1, day2 float64
+		for i := 0; i < SeasonLength; i++ {
+			day1 += values[i]
+			day2 += values[i+SeasonLength]
+		}
+		day1 /= SeasonLength
+		day2 /= SeasonLength
+		s.season = make([]float64, SeasonLength)
+		for i := 0; i < SeasonLength; i++ {
+			s.season[i] = values[i] - day1
+		}
+		s.level = day1
+		s.trend = (day2 - day1) / SeasonLength
+		first = SeasonLength
+		// Bring the level forward to the end of the first day
+		s.level += s.trend * (SeasonLength - 1) / 2
+	} else {
+		s.level = values[1]
+		s.trend = values[1] - values[0]
+		first = 2
+	}
+
+	for i := first; i < len(values); i++ {
+		var cycle float64
+		if seasonal {
+			cycle = s.season[i%SeasonLength]
+		}
+		err := values[i] - (s.level + s.trend + cycle)
+		s.sse += err * err
+		s.steps++
+
+		prevLevel := s.level
+		s.level = alpha*(values[i]-cycle) + (1-alpha)*(s.level+s.trend)
+		s.trend = beta*(s.level-prevLevel) + (1-beta)*s.trend
+		if seasonal {
+			s.season[i%SeasonLength] = gamma*(values[i]-s.level) + (1-gamma)*cycle
+		}
+	}
+
+	return s
+}
@@ -0,0 +1,244 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHourlySeries(t *testing.T) {
+	tests := []struct {
+		name      string
+		points    []Point
+		wantStart time.Time
+		want      []float64
+	}{
+		{
+			name:   "empty",
+			points: nil,
+			want:   nil,
+		},
+		{
+			name:      "one point",
+			points:    []Point{{Time: seriesStart.Add(90 * time.Minute), Value: 7}},
+			wantStart: seriesStart.Add(time.Hour),
+			want:      []float64{7},
+		},
+		{
+			name: "readings in an hour are averaged",
+			points: []Point{
+				{Time: seriesStart, Value: 10},
+				{Time: seriesStart.Add(20 * time.Minute), Value: 20},
+				{Time: seriesStart.Add(70 * time.Minute), Value: 30},
+			},
+			wantStart: seriesStart,
+			want:      []float64{15, 30},
+		},
+		{
+			name: "gaps are interpolated",
+			points: []Point{
+				{Time: seriesStart, Value: 10},
+				{Time: seriesStart.Add(4 * time.Hour), Value: 30},
+			},
+			wantStart: seriesStart,
+			want:      []float64{10, 15, 20, 25, 30},
+		},
+		{
+			name: "unsorted",
+			points: []Point{
+				{Time: seriesStart.Add(2 * time.Hour), Value: 30},
+				{Time: seriesStart, Value: 10},
+				{Time: seriesStart.Add(3 * time.Hour), Value: 40},
+			},
+			wantStart: seriesStart,
+			want:      []float64{10, 20, 30, 40},
+		},
+		{
+			name: "newest first",
+			points: []Point{
+				{Time: seriesStart.Add(2 * time.Hour), Value: 30},
+				{Time: seriesStart.Add(time.Hour), Value: 20},
+				{Time: seriesStart, Value: 10},
+			},
+			wantStart: seriesStart,
+			want:      []float64{10, 20, 30},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input []Point
+			if tt.points != nil {
+				input = append([]Point(nil), tt.points...)
+			}
+			start, values := HourlySeries(tt.points)
+			if !start.Equal(tt.wantStart) {
+				t.Errorf("start = %v, want %v", start, tt.wantStart)
+			}
+			if len(values) != len(tt.want) {
+				t.Fatalf("values = %v, want %v", values, tt.want)
+			}
+			for i := range values {
+				if math.Abs(values[i]-tt.want[i]) > 1e-9 {
+					t.Fatalf("values = %v, want %v", values, tt.want)
+				}
+			}
+			for i := range input {
+				if tt.points[i] != input[i] {
+					t.Fatalf("the input was reordered: %v", tt.points)
+				}
+			}
+		})
+	}
+}
+
+func TestForecastHourly(t *testing.T) {
+	jitter := noise(0.3)
+	daily := func(i int) float64 { return 5 * math.Sin(2*math.Pi*float64(i%SeasonLength)/SeasonLength) }
+
+	tests := []struct {
+		name       string
+		points     []Point
+		horizon    int
+		wantOK     bool
+		wantMethod string
+		// truth is the noiseless value at step i of the hourly series, checked against
+		// the forecast within tolerance
+		truth     func(i int) float64
+		tolerance float64
+	}{
+		{
+			name:    "too short",
+			points:  series(MinForecastHours-1, time.Hour, func(i int) float64 { return 30 }),
+			horizon: 12,
+		},
+		{
+			name:    "no horizon",
+			points:  series(24, time.Hour, func(i int) float64 { return 30 }),
+			horizon: 0,
+		},
+		{
+			name:       "linear drying",
+			points:     series(24, time.Hour, func(i int) float64 { return 40 - 0.5*float64(i) }),
+			horizon:    12,
+			wantOK:     true,
+			wantMethod: MethodHolt,
+			truth:      func(i int) float64 { return 40 - 0.5*float64(i) },
+			tolerance:  0.01,
+		},
+		{
+			name:       "noisy drying",
+			points:     series(36, time.Hour, func(i int) float64 { return 40 - 0.5*float64(i) + jitter() }),
+			horizon:    12,
+			wantOK:     true,
+			wantMethod: MethodHolt,
+			truth:      func(i int) float64 { return 40 - 0.5*float64(i) },
+			tolerance:  2,
+		},
+		{
+			name:       "daily cycle",
+			points:     series(5*SeasonLength, time.Hour, func(i int) float64 { return 30 + daily(i) + jitter() }),
+			horizon:    SeasonLength,
+			wantOK:     true,
+			wantMethod: MethodHoltWinters,
+			truth:      func(i int) float64 { return 30 + daily(i) },
+			tolerance:  1.5,
+		},
+		{
+			name: "daily cycle with a gap",
+			points: func() []Point {
+				points := series(5*SeasonLength, time.Hour, func(i int) float64 { return 30 + daily(i) })
+				return append(points[:60], points[66:]...)
+			}(),
+			horizon:    SeasonLength,
+			wantOK:     true,
+			wantMethod: MethodHoltWinters,
+			truth:      func(i int) float64 { return 30 + daily(i) },
+			tolerance:  1.5,
+		},
+		{
+			name: "unsorted",
+			points: func() []Point {
+				points := series(24, time.Hour, func(i int) float64 { return 40 - 0.5*float64(i) })
+				points[3], points[17] = points[17], points[3]
+				return points
+			}(),
+			horizon:    6,
+			wantOK:     true,
+			wantMethod: MethodHolt,
+			truth:      func(i int) float64 { return 40 - 0.5*float64(i) },
+			tolerance:  0.01,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, ok := ForecastHourly(tt.points, tt.horizon)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if f.Method != tt.wantMethod {
+				t.Errorf("method = %s, want %s", f.Method, tt.wantMethod)
+			}
+			if len(f.Points) != tt.horizon {
+				t.Fatalf("%d points, want %d", len(f.Points), tt.horizon)
+			}
+
+			start, values := HourlySeries(tt.points)
+			for h, p := range f.Points {
+				step := len(values) + h
+				if want := start.Add(time.Duration(step) * time.Hour); !p.Time.Equal(want) {
+					t.Fatalf("point %d at %v, want %v", h, p.Time, want)
+				}
+				if math.Abs(p.Value-tt.truth(step)) > tt.tolerance {
+					t.Errorf("point %d = %.2f, want %.2f ± %v", h, p.Value, tt.truth(step), tt.tolerance)
+				}
+				if p.Lower > p.Value || p.Upper < p.Value {
+					t.Errorf("point %d = %.2f outside its band [%.2f, %.2f]", h, p.Value, p.Lower, p.Upper)
+				}
+				if h > 0 {
+					prev := f.Points[h-1]
+					if p.Upper-p.Lower < prev.Upper-prev.Lower-1e-9 {
+						t.Errorf("band narrows from %.3f to %.3f at point %d", prev.Upper-prev.Lower, p.Upper-p.Lower, h)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCrossingBelow(t *testing.T) {
+	jitter := noise(0.3)
+	drying, ok := ForecastHourly(series(36, time.Hour, func(i int) float64 { return 40 - 0.5*float64(i) + jitter() }), 24)
+	if !ok {
+		t.Fatal("no forecast")
+	}
+
+	c, ok := drying.CrossingBelow(20)
+	if !ok {
+		t.Fatal("drying series never crosses 20")
+	}
+	// The truth crosses 20 at step 40, four hours after the last reading
+	want := seriesStart.Add(40 * time.Hour)
+	if d := c.At.Sub(want); d < -2*time.Hour || d > 2*time.Hour {
+		t.Errorf("crossing at %v, want about %v", c.At, want)
+	}
+	if c.Earliest.After(c.At) {
+		t.Errorf("earliest %v after the crossing %v", c.Earliest, c.At)
+	}
+	if c.Latest != nil && c.Latest.Before(c.At) {
+		t.Errorf("latest %v before the crossing %v", *c.Latest, c.At)
+	}
+
+	if _, ok := drying.CrossingBelow(-100); ok {
+		t.Error("crossed a threshold far below the forecast")
+	}
+
+	flat, _ := ForecastHourly(series(24, time.Hour, func(int) float64 { return 30 }), 24)
+	if _, ok := flat.CrossingBelow(25); ok {
+		t.Error("flat series crosses a threshold below it")
+	}
+}
@@ -0,0 +1,204 @@
+// Package analysis holds the statistics used to analyse device readings.
+package analysis
+
+import (
+	"math"
+	"time"
+)
+
+// Trend labels
+const (
+	TrendIncreasing   = "increasing"
+	TrendDecreasing   = "decreasing"
+	TrendStable       = "stable"
+	TrendInsufficient = "insufficient_data"
+)
+
+// MinTrendPoints is the fewest readings a trend is computed from
+const MinTrendPoints = 3
+
+// TrendTStat is the t-statistic the regression slope must reach to count as a trend,
+// roughly a 95% two-sided significance level
+const TrendTStat = 2.0
+
+// Point is one timestamped value of a metric
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Summary describes a series of readings of one metric
+type Summary struct {
+	Count       int     `json:"count"`
+	Min         float64 `json:"min"`
+	Max         float64 `json:"max"`
+	Mean        float64 `json:"mean"`
+	StdDev      float64 `json:"stddev"`
+	First       float64 `json:"first"`
+	Last        float64 `json:"last"`
+	RatePerHour float64 `json:"rate_per_hour"` // least-squares slope
+	TStat       float64 `json:"t_stat"`        // slope divided by its standard error
+	RSquared    float64 `json:"r_squared"`
+	Trend       string  `json:"trend"`
+}
+
+// Fit is a least-squares line through a series, with time in hours from Origin
+type Fit struct {
+	Origin    time.Time
+	Slope     float64 // change per hour
+	Intercept float64 // value at Origin
+	TStat     float64
+	RSquared  float64
+}
+
+// At returns the fitted value at a time
+func (f Fit) At(t time.Time) float64 {
+	return f.Intercept + f.Slope*t.Sub(f.Origin).Hours()
+}
+
+// LinearFit fits a least-squares line through the points. It reports false if there
+// are fewer than two points or they all share a timestamp.
+func LinearFit(points []Point) (Fit, bool) {
+	n := float64(len(points))
+	if len(points) < 2 {
+		return Fit{}, false
+	}
+
+	origin := points[0].Time
+	var sumX, sumY float64
+	for _, p := range points {
+		sumX += p.Time.Sub(origin).Hours()
+		sumY += p.Value
+	}
+	meanX, meanY := sumX/n, sumY/n
+
+	var sxx, sxy, syy float64
+	for _, p := range points {
+		dx := p.Time.Sub(origin).Hours() - meanX
+		dy := p.Value - meanY
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+	if sxx == 0 {
+		return Fit{}, false
+	}
+
+	fit := Fit{Origin: origin, Slope: sxy / sxx}
+	fit.Intercept = meanY - fit.Slope*meanX
+
+	// Residual sum of squares gives the slope's standard error
+	sse := syy - fit.Slope*sxy
+	if sse < 0 {
+		sse = 0
+	}
+	if syy > 0 {
+		fit.RSquared = 1 - sse/syy
+	}
+	if len(points) > 2 {
+		se := math.Sqrt(sse / (n - 2) / sxx)
+		switch {
+		case se > 0:
+			fit.TStat = fit.Slope / se
+		case fit.Slope != 0:
+			// A perfect fit is as significant as it gets
+			fit.TStat = math.Copysign(math.MaxFloat64, fit.Slope)
+		}
+	}
+
+	return fit, true
+}
+
+// DailyMeans averages a series sorted by time over consecutive 24 hour periods starting
+// at its first point. Each mean is placed at the middle of its readings' times.
+func DailyMeans(points []Point) []Point {
+	if len(points) == 0 {
+		return nil
+	}
+
+	var means []Point
+	start := points[0].Time
+	var day int
+	var sum, offset float64
+	var count int
+	flush := func() {
+		if count > 0 {
+			at := start.Add(time.Duration(offset / float64(count) * float64(time.Hour)))
+			means = append(means, Point{Time: at, Value: sum / float64(count)})
+		}
+		sum, offset, count = 0, 0, 0
+	}
+	for _, p := range points {
+		hours := p.Time.Sub(start).Hours()
+		if d := int(hours / 24); d != day {
+			flush()
+			day = d
+		}
+		sum += p.Value
+		offset += hours
+		count++
+	}
+	flush()
+
+	return means
+}
+
+// Summarize computes the statistics and trend of a series sorted by time.
+// A trend is only reported when the slope is statistically significant and the
+// fitted change over the series is at least minChange, so noise and negligible
+// drifts are labelled stable.
+func Summarize(points []Point, minChange float64) Summary {
+	s := Summary{Count: len(points), Trend: TrendInsufficient}
+	if len(points) == 0 {
+		return s
+	}
+
+	s.Min, s.Max = points[0].Value, points[0].Value
+	s.First, s.Last = points[0].Value, points[len(points)-1].Value
+	var sum float64
+	for _, p := range points {
+		s.Min = math.Min(s.Min, p.Value)
+		s.Max = math.Max(s.Max, p.Value)
+		sum += p.Value
+	}
+	s.Mean = sum / float64(len(points))
+
+	if len(points) > 1 {
+		var sq float64
+		for _, p := range points {
+			sq += (p.Value - s.Mean) * (p.Value - s.Mean)
+		}
+		s.StdDev = math.Sqrt(sq / float64(len(points)-1))
+	}
+
+	if len(points) < MinTrendPoints {
+		return s
+	}
+
+	// Over several days the day/night cycle would dominate a fit of the raw readings,
+	// so longer series are fitted on their daily means
+	series := points
+	if daily := DailyMeans(points); len(daily) >= MinTrendPoints {
+		series = daily
+	}
+
+	fit, ok := LinearFit(series)
+	if !ok {
+		return s
+	}
+	s.RatePerHour = fit.Slope
+	s.TStat = fit.TStat
+	s.RSquared = fit.RSquared
+
+	hours := points[len(points)-1].Time.Sub(points[0].Time).Hours()
+	switch {
+	case math.Abs(fit.TStat) < TrendTStat || math.Abs(fit.Slope*hours) < minChange:
+		s.Trend = TrendStable
+	case fit.Slope > 0:
+		s.Trend = TrendIncreasing
+	default:
+		s.Trend = TrendDecreasing
+	}
+
+	return s
+}
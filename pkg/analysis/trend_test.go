@@ -0,0 +1,202 @@
+package analysis
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+var seriesStart = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// series returns n points spaced by step from seriesStart, valued by fn
+func series(n int, step time.Duration, fn func(i int) float64) []Point {
+	points := make([]Point, n)
+	for i := range points {
+		points[i] = Point{Time: seriesStart.Add(time.Duration(i) * step), Value: fn(i)}
+	}
+	return points
+}
+
+// noise returns a source of reproducible normally distributed noise
+func noise(stddev float64) func() float64 {
+	r := rand.New(rand.NewSource(1))
+	return func() float64 { return r.NormFloat64() * stddev }
+}
+
+func TestSummarizeTrend(t *testing.T) {
+	jitter := noise(0.5)
+
+	// Half a day of falling readings, nothing for a day and a half, then half a day more
+	gapped := series(12, time.Hour, func(i int) float64 { return 50 - 0.5*float64(i) + jitter() })
+	for _, p := range series(12, time.Hour, func(i int) float64 { return 26 - 0.5*float64(i) + jitter() }) {
+		gapped = append(gapped, Point{Time: p.Time.Add(48 * time.Hour), Value: p.Value})
+	}
+
+	tests := []struct {
+		name      string
+		points    []Point
+		minChange float64
+		want      string
+	}{
+		{
+			name:   "empty",
+			points: nil,
+			want:   TrendInsufficient,
+		},
+		{
+			name:   "too short",
+			points: series(2, time.Hour, func(i int) float64 { return float64(i * 10) }),
+			want:   TrendInsufficient,
+		},
+		{
+			name:      "noise around a constant",
+			points:    series(48, time.Hour, func(int) float64 { return 30 + jitter() }),
+			minChange: 2,
+			want:      TrendStable,
+		},
+		{
+			name: "daily cycle without drift",
+			points: series(7*24, time.Hour, func(i int) float64 {
+				return 20 + 8*math.Sin(2*math.Pi*float64(i)/24) + jitter()
+			}),
+			minChange: 1,
+			want:      TrendStable,
+		},
+		{
+			name:      "downward drift in noise",
+			points:    series(48, time.Hour, func(i int) float64 { return 40 - 0.2*float64(i) + jitter() }),
+			minChange: 2,
+			want:      TrendDecreasing,
+		},
+		{
+			name: "upward drift under a daily cycle",
+			points: series(7*24, time.Hour, func(i int) float64 {
+				return 20 + 0.05*float64(i) + 8*math.Sin(2*math.Pi*float64(i)/24) + jitter()
+			}),
+			minChange: 1,
+			want:      TrendIncreasing,
+		},
+		{
+			name:      "significant drift smaller than the minimum change",
+			points:    series(48, time.Hour, func(i int) float64 { return 30 + 0.01*float64(i) }),
+			minChange: 2,
+			want:      TrendStable,
+		},
+		{
+			name: "step change",
+			points: series(48, time.Hour, func(i int) float64 {
+				if i < 24 {
+					return 20 + jitter()
+				}
+				return 35 + jitter()
+			}),
+			minChange: 2,
+			want:      TrendIncreasing,
+		},
+		{
+			name:      "drift across a gap",
+			points:    gapped,
+			minChange: 2,
+			want:      TrendDecreasing,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Summarize(tt.points, tt.minChange)
+			if s.Trend != tt.want {
+				t.Errorf("trend = %s, want %s (rate %.4g/h, t %.3g)", s.Trend, tt.want, s.RatePerHour, s.TStat)
+			}
+			if s.Count != len(tt.points) {
+				t.Errorf("count = %d, want %d", s.Count, len(tt.points))
+			}
+		})
+	}
+}
+
+func TestSummarizeStatistics(t *testing.T) {
+	points := series(4, time.Hour, func(i int) float64 { return []float64{4, 2, 8, 6}[i] })
+	s := Summarize(points, 0)
+
+	if s.Min != 2 || s.Max != 8 || s.Mean != 5 || s.First != 4 || s.Last != 6 {
+		t.Errorf("got min %g max %g mean %g first %g last %g, want 2 8 5 4 6", s.Min, s.Max, s.Mean, s.First, s.Last)
+	}
+	if want := math.Sqrt(20.0 / 3); math.Abs(s.StdDev-want) > 1e-9 {
+		t.Errorf("stddev = %g, want %g", s.StdDev, want)
+	}
+}
+
+func TestLinearFit(t *testing.T) {
+	tests := []struct {
+		name      string
+		points    []Point
+		ok        bool
+		slope     float64
+		intercept float64
+	}{
+		{
+			name:   "one point",
+			points: series(1, time.Hour, func(int) float64 { return 1 }),
+		},
+		{
+			name: "same timestamp",
+			points: []Point{
+				{Time: seriesStart, Value: 1},
+				{Time: seriesStart, Value: 3},
+			},
+		},
+		{
+			name:      "exact line",
+			points:    series(5, 30*time.Minute, func(i int) float64 { return 10 + 1.5*float64(i) }),
+			ok:        true,
+			slope:     3,
+			intercept: 10,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fit, ok := LinearFit(tt.points)
+			if ok != tt.ok {
+				t.Fatalf("ok = %t, want %t", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if math.Abs(fit.Slope-tt.slope) > 1e-9 || math.Abs(fit.Intercept-tt.intercept) > 1e-9 {
+				t.Errorf("got slope %g intercept %g, want %g %g", fit.Slope, fit.Intercept, tt.slope, tt.intercept)
+			}
+			if fit.RSquared != 1 {
+				t.Errorf("r squared = %g, want 1", fit.RSquared)
+			}
+		})
+	}
+}
+
+func TestDailyMeans(t *testing.T) {
+	// Two readings on the first day, none on the second, one on the third
+	points := []Point{
+		{Time: seriesStart, Value: 10},
+		{Time: seriesStart.Add(12 * time.Hour), Value: 20},
+		{Time: seriesStart.Add(50 * time.Hour), Value: 40},
+	}
+	want := []Point{
+		{Time: seriesStart.Add(6 * time.Hour), Value: 15},
+		{Time: seriesStart.Add(50 * time.Hour), Value: 40},
+	}
+
+	got := DailyMeans(points)
+	if len(got) != len(want) {
+		t.Fatalf("got %d means, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if !got[i].Time.Equal(want[i].Time) || got[i].Value != want[i].Value {
+			t.Errorf("mean %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if got := DailyMeans(nil); got != nil {
+		t.Errorf("DailyMeans(nil) = %v, want nil", got)
+	}
+}
@@ -1,14 +1,22 @@
 package email
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
+	"net/mail"
 	"net/smtp"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Mailer is the interface for sending emails
 type Mailer interface {
-	SendOTP(to, otp string) error
+	Send(ctx context.Context, msg Message) error
 }
 
 // SMTPMailer implements the Mailer interface using SMTP
@@ -31,40 +39,122 @@ func NewSMTPMailer() *SMTPMailer {
 	}
 }
 
-// SendOTP sends an OTP code to the specified email address
-func (m *SMTPMailer) SendOTP(to, otp string) error {
-	subject := "Your Password Reset OTP"
-	body := fmt.Sprintf(`
-	<html>
-		<body>
-			<h1>Password Reset Request</h1>
-			<p>Dear User,</p>
-			<p>Your OTP for password reset is: <strong>%s</strong></p>
-			<p>This OTP will expire in 15 minutes.</p>
-			<p>If you did not request this password reset, please ignore this email.</p>
-			<p>Regards,<br>Field Eyes Team</p>
-		</body>
-	</html>
-	`, otp)
+// Send delivers the message to the SMTP server. Port 465 uses implicit TLS, other
+// ports are upgraded with STARTTLS when the server offers it. Cancelling the
+// context aborts the conversation.
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if len(msg.To) == 0 {
+		return errors.New("email has no recipients")
+	}
+	for _, to := range msg.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("invalid recipient %q: %v", to, err)
+		}
+	}
+	raw, err := msg.build(m.From, time.Now())
+	if err != nil {
+		return err
+	}
 
-	message := fmt.Sprintf("To: %s\r\n"+
-		"Subject: %s\r\n"+
-		"MIME-Version: 1.0\r\n"+
-		"Content-Type: text/html; charset=UTF-8\r\n"+
-		"\r\n"+
-		"%s\r\n", to, subject, body)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(m.Host, m.Port))
+	if err != nil {
+		return err
+	}
+	// Unblocks the client below if the context ends mid-conversation
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	tlsConfig := &tls.Config{ServerName: m.Host, MinVersion: tls.VersionTLS12}
+	if m.Port == "465" {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
 
-	auth := smtp.PlainAuth("", m.Username, m.Password, m.Host)
-	addr := fmt.Sprintf("%s:%s", m.Host, m.Port)
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+				return err
+			}
+		}
+	}
 
-	return smtp.SendMail(addr, auth, m.From, []string{to}, []byte(message))
+	if err := client.Mail(m.From); err != nil {
+		return err
+	}
+	for _, to := range msg.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
 }
 
-// MockMailer is a mock implementation of the Mailer interface for testing
-type MockMailer struct{}
+// Recorder is a Mailer that keeps the messages it is given instead of sending them,
+// for tests and local development
+type Recorder struct {
+	mu       sync.Mutex
+	messages []Message
+	// Err, when set, is returned by Send and nothing is recorded
+	Err error
+	// Log, when set, is called with each message
+	Log func(format string, v ...interface{})
+}
 
-// SendOTP mocks sending an OTP code (for testing or development)
-func (m *MockMailer) SendOTP(to, otp string) error {
-	fmt.Printf("[MOCK EMAIL] To: %s, OTP: %s\n", to, otp)
+// Send records the message
+func (r *Recorder) Send(ctx context.Context, msg Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.messages = append(r.messages, msg)
+	if r.Log != nil {
+		r.Log("[EMAIL] To: %s, Subject: %s", strings.Join(msg.To, ", "), msg.Subject)
+	}
 	return nil
 }
+
+// Messages returns the messages recorded so far, oldest first
+func (r *Recorder) Messages() []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Message(nil), r.messages...)
+}
+
+// Last returns the most recent message, if any
+func (r *Recorder) Last() (Message, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.messages) == 0 {
+		return Message{}, false
+	}
+	return r.messages[len(r.messages)-1], true
+}
+
+// Reset forgets the recorded messages
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = nil
+}
@@ -0,0 +1,169 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message is an email with a plain text body, an HTML alternative or both, and
+// optional attachments
+type Message struct {
+	To          []string
+	Subject     string
+	Text        string // text/plain body
+	HTML        string // text/html body
+	Attachments []Attachment
+}
+
+// Attachment is a file sent with a message
+type Attachment struct {
+	Filename    string
+	ContentType string // defaults to application/octet-stream
+	Data        []byte
+}
+
+// Attach adds a file to the message
+func (msg *Message) Attach(filename, contentType string, data []byte) {
+	msg.Attachments = append(msg.Attachments, Attachment{Filename: filename, ContentType: contentType, Data: data})
+}
+
+// build encodes the message as MIME, ready for the SMTP DATA command
+func (msg *Message) build(from string, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	writeHeader(&buf, "From", from)
+	writeHeader(&buf, "To", strings.Join(msg.To, ", "))
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	writeHeader(&buf, "Date", now.Format(time.RFC1123Z))
+	writeHeader(&buf, "Message-ID", messageID(from))
+	writeHeader(&buf, "MIME-Version", "1.0")
+
+	bodyHeader, body, err := msg.body()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msg.Attachments) == 0 {
+		for _, key := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+			if value := bodyHeader.Get(key); value != "" {
+				writeHeader(&buf, key, value)
+			}
+		}
+		buf.WriteString("\r\n")
+		buf.Write(body)
+		return buf.Bytes(), nil
+	}
+
+	mixed := multipart.NewWriter(&buf)
+	writeHeader(&buf, "Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	buf.WriteString("\r\n")
+
+	part, err := mixed.CreatePart(bodyHeader)
+	if err != nil {
+		return nil, err
+	}
+	part.Write(body)
+
+	for _, attachment := range msg.Attachments {
+		contentType := attachment.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+		header.Set("Content-Transfer-Encoding", "base64")
+		part, err := mixed.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		writeBase64(part, attachment.Data)
+	}
+
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// body encodes the text and HTML bodies, as multipart/alternative when there are
+// both, and returns the headers describing them
+func (msg *Message) body() (textproto.MIMEHeader, []byte, error) {
+	if msg.HTML == "" || msg.Text == "" {
+		contentType, content := "text/plain; charset=UTF-8", msg.Text
+		if msg.HTML != "" {
+			contentType, content = "text/html; charset=UTF-8", msg.HTML
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		return header, quotedPrintable(content), nil
+	}
+
+	var buf bytes.Buffer
+	alternative := multipart.NewWriter(&buf)
+	// The last alternative is the preferred one
+	for _, body := range []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", msg.Text},
+		{"text/html; charset=UTF-8", msg.HTML},
+	} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", body.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		part, err := alternative.CreatePart(header)
+		if err != nil {
+			return nil, nil, err
+		}
+		part.Write(quotedPrintable(body.content))
+	}
+	if err := alternative.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "multipart/alternative; boundary="+alternative.Boundary())
+	return header, buf.Bytes(), nil
+}
+
+// writeHeader writes one header line
+func writeHeader(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(key + ": " + value + "\r\n")
+}
+
+// quotedPrintable encodes text with CRLF line endings
+func quotedPrintable(text string) []byte {
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	w.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")))
+	w.Close()
+	return buf.Bytes()
+}
+
+// writeBase64 writes data as base64 in lines of 76 characters
+func writeBase64(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		io.WriteString(w, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(w, encoded+"\r\n")
+}
+
+// messageID returns a unique Message-ID in the sender's domain
+func messageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = strings.Trim(from[at+1:], "> ")
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return "<" + hex.EncodeToString(id) + "@" + domain + ">"
+}
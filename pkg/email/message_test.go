@@ -0,0 +1,202 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mimePart is a decoded part of a built message
+type mimePart struct {
+	mediaType string
+	params    map[string]string
+	header    map[string][]string
+	body      []byte
+	parts     []mimePart
+}
+
+// readPart decodes a part and, if it is multipart, the parts inside it
+func readPart(t *testing.T, header map[string][]string, body io.Reader) mimePart {
+	t.Helper()
+	get := func(key string) string {
+		if values := header[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	mediaType, params, err := mime.ParseMediaType(get("Content-Type"))
+	if err != nil {
+		t.Fatalf("Content-Type %q: %v", get("Content-Type"), err)
+	}
+	p := mimePart{mediaType: mediaType, params: params, header: header}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := r.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.parts = append(p.parts, readPart(t, part.Header, part))
+		}
+		return p
+	}
+
+	switch get("Content-Transfer-Encoding") {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\r\n") {
+			if len(line) > 76 {
+				t.Errorf("base64 line of %d characters", len(line))
+			}
+		}
+		decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(raw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.body = decoded
+		return p
+	default:
+		t.Fatalf("unexpected Content-Transfer-Encoding %q", get("Content-Transfer-Encoding"))
+	}
+	if p.body, err = io.ReadAll(body); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestMessageBuild(t *testing.T) {
+	now := time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC)
+	text := "Habari wanjiru,\nUnyevu wa udongo ni 15%.\n"
+	html := "<p>Habari wanjiru,</p><p>Unyevu wa udongo ni <strong>15%</strong>.</p>"
+	report := bytes.Repeat([]byte("serial_number,soil_moisture\nSN1,15.2\n"), 10)
+
+	// Bodies go on the wire with CRLF line endings
+	wantText := strings.ReplaceAll(text, "\n", "\r\n")
+	textPart := func(t *testing.T, p mimePart) {
+		if p.mediaType != "text/plain" || p.params["charset"] != "UTF-8" || string(p.body) != wantText {
+			t.Errorf("text part is %s %v: %q", p.mediaType, p.params, p.body)
+		}
+	}
+	htmlPart := func(t *testing.T, p mimePart) {
+		if p.mediaType != "text/html" || p.params["charset"] != "UTF-8" || string(p.body) != html {
+			t.Errorf("HTML part is %s %v: %q", p.mediaType, p.params, p.body)
+		}
+	}
+	alternative := func(t *testing.T, p mimePart) {
+		// The preferred alternative comes last
+		if p.mediaType != "multipart/alternative" || len(p.parts) != 2 {
+			t.Fatalf("body is %s with %d parts, want multipart/alternative with 2", p.mediaType, len(p.parts))
+		}
+		textPart(t, p.parts[0])
+		htmlPart(t, p.parts[1])
+	}
+	attachment := func(t *testing.T, p mimePart, filename, contentType string, data []byte) {
+		disposition, params, err := mime.ParseMediaType(p.header["Content-Disposition"][0])
+		if err != nil || disposition != "attachment" || params["filename"] != filename {
+			t.Errorf("attachment disposition %q", p.header["Content-Disposition"])
+		}
+		if p.mediaType != contentType || !bytes.Equal(p.body, data) {
+			t.Errorf("attachment %s is %s with %d bytes, want %s with %d", filename, p.mediaType, len(p.body), contentType, len(data))
+		}
+	}
+
+	tests := []struct {
+		name  string
+		msg   Message
+		check func(t *testing.T, p mimePart)
+	}{
+		{
+			name:  "text only",
+			msg:   Message{Text: text},
+			check: textPart,
+		},
+		{
+			name:  "HTML only",
+			msg:   Message{HTML: html},
+			check: htmlPart,
+		},
+		{
+			name:  "text and HTML",
+			msg:   Message{Text: text, HTML: html},
+			check: alternative,
+		},
+		{
+			name: "with attachments",
+			msg: Message{Text: text, HTML: html, Attachments: []Attachment{
+				{Filename: "ripoti ya wiki.csv", ContentType: "text/csv", Data: report},
+				{Filename: "raw.bin", Data: []byte{0, 1, 2, 0xff}},
+			}},
+			check: func(t *testing.T, p mimePart) {
+				if p.mediaType != "multipart/mixed" || len(p.parts) != 3 {
+					t.Fatalf("message is %s with %d parts, want multipart/mixed with 3", p.mediaType, len(p.parts))
+				}
+				alternative(t, p.parts[0])
+				attachment(t, p.parts[1], "ripoti ya wiki.csv", "text/csv", report)
+				attachment(t, p.parts[2], "raw.bin", "application/octet-stream", []byte{0, 1, 2, 0xff})
+			},
+		},
+		{
+			name: "text with an attachment",
+			msg:  Message{Text: text, Attachments: []Attachment{{Filename: "report.csv", ContentType: "text/csv", Data: report}}},
+			check: func(t *testing.T, p mimePart) {
+				if p.mediaType != "multipart/mixed" || len(p.parts) != 2 {
+					t.Fatalf("message is %s with %d parts, want multipart/mixed with 2", p.mediaType, len(p.parts))
+				}
+				textPart(t, p.parts[0])
+				attachment(t, p.parts[1], "report.csv", "text/csv", report)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.msg
+			msg.To = []string{"wanjiru@example.com", "otieno@example.com"}
+			msg.Subject = "Tahadhari: udongo ni mkavu ✓"
+			raw, err := msg.build("Field Eyes <alerts@fieldeyes.example.com>", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := mail.ReadMessage(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatalf("not a valid message: %v\n%s", err, raw)
+			}
+			subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+			if err != nil || subject != msg.Subject {
+				t.Errorf("subject decodes to %q (%v), want %q", subject, err, msg.Subject)
+			}
+			if to, err := m.Header.AddressList("To"); err != nil || len(to) != 2 || to[1].Address != "otieno@example.com" {
+				t.Errorf("To %q", m.Header.Get("To"))
+			}
+			if date, err := m.Header.Date(); err != nil || !date.Equal(now) {
+				t.Errorf("Date %q", m.Header.Get("Date"))
+			}
+			if id := m.Header.Get("Message-ID"); !strings.HasSuffix(id, "@fieldeyes.example.com>") {
+				t.Errorf("Message-ID %q isn't in the sender's domain", id)
+			}
+			if m.Header.Get("MIME-Version") != "1.0" {
+				t.Errorf("MIME-Version %q", m.Header.Get("MIME-Version"))
+			}
+
+			tt.check(t, readPart(t, m.Header, m.Body))
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package email
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+// Email templates. Each is a file in templates/<locale>/ defining "subject" and
+// "text", rendered as plain text, and "html", rendered inside the locale's layout.
+const (
+	TemplateVerification  = "verification"
+	TemplatePasswordReset = "password_reset"
+	TemplateAlert         = "alert"
+	TemplateDigest        = "digest"
+	TemplateDeviceClaimed = "device_claimed"
+)
+
+// DefaultLocale is used when a template has no translation for the requested locale
+const DefaultLocale = "en"
+
+//go:embed templates
+var templateFS embed.FS
+
+// VerificationData fills the account verification email
+type VerificationData struct {
+	Username         string
+	Code             string
+	Link             string // optional link that verifies without typing the code
+	ExpiresInMinutes int
+}
+
+// PasswordResetData fills the password reset email
+type PasswordResetData struct {
+	Username         string
+	Code             string
+	ExpiresInMinutes int
+}
+
+// AlertData fills the alert notification email
+type AlertData struct {
+	Title    string
+	Message  string
+	Severity string // info, warning or alert
+	Device   string
+	Time     time.Time
+}
+
+// DigestData fills the daily or weekly digest email
+type DigestData struct {
+	Username      string
+	Period        string // daily or weekly
+	From          time.Time
+	To            time.Time
+	Devices       []DigestDevice
+	Notifications []DigestNotification
+}
+
+// DigestDevice summarises a device over a digest's period
+type DigestDevice struct {
+	SerialNumber string
+	Readings     int
+	Online       bool
+	LastSeen     *time.Time
+}
+
+// DigestNotification is a notification listed in a digest
+type DigestNotification struct {
+	Severity string
+	Device   string
+	Message  string
+	Time     time.Time
+}
+
+// DeviceClaimedData fills the device claimed confirmation email
+type DeviceClaimedData struct {
+	Username     string
+	SerialNumber string
+	DeviceType   string
+	ClaimedAt    time.Time
+}
+
+// compiledTemplate is a template parsed for one locale
+type compiledTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// templateCache holds parsed templates by "<locale>/<name>"
+var templateCache sync.Map
+
+// Compose renders a template in the closest available locale and returns the
+// message without recipients. Locales are tags such as "sw" or "sw-KE"; a region
+// falls back to its language, then to DefaultLocale.
+func Compose(name, locale string, data interface{}) (Message, error) {
+	tmpl, err := loadTemplate(name, resolveLocale(name, locale))
+	if err != nil {
+		return Message{}, err
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Message{}, fmt.Errorf("rendering %s subject: %v", name, err)
+	}
+	if err := tmpl.text.ExecuteTemplate(&text, "text", data); err != nil {
+		return Message{}, fmt.Errorf("rendering %s text: %v", name, err)
+	}
+	if err := tmpl.html.ExecuteTemplate(&html, "layout", data); err != nil {
+		return Message{}, fmt.Errorf("rendering %s html: %v", name, err)
+	}
+
+	return Message{
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    html.String(),
+	}, nil
+}
+
+// resolveLocale picks the locale a template is rendered in
+func resolveLocale(name, locale string) string {
+	locale = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+	candidates := []string{locale}
+	if i := strings.Index(locale, "-"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		if _, err := fs.Stat(templateFS, templatePath(candidate, name)); err == nil {
+			return candidate
+		}
+	}
+	return DefaultLocale
+}
+
+// templatePath is where a template is embedded
+func templatePath(locale, name string) string {
+	return "templates/" + locale + "/" + name + ".tmpl"
+}
+
+// loadTemplate parses a template with its locale's layout, once
+func loadTemplate(name, locale string) (*compiledTemplate, error) {
+	key := locale + "/" + name
+	if cached, ok := templateCache.Load(key); ok {
+		return cached.(*compiledTemplate), nil
+	}
+
+	layout := templatePath(locale, "layout")
+	if _, err := fs.Stat(templateFS, layout); err != nil {
+		layout = templatePath(DefaultLocale, "layout")
+	}
+	files := []string{layout, templatePath(locale, name)}
+
+	text, err := texttemplate.ParseFS(templateFS, files...)
+	if err != nil {
+		return nil, fmt.Errorf("email template %s: %v", key, err)
+	}
+	html, err := htmltemplate.ParseFS(templateFS, files...)
+	if err != nil {
+		return nil, fmt.Errorf("email template %s: %v", key, err)
+	}
+
+	tmpl := &compiledTemplate{text: text, html: html}
+	templateCache.Store(key, tmpl)
+	return tmpl, nil
+}
@@ -0,0 +1,108 @@
+package email
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sampleData fills every template, with a value each rendering must show
+var sampleData = func() map[string]struct {
+	data interface{}
+	show string
+} {
+	at := time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC)
+	lastSeen := at.Add(-30 * time.Hour)
+	return map[string]struct {
+		data interface{}
+		show string
+	}{
+		TemplateVerification: {VerificationData{Username: "wanjiru", Code: "482913", Link: "https://fieldeyes.example.com/verify?code=482913", ExpiresInMinutes: 30}, "482913"},
+		TemplatePasswordReset: {PasswordResetData{Username: "wanjiru", Code: "771204", ExpiresInMinutes: 15}, "771204"},
+		TemplateAlert:         {AlertData{Title: "Soil moisture alert", Message: "Soil moisture is below 20 (15.20)", Severity: "alert", Device: "SN-0042", Time: at}, "Soil moisture is below 20 (15.20)"},
+		TemplateDigest: {DigestData{
+			Username: "wanjiru",
+			Period:   "weekly",
+			From:     at.Add(-7 * 24 * time.Hour),
+			To:       at,
+			Devices: []DigestDevice{
+				{SerialNumber: "SN-0042", Readings: 672, Online: true},
+				{SerialNumber: "SN-0043", Readings: 12, LastSeen: &lastSeen},
+			},
+			Notifications: []DigestNotification{{Severity: "alert", Device: "SN-0042", Message: "Soil is dry", Time: at}},
+		}, "SN-0043"},
+		TemplateDeviceClaimed: {DeviceClaimedData{Username: "wanjiru", SerialNumber: "SN-0042", DeviceType: "soil-probe", ClaimedAt: at}, "SN-0042"},
+	}
+}()
+
+func TestComposeEveryTemplate(t *testing.T) {
+	for _, locale := range []string{"en", "sw"} {
+		// Every template in the locale is exercised
+		files, err := fs.Glob(templateFS, "templates/"+locale+"/*.tmpl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			name := strings.TrimSuffix(file[strings.LastIndex(file, "/")+1:], ".tmpl")
+			if _, ok := sampleData[name]; !ok && name != "layout" {
+				t.Errorf("%s has no sample data", file)
+			}
+		}
+
+		for name, sample := range sampleData {
+			t.Run(locale+"/"+name, func(t *testing.T) {
+				if resolveLocale(name, locale) != locale {
+					t.Fatalf("%s has no %s translation", name, locale)
+				}
+				msg, err := Compose(name, locale, sample.data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msg.Subject == "" || strings.ContainsAny(msg.Subject, "\r\n") {
+					t.Errorf("subject %q", msg.Subject)
+				}
+				if !strings.Contains(msg.Text, sample.show) || !strings.Contains(msg.HTML, sample.show) {
+					t.Errorf("text or HTML doesn't show %q:\n%s\n%s", sample.show, msg.Text, msg.HTML)
+				}
+				if !strings.Contains(msg.HTML, `<html lang="`+locale+`">`) || !strings.Contains(msg.HTML, "<title>"+msg.Subject+"</title>") {
+					t.Errorf("HTML isn't in the %s layout:\n%s", locale, msg.HTML)
+				}
+				if strings.Contains(msg.Text+msg.HTML, "<no value>") {
+					t.Errorf("rendered a missing value:\n%s", msg.Text)
+				}
+
+				// Translations differ from the default
+				if locale != DefaultLocale {
+					en, err := Compose(name, DefaultLocale, sample.data)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if en.Subject == msg.Subject || en.Text == msg.Text {
+						t.Errorf("%s reads the same as %s: %q", locale, DefaultLocale, msg.Subject)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestResolveLocale(t *testing.T) {
+	tests := []struct {
+		locale string
+		want   string
+	}{
+		{"sw", "sw"},
+		{"sw-KE", "sw"},
+		{" SW_ke ", "sw"},
+		{"en-GB", "en"},
+		{"fr", DefaultLocale},
+		{"", DefaultLocale},
+	}
+
+	for _, tt := range tests {
+		if got := resolveLocale(TemplateAlert, tt.locale); got != tt.want {
+			t.Errorf("resolveLocale(%q) = %q, want %q", tt.locale, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package notify
+
+import (
+	"context"
+	"errors"
+
+	"field_eyes/pkg/email"
+)
+
+// EmailNotifier sends messages as alert emails through a Mailer
+type EmailNotifier struct {
+	Mailer email.Mailer
+}
+
+// Send emails the message to the recipient's address, in their locale
+func (n *EmailNotifier) Send(ctx context.Context, to Recipient, msg Message) error {
+	if to.Email == "" {
+		return errors.New("recipient has no email address")
+	}
+
+	mail, err := email.Compose(email.TemplateAlert, to.Locale, email.AlertData{
+		Message:  msg.Body,
+		Severity: msg.Severity,
+		Device:   msg.Device,
+		Time:     msg.Time,
+	})
+	if err != nil {
+		return err
+	}
+	mail.To = []string{to.Email}
+	return n.Mailer.Send(ctx, mail)
+}
@@ -0,0 +1,96 @@
+// Package notify delivers notifications to users over email, SMS and web push
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Channels a notification can be delivered over
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+	ChannelPush  = "push"
+)
+
+// Message is a notification as sent over any channel
+type Message struct {
+	Title    string // email subject and push title
+	Body     string // plain text
+	Severity string // info, warning or alert
+	Tag      string // groups push notifications, e.g. by notification ID
+	Device   string // the device the message is about, if any
+	Time     time.Time
+}
+
+// Recipient is where a message is sent. Each channel uses its own address.
+type Recipient struct {
+	Email string
+	Phone string // E.164, e.g. +254712345678
+	Push  *PushSubscription
+	// Locale is the language emails are written in, e.g. "sw"
+	Locale string
+}
+
+// Notifier sends messages over one channel
+type Notifier interface {
+	Send(ctx context.Context, to Recipient, msg Message) error
+}
+
+// ErrGone is returned when the recipient's address no longer exists, such as an
+// expired push subscription. Sending to it again won't succeed.
+var ErrGone = errors.New("the recipient's address no longer exists")
+
+// Sent is a message recorded by a Recorder
+type Sent struct {
+	To      Recipient
+	Message Message
+}
+
+// Recorder is a Notifier that keeps the messages it is given instead of sending
+// them, for tests and local development
+type Recorder struct {
+	mu   sync.Mutex
+	sent []Sent
+	// Err, when set, is returned by Send and nothing is recorded
+	Err error
+	// Log, when set, is called with each message
+	Log func(format string, v ...interface{})
+}
+
+// Send records the message
+func (r *Recorder) Send(ctx context.Context, to Recipient, msg Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.sent = append(r.sent, Sent{To: to, Message: msg})
+	if r.Log != nil {
+		r.Log("[FAKE NOTIFY] To: %s, %s: %s", describe(to), msg.Title, msg.Body)
+	}
+	return nil
+}
+
+// Sent returns the messages recorded so far
+func (r *Recorder) Sent() []Sent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Sent(nil), r.sent...)
+}
+
+// describe returns the address of a recipient for logging
+func describe(to Recipient) string {
+	switch {
+	case to.Phone != "":
+		return to.Phone
+	case to.Email != "":
+		return to.Email
+	case to.Push != nil:
+		return to.Push.Endpoint
+	}
+	return fmt.Sprintf("%+v", to)
+}
@@ -0,0 +1,64 @@
+package notify
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testSubscription returns a subscription to endpoint with fresh browser keys
+func testSubscription(t *testing.T, endpoint string) (*PushSubscription, *ecdh.PrivateKey, []byte) {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	sub := &PushSubscription{Endpoint: endpoint}
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(auth)
+	return sub, key, auth
+}
+
+// testVAPIDKey returns a base64url VAPID private key
+func testVAPIDKey(t *testing.T) string {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(key.Bytes())
+}
+
+func TestErrorsLeaveOutResponseBody(t *testing.T) {
+	const secret = "internal-token-1234"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream said "+secret, http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	push, err := NewWebPush(testVAPIDKey(t), "mailto:admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, _, _ := testSubscription(t, server.URL)
+	sms := &SMSGateway{URL: server.URL, ToField: "to", MessageField: "message"}
+
+	msg := Message{Title: "Alert", Body: "Soil is dry", Severity: "alert"}
+	for name, err := range map[string]error{
+		"push": push.Send(context.Background(), Recipient{Push: sub}, msg),
+		"sms":  sms.Send(context.Background(), Recipient{Phone: "+254712345678"}, msg),
+	} {
+		if err == nil || !strings.Contains(err.Error(), "502") {
+			t.Errorf("%s: err = %v, want the status", name, err)
+		} else if strings.Contains(err.Error(), secret) {
+			t.Errorf("%s: error keeps the response body: %v", name, err)
+		}
+	}
+}
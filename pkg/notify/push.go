@@ -0,0 +1,292 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// pushRecordSize is the record size declared in the encrypted content
+	pushRecordSize = 4096
+	// maxPushPayload is the largest plaintext that fits in one record
+	maxPushPayload = pushRecordSize - 16 - 1
+	// pushTTL is how long a push service keeps a message for an offline browser
+	pushTTL = 24 * time.Hour
+	// vapidExpiry is the lifetime of the VAPID token sent with each message
+	vapidExpiry = 12 * time.Hour
+)
+
+// PushSubscription is a browser's push subscription, as returned by
+// PushManager.subscribe()
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// WebPush sends messages to browsers through their push service, encrypted as
+// RFC 8291 requires and authenticated with VAPID (RFC 8292)
+type WebPush struct {
+	publicKey  []byte // uncompressed P-256 point
+	privateKey *ecdsa.PrivateKey
+	subject    string // mailto: or https: contact for the push service
+	Client     *http.Client
+}
+
+// NewWebPush creates a web push sender from a base64url VAPID private key, the raw
+// 32 byte scalar as printed by `web-push generate-vapid-keys`
+func NewWebPush(privateKey, subject string) (*WebPush, error) {
+	d, err := decodeBase64URL(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %v", err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %v", err)
+	}
+	public := key.PublicKey().Bytes()
+
+	signer := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:]),
+		},
+		D: new(big.Int).SetBytes(d),
+	}
+	return &WebPush{
+		publicKey:  public,
+		privateKey: signer,
+		subject:    subject,
+		Client:     &http.Client{Timeout: 15 * time.Second},
+	}, nil
+}
+
+// PublicKey returns the base64url VAPID public key browsers subscribe with
+// (the applicationServerKey)
+func (p *WebPush) PublicKey() string {
+	return base64.RawURLEncoding.EncodeToString(p.publicKey)
+}
+
+// decodeBase64URL decodes base64url with or without padding
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// Validate checks that a subscription has an https endpoint and usable keys
+func (s *PushSubscription) Validate() error {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return errors.New("endpoint must be an https URL")
+	}
+	key, err := decodeBase64URL(s.Keys.P256dh)
+	if err != nil {
+		return errors.New("keys.p256dh is not base64url")
+	}
+	if _, err := ecdh.P256().NewPublicKey(key); err != nil {
+		return errors.New("keys.p256dh is not a P-256 public key")
+	}
+	auth, err := decodeBase64URL(s.Keys.Auth)
+	if err != nil || len(auth) != 16 {
+		return errors.New("keys.auth must be 16 bytes of base64url")
+	}
+	return nil
+}
+
+// Send encrypts the message as JSON and posts it to the subscription's endpoint.
+// ErrGone is returned when the push service reports the subscription expired.
+func (p *WebPush) Send(ctx context.Context, to Recipient, msg Message) error {
+	if to.Push == nil {
+		return errors.New("recipient has no push subscription")
+	}
+	sub := to.Push
+
+	payload, err := json.Marshal(map[string]string{
+		"title":    msg.Title,
+		"body":     msg.Body,
+		"severity": msg.Severity,
+		"tag":      msg.Tag,
+	})
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxPushPayload {
+		return fmt.Errorf("push payload of %d bytes is too large", len(payload))
+	}
+
+	uaPublic, err := decodeBase64URL(sub.Keys.P256dh)
+	if err != nil {
+		return fmt.Errorf("invalid subscription key: %v", err)
+	}
+	authSecret, err := decodeBase64URL(sub.Keys.Auth)
+	if err != nil {
+		return fmt.Errorf("invalid subscription auth secret: %v", err)
+	}
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	body, err := encryptPush(payload, uaPublic, authSecret, asPrivate, salt)
+	if err != nil {
+		return err
+	}
+
+	authorization, err := p.vapidAuthorization(sub.Endpoint, time.Now())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(pushTTL.Seconds())))
+	req.Header.Set("Urgency", pushUrgency(msg.Severity))
+	req.Header.Set("Authorization", authorization)
+	if msg.Tag != "" {
+		req.Header.Set("Topic", msg.Tag)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return ErrGone
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		// The body isn't kept: errors are shown to the user, and it could be anything
+		return fmt.Errorf("push service answered %s", resp.Status)
+	}
+	return nil
+}
+
+// pushUrgency maps a severity to the Urgency header, which lets browsers on battery
+// hold back less urgent messages
+func pushUrgency(severity string) string {
+	switch severity {
+	case "alert":
+		return "high"
+	case "warning":
+		return "normal"
+	default:
+		return "low"
+	}
+}
+
+// vapidAuthorization returns the Authorization header for a push endpoint: a
+// JWT signed with the VAPID key whose audience is the endpoint's origin
+func (p *WebPush) vapidAuthorization(endpoint string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(vapidExpiry).Unix(),
+		"sub": p.subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, p.privateKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// ES256 signatures are r and s as two 32 byte big-endian numbers
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	token := signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return "vapid t=" + token + ", k=" + p.PublicKey(), nil
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the parts under key
+func hmacSHA256(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// encryptPush encrypts a payload for a subscription with the aes128gcm content
+// encoding of RFC 8291, as a single record. asPrivate is the sender's one-off key.
+func encryptPush(plaintext, uaPublic, authSecret []byte, asPrivate *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	uaKey, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subscription key: %v", err)
+	}
+	ecdhSecret, err := asPrivate.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+
+	// HKDF-SHA256 with one block of output, so each expand is a single HMAC
+	prkKey := hmacSHA256(authSecret, ecdhSecret)
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hmacSHA256(prkKey, keyInfo, []byte{1})
+	prk := hmacSHA256(salt, ikm)
+	cek := hmacSHA256(prk, []byte("Content-Encoding: aes128gcm\x00"), []byte{1})[:16]
+	nonce := hmacSHA256(prk, []byte("Content-Encoding: nonce\x00"), []byte{1})[:12]
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// The last (and only) record ends with the 0x02 padding delimiter
+	record := append(append([]byte(nil), plaintext...), 2)
+
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, pushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	return gcm.Seal(header, nonce, record, nil), nil
+}
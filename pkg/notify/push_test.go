@@ -0,0 +1,112 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// b64 decodes base64url test data
+func b64(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := decodeBase64URL(s)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", s, err)
+	}
+	return b
+}
+
+// TestEncryptPushRFC8291 encrypts the example message of RFC 8291 Appendix A with its
+// keys and salt, and expects the same bytes
+func TestEncryptPushRFC8291(t *testing.T) {
+	plaintext := []byte("When I grow up, I want to be a watermelon")
+	asPrivate, err := ecdh.P256().NewPrivateKey(b64(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantASPublic := b64(t, "BP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A8")
+	if !bytes.Equal(asPrivate.PublicKey().Bytes(), wantASPublic) {
+		t.Fatal("the sender's public key doesn't match the RFC")
+	}
+	uaPublic := b64(t, "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4")
+	authSecret := b64(t, "BTBZMqHH6r4Tts7J_aSIgg")
+	salt := b64(t, "DGv6ra1nlYgDCS1FRnbzlw")
+
+	got, err := encryptPush(plaintext, uaPublic, authSecret, asPrivate, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := b64(t, "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN")
+	if !bytes.Equal(got, want) {
+		t.Errorf("encrypted body\n%s\nwant\n%s", base64.RawURLEncoding.EncodeToString(got), base64.RawURLEncoding.EncodeToString(want))
+	}
+}
+
+func TestVAPIDAuthorization(t *testing.T) {
+	push, err := NewWebPush(testVAPIDKey(t), "mailto:admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	header, err := push.vapidAuthorization("https://push.example.net:8443/send/abc?x=1", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rest, ok := strings.CutPrefix(header, "vapid t=")
+	token, key, ok2 := strings.Cut(rest, ", k=")
+	if !ok || !ok2 {
+		t.Fatalf("header %q is not vapid t=..., k=...", header)
+	}
+	if key != push.PublicKey() {
+		t.Errorf("k = %s, want the VAPID public key", key)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token has %d parts", len(parts))
+	}
+	var jwtHeader map[string]string
+	if err := json.Unmarshal(b64(t, parts[0]), &jwtHeader); err != nil || jwtHeader["alg"] != "ES256" || jwtHeader["typ"] != "JWT" {
+		t.Errorf("JWT header = %s", b64(t, parts[0]))
+	}
+	var claims struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(b64(t, parts[1]), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Aud != "https://push.example.net:8443" || claims.Exp != now.Add(vapidExpiry).Unix() || claims.Sub != "mailto:admin@example.com" {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	// The signature verifies against the public key the browser subscribed with
+	public := b64(t, key)
+	if len(public) != 65 || public[0] != 4 {
+		t.Fatalf("public key is not an uncompressed P-256 point: %x", public)
+	}
+	verifier := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(public[1:33]),
+		Y:     new(big.Int).SetBytes(public[33:]),
+	}
+	signature := b64(t, parts[2])
+	if len(signature) != 64 {
+		t.Fatalf("signature is %d bytes, want 64", len(signature))
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(verifier, digest[:], r, s) {
+		t.Error("the VAPID signature doesn't verify")
+	}
+}
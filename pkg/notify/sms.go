@@ -0,0 +1,150 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// maxSMSLength is where SMS texts are cut, the length of three concatenated messages
+const maxSMSLength = 459
+
+// SMSGateway sends text messages through an HTTP SMS API. The request is a form or
+// JSON POST whose field names are configurable, which covers Africa's Talking
+// (to, message, from plus username, with an apiKey header) and Twilio (To, Body,
+// From with basic auth) among others.
+type SMSGateway struct {
+	URL          string
+	JSON         bool              // send a JSON body instead of a form
+	ToField      string            // field holding the phone number
+	MessageField string            // field holding the text
+	FromField    string            // field holding the sender ID, if From is set
+	From         string            // sender ID or number
+	Params       url.Values        // extra fields sent with every message
+	Headers      map[string]string // extra headers, e.g. an API key
+	Username     string            // basic auth, if set
+	Password     string
+	Client       *http.Client
+}
+
+// NewSMSGatewayFromEnv configures a gateway from the SMS_GATEWAY_* variables. It
+// returns nil when SMS_GATEWAY_URL is not set.
+func NewSMSGatewayFromEnv() (*SMSGateway, error) {
+	gatewayURL := os.Getenv("SMS_GATEWAY_URL")
+	if gatewayURL == "" {
+		return nil, nil
+	}
+
+	params, err := url.ParseQuery(os.Getenv("SMS_GATEWAY_PARAMS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMS_GATEWAY_PARAMS: %v", err)
+	}
+
+	headers := make(map[string]string)
+	if name := os.Getenv("SMS_GATEWAY_API_KEY_HEADER"); name != "" {
+		headers[name] = os.Getenv("SMS_GATEWAY_API_KEY")
+	}
+
+	gateway := &SMSGateway{
+		URL:          gatewayURL,
+		JSON:         os.Getenv("SMS_GATEWAY_ENCODING") == "json",
+		ToField:      envOr("SMS_GATEWAY_TO_FIELD", "to"),
+		MessageField: envOr("SMS_GATEWAY_MESSAGE_FIELD", "message"),
+		FromField:    envOr("SMS_GATEWAY_FROM_FIELD", "from"),
+		From:         os.Getenv("SMS_FROM"),
+		Params:       params,
+		Headers:      headers,
+		Username:     os.Getenv("SMS_GATEWAY_USERNAME"),
+		Password:     os.Getenv("SMS_GATEWAY_PASSWORD"),
+		Client:       &http.Client{Timeout: 15 * time.Second},
+	}
+	return gateway, nil
+}
+
+// envOr returns the environment variable, or def when it is empty
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// smsText is the text sent for a message
+func smsText(msg Message) string {
+	text := msg.Body
+	if msg.Title != "" {
+		text = msg.Title + ": " + msg.Body
+	}
+	if runes := []rune(text); len(runes) > maxSMSLength {
+		text = string(runes[:maxSMSLength-3]) + "..."
+	}
+	return text
+}
+
+// Send posts the message to the gateway. Any status other than 2xx is an error.
+func (g *SMSGateway) Send(ctx context.Context, to Recipient, msg Message) error {
+	if to.Phone == "" {
+		return errors.New("recipient has no phone number")
+	}
+
+	fields := url.Values{}
+	for name, values := range g.Params {
+		fields[name] = values
+	}
+	fields.Set(g.ToField, to.Phone)
+	fields.Set(g.MessageField, smsText(msg))
+	if g.From != "" {
+		fields.Set(g.FromField, g.From)
+	}
+
+	var body []byte
+	contentType := "application/x-www-form-urlencoded"
+	if g.JSON {
+		object := make(map[string]string, len(fields))
+		for name := range fields {
+			object[name] = fields.Get(name)
+		}
+		var err error
+		if body, err = json.Marshal(object); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	} else {
+		body = []byte(fields.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+	for name, value := range g.Headers {
+		req.Header.Set(name, value)
+	}
+	if g.Username != "" {
+		req.SetBasicAuth(g.Username, g.Password)
+	}
+
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// The body isn't kept: errors are shown to the user, and it may echo credentials
+		return fmt.Errorf("SMS gateway answered %s", resp.Status)
+	}
+	return nil
+}